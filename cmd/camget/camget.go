@@ -23,6 +23,21 @@ limitations under the License.
 //   camget -o dir BLOBREF     (if dir exists and is directory, BLOBREF must be a directory, and -f to overwrite any files)
 //   camget -o file  BLOBREF   
 //
+// Restoring a directory is resumable: files already matching are
+// skipped, and only the missing chunks of partially restored files
+// are fetched. Use -n to list what would be written without writing.
+// Files get back their mode, owner (mapped by name when possible),
+// modification time and symlink target. Extended attributes aren't
+// restored: the file schema doesn't record them, so camput can't
+// back them up.
+//
+// Permanodes backed up repeatedly with "camput file -snapshot" have a
+// history of snapshots, which can be listed, restored, or compared:
+//   camget -snapshots PERMANODE
+//   camget -o dir PERMANODE@3          (the third snapshot; -1 is the latest)
+//   camget -o dir PERMANODE@2012-10-16 (the latest one as of that day)
+//   camget -diff PERMANODE@-2 PERMANODE@-1
+//
 // Should be possible to get a directory JSON blob without recursively
 // fetching an entire directory.  Likewise with files.  But default
 // should be sensitive on the type of the listed blob.  Maybe --blob
@@ -31,28 +46,28 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/client"
-	"camlistore.org/pkg/index"
-	"camlistore.org/pkg/schema"
 )
 
 var (
 	flagVerbose = flag.Bool("verbose", false, "be verbose")
 	flagCheck   = flag.Bool("check", false, "just check for the existence of listed blobs; returning 0 if all our present")
-	flagOutput  = flag.String("o", "-", "Output file/directory to create.  Use -f to overwrite.")
+	flagOutput  = flag.String("o", "-", "Output file/directory to create. Existing files are overwritten, unless already up to date.")
 	flagVia     = flag.String("via", "", "Fetch the blob via the given comma-separated sharerefs (dev only).")
+	flagJobs    = flag.Int("j", 8, "Number of chunks to fetch in parallel when restoring files.")
+	flagDryRun  = flag.Bool("n", false, "Dry run: list what would be written to -o, without writing anything.")
+
+	flagSnapshots = flag.Bool("snapshots", false, "List the snapshots of the given permanodes, oldest first, as numbered for PERMANODE@N arguments.")
+	flagDiff      = flag.Bool("diff", false, "List the files added (A), removed (D) or changed (M) between two directories, such as two snapshots.")
 )
 
 var viaRefs []*blobref.BlobRef
@@ -77,17 +92,69 @@ func main() {
 
 	cl := client.NewOrFail()
 
+	var refs []*blobref.BlobRef
 	for n := 0; n < flag.NArg(); n++ {
 		arg := flag.Arg(n)
-		br := blobref.Parse(arg)
-		if br == nil {
-			log.Fatalf("Failed to parse argument %q as a blobref.", arg)
+		br, snapshot, ok := parseArg(arg)
+		if !ok {
+			log.Fatalf("Failed to parse argument %q as a blobref or PERMANODE@SNAPSHOT.", arg)
 		}
-		if *flagCheck {
-			// TODO: do HEAD requests checking if the blobs exists.
-			log.Fatal("not implemented")
-			return
+		if *flagSnapshots {
+			if snapshot != "" {
+				log.Fatalf("Argument %q of -snapshots isn't a permanode.", arg)
+			}
+			snaps, err := cl.Snapshots(br)
+			if err != nil {
+				log.Fatalf("Error listing the snapshots of %s: %v", br, err)
+			}
+			if flag.NArg() > 1 {
+				fmt.Printf("%s:\n", br)
+			}
+			listSnapshots(os.Stdout, snaps)
+			continue
 		}
+		if snapshot != "" {
+			snaps, err := cl.Snapshots(br)
+			if err != nil {
+				log.Fatalf("Error listing the snapshots of %s: %v", br, err)
+			}
+			snap, err := selectSnapshot(snaps, snapshot)
+			if err != nil {
+				log.Fatalf("Argument %q: %v", arg, err)
+			}
+			if *flagVerbose {
+				log.Printf("%s is %s, of %s", arg, snap.Content, snap.Date.Local().Format(time.RFC3339))
+			}
+			br = snap.Content
+		}
+		refs = append(refs, br)
+	}
+	if *flagSnapshots {
+		return
+	}
+	if *flagCheck {
+		if !check(cl, refs) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	rs := &restorer{
+		fetcher: clientFetcher{cl},
+		jobs:    *flagJobs,
+		dryRun:  *flagDryRun,
+		verbose: *flagVerbose,
+	}
+	if *flagDiff {
+		if len(refs) != 2 {
+			log.Fatalf("-diff needs two directories, not %d.", len(refs))
+		}
+		if err := rs.diff(os.Stdout, refs[0], refs[1]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	for _, br := range refs {
 		if *flagOutput == "-" {
 			rc, err := fetch(cl, br)
 			if err != nil {
@@ -99,133 +166,58 @@ func main() {
 			}
 			return
 		}
-		if err := smartFetch(cl, *flagOutput, br); err != nil {
+		if err := rs.restore(*flagOutput, br); err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
-func fetch(cl *client.Client, br *blobref.BlobRef) (r io.ReadCloser, err error) {
-	if *flagVerbose {
-		log.Printf("Fetching %s", br.String())
-	}
-	if len(viaRefs) > 0 {
-		r, _, err = cl.FetchVia(br, viaRefs)
-	} else {
-		r, _, err = cl.FetchStreaming(br)
-	}
-	if err != nil {
-		return nil, fmt.Errorf("Failed to fetch %q: %s", br, err)
-	}
-	return r, err
-}
-
-// A little less than the sniffer will take, so we don't truncate.
-const sniffSize = 900 * 1024
-
-// smartFetch the things that blobs point to, not just blobs. (wow)
-func smartFetch(cl *client.Client, targ string, br *blobref.BlobRef) error {
-	if *flagVerbose {
-		log.Printf("Fetching %v into %q", br, targ)
-	}
-
-	rc, err := fetch(cl, br)
-	if err != nil {
-		return err
+// check reports whether all the blobs exist on the server, listing
+// the missing ones.
+func check(cl *client.Client, refs []*blobref.BlobRef) bool {
+	ch := make(chan blobref.SizedBlobRef, len(refs))
+	if err := cl.StatBlobs(ch, refs, 0); err != nil {
+		log.Fatalf("Error checking blobs: %v", err)
 	}
-	defer rc.Close()
-
-	sniffer := new(index.BlobSniffer)
-	_, err = io.CopyN(sniffer, rc, sniffSize)
-	if err != nil && err != io.EOF {
-		return err
+	close(ch)
+	have := make(map[string]bool)
+	for sb := range ch {
+		have[sb.BlobRef.String()] = true
 	}
-
-	sniffer.Parse()
-	sc, ok := sniffer.Superset()
-
-	if !ok {
-		// opaque data - put it in a file
-		f, err := os.Create(targ)
-		if err != nil {
-			return fmt.Errorf("opaque: %v", err)
+	ok := true
+	for _, br := range refs {
+		if !have[br.String()] {
+			fmt.Printf("%s missing\n", br)
+			ok = false
 		}
-		defer f.Close()
-		body, _ := sniffer.Body()
-		r := io.MultiReader(bytes.NewBuffer(body), rc)
-		_, err = io.Copy(f, r)
-		return err
 	}
+	return ok
+}
 
-	sc.BlobRef = br
+// clientFetcher fetches blobs from the server, via the -via
+// sharerefs if set.
+type clientFetcher struct {
+	cl *client.Client
+}
 
-	switch sc.Type {
-	case "directory":
-		dir := filepath.Join(targ, sc.FileName)
-		if err := os.MkdirAll(dir, sc.FileMode()); err != nil {
-			return err
-		}
-		if err := setFileMeta(dir, sc); err != nil {
-			log.Print(err)
-		}
-		entries := blobref.Parse(sc.Entries)
-		if entries == nil {
-			return fmt.Errorf("bad entries blobref: %v", sc.Entries)
-		}
-		return smartFetch(cl, dir, entries)
-	case "static-set":
-		// directory entries
-		for _, m := range sc.Members {
-			dref := blobref.Parse(m)
-			if dref == nil {
-				return fmt.Errorf("bad member blobref: %v", m)
-			}
-			if err := smartFetch(cl, targ, dref); err != nil {
-				return err
-			}
-		}
-		return nil
-	case "file":
-		name := filepath.Join(targ, sc.FileName)
-		f, err := os.Create(name)
-		if err != nil {
-			return fmt.Errorf("file type: %v", err)
-		}
-		defer f.Close()
-		for _, p := range sc.Parts {
-			if p.BytesRef != nil {
-				panic("don't know how to handle BytesRef")
-			}
-			rc, err := fetch(cl, p.BlobRef)
-			if err != nil {
-				return err
-			}
-			_, err = io.Copy(f, rc)
-			rc.Close()
-			if err != nil {
-				return err
-			}
-		}
-		if err := setFileMeta(name, sc); err != nil {
-			log.Print(err)
-		}
-		return nil
-	default:
-		return errors.New("unknown blob type: " + sc.Type)
+func (f clientFetcher) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error) {
+	if len(viaRefs) > 0 {
+		return f.cl.FetchVia(br, viaRefs)
 	}
-	panic("unreachable")
+	return f.cl.FetchStreaming(br)
 }
 
-func setFileMeta(name string, sc *schema.Superset) error {
-	if err := os.Chmod(name, sc.FileMode()); err != nil {
-		return err
+func fetch(cl *client.Client, br *blobref.BlobRef) (r io.ReadCloser, err error) {
+	if *flagVerbose {
+		log.Printf("Fetching %s", br.String())
 	}
-	if err := os.Chown(name, sc.UnixOwnerId, sc.UnixGroupId); err != nil {
-		return err
+	if len(viaRefs) > 0 {
+		r, _, err = cl.FetchVia(br, viaRefs)
+	} else {
+		r, _, err = cl.FetchStreaming(br)
 	}
-	t, err := time.Parse(time.RFC3339, sc.UnixMtime)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("Failed to fetch %q: %s", br, err)
 	}
-	return os.Chtimes(name, t, t)
+	return r, err
 }
@@ -0,0 +1,180 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+// diff writes to w how the tree to differs from the tree from, both
+// directories or both files, one path per line, like
+// "git diff --name-status":
+//
+//	A	sub/new.txt
+//	D	old/
+//	M	changed.txt
+//
+// Files are changed if their contents, permissions or symlink
+// targets are; modification times alone don't count.  Subtrees of
+// the same blobref aren't fetched.
+func (r *restorer) diff(w io.Writer, from, to *blobref.BlobRef) error {
+	f, err := r.fetchTreeSchema(from)
+	if err != nil {
+		return err
+	}
+	t, err := r.fetchTreeSchema(to)
+	if err != nil {
+		return err
+	}
+	if f.Type == "directory" && t.Type == "directory" {
+		return r.diffDirs(w, "", f, t)
+	}
+	return r.diffEntries(w, t.FileNameString(), f, t)
+}
+
+// fetchTreeSchema fetches br, which must be the schema blob of a
+// directory, file or symlink.
+func (r *restorer) fetchTreeSchema(br *blobref.BlobRef) (*schema.Superset, error) {
+	ss, _, rc, err := r.fetchSchema(br)
+	if err != nil {
+		return nil, err
+	}
+	if ss == nil {
+		rc.Close()
+		return nil, fmt.Errorf("%s is not a schema blob", br)
+	}
+	switch ss.Type {
+	case "directory", "file", "symlink":
+		return ss, nil
+	}
+	return nil, fmt.Errorf("%s is a %q, not a directory, file or symlink", br, ss.Type)
+}
+
+// dirEntries returns the entries of the directory dir by name.
+func (r *restorer) dirEntries(dir *schema.Superset) (map[string]*schema.Superset, error) {
+	entries := blobref.Parse(dir.Entries)
+	if entries == nil {
+		return nil, fmt.Errorf("bad entries blobref: %v", dir.Entries)
+	}
+	set, _, rc, err := r.fetchSchema(entries)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil || set.Type != "static-set" {
+		if rc != nil {
+			rc.Close()
+		}
+		return nil, fmt.Errorf("entries %s of %s aren't a static-set", entries, dir.BlobRef)
+	}
+	m := make(map[string]*schema.Superset)
+	for _, member := range set.Members {
+		br := blobref.Parse(member)
+		if br == nil {
+			return nil, fmt.Errorf("bad member blobref: %v", member)
+		}
+		ss, err := r.fetchTreeSchema(br)
+		if err != nil {
+			return nil, err
+		}
+		m[ss.FileNameString()] = ss
+	}
+	return m, nil
+}
+
+// diffDirs writes the differences between the entries of the
+// directories from and to, at dir in the trees.
+func (r *restorer) diffDirs(w io.Writer, dir string, from, to *schema.Superset) error {
+	fromEntries, err := r.dirEntries(from)
+	if err != nil {
+		return err
+	}
+	toEntries, err := r.dirEntries(to)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range fromEntries {
+		names = append(names, name)
+	}
+	for name := range toEntries {
+		if _, ok := fromEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, t := fromEntries[name], toEntries[name]
+		p := path.Join(dir, name)
+		switch {
+		case t == nil:
+			fmt.Fprintf(w, "D\t%s\n", displayPath(p, f))
+		case f == nil:
+			fmt.Fprintf(w, "A\t%s\n", displayPath(p, t))
+		default:
+			if err := r.diffEntries(w, p, f, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// diffEntries writes the differences between from and to, the
+// entries at p in the trees.
+func (r *restorer) diffEntries(w io.Writer, p string, from, to *schema.Superset) error {
+	switch {
+	case from.BlobRef.String() == to.BlobRef.String():
+	case from.Type != to.Type:
+		fmt.Fprintf(w, "D\t%s\n", displayPath(p, from))
+		fmt.Fprintf(w, "A\t%s\n", displayPath(p, to))
+	case from.Type == "directory":
+		return r.diffDirs(w, p, from, to)
+	case from.UnixPermission != to.UnixPermission ||
+		from.SymlinkTargetString() != to.SymlinkTargetString() ||
+		!sameParts(from.Parts, to.Parts):
+		fmt.Fprintf(w, "M\t%s\n", p)
+	}
+	return nil
+}
+
+func sameParts(a, b []*schema.BytesPart) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Size != b[i].Size || a[i].Offset != b[i].Offset ||
+			a[i].BlobRef.String() != b[i].BlobRef.String() ||
+			a[i].BytesRef.String() != b[i].BytesRef.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// displayPath returns p, with a trailing slash if ss is a directory.
+func displayPath(p string, ss *schema.Superset) string {
+	if ss.Type == "directory" {
+		return p + "/"
+	}
+	return p
+}
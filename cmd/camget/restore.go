@@ -0,0 +1,415 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/schema"
+)
+
+// A little less than the sniffer will take, so we don't truncate.
+const sniffSize = 900 * 1024
+
+// restorer writes the files, directories and symlinks that blobs
+// describe to the local file system.
+//
+// Restoring is resumable: files whose contents already match are left
+// alone, and the chunks of partially written files that are already
+// right aren't fetched again.
+type restorer struct {
+	fetcher blobref.StreamingFetcher
+	jobs    int       // chunks fetched in parallel; at least 1
+	dryRun  bool      // only report what would be written
+	out     io.Writer // where dry runs report; os.Stdout if nil
+	verbose bool
+}
+
+// chunk is a span of a file's contents: size bytes at offset off in
+// the file, which are the bytes at blobOff in br, or zeros if br is nil.
+type chunk struct {
+	off     int64
+	size    int64
+	br      *blobref.BlobRef
+	blobOff int64
+}
+
+func (r *restorer) logf(format string, args ...interface{}) {
+	if r.dryRun {
+		out := r.out
+		if out == nil {
+			out = os.Stdout
+		}
+		fmt.Fprintf(out, format+"\n", args...)
+		return
+	}
+	if r.verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// fetchSchema fetches br and parses it as a schema blob. If it isn't
+// one, ss is nil and rc, which the caller must close, is positioned
+// after body.
+func (r *restorer) fetchSchema(br *blobref.BlobRef) (ss *schema.Superset, body []byte, rc io.ReadCloser, err error) {
+	rc, _, err = r.fetcher.FetchStreaming(br)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to fetch %q: %s", br, err)
+	}
+	sniffer := new(index.BlobSniffer)
+	_, err = io.CopyN(sniffer, rc, sniffSize)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, nil, nil, err
+	}
+	sniffer.Parse()
+	if ss, ok := sniffer.Superset(); ok {
+		rc.Close()
+		ss.BlobRef = br
+		return ss, nil, nil, nil
+	}
+	body, _ = sniffer.Body()
+	return nil, body, rc, nil
+}
+
+// restore writes what br describes in the directory targ. Opaque
+// blobs are written to the file targ.
+func (r *restorer) restore(targ string, br *blobref.BlobRef) error {
+	if r.verbose {
+		log.Printf("Fetching %v into %q", br, targ)
+	}
+	sc, body, rc, err := r.fetchSchema(br)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		// opaque data - put it in a file
+		defer rc.Close()
+		r.logf("write %s", targ)
+		if r.dryRun {
+			return nil
+		}
+		f, err := os.Create(targ)
+		if err != nil {
+			return fmt.Errorf("opaque: %v", err)
+		}
+		defer f.Close()
+		_, err = io.Copy(f, io.MultiReader(bytes.NewBuffer(body), rc))
+		return err
+	}
+
+	switch sc.Type {
+	case "directory":
+		dir := filepath.Join(targ, sc.FileNameString())
+		r.logf("mkdir %s", dir)
+		if !r.dryRun {
+			// Keep the directory writable until its children
+			// are restored; setFileMeta fixes the mode after.
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+			if err := os.Chmod(dir, 0700); err != nil {
+				return err
+			}
+		}
+		entries := blobref.Parse(sc.Entries)
+		if entries == nil {
+			return fmt.Errorf("bad entries blobref: %v", sc.Entries)
+		}
+		if err := r.restore(dir, entries); err != nil {
+			return err
+		}
+		// Restoring the children changed the directory's mtime,
+		// so set it last.
+		return r.setFileMeta(dir, sc)
+	case "static-set":
+		// directory entries
+		for _, m := range sc.Members {
+			dref := blobref.Parse(m)
+			if dref == nil {
+				return fmt.Errorf("bad member blobref: %v", m)
+			}
+			if err := r.restore(targ, dref); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "file":
+		return r.restoreFile(filepath.Join(targ, sc.FileNameString()), sc)
+	case "symlink":
+		return r.restoreSymlink(filepath.Join(targ, sc.FileNameString()), sc)
+	}
+	return errors.New("unknown blob type: " + sc.Type)
+}
+
+func (r *restorer) restoreSymlink(name string, sc *schema.Superset) error {
+	target := sc.SymlinkTargetString()
+	if cur, err := os.Readlink(name); err == nil && cur == target {
+		r.logf("skip %s (up to date)", name)
+		return r.setFileMeta(name, sc)
+	}
+	r.logf("symlink %s -> %s", name, target)
+	if r.dryRun {
+		return nil
+	}
+	if _, err := os.Lstat(name); err == nil {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink(target, name); err != nil {
+		return err
+	}
+	return r.setFileMeta(name, sc)
+}
+
+func (r *restorer) restoreFile(name string, sc *schema.Superset) error {
+	chunks, err := r.chunks(sc.Parts, 0, 0, int64(sc.SumPartsSize()))
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	size := int64(sc.SumPartsSize())
+
+	var f *os.File
+	if r.dryRun {
+		f, err = os.Open(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+		if os.IsPermission(err) {
+			// Probably restored read-only before; setFileMeta
+			// puts the mode back.
+			if os.Chmod(name, 0600) == nil {
+				f, err = os.OpenFile(name, os.O_RDWR, 0)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("file type: %v", err)
+		}
+	}
+	var todo []chunk
+	var curSize int64 = -1
+	if f != nil {
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil {
+			curSize = fi.Size()
+		}
+		for _, c := range chunks {
+			if !chunkMatches(f, c) {
+				todo = append(todo, c)
+			}
+		}
+	} else {
+		todo = chunks
+	}
+	if len(todo) == 0 && curSize == size {
+		r.logf("skip %s (up to date)", name)
+		return r.setFileMeta(name, sc)
+	}
+	r.logf("write %s (%d bytes, %d of %d chunks)", name, size, len(todo), len(chunks))
+	if r.dryRun {
+		return nil
+	}
+
+	if err := r.writeChunks(f, todo); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return r.setFileMeta(name, sc)
+}
+
+// chunks returns the chunks making up limit bytes of the contents
+// described by parts, starting skip bytes in. The first chunk is
+// at offset off in the file.
+func (r *restorer) chunks(parts []*schema.BytesPart, off, skip, limit int64) ([]chunk, error) {
+	var chunks []chunk
+	var pos int64 // offset of part in the contents described by parts
+	for _, p := range parts {
+		if limit <= 0 {
+			break
+		}
+		psize := int64(p.Size)
+		if pos+psize <= skip {
+			pos += psize
+			continue
+		}
+		in := skip - pos // bytes of p to skip
+		if in < 0 {
+			in = 0
+		}
+		n := psize - in
+		if n > limit {
+			n = limit
+		}
+		switch {
+		case p.BlobRef != nil:
+			chunks = append(chunks, chunk{off: off, size: n, br: p.BlobRef, blobOff: int64(p.Offset) + in})
+		case p.BytesRef != nil:
+			ss, _, rc, err := r.fetchSchema(p.BytesRef)
+			if err != nil {
+				return nil, err
+			}
+			if ss == nil {
+				rc.Close()
+				return nil, fmt.Errorf("bytesRef %v isn't a schema blob", p.BytesRef)
+			}
+			sub, err := r.chunks(ss.Parts, off, int64(p.Offset)+in, n)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, sub...)
+		default:
+			chunks = append(chunks, chunk{off: off, size: n})
+		}
+		off += n
+		skip += n
+		limit -= n
+		pos += psize
+	}
+	return chunks, nil
+}
+
+// chunkMatches reports whether f already has the contents of c.
+// Only whole blobs, which can be checked against their digest, and
+// zeros are recognized.
+func chunkMatches(f *os.File, c chunk) bool {
+	if c.br != nil && c.blobOff != 0 {
+		return false
+	}
+	sr := io.NewSectionReader(f, c.off, c.size)
+	if c.br == nil {
+		buf := make([]byte, 32<<10)
+		var n int64
+		for {
+			m, err := sr.Read(buf)
+			for _, b := range buf[:m] {
+				if b != 0 {
+					return false
+				}
+			}
+			n += int64(m)
+			if err != nil {
+				return n == c.size
+			}
+		}
+	}
+	h := c.br.Hash()
+	if h == nil {
+		return false
+	}
+	n, err := io.Copy(h, sr)
+	return err == nil && n == c.size && c.br.HashMatches(h)
+}
+
+// writeChunks fetches the chunks and writes them to f, r.jobs at a
+// time.
+func (r *restorer) writeChunks(f *os.File, chunks []chunk) error {
+	jobs := r.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	work := make(chan chunk)
+	errc := make(chan error, len(chunks))
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				errc <- r.writeChunk(f, c)
+			}
+		}()
+	}
+	for _, c := range chunks {
+		work <- c
+	}
+	close(work)
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *restorer) writeChunk(f *os.File, c chunk) error {
+	buf := make([]byte, c.size)
+	if c.br != nil {
+		if r.verbose {
+			log.Printf("Fetching %s", c.br)
+		}
+		rc, _, err := r.fetcher.FetchStreaming(c.br)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch %q: %s", c.br, err)
+		}
+		defer rc.Close()
+		if _, err := io.CopyN(ioutil.Discard, rc, c.blobOff); err != nil {
+			return fmt.Errorf("blob %v too short: %v", c.br, err)
+		}
+		if _, err := io.ReadFull(rc, buf); err != nil {
+			return fmt.Errorf("blob %v too short: %v", c.br, err)
+		}
+	}
+	_, err := f.WriteAt(buf, c.off)
+	return err
+}
+
+// setFileMeta restores the mode, owner and modification time of name.
+// Owners are mapped by name when possible, see schema.Superset.MapUid.
+// There are no extended attributes to restore, as the schema doesn't
+// store them.
+func (r *restorer) setFileMeta(name string, sc *schema.Superset) error {
+	if r.dryRun {
+		return nil
+	}
+	if err := os.Lchown(name, sc.MapUid(), sc.MapGid()); err != nil {
+		// Only root can give files away; others get to keep
+		// them.
+		if !os.IsPermission(err) || os.Getuid() == 0 {
+			log.Print(err)
+		}
+	}
+	if sc.Type == "symlink" {
+		// Symlinks have no mode of their own, and Go can't set
+		// their times.
+		return nil
+	}
+	if err := os.Chmod(name, sc.FileMode()); err != nil {
+		return err
+	}
+	t := sc.ModTime()
+	if t.IsZero() {
+		return nil
+	}
+	return os.Chtimes(name, t, t)
+}
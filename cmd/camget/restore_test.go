@@ -0,0 +1,188 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/test"
+)
+
+// countingFetcher counts the fetches of each blob.
+type countingFetcher struct {
+	test.Fetcher
+
+	mu      sync.Mutex
+	fetches map[string]int
+}
+
+func (f *countingFetcher) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error) {
+	f.mu.Lock()
+	f.fetches[br.String()]++
+	f.mu.Unlock()
+	return f.Fetcher.FetchStreaming(br)
+}
+
+func (f *countingFetcher) add(contents string) *blobref.BlobRef {
+	b := &test.Blob{Contents: contents}
+	f.AddBlob(b)
+	return b.BlobRef()
+}
+
+func (f *countingFetcher) addMap(t *testing.T, m map[string]interface{}) *blobref.BlobRef {
+	json, err := schema.MapToCamliJSON(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.add(json)
+}
+
+var (
+	topTime = time.Date(2011, 1, 2, 3, 4, 5, 0, time.UTC)
+	subTime = time.Date(2011, 2, 3, 4, 5, 6, 0, time.UTC)
+)
+
+// restoreTree adds to f a directory "top" containing:
+//
+//	a.txt: "hello world" and 3 zeros, from a chunk, a "bytes" and a hole
+//	link: a symlink to a.txt
+//	sub: an empty directory
+//
+// It returns the top directory and the first chunk of a.txt.
+func restoreTree(t *testing.T, f *countingFetcher) (top, chunk1 *blobref.BlobRef) {
+	chunk1 = f.add("hello ")
+	chunk2 := f.add("world")
+	bytesMap := schema.NewBytes()
+	if err := schema.PopulateParts(bytesMap, 5, []schema.BytesPart{{Size: 5, BlobRef: chunk2}}); err != nil {
+		t.Fatal(err)
+	}
+	bytesRef := f.addMap(t, bytesMap)
+
+	file := schema.NewFileMap("a.txt")
+	file["unixPermission"] = "0640"
+	if err := schema.PopulateParts(file, 14, []schema.BytesPart{
+		{Size: 6, BlobRef: chunk1},
+		{Size: 5, BytesRef: bytesRef},
+		{Size: 3},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fileRef := f.addMap(t, file)
+
+	link := schema.NewCommonFilenameMap("link")
+	link["camliType"] = "symlink"
+	link["symlinkTarget"] = "a.txt"
+	linkRef := f.addMap(t, link)
+
+	sub := schema.NewCommonFilenameMap("sub")
+	sub["unixPermission"] = "0750"
+	sub["unixMtime"] = schema.RFC3339FromTime(subTime)
+	schema.PopulateDirectoryMap(sub, f.addMap(t, new(schema.StaticSet).Map()))
+	subRef := f.addMap(t, sub)
+
+	entries := new(schema.StaticSet)
+	entries.Add(fileRef)
+	entries.Add(linkRef)
+	entries.Add(subRef)
+	dir := schema.NewCommonFilenameMap("top")
+	dir["unixPermission"] = "0755"
+	dir["unixMtime"] = schema.RFC3339FromTime(topTime)
+	schema.PopulateDirectoryMap(dir, f.addMap(t, entries.Map()))
+	return f.addMap(t, dir), chunk1
+}
+
+func TestRestore(t *testing.T) {
+	f := &countingFetcher{fetches: make(map[string]int)}
+	top, chunk1 := restoreTree(t, f)
+	dst, err := ioutil.TempDir("", "camget-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// A dry run writes nothing.
+	var out bytes.Buffer
+	r := &restorer{fetcher: f, jobs: 2, dryRun: true, out: &out}
+	if err := r.restore(dst, top); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !strings.Contains(out.String(), "write "+filepath.Join(dst, "top", "a.txt")) {
+		t.Errorf("dry run output lacks a.txt:\n%s", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dst, "top")); !os.IsNotExist(err) {
+		t.Fatalf("dry run created top: %v", err)
+	}
+
+	r = &restorer{fetcher: f, jobs: 2}
+	if err := r.restore(dst, top); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	aName := filepath.Join(dst, "top", "a.txt")
+	if b, err := ioutil.ReadFile(aName); err != nil || string(b) != "hello world\x00\x00\x00" {
+		t.Errorf("a.txt = %q, %v", b, err)
+	}
+	if fi, err := os.Stat(aName); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("a.txt mode = %v, %v; want 0640", fi.Mode(), err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "top", "link")); err != nil || target != "a.txt" {
+		t.Errorf("link = %q, %v", target, err)
+	}
+	for name, want := range map[string]time.Time{"top": topTime, "top/sub": subTime} {
+		fi, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(want) {
+			t.Errorf("%s mtime = %v; want %v", name, fi.ModTime(), want)
+		}
+		if !fi.IsDir() {
+			t.Errorf("%s isn't a directory", name)
+		}
+	}
+
+	// Restoring again fetches no chunks, and only the damaged one
+	// once a.txt is damaged.
+	f.fetches = make(map[string]int)
+	if err := r.restore(dst, top); err != nil {
+		t.Fatalf("second restore: %v", err)
+	}
+	if n := f.fetches[chunk1.String()]; n != 0 {
+		t.Errorf("second restore fetched chunk1 %d times", n)
+	}
+	if err := ioutil.WriteFile(aName, []byte("jello world\x00\x00\x00 and more"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.restore(dst, top); err != nil {
+		t.Fatalf("third restore: %v", err)
+	}
+	if n := f.fetches[chunk1.String()]; n != 1 {
+		t.Errorf("third restore fetched chunk1 %d times; want 1", n)
+	}
+	if b, err := ioutil.ReadFile(aName); err != nil || string(b) != "hello world\x00\x00\x00" {
+		t.Errorf("repaired a.txt = %q, %v", b, err)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+)
+
+// parseArg parses a command line argument, either a blobref or
+// PERMANODE@SNAPSHOT, naming a snapshot of the permanode as
+// selectSnapshot does.
+func parseArg(arg string) (br *blobref.BlobRef, snapshot string, ok bool) {
+	if i := strings.Index(arg, "@"); i >= 0 {
+		arg, snapshot = arg[:i], arg[i+1:]
+		if snapshot == "" {
+			return nil, "", false
+		}
+	}
+	br = blobref.Parse(arg)
+	return br, snapshot, br != nil
+}
+
+// snapshotDateFormats are the formats of the dates selecting
+// snapshots, in local time unless they say otherwise.
+var snapshotDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// selectSnapshot returns the snapshot of snaps, sorted oldest first,
+// that sel names:
+//
+//	3           the third snapshot
+//	-1          the latest one; -2 is the one before, and so on
+//	2012-10-16  the latest one as of that date, or any other of
+//	            snapshotDateFormats
+func selectSnapshot(snaps []*client.Snapshot, sel string) (*client.Snapshot, error) {
+	if n, err := strconv.Atoi(sel); err == nil {
+		i := n - 1
+		if n < 0 {
+			i = len(snaps) + n
+		}
+		if n == 0 || i < 0 || i >= len(snaps) {
+			return nil, fmt.Errorf("no snapshot %d; there are %d", n, len(snaps))
+		}
+		return snaps[i], nil
+	}
+	for _, layout := range snapshotDateFormats {
+		at, err := time.ParseInLocation(layout, sel, time.Local)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" {
+			// The whole day.
+			at = at.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		var last *client.Snapshot
+		for _, snap := range snaps {
+			if snap.Date.After(at) {
+				break
+			}
+			last = snap
+		}
+		if last == nil {
+			return nil, fmt.Errorf("no snapshot as of %s", sel)
+		}
+		return last, nil
+	}
+	return nil, fmt.Errorf("invalid snapshot %q; want a number or a date", sel)
+}
+
+// listSnapshots writes snaps to w, one per line with the number
+// selecting it.
+func listSnapshots(w io.Writer, snaps []*client.Snapshot) {
+	for i, snap := range snaps {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", i+1, snap.Date.Local().Format(time.RFC3339), snap.Content)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/schema"
+)
+
+func TestSelectSnapshot(t *testing.T) {
+	day := func(d, h int) time.Time {
+		return time.Date(2012, 10, d, h, 0, 0, 0, time.Local)
+	}
+	var snaps []*client.Snapshot
+	for i, date := range []time.Time{day(1, 10), day(2, 10), day(2, 20), day(5, 10)} {
+		snaps = append(snaps, &client.Snapshot{
+			Claim:   blobref.SHA1FromString(fmt.Sprintf("claim%d", i)),
+			Date:    date.UTC(),
+			Content: blobref.SHA1FromString(fmt.Sprintf("dir%d", i)),
+		})
+	}
+	for _, tt := range []struct {
+		sel  string
+		want int // 1-based index in snaps; 0 for an error
+	}{
+		{"1", 1},
+		{"4", 4},
+		{"5", 0},
+		{"0", 0},
+		{"-1", 4},
+		{"-4", 1},
+		{"-5", 0},
+		{"2012-10-02", 3},
+		{"2012-10-04", 3},
+		{"2012-09-30", 0},
+		{"2012-10-02T12:00", 2},
+		{day(1, 10).Format(time.RFC3339), 1},
+		{"yesterday", 0},
+	} {
+		snap, err := selectSnapshot(snaps, tt.sel)
+		switch {
+		case tt.want == 0 && err == nil:
+			t.Errorf("%q: got snapshot %s; want an error", tt.sel, snap.Content)
+		case tt.want != 0 && err != nil:
+			t.Errorf("%q: %v", tt.sel, err)
+		case tt.want != 0 && snap != snaps[tt.want-1]:
+			t.Errorf("%q: got snapshot %s; want %s", tt.sel, snap.Content, snaps[tt.want-1].Content)
+		}
+	}
+}
+
+func TestParseArg(t *testing.T) {
+	for _, tt := range []struct {
+		arg, br, snapshot string
+		ok                bool
+	}{
+		{"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", "sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", "", true},
+		{"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33@-1", "sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", "-1", true},
+		{"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33@", "", "", false},
+		{"foo@1", "", "", false},
+	} {
+		br, snapshot, ok := parseArg(tt.arg)
+		if ok != tt.ok || (ok && (br.String() != tt.br || snapshot != tt.snapshot)) {
+			t.Errorf("parseArg(%q) = %v, %q, %v", tt.arg, br, snapshot, ok)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	f := &countingFetcher{fetches: make(map[string]int)}
+	mtime := time.Unix(1e9, 0)
+	file := func(name, contents string) *blobref.BlobRef {
+		m := schema.NewFileMap(name)
+		m["unixPermission"] = "0644"
+		m["unixMtime"] = schema.RFC3339FromTime(mtime)
+		if err := schema.PopulateParts(m, int64(len(contents)), []schema.BytesPart{
+			{Size: uint64(len(contents)), BlobRef: f.add(contents)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return f.addMap(t, m)
+	}
+	symlink := func(name, target string) *blobref.BlobRef {
+		m := schema.NewCommonFilenameMap(name)
+		m["camliType"] = "symlink"
+		m["symlinkTarget"] = target
+		return f.addMap(t, m)
+	}
+	dir := func(name string, entries ...*blobref.BlobRef) *blobref.BlobRef {
+		set := new(schema.StaticSet)
+		for _, br := range entries {
+			set.Add(br)
+		}
+		m := schema.NewCommonFilenameMap(name)
+		m["unixPermission"] = "0755"
+		schema.PopulateDirectoryMap(m, f.addMap(t, set.Map()))
+		return f.addMap(t, m)
+	}
+
+	sameFile := file("c", "same")
+	same := dir("same", sameFile)
+	from := dir("top",
+		file("a.txt", "a"),
+		file("b.txt", "b"),
+		dir("sub", file("c", "c")),
+		dir("gone", file("x", "x")),
+		symlink("link", "a.txt"),
+		file("kind", "file"),
+		same,
+	)
+	mtime = mtime.Add(time.Hour)
+	to := dir("top",
+		file("a.txt", "a"),
+		file("b.txt", "bb"),
+		dir("sub", file("c", "c"), file("d", "d")),
+		symlink("link", "b.txt"),
+		dir("kind"),
+		file("new.txt", "new"),
+		same,
+	)
+
+	var out bytes.Buffer
+	r := &restorer{fetcher: f, jobs: 1}
+	if err := r.diff(&out, from, to); err != nil {
+		t.Fatal(err)
+	}
+	want := "M\tb.txt\n" +
+		"D\tgone/\n" +
+		"D\tkind\n" +
+		"A\tkind/\n" +
+		"M\tlink\n" +
+		"A\tnew.txt\n" +
+		"A\tsub/d\n"
+	if out.String() != want {
+		t.Errorf("diff:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if n := f.fetches[sameFile.String()]; n != 0 {
+		t.Errorf("diff fetched the unchanged subtree")
+	}
+
+	out.Reset()
+	if err := r.diff(&out, to, to); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("diff of a tree with itself:\n%s", out.String())
+	}
+}
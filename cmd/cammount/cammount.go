@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -28,6 +29,7 @@ import (
 	"camlistore.org/pkg/cacher"
 	"camlistore.org/pkg/client"
 	"camlistore.org/pkg/fs"
+	"camlistore.org/pkg/schema"
 
 	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
 )
@@ -44,7 +46,9 @@ func main() {
 	}
 
 	if n := flag.NArg(); n < 1 || n > 2 {
-		errorf("usage: cammount <mountpoint> [<root-blobref>]\n")
+		errorf("usage: cammount <mountpoint> [<root-blobref>]\n\n" +
+			"If root-blobref is a permanode, it is mounted read/write,\n" +
+			"which requires a search server (-searchserver).\n")
 	}
 
 	mountPoint := flag.Arg(0)
@@ -69,7 +73,15 @@ func main() {
 			errorf("Error parsing root blobref: %q\n", root)
 		}
 		var err error
-		camfs, err = fs.NewRootedCamliFileSystem(fetcher, root)
+		if isPermanode(fetcher, root) {
+			srv := newServer(client)
+			if _, err := srv.PermanodeAttrs(root); err != nil {
+				errorf("Error loading permanode %v: %v\n", root, err)
+			}
+			camfs = fs.NewMutableCamliFileSystem(fetcher, srv, root)
+		} else {
+			camfs, err = fs.NewRootedCamliFileSystem(fetcher, root)
+		}
 		if err != nil {
 			errorf("Error creating root with %v: %v", root, err)
 		}
@@ -92,3 +104,17 @@ func main() {
 	}
 	log.Printf("fuse process ending.")
 }
+
+// isPermanode reports whether br is a permanode.
+func isPermanode(fetcher blobref.SeekFetcher, br *blobref.BlobRef) bool {
+	rsc, _, err := fetcher.Fetch(br)
+	if err != nil {
+		return false
+	}
+	defer rsc.Close()
+	ss := new(schema.Superset)
+	if err := json.NewDecoder(rsc).Decode(ss); err != nil {
+		return false
+	}
+	return ss.Type == "permanode"
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/remote"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/fs"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+)
+
+// server implements fs.Server on top of a client, for read/write
+// mounts of a permanode.
+type server struct {
+	c             *client.Client
+	sto           blobserver.Storage
+	entityFetcher jsonsign.EntityFetcher
+}
+
+var _ fs.Server = (*server)(nil)
+
+func newServer(c *client.Client) *server {
+	return &server{
+		c:   c,
+		sto: remote.NewFromClient(c),
+		entityFetcher: &jsonsign.CachingEntityFetcher{
+			Fetcher: &jsonsign.FileEntityFetcher{File: c.SecretRingFile()},
+		},
+	}
+}
+
+func (s *server) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	return s.sto.ReceiveBlob(br, source)
+}
+
+func (s *server) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
+	return s.sto.StatBlobs(dest, blobs, wait)
+}
+
+func (s *server) UploadAndSignMap(m map[string]interface{}) (*blobref.BlobRef, error) {
+	signer := s.c.SignerPublicKeyBlobref()
+	if signer == nil {
+		return nil, errors.New("No public key configured.")
+	}
+	m["camliSigner"] = signer.String()
+	unsigned, err := schema.MapToCamliJSON(m)
+	if err != nil {
+		return nil, err
+	}
+	sr := &jsonsign.SignRequest{
+		UnsignedJson:  unsigned,
+		Fetcher:       s.c.GetBlobFetcher(),
+		EntityFetcher: s.entityFetcher,
+	}
+	signed, err := sr.Sign()
+	if err != nil {
+		return nil, err
+	}
+	pr, err := s.c.Upload(client.NewUploadHandleFromString(signed))
+	if err != nil {
+		return nil, err
+	}
+	return pr.BlobRef, nil
+}
+
+func (s *server) PermanodeAttrs(pn *blobref.BlobRef) (url.Values, error) {
+	return s.c.PermanodeAttrs(pn)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The campack command maintains "packed" blob storage directories.
+//
+// Usage:
+//
+//	campack [-maxpacksize=<bytes>] compact <dir>
+//	campack reindex <dir>
+//
+// compact reclaims the space of the blobs removed from the storage in
+// dir. -maxpacksize should be the storage's "maxPackSize" config
+// value, if it sets one.
+//
+// reindex rebuilds the storage's index from the headers in the pack
+// files, for when the index is lost or corrupt. Removed blobs that
+// weren't compacted away yet come back.
+//
+// The storage directory is locked while in use, so campack fails if
+// the server using dir is running.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"camlistore.org/pkg/blobserver/packed"
+)
+
+var flagMaxPackSize = flag.Int64("maxpacksize", 0, "Size after which a new pack file is started, as in the storage's config. Zero means the default.")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: campack [-maxpacksize=<bytes>] compact <dir>\n")
+	fmt.Fprintf(os.Stderr, "       campack reindex <dir>\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+	cmd, dir := flag.Arg(0), flag.Arg(1)
+	if cmd != "compact" && cmd != "reindex" {
+		usage()
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		exitf("%q isn't a directory", dir)
+	}
+
+	s, err := packed.New(dir, *flagMaxPackSize)
+	if err != nil {
+		exitf("Error opening %s: %v", dir, err)
+	}
+	switch cmd {
+	case "compact":
+		stats, err := s.Compact()
+		if err != nil {
+			exitf("Error compacting %s: %v", dir, err)
+		}
+		fmt.Printf("Rewrote %d pack files (%d left alone), copying %d blobs (%d bytes); freed %d bytes.\n",
+			stats.Packs, stats.PacksSkipped, stats.Blobs, stats.BytesCopied, stats.BytesFreed)
+	case "reindex":
+		n, err := s.Reindex()
+		if err != nil {
+			exitf("Error reindexing %s: %v", dir, err)
+		}
+		fmt.Printf("Indexed %d blobs.\n", n)
+	}
+	if err := s.Close(); err != nil {
+		exitf("Error closing %s: %v", dir, err)
+	}
+}
+
+func exitf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -18,7 +18,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"errors"
 	"flag"
 	"fmt"
@@ -74,13 +73,13 @@ func stdinBlobHandle() (uh *client.UploadHandle, err error) {
 	}
 	// TODO(bradfitz,mpl): limit this buffer size?
 	file := buf.Bytes()
-	s1 := sha1.New()
-	size, err = io.Copy(s1, &buf)
+	h := blobref.NewHash()
+	size, err = io.Copy(h, &buf)
 	if err != nil {
 		return
 	}
 	return &client.UploadHandle{
-		BlobRef:  blobref.FromHash("sha1", s1),
+		BlobRef:  blobref.FromHash(blobref.DefaultDigest(), h),
 		Size:     size,
 		Contents: io.LimitReader(bytes.NewReader(file), size),
 	}, nil
@@ -110,11 +109,11 @@ func fileBlobHandle(up *Uploader, path string) (uh *client.UploadHandle, err err
 }
 
 func blobDetails(contents io.ReadSeeker) (bref *blobref.BlobRef, size int64, err error) {
-	s1 := sha1.New()
+	h := blobref.NewHash()
 	contents.Seek(0, 0)
-	size, err = io.Copy(s1, contents)
+	size, err = io.Copy(h, contents)
 	if err == nil {
-		bref = blobref.FromHash("sha1", s1)
+		bref = blobref.FromHash(blobref.DefaultDigest(), h)
 	}
 	contents.Seek(0, 0)
 	return
@@ -0,0 +1,132 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/osutil"
+)
+
+type cacheCmd struct {
+	clear   bool
+	all     bool
+	compact bool
+	verify  bool
+}
+
+func init() {
+	RegisterCommand("cache", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(cacheCmd)
+		flags.BoolVar(&cmd.clear, "clear", false, "Forget what's cached for the current blob server and identity.")
+		flags.BoolVar(&cmd.all, "all", false, "With -clear, forget everything cached, for all blob servers and identities.")
+		flags.BoolVar(&cmd.compact, "compact", false, "Forget the files changed or gone since they were cached, and compact the cache.")
+		flags.BoolVar(&cmd.verify, "verify", false, "Ask the blob server which of the cached blobs it still has, and forget the others.")
+		return cmd
+	})
+}
+
+func (c *cacheCmd) Usage() {
+	fmt.Fprintf(os.Stderr, `Usage: camput cache [opts]
+
+Shows what the stat and have caches of "camput file -statcache -havecache"
+hold, per blob server and identity, or cleans them up. The current blob
+server and identity are marked with a star.
+`)
+}
+
+func (c *cacheCmd) Examples() []string {
+	return []string{
+		"",
+		"--verify --compact",
+		"--clear [--all]",
+	}
+}
+
+// verifyBatch is the number of blobs stated at once by -verify.
+const verifyBatch = 1000
+
+func (c *cacheCmd) RunCommand(up *Uploader, args []string) error {
+	if len(args) != 0 {
+		return UsageError("cache takes no arguments")
+	}
+	if c.all && !c.clear {
+		return UsageError("Can't use --all without --clear")
+	}
+	if c.clear && (c.compact || c.verify) {
+		return UsageError("Can't use --clear with --compact or --verify")
+	}
+	cache, err := up.openCache()
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+
+	switch {
+	case c.clear && c.all:
+		if err := clearCache(cache.s, ""); err != nil {
+			return err
+		}
+		// And the caches of older camputs, which weren't per server.
+		for _, name := range []string{"camput.statcache", "camput.havecache"} {
+			os.Remove(filepath.Join(osutil.CacheDir(), name))
+		}
+		return nil
+	case c.clear:
+		return clearCache(cache.s, cache.id)
+	}
+
+	if c.verify {
+		brs, err := cache.cachedBlobs()
+		if err != nil {
+			return err
+		}
+		missing := 0
+		for i := 0; i < len(brs); i += verifyBatch {
+			batch := brs[i:]
+			if len(batch) > verifyBatch {
+				batch = batch[:verifyBatch]
+			}
+			// The cache forgets the missing blobs, in the
+			// client's missing blob hook.
+			have := make(chan blobref.SizedBlobRef, len(batch))
+			if err := up.StatBlobs(have, batch, 0); err != nil {
+				return err
+			}
+			missing += len(batch) - len(have)
+		}
+		fmt.Printf("%d of %d cached blobs missing on %s; forgotten.\n", missing, len(brs), up.Server())
+	}
+	if c.compact {
+		n, err := cache.prune()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d changed or deleted files forgotten.\n", n)
+	}
+
+	infos, err := listCaches(cache.s)
+	if err != nil {
+		return err
+	}
+	writeCacheList(os.Stdout, infos, cache.id)
+	return nil
+}
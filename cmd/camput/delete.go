@@ -0,0 +1,58 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+type deleteCmd struct{}
+
+func init() {
+	RegisterCommand("delete", func(flags *flag.FlagSet) CommandRunner {
+		return new(deleteCmd)
+	})
+}
+
+func (c *deleteCmd) Usage() {
+	errf("Usage: camput [globalopts] delete <claim>")
+}
+
+func (c *deleteCmd) Examples() []string {
+	return []string{
+		"<claim>    Retract a previous claim (e.g. an unwanted tag or member)",
+	}
+}
+
+func (c *deleteCmd) RunCommand(up *Uploader, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Delete takes 1 arg: <claim>")
+	}
+	target := blobref.Parse(args[0])
+	if target == nil {
+		return fmt.Errorf("Error parsing blobref %q", args[0])
+	}
+	m := schema.NewDeleteClaim(target)
+	put, err := up.UploadAndSignMap(m)
+	handleResult(m["claimType"].(string), put, err)
+	return nil
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stringsFlag is a flag.Value collecting the values of a repeated
+// flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// An excludeRule is a gitignore-style pattern of paths not to upload:
+//
+//	# comment
+//	*.o        a name, at any depth
+//	/build     a path, relative to the directory of the rule
+//	logs/      only directories
+//	doc/**/*.o "**" matches any number of directories
+//	!keep.o    includes again what a previous rule excluded
+//
+// The last matching rule decides.  The contents of an excluded
+// directory are excluded, whatever the rules about them.
+type excludeRule struct {
+	base     string   // directory the pattern is relative to; "" for the root of the upload
+	elems    []string // of the pattern, split at slashes
+	anchored bool     // whether the pattern is a path below base, rather than a name
+	negate   bool
+	dirOnly  bool
+	text     string // as written
+	source   string // where it's written, e.g. "-exclude" or "/home/bob/.camliignore:3"
+}
+
+// parseExcludeRule parses the rule line, returning false for blank
+// lines and comments.
+func parseExcludeRule(line, base, source string) (r excludeRule, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+	r = excludeRule{base: base, text: line, source: source}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// "\#" and "\!" start patterns with those characters.
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	r.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return r, false
+	}
+	r.elems = strings.Split(line, "/")
+	return r, true
+}
+
+func (r *excludeRule) match(root, p string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	base := r.base
+	if base == "" {
+		base = root
+	}
+	rel, err := filepath.Rel(base, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	names := strings.Split(filepath.ToSlash(rel), "/")
+	if !r.anchored {
+		names = names[len(names)-1:]
+	}
+	return matchElems(r.elems, names)
+}
+
+func matchElems(pattern, names []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(names) > 0
+			}
+			for i := range names {
+				if matchElems(pattern[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], names[0]); !ok {
+			return false
+		}
+		pattern, names = pattern[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// An excluder decides which paths a tree upload skips.
+type excluder struct {
+	config []excludeRule // from the "exclude" list of the configuration file
+	flags  []excludeRule // from -exclude, taking precedence over all others
+
+	ignoreFile string // name of the per-directory rule files, or ""
+
+	maxSize int64         // of files, if non-zero
+	maxAge  time.Duration // since the files' last modification, if non-zero
+	minAge  time.Duration // since the files' last modification, if non-zero
+}
+
+func newExcluder(config, flags []string) *excluder {
+	e := new(excluder)
+	for _, p := range config {
+		if r, ok := parseExcludeRule(p, "", "config"); ok {
+			e.config = append(e.config, r)
+		}
+	}
+	for _, p := range flags {
+		if r, ok := parseExcludeRule(p, "", "-exclude"); ok {
+			e.flags = append(e.flags, r)
+		}
+	}
+	return e
+}
+
+// A dirExcluder is an excluder for the entries of a directory, with
+// the rules of the ignore files of that directory and of its parents.
+// A nil *dirExcluder excludes nothing.
+type dirExcluder struct {
+	*excluder
+	root  string        // of the tree upload
+	rules []excludeRule // of the ignore files, outermost first
+}
+
+// forTree returns the dirExcluder of the entries of root's parent.
+func (e *excluder) forTree(root string) *dirExcluder {
+	if e == nil {
+		return nil
+	}
+	return &dirExcluder{excluder: e, root: root}
+}
+
+// enter returns the dirExcluder of the entries of dir, a directory
+// not excluded by d.
+func (d *dirExcluder) enter(dir string) (*dirExcluder, error) {
+	if d == nil || d.ignoreFile == "" {
+		return d, nil
+	}
+	filename := filepath.Join(dir, d.ignoreFile)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	nd := &dirExcluder{excluder: d.excluder, root: d.root}
+	nd.rules = append(nd.rules, d.rules...)
+	br := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if r, ok := parseExcludeRule(strings.TrimSuffix(line, "\n"), dir, fmt.Sprintf("%s:%d", filename, n)); ok {
+			nd.rules = append(nd.rules, r)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nd, nil
+}
+
+// excluded returns why the entry p, of file info fi, is excluded, or
+// "" if it isn't.
+func (d *dirExcluder) excluded(p string, fi os.FileInfo) string {
+	if d == nil {
+		return ""
+	}
+	var last *excludeRule
+	for _, rules := range [][]excludeRule{d.config, d.rules, d.flags} {
+		for i := range rules {
+			if rules[i].match(d.root, p, fi.IsDir()) {
+				last = &rules[i]
+			}
+		}
+	}
+	if last != nil && !last.negate {
+		return fmt.Sprintf("%s: %q", last.source, last.text)
+	}
+	if !fi.Mode().IsRegular() {
+		return ""
+	}
+	if d.maxSize > 0 && fi.Size() > d.maxSize {
+		return fmt.Sprintf("larger than -maxsize %d", d.maxSize)
+	}
+	age := time.Now().Sub(fi.ModTime())
+	if d.maxAge > 0 && age > d.maxAge {
+		return fmt.Sprintf("older than -maxage %v", d.maxAge)
+	}
+	if d.minAge > 0 && age < d.minAge {
+		return fmt.Sprintf("newer than -minage %v", d.minAge)
+	}
+	return ""
+}
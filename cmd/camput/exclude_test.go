@@ -0,0 +1,150 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExcludeRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		isDir         bool
+		want          bool
+	}{
+		{"*.o", "/r/a.o", false, true},
+		{"*.o", "/r/sub/dir/a.o", false, true},
+		{"*.o", "/r/a.c", false, false},
+		{"build/", "/r/sub/build", true, true},
+		{"build/", "/r/sub/build", false, false},
+		{"/build", "/r/build", false, true},
+		{"/build", "/r/sub/build", false, false},
+		{"doc/*.html", "/r/doc/a.html", false, true},
+		{"doc/*.html", "/r/x/doc/a.html", false, false},
+		{"**/tmp", "/r/tmp", true, true},
+		{"**/tmp", "/r/a/b/tmp", true, true},
+		{"doc/**/*.o", "/r/doc/a.o", false, true},
+		{"doc/**/*.o", "/r/doc/a/b/c.o", false, true},
+		{"logs/**", "/r/logs/a/b", false, true},
+		{"logs/**", "/r/logs", true, false},
+		{`\#notes`, "/r/#notes", false, true},
+		{"*", "/other/a", false, false},
+	}
+	for _, tt := range tests {
+		r, ok := parseExcludeRule(tt.pattern, "", "test")
+		if !ok {
+			t.Errorf("pattern %q not parsed", tt.pattern)
+			continue
+		}
+		if got := r.match("/r", tt.path, tt.isDir); got != tt.want {
+			t.Errorf("pattern %q matching %q (dir=%v) = %v; want %v", tt.pattern, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+	for _, line := range []string{"", "   ", "# comment", "/"} {
+		if _, ok := parseExcludeRule(line, "", "test"); ok {
+			t.Errorf("line %q parsed as a rule", line)
+		}
+	}
+}
+
+func TestExcluder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camput-exclude-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, contents string) (string, os.FileInfo) {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name, fi
+	}
+	write(".camliignore", "*.log\n!keep.log\n/top.txt")
+	write("sub/.camliignore", "keep.log\n*.txt")
+
+	e := newExcluder([]string{"*.bak", "*.txt"}, []string{"!important.bak"})
+	e.ignoreFile = ".camliignore"
+	e.maxSize = 10
+	root, err := e.forTree(dir).enter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := root.enter(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ex   *dirExcluder
+		name string
+		size int
+		want string // in the reason, or "" if not excluded
+	}{
+		{root, "a.log", 1, ".camliignore:1"},
+		{root, "keep.log", 1, ""},
+		{root, "top.txt", 1, ".camliignore:3"},
+		{root, "b.txt", 1, "config"},
+		{root, "a.bak", 1, "config"},
+		{root, "important.bak", 1, ""},
+		{root, "big", 11, "-maxsize"},
+		{sub, "sub/top.txt", 1, "sub/.camliignore:2"},
+		{sub, "sub/keep.log", 1, "sub/.camliignore:1"},
+		{sub, "sub/important.bak", 1, ""},
+	}
+	for _, tt := range tests {
+		path, fi := write(tt.name, strings.Repeat("x", tt.size))
+		got := tt.ex.excluded(path, fi)
+		if (got == "") != (tt.want == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("%s excluded because %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	e.maxAge = time.Hour
+	path, fi := write("old", "x")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Lstat(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := root.excluded(path, fi); !strings.Contains(got, "-maxage") {
+		t.Errorf("old file excluded because %q; want -maxage", got)
+	}
+	e.maxAge, e.minAge = 0, time.Hour
+	path, fi = write("new", "x")
+	if got := root.excluded(path, fi); !strings.Contains(got, "-minage") {
+		t.Errorf("new file excluded because %q; want -minage", got)
+	}
+
+	var none *dirExcluder
+	if got := none.excluded(path, fi); got != "" {
+		t.Errorf("nil dirExcluder excluded %s: %s", path, got)
+	}
+}
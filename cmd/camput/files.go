@@ -43,11 +43,21 @@ type fileCmd struct {
 	tag  string
 
 	makePermanode bool
+	snapshot      string // blobref of an existing permanode getting the upload as its new camliContent
 	rollSplits    bool
 	diskUsage     bool // show "du" disk usage only (dry run mode), don't actually upload
 
 	havecache, statcache bool
 
+	excludes   stringsFlag   // gitignore-style patterns of paths not to upload
+	ignoreFile string        // name of the per-directory files of such patterns
+	maxSize    int64         // of the files uploaded, if non-zero
+	maxAge     time.Duration // since the last modification of the files uploaded, if non-zero
+	minAge     time.Duration // since the last modification of the files uploaded, if non-zero
+
+	watch         bool          // keep uploading the changes of the directory
+	watchDebounce time.Duration // quiet time before a snapshot of the changes
+
 	// Go into in-memory stats mode only; doesn't actually upload.
 	memstats bool
 	histo    string // optional histogram output filename
@@ -57,15 +67,23 @@ func init() {
 	RegisterCommand("file", func(flags *flag.FlagSet) CommandRunner {
 		cmd := new(fileCmd)
 		flags.BoolVar(&cmd.makePermanode, "permanode", false, "Create an associate a new permanode for the uploaded file or directory.")
-		flags.StringVar(&cmd.name, "name", "", "Optional name attribute to set on permanode when using -permanode.")
-		flags.StringVar(&cmd.tag, "tag", "", "Optional tag(s) to set on permanode when using -permanode. Single value or comma separated.")
+		flags.StringVar(&cmd.snapshot, "snapshot", "", "Blobref of an existing permanode, to set the upload as its new camliContent instead of creating a new permanode. Re-running with the same permanode keeps a history of snapshots, listed by camget -snapshots.")
+		flags.StringVar(&cmd.name, "name", "", "Optional name attribute to set on permanode when using -permanode or -snapshot.")
+		flags.StringVar(&cmd.tag, "tag", "", "Optional tag(s) to set on permanode when using -permanode or -snapshot. Single value or comma separated.")
 
-		flags.BoolVar(&cmd.statcache, "statcache", false, "Use the stat cache, assuming unchanged files already uploaded in the past are still there. Fast, but potentially dangerous.")
-		flags.BoolVar(&cmd.havecache, "havecache", false, "Use the 'have cache', a cache keeping track of what blobs the remote server should already have from previous uploads.")
+		flags.BoolVar(&cmd.statcache, "statcache", false, "Use the stat cache, assuming unchanged files already uploaded in the past to the same server are still there. Fast, but potentially dangerous. See camput cache.")
+		flags.BoolVar(&cmd.havecache, "havecache", false, "Use the 'have cache', a cache keeping track of what blobs the remote server should already have from previous uploads. See camput cache.")
 		flags.BoolVar(&cmd.rollSplits, "rolling", false, "Use rolling checksum file splits.")
 		flags.BoolVar(&cmd.memstats, "debug-memstats", false, "Enter debug in-memory mode; collecting stats only. Doesn't upload anything.")
-		flags.BoolVar(&cmd.diskUsage, "du", false, "Dry run mode: only show disk usage information, without upload or statting dest. Used for testing skipDirs configs, mostly.")
+		flags.BoolVar(&cmd.diskUsage, "du", false, "Dry run mode: only show disk usage information, and what's excluded and why, without upload or statting dest. Used for testing exclude rules, mostly.")
 		flags.StringVar(&cmd.histo, "debug-histogram-file", "", "File where to print the histogram of the blob sizes. Requires debug-memstats.")
+		flags.Var(&cmd.excludes, "exclude", "Gitignore-style pattern of the paths not to upload, such as '*.o', '/tmp/' or '!keep.o'. Repeatable; adds to the \"exclude\" list of the config file, and takes precedence over it and the per-directory -ignorefile.")
+		flags.StringVar(&cmd.ignoreFile, "ignorefile", ".camliignore", "Name of the files of exclude patterns, one per line, applying to the directory they're in. Empty to disable.")
+		flags.Int64Var(&cmd.maxSize, "maxsize", 0, "If non-zero, don't upload the files larger than this many bytes.")
+		flags.DurationVar(&cmd.maxAge, "maxage", 0, "If non-zero, don't upload the files not modified in that long, such as 720h.")
+		flags.DurationVar(&cmd.minAge, "minage", 0, "If non-zero, don't upload the files modified more recently, such as 10m, as they may still be written.")
+		flags.BoolVar(&cmd.watch, "watch", false, "Upload the directory, then keep watching it (Linux only), uploading its changes and setting the new tree as the camliContent of the permanode. The permanode and the state of the watch are kept across restarts.")
+		flags.DurationVar(&cmd.watchDebounce, "watch-debounce", 5*time.Second, "With -watch, how long the directory must be quiet before its changes are uploaded.")
 
 		flagCacheLog = flags.Bool("logcache", false, "log caching details")
 
@@ -81,6 +99,8 @@ func (c *fileCmd) Examples() []string {
 	return []string{
 		"[opts] <file(s)/director(ies)",
 		"--permanode --name='Homedir backup' --tag=backup,homedir $HOME",
+		"--snapshot=sha1-xxx $HOME",
+		"--watch --name='Homedir backup' $HOME",
 	}
 }
 
@@ -88,12 +108,26 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 	if len(args) == 0 {
 		return UsageError("No files or directories given.")
 	}
-	if c.name != "" && !c.makePermanode {
+	hasPermanode := c.makePermanode || c.snapshot != "" || c.watch
+	if c.name != "" && !hasPermanode {
 		return UsageError("Can't set name without using --permanode")
 	}
-	if c.tag != "" && !c.makePermanode {
+	if c.tag != "" && !hasPermanode {
 		return UsageError("Can't set tag without using --permanode")
 	}
+	if c.watch && (c.memstats || c.diskUsage) {
+		return UsageError("Can't use --watch with --debug-memstats or --du")
+	}
+	var snapshotOf *blobref.BlobRef
+	if c.snapshot != "" {
+		if c.makePermanode || c.memstats || c.diskUsage {
+			return UsageError("Can't use --snapshot with --permanode, --debug-memstats or --du")
+		}
+		snapshotOf = blobref.Parse(c.snapshot)
+		if snapshotOf == nil {
+			return UsageError(fmt.Sprintf("Invalid --snapshot permanode blobref %q", c.snapshot))
+		}
+	}
 	if c.histo != "" && !c.memstats {
 		return UsageError("Can't use histo without memstats")
 	}
@@ -106,13 +140,33 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 		up.altStatReceiver = sr
 		defer func() { sr.DumpStats(c.histo) }()
 	}
-	if c.statcache {
-		cache := NewFlatStatCache()
-		up.statCache = cache
+	if c.statcache || c.havecache {
+		cache, err := up.openCache()
+		if err != nil {
+			log.Printf("Not using the stat and have caches: %v", err)
+		} else {
+			defer cache.Close()
+			if c.statcache {
+				up.statCache = cache
+			}
+			if c.havecache {
+				up.haveCache = cache
+			}
+		}
+	}
+	if c.rollSplits {
+		up.rollSplits = true
 	}
-	if c.havecache {
-		cache := NewFlatHaveCache()
-		up.haveCache = cache
+	up.exclude = newExcluder(client.ExcludePatterns(), c.excludes)
+	up.exclude.ignoreFile = c.ignoreFile
+	up.exclude.maxSize = c.maxSize
+	up.exclude.maxAge = c.maxAge
+	up.exclude.minAge = c.minAge
+	if c.watch {
+		if len(args) != 1 {
+			return UsageError("The --watch flag can only be used with exactly one directory argument")
+		}
+		return c.watchDir(up, args[0], snapshotOf)
 	}
 
 	var (
@@ -129,6 +183,12 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 			return fmt.Errorf("Uploading permanode: %v", err)
 		}
 	}
+	if snapshotOf != nil {
+		if len(args) != 1 {
+			return fmt.Errorf("The --snapshot flag can only be used with exactly one file or directory argument")
+		}
+		permaNode = &client.PutResult{BlobRef: snapshotOf}
+	}
 	if c.diskUsage {
 		if len(args) != 1 {
 			return fmt.Errorf("The --du flag can only be used with exactly one directory argument")
@@ -151,9 +211,6 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 		handleResult("tree-upload", pr, err)
 		return nil
 	}
-	if c.rollSplits {
-		up.rollSplits = true
-	}
 
 	for _, filename := range args {
 		if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
@@ -173,24 +230,29 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 		if handleResult("claim-permanode-content", put, err) != nil {
 			return err
 		}
-		if c.name != "" {
-			put, err := up.UploadAndSignMap(schema.NewSetAttributeClaim(permaNode.BlobRef, "name", c.name))
-			handleResult("claim-permanode-name", put, err)
-		}
-		if c.tag != "" {
-			tags := strings.Split(c.tag, ",")
-			m := schema.NewSetAttributeClaim(permaNode.BlobRef, "tag", tags[0])
-			for _, tag := range tags {
-				m = schema.NewAddAttributeClaim(permaNode.BlobRef, "tag", tag)
-				put, err := up.UploadAndSignMap(m)
-				handleResult("claim-permanode-tag", put, err)
-			}
-		}
+		c.setPermanodeAttrs(up, permaNode.BlobRef)
 		handleResult("permanode", permaNode, nil)
 	}
 	return nil
 }
 
+// setPermanodeAttrs sets the -name and -tag attributes on permaNode.
+func (c *fileCmd) setPermanodeAttrs(up *Uploader, permaNode *blobref.BlobRef) {
+	if c.name != "" {
+		put, err := up.UploadAndSignMap(schema.NewSetAttributeClaim(permaNode, "name", c.name))
+		handleResult("claim-permanode-name", put, err)
+	}
+	if c.tag != "" {
+		tags := strings.Split(c.tag, ",")
+		m := schema.NewSetAttributeClaim(permaNode, "tag", tags[0])
+		for _, tag := range tags {
+			m = schema.NewAddAttributeClaim(permaNode, "tag", tag)
+			put, err := up.UploadAndSignMap(m)
+			handleResult("claim-permanode-tag", put, err)
+		}
+	}
+}
+
 // statsStatReceiver is a dummy blobserver.StatReceiver that doesn't store anything;
 // it just collects statistics.
 type statsStatReceiver struct {
@@ -407,6 +469,7 @@ func (up *Uploader) NewTreeUpload(dir string) *TreeUpload {
 	return &TreeUpload{
 		base:     dir,
 		up:       up,
+		exclude:  up.exclude.forTree(dir),
 		donec:    make(chan bool, 1),
 		errc:     make(chan error, 1),
 		stattedc: make(chan *node, buffered),
@@ -480,7 +543,7 @@ which may involve multiple goroutines:
 
 1) one process stats all files and walks all directories as fast as possible
    to calculate how much total work there will be.  this goroutine also
-   filters out directories to be skipped. (caches, temp files, skipDirs, etc)
+   filters out the excluded paths. (caches, temp files, see exclude.go)
 
  2) one process works though the files that were discovered and checks
     the statcache to see what actually needs to be uploaded.
@@ -501,10 +564,15 @@ type TreeUpload struct {
 	// command.
 	DiskUsageMode bool
 
+	// If non-nil, DirHook is called with each directory before
+	// its entries are read. An error aborts the upload.
+	DirHook func(dir string) error
+
 	// Immutable:
 	base     string // base directory
 	up       *Uploader
-	stattedc chan *node // from stat-the-world goroutine to run()
+	exclude  *dirExcluder // of base's entries; nil excludes nothing
+	stattedc chan *node   // from stat-the-world goroutine to run()
 
 	donec chan bool // closed when run() finishes
 	err   error
@@ -516,10 +584,12 @@ type TreeUpload struct {
 	uploaded stats // uploaded (even if server said it already had it and bytes weren't sent)
 
 	finalPutRes *client.PutResult // set after run() returns
+	root        *node             // set after run() returns
 }
 
 // fi is optional (will be statted if nil)
-func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo) (nod *node, err error) {
+// ex is the excluder of fullPath's siblings.
+func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo, ex *dirExcluder) (nod *node, err error) {
 	defer func() {
 		if err == nil && nod != nil {
 			t.stattedc <- nod
@@ -541,6 +611,15 @@ func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo) (nod *node, err e
 	if !fi.IsDir() {
 		return n, nil
 	}
+	if t.DirHook != nil {
+		if err := t.DirHook(fullPath); err != nil {
+			return nil, err
+		}
+	}
+	ex, err = ex.enter(fullPath)
+	if err != nil {
+		return nil, err
+	}
 	f, err := t.up.open(fullPath)
 	if err != nil {
 		return nil, err
@@ -552,7 +631,12 @@ func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo) (nod *node, err e
 	}
 	sort.Sort(byFileName(fis))
 	for _, fi := range fis {
-		depn, err := t.statPath(filepath.Join(fullPath, filepath.Base(fi.Name())), fi)
+		path := filepath.Join(fullPath, filepath.Base(fi.Name()))
+		if why := ex.excluded(path, fi); why != "" {
+			t.noteExcluded(path, why)
+			continue
+		}
+		depn, err := t.statPath(path, fi, ex)
 		if err != nil {
 			return nil, err
 		}
@@ -561,6 +645,16 @@ func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo) (nod *node, err e
 	return n, nil
 }
 
+func (t *TreeUpload) noteExcluded(path, why string) {
+	if t.DiskUsageMode {
+		fmt.Printf("excluded\t%s\t%s\n", path, why)
+		return
+	}
+	vlog.Printf("Excluded %s: %s", path, why)
+}
+
+// uploadWorkers is how many nodes are uploaded at once, unless the
+// client's concurrent requests are limited to another number.
 const uploadWorkers = 5
 
 func (t *TreeUpload) run() {
@@ -571,7 +665,7 @@ func (t *TreeUpload) run() {
 	var root *node // nil until received and set in loop below.
 	rootc := make(chan *node, 1)
 	go func() {
-		n, err := t.statPath(t.base, nil)
+		n, err := t.statPath(t.base, nil, t.exclude)
 		if err != nil {
 			log.Fatalf("Error scanning files under %s: %v", t.base, err)
 		}
@@ -609,7 +703,11 @@ func (t *TreeUpload) run() {
 			}
 		})
 	} else {
-		upload = NewNodeWorker(uploadWorkers, func(n *node, ok bool) {
+		workers := uploadWorkers
+		if max := t.up.Limits().MaxConns; max > 0 {
+			workers = max
+		}
+		upload = NewNodeWorker(workers, func(n *node, ok bool) {
 			if !ok {
 				log.Printf("done with all uploads.")
 				uploadsdonec <- true
@@ -689,6 +787,7 @@ Loop:
 	if root == nil {
 		panic("unexpected nil root node")
 	}
+	t.root = root
 	var err error
 	log.Printf("Waiting on root node %q", root.fullPath)
 	t.finalPutRes, err = root.PutResult()
@@ -129,6 +129,7 @@ func (c *initCmd) RunCommand(_ *Uploader, args []string) error {
 		return err
 	}
 
+	// Public key blobrefs are always sha1 (see blobref.SetDefaultDigest).
 	bref := blobref.SHA1FromString(string(pubArmor))
 
 	keyBlobPath := path.Join(blobDir, bref.String()+".camli")
@@ -0,0 +1,426 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/leveldb"
+	"camlistore.org/pkg/osutil"
+)
+
+type statFingerprint string
+
+func fileInfoToFingerprint(fi os.FileInfo) statFingerprint {
+	// TODO: add ctime, etc
+	return statFingerprint(fmt.Sprintf("%dB/%dMOD", fi.Size(), fi.ModTime().UnixNano()))
+}
+
+type fileInfoPutRes struct {
+	Fingerprint statFingerprint
+	Result      client.PutResult
+}
+
+var ErrCacheMiss = errors.New("not in cache")
+
+// filename may be relative.
+func cacheKey(pwd, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filepath.Clean(filename)
+	}
+	return filepath.Join(pwd, filename)
+}
+
+// KvCache is both the stat cache and the have cache of camput, kept
+// in a leveldb store in camput's cache directory. Its entries are per
+// blob server and identity: what was uploaded to one server, or as
+// one identity, is never trusted for another.
+//
+// The keys, where <id> is the cacheID of the server and identity:
+//
+//	server|<id>                    "<server URL>\t<identity>"
+//	stat|<id>|<path>               "<fingerprint>\t<blobref>/<size>"
+//	statref|<id>|<blobref>|<path>  ""   (the stat entries of a blob)
+//	have|<id>|<blobref>            ""
+//
+// Entries are forgotten when the server reports their blob missing.
+//
+// The store keeps its entries on disk, in tables it merges as they
+// pile up, so the cache can grow with the files uploaded without
+// growing camput's memory.
+type KvCache struct {
+	s      cacheStorage
+	unlock io.Closer
+	id     string
+
+	mu sync.Mutex // serializes the read-modify-writes of entries
+}
+
+var (
+	_ UploadCache = (*KvCache)(nil)
+	_ HaveCache   = (*KvCache)(nil)
+)
+
+// cacheStorage is the leveldb index storage of the cache.
+type cacheStorage interface {
+	index.IndexStorage
+	Compact() error
+	Close() error
+}
+
+// errCacheLocked is returned when another camput uses the cache.
+var errCacheLocked = errors.New("the camput cache is in use by another camput")
+
+// kvCacheDir returns the directory of the cache.
+func kvCacheDir() string {
+	return filepath.Join(osutil.CacheDir(), "camput.cache")
+}
+
+// openCacheStorage opens the cache store in dir, locking it for this
+// process.
+func openCacheStorage(dir string) (cacheStorage, io.Closer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	// The store locks its own LOCK file too, but its error doesn't
+	// tell a cache in use from other failures.
+	unlock, err := osutil.LockFile(filepath.Join(dir, "camput.lock"))
+	if err != nil {
+		return nil, nil, errCacheLocked
+	}
+	is, err := leveldb.NewStorage(dir)
+	if err != nil {
+		unlock.Close()
+		return nil, nil, fmt.Errorf("opening camput cache: %v", err)
+	}
+	return is.(cacheStorage), unlock, nil
+}
+
+// cacheID returns the ID scoping the cache entries of server and
+// identity.
+func cacheID(server, identity string) string {
+	h := sha1.New()
+	io.WriteString(h, server+"\n"+identity)
+	return fmt.Sprintf("%x", h.Sum(nil)[:8])
+}
+
+// NewKvCache opens the cache in dir, scoped to the blob server at the
+// URL server and to identity, the GPG key ID the blobs are signed
+// with, if any.
+func NewKvCache(dir, server, identity string) (*KvCache, error) {
+	s, unlock, err := openCacheStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &KvCache{s: s, unlock: unlock, id: cacheID(server, identity)}
+	if err := s.Set("server|"+c.id, server+"\t"+identity); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// openCache opens the cache of up's blob server and identity, and
+// has it forget the blobs the server reports missing.
+func (up *Uploader) openCache() (*KvCache, error) {
+	c, err := NewKvCache(kvCacheDir(), up.Server(), client.KeyId())
+	if err != nil {
+		return nil, err
+	}
+	up.SetMissingBlobHook(c.NoteBlobMissing)
+	return c, nil
+}
+
+// Close closes the cache and releases its lock.
+func (c *KvCache) Close() error {
+	err := c.s.Close()
+	c.unlock.Close()
+	return err
+}
+
+func (c *KvCache) statKey(path string) string {
+	return "stat|" + c.id + "|" + path
+}
+
+func (c *KvCache) statRefKey(br, path string) string {
+	return "statref|" + c.id + "|" + br + "|" + path
+}
+
+func (c *KvCache) haveKey(br string) string {
+	return "have|" + c.id + "|" + br
+}
+
+// parseStatValue parses the value of a stat entry.
+func parseStatValue(v string) (fileInfoPutRes, bool) {
+	f := strings.Split(v, "\t")
+	if len(f) != 2 {
+		return fileInfoPutRes{}, false
+	}
+	slash := strings.LastIndex(f[1], "/")
+	if slash < 0 {
+		return fileInfoPutRes{}, false
+	}
+	br := blobref.Parse(f[1][:slash])
+	size, err := strconv.ParseInt(f[1][slash+1:], 10, 64)
+	if br == nil || err != nil {
+		return fileInfoPutRes{}, false
+	}
+	return fileInfoPutRes{
+		Fingerprint: statFingerprint(f[0]),
+		Result:      client.PutResult{BlobRef: br, Size: size, Skipped: true},
+	}, true
+}
+
+func (c *KvCache) CachedPutResult(pwd, filename string, fi os.FileInfo) (*client.PutResult, error) {
+	key := cacheKey(pwd, filename)
+	v, err := c.s.Get(c.statKey(key))
+	if err != nil {
+		if err != index.ErrNotFound {
+			log.Printf("Warning: (ignoring) reading stat cache: %v", err)
+		}
+		cachelog.Printf("cache MISS on %q: not in cache", key)
+		return nil, ErrCacheMiss
+	}
+	val, ok := parseStatValue(v)
+	if !ok {
+		cachelog.Printf("cache MISS on %q: bogus entry %q", key, v)
+		return nil, ErrCacheMiss
+	}
+	if fp := fileInfoToFingerprint(fi); val.Fingerprint != fp {
+		cachelog.Printf("cache MISS on %q: stats not equal:\n%#v\n%#v", key, val.Fingerprint, fp)
+		return nil, ErrCacheMiss
+	}
+	pr := val.Result
+	return &pr, nil
+}
+
+func (c *KvCache) AddCachedPutResult(pwd, filename string, fi os.FileInfo, pr *client.PutResult) {
+	key := cacheKey(pwd, filename)
+	br := pr.BlobRef.String()
+	cachelog.Printf("Adding to stat cache %q: %s/%d", key, br, pr.Size)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.s.BeginBatch()
+	if old, err := c.s.Get(c.statKey(key)); err == nil {
+		if val, ok := parseStatValue(old); ok && val.Result.BlobRef.String() != br {
+			b.Delete(c.statRefKey(val.Result.BlobRef.String(), key))
+		}
+	}
+	b.Set(c.statKey(key), fmt.Sprintf("%s\t%s/%d", fileInfoToFingerprint(fi), br, pr.Size))
+	b.Set(c.statRefKey(br, key), "")
+	if err := c.s.CommitBatch(b); err != nil {
+		log.Printf("Error adding to stat cache: %v", err)
+	}
+}
+
+func (c *KvCache) BlobExists(br *blobref.BlobRef) bool {
+	_, err := c.s.Get(c.haveKey(br.String()))
+	return err == nil
+}
+
+func (c *KvCache) NoteBlobExists(br *blobref.BlobRef) {
+	if err := c.s.Set(c.haveKey(br.String()), ""); err != nil {
+		log.Printf("Error adding to have cache: %v", err)
+	}
+}
+
+// NoteBlobMissing forgets br, which the server reported it doesn't
+// have, along with the files whose put result it is. It's the missing
+// blob hook of the client.
+func (c *KvCache) NoteBlobMissing(br *blobref.BlobRef) {
+	brs := br.String()
+	refPrefix := c.statRefKey(brs, "")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.s.BeginBatch()
+	n := 0
+	if _, err := c.s.Get(c.haveKey(brs)); err == nil {
+		b.Delete(c.haveKey(brs))
+		n++
+	}
+	it := c.s.Find(refPrefix)
+	for it.Next() && strings.HasPrefix(it.Key(), refPrefix) {
+		b.Delete(it.Key())
+		b.Delete(c.statKey(strings.TrimPrefix(it.Key(), refPrefix)))
+		n++
+	}
+	if err := it.Close(); err != nil {
+		log.Printf("Warning: (ignoring) reading stat cache: %v", err)
+	}
+	if n == 0 {
+		return
+	}
+	cachelog.Printf("Server is missing %s; forgetting %d cache entries", brs, n)
+	if err := c.s.CommitBatch(b); err != nil {
+		log.Printf("Error invalidating cache entries of %s: %v", brs, err)
+	}
+}
+
+// cachedBlobs returns the blobs the cache assumes the server has.
+func (c *KvCache) cachedBlobs() ([]*blobref.BlobRef, error) {
+	seen := make(map[string]bool)
+	var brs []*blobref.BlobRef
+	for _, prefix := range []string{"have|" + c.id + "|", "statref|" + c.id + "|"} {
+		it := c.s.Find(prefix)
+		for it.Next() && strings.HasPrefix(it.Key(), prefix) {
+			s := strings.TrimPrefix(it.Key(), prefix)
+			if i := strings.Index(s, "|"); i >= 0 {
+				s = s[:i]
+			}
+			if br := blobref.Parse(s); br != nil && !seen[s] {
+				seen[s] = true
+				brs = append(brs, br)
+			}
+		}
+		if err := it.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return brs, nil
+}
+
+// prune forgets the stat entries of the files changed or gone since
+// they were cached, and compacts the store.
+func (c *KvCache) prune() (int, error) {
+	prefix := c.statKey("")
+	b := c.s.BeginBatch()
+	n := 0
+	it := c.s.Find(prefix)
+	for it.Next() && strings.HasPrefix(it.Key(), prefix) {
+		path := strings.TrimPrefix(it.Key(), prefix)
+		val, ok := parseStatValue(it.Value())
+		if ok {
+			fi, err := os.Lstat(path)
+			ok = err == nil && fileInfoToFingerprint(fi) == val.Fingerprint
+		}
+		if !ok {
+			b.Delete(it.Key())
+			if val.Result.BlobRef != nil {
+				b.Delete(c.statRefKey(val.Result.BlobRef.String(), path))
+			}
+			n++
+		}
+	}
+	if err := it.Close(); err != nil {
+		return 0, err
+	}
+	if err := c.s.CommitBatch(b); err != nil {
+		return 0, err
+	}
+	return n, c.s.Compact()
+}
+
+// A cacheInfo describes the entries of a server and identity.
+type cacheInfo struct {
+	id, server, identity string
+	stats, haves         int
+}
+
+// listCaches returns the servers and identities with entries in s.
+func listCaches(s index.IndexStorage) ([]*cacheInfo, error) {
+	var infos []*cacheInfo
+	byID := make(map[string]*cacheInfo)
+	it := s.Find("server|")
+	for it.Next() && strings.HasPrefix(it.Key(), "server|") {
+		ci := &cacheInfo{id: strings.TrimPrefix(it.Key(), "server|")}
+		ci.server, ci.identity = it.Value(), ""
+		if i := strings.Index(it.Value(), "\t"); i >= 0 {
+			ci.server, ci.identity = it.Value()[:i], it.Value()[i+1:]
+		}
+		infos = append(infos, ci)
+		byID[ci.id] = ci
+	}
+	if err := it.Close(); err != nil {
+		return nil, err
+	}
+	for _, kind := range []string{"stat|", "have|"} {
+		it := s.Find(kind)
+		for it.Next() && strings.HasPrefix(it.Key(), kind) {
+			id := strings.TrimPrefix(it.Key(), kind)
+			if i := strings.Index(id, "|"); i >= 0 {
+				id = id[:i]
+			}
+			ci := byID[id]
+			if ci == nil {
+				continue
+			}
+			if kind == "stat|" {
+				ci.stats++
+			} else {
+				ci.haves++
+			}
+		}
+		if err := it.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// clearCache deletes the entries of the cache ID id, or all the
+// entries if id is empty, and compacts s.
+func clearCache(s cacheStorage, id string) error {
+	b := s.BeginBatch()
+	it := s.Find("")
+	for it.Next() {
+		k := it.Key()
+		if id != "" {
+			f := strings.SplitN(k, "|", 3)
+			if len(f) < 2 || f[1] != id {
+				continue
+			}
+		}
+		b.Delete(k)
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	if err := s.CommitBatch(b); err != nil {
+		return err
+	}
+	return s.Compact()
+}
+
+// writeCacheList writes infos to w, marking the one of the cache ID
+// current.
+func writeCacheList(w io.Writer, infos []*cacheInfo, current string) {
+	for _, ci := range infos {
+		mark := " "
+		if ci.id == current {
+			mark = "*"
+		}
+		identity := ci.identity
+		if identity == "" {
+			identity = "(no identity)"
+		}
+		fmt.Fprintf(w, "%s %s\t%s\t%d files\t%d blobs\n", mark, ci.server, identity, ci.stats, ci.haves)
+	}
+}
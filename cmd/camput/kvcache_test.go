@@ -0,0 +1,247 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/handlers"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+func TestKvCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camput-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, "cache")
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileRef := blobref.SHA1FromString("file schema")
+	haveRef := blobref.SHA1FromString("blob")
+
+	open := func(server, identity string) *KvCache {
+		c, err := NewKvCache(cacheDir, server, identity)
+		if err != nil {
+			t.Fatalf("opening cache of %s: %v", server, err)
+		}
+		return c
+	}
+	c := open("http://a", "KEY")
+	c.AddCachedPutResult(dir, "file", fi, &client.PutResult{BlobRef: fileRef, Size: 42})
+	c.NoteBlobExists(haveRef)
+	if _, err := NewKvCache(cacheDir, "http://a", "KEY"); err != errCacheLocked {
+		t.Errorf("second open of the cache = %v; want errCacheLocked", err)
+	}
+	c.Close()
+
+	// Persisted, but only for the same server and identity.
+	c = open("http://a", "KEY")
+	if pr, err := c.CachedPutResult("/", file, fi); err != nil || pr.BlobRef.String() != fileRef.String() || pr.Size != 42 {
+		t.Errorf("cached put result = %v, %v", pr, err)
+	}
+	if !c.BlobExists(haveRef) {
+		t.Errorf("blob not in the have cache after reopening")
+	}
+	c.Close()
+	for _, other := range [][2]string{{"http://b", "KEY"}, {"http://a", ""}} {
+		c = open(other[0], other[1])
+		if _, err := c.CachedPutResult("/", file, fi); err != ErrCacheMiss {
+			t.Errorf("%s: stat cache hit for another server or identity", other)
+		}
+		if c.BlobExists(haveRef) {
+			t.Errorf("%s: have cache hit for another server or identity", other)
+		}
+		c.Close()
+	}
+
+	c = open("http://a", "KEY")
+	infos, err := listCaches(c.s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("%d caches listed; want 3", len(infos))
+	}
+	for _, ci := range infos {
+		want := 0
+		if ci.id == c.id {
+			want = 1
+			if ci.server != "http://a" || ci.identity != "KEY" {
+				t.Errorf("current cache listed as %q, %q", ci.server, ci.identity)
+			}
+		}
+		if ci.stats != want || ci.haves != want {
+			t.Errorf("cache of %s, %q has %d files, %d blobs; want %d", ci.server, ci.identity, ci.stats, ci.haves, want)
+		}
+	}
+
+	// The server reporting the file schema missing invalidates the
+	// file.
+	c.NoteBlobMissing(fileRef)
+	if _, err := c.CachedPutResult("/", file, fi); err != ErrCacheMiss {
+		t.Errorf("stat cache hit for a missing blob")
+	}
+	if !c.BlobExists(haveRef) {
+		t.Errorf("unrelated blob forgotten")
+	}
+
+	// Pruning forgets the changed files.
+	c.AddCachedPutResult("/", file, fi, &client.PutResult{BlobRef: fileRef, Size: 42})
+	os.Chtimes(file, time.Now(), fi.ModTime().Add(time.Hour))
+	if n, err := c.prune(); err != nil || n != 1 {
+		t.Errorf("prune = %d, %v; want 1 file forgotten", n, err)
+	}
+	if brs, err := c.cachedBlobs(); err != nil || len(brs) != 1 || brs[0].String() != haveRef.String() {
+		t.Errorf("cached blobs = %v, %v; want [%s]", brs, err, haveRef)
+	}
+
+	if err := clearCache(c.s, c.id); err != nil {
+		t.Fatal(err)
+	}
+	if c.BlobExists(haveRef) {
+		t.Errorf("blob still cached after clearing")
+	}
+	if infos, _ := listCaches(c.s); len(infos) != 2 {
+		t.Errorf("%d caches listed after clearing one; want 2", len(infos))
+	}
+	c.Close()
+}
+
+func TestKvCacheManyEntries(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	dir, err := ioutil.TempDir("", "camput-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewKvCache(dir, "http://a", "KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough for the store to write out several tables.
+	const n = 40000
+	name := func(i int) string { return fmt.Sprintf("dir%03d/file%06d", i%100, i) }
+	for i := 0; i < n; i++ {
+		br := blobref.SHA1FromString(name(i))
+		c.AddCachedPutResult("/", name(i), fi, &client.PutResult{BlobRef: br, Size: int64(i)})
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tables, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(tables) == 0 {
+		t.Errorf("no tables written for %d entries", n)
+	}
+
+	c, err = NewKvCache(dir, "http://a", "KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, i := range []int{0, 1, n / 2, n - 1} {
+		pr, err := c.CachedPutResult("/", name(i), fi)
+		if err != nil || pr.Size != int64(i) || pr.BlobRef.String() != blobref.SHA1FromString(name(i)).String() {
+			t.Errorf("cached put result of %s = %v, %v", name(i), pr, err)
+		}
+	}
+}
+
+func TestKvCacheMissingBlobHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camput-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sto := &configuredStorage{Storage: ds, config: &blobserver.Config{Writable: true, Readable: true}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/camli/stat", handlers.CreateStatHandler(sto))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cl := client.New(ts.URL)
+	cl.SetLogger(nil)
+	if err := cl.SetupAuthFromConfig(jsonconfig.Obj{"auth": "none"}); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir, err := ioutil.TempDir("", "camput-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	c, err := NewKvCache(cacheDir, cl.Server(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cl.SetMissingBlobHook(c.NoteBlobMissing)
+
+	have := blobref.SHA1FromString("have")
+	gone := blobref.SHA1FromString("gone")
+	if _, err := ds.ReceiveBlob(have, strings.NewReader("have")); err != nil {
+		t.Fatal(err)
+	}
+	c.NoteBlobExists(have)
+	c.NoteBlobExists(gone)
+	if _, _, err := cl.FetchStreaming(gone); err == nil {
+		t.Fatal("fetch of a missing blob succeeded")
+	}
+	if c.BlobExists(gone) {
+		t.Errorf("blob the server answered 404 for still cached")
+	}
+
+	c.NoteBlobExists(gone)
+	dest := make(chan blobref.SizedBlobRef, 2)
+	if err := cl.StatBlobs(dest, []*blobref.BlobRef{have, gone}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if c.BlobExists(gone) {
+		t.Errorf("blob missing from the stat response still cached")
+	}
+	if !c.BlobExists(have) {
+		t.Errorf("blob the server has forgotten")
+	}
+}
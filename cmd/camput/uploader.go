@@ -51,6 +51,7 @@ type Uploader struct {
 	pwd       string
 	statCache UploadCache
 	haveCache HaveCache
+	exclude   *excluder // of the tree uploads; nil excludes nothing
 
 	fs http.FileSystem // virtual filesystem to read from; nil means OS filesystem.
 }
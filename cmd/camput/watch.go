@@ -0,0 +1,697 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/osutil"
+	"camlistore.org/pkg/schema"
+)
+
+// A dirWatcher reports the paths changing in the directories it
+// watches.
+type dirWatcher interface {
+	// Watch starts watching the entries of dir (but not of its
+	// subdirectories).
+	Watch(dir string) error
+
+	// Changes returns the channel of the changed paths.  A changed
+	// directory may have changed anywhere in its tree.  The empty
+	// string means that events were lost, and that anything may
+	// have changed.  The channel is closed if watching fails.
+	Changes() <-chan string
+
+	Close() error
+}
+
+// A watchJournal is the state of a "camput file -watch" of a
+// directory, kept across camput restarts: the permanode, the put
+// results of the files (it is the stat cache of the watch), the paths
+// changed since the last snapshot, and that snapshot.
+//
+// The journal file is a log of tab-separated lines, compacted when
+// opened:
+//
+//	permanode <blobref>
+//	file <quoted path> <stat fingerprint> <blobref>/<size>
+//	gone <quoted path>
+//	dirty <quoted path>
+//	snapshot <blobref>
+type watchJournal struct {
+	mu        sync.Mutex
+	filename  string
+	permanode *blobref.BlobRef
+	snapshot  *blobref.BlobRef
+	files     map[string]fileInfoPutRes
+	dirty     map[string]bool
+	af        *os.File // for appending
+}
+
+var _ UploadCache = (*watchJournal)(nil)
+
+// watchJournalFile returns the journal filename of the watch of dir,
+// an absolute path, uploading to the blob server at the URL server as
+// identity. Like the cache entries, the journal of one server and
+// identity is never used for another.
+func watchJournalFile(dir, server, identity string) string {
+	h := sha1.New()
+	io.WriteString(h, dir)
+	return filepath.Join(osutil.CacheDir(), fmt.Sprintf("camput.watch-%s-%x", cacheID(server, identity), h.Sum(nil)[:8]))
+}
+
+func openWatchJournal(filename string) (*watchJournal, error) {
+	j := &watchJournal{
+		filename: filename,
+		files:    make(map[string]fileInfoPutRes),
+		dirty:    make(map[string]bool),
+	}
+	f, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = j.read(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading watch journal %s: %v", filename, err)
+		}
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *watchJournal) read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		ln, err := br.ReadString('\n')
+		if err == io.EOF {
+			// An incomplete last line is from a crash while
+			// writing it; drop it.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f := strings.Split(strings.TrimSuffix(ln, "\n"), "\t")
+		switch {
+		case f[0] == "permanode" && len(f) == 2:
+			j.permanode = blobref.Parse(f[1])
+		case f[0] == "snapshot" && len(f) == 2:
+			j.snapshot = blobref.Parse(f[1])
+			j.dirty = make(map[string]bool)
+		case f[0] == "gone" && len(f) == 2:
+			if path, err := strconv.Unquote(f[1]); err == nil {
+				j.forget(path)
+			}
+		case f[0] == "dirty" && len(f) == 2:
+			if path, err := strconv.Unquote(f[1]); err == nil {
+				j.dirty[path] = true
+			}
+		case f[0] == "file" && len(f) == 4:
+			path, err := strconv.Unquote(f[1])
+			if err != nil {
+				continue
+			}
+			pr := strings.Split(f[3], "/")
+			if len(pr) != 2 {
+				continue
+			}
+			br := blobref.Parse(pr[0])
+			size, err := strconv.ParseInt(pr[1], 10, 64)
+			if br == nil || err != nil {
+				continue
+			}
+			j.files[path] = fileInfoPutRes{
+				Fingerprint: statFingerprint(f[2]),
+				Result:      client.PutResult{BlobRef: br, Size: size, Skipped: true},
+			}
+		}
+	}
+}
+
+// compact rewrites the journal file with only its current state.
+func (j *watchJournal) compact() error {
+	tmp := j.filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if j.permanode != nil {
+		fmt.Fprintf(w, "permanode\t%s\n", j.permanode)
+	}
+	if j.snapshot != nil {
+		fmt.Fprintf(w, "snapshot\t%s\n", j.snapshot)
+	}
+	for path, val := range j.files {
+		fmt.Fprintf(w, "file\t%s\t%s\t%s/%d\n", strconv.Quote(path), val.Fingerprint, val.Result.BlobRef, val.Result.Size)
+	}
+	for path := range j.dirty {
+		fmt.Fprintf(w, "dirty\t%s\n", strconv.Quote(path))
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing watch journal %s: %v", j.filename, err)
+	}
+	j.af, err = os.OpenFile(j.filename, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+// appendf must be called with j.mu held.
+func (j *watchJournal) appendf(format string, args ...interface{}) {
+	if _, err := fmt.Fprintf(j.af, format, args...); err != nil {
+		log.Printf("writing watch journal %s: %v", j.filename, err)
+	}
+}
+
+func (j *watchJournal) Permanode() *blobref.BlobRef {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.permanode
+}
+
+func (j *watchJournal) SetPermanode(br *blobref.BlobRef) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.permanode = br
+	j.appendf("permanode\t%s\n", br)
+}
+
+func (j *watchJournal) Snapshot() *blobref.BlobRef {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.snapshot
+}
+
+// NoteSnapshot records br as the latest snapshot, which includes all
+// the changes noted before.
+func (j *watchJournal) NoteSnapshot(br *blobref.BlobRef) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.snapshot = br
+	j.dirty = make(map[string]bool)
+	j.appendf("snapshot\t%s\n", br)
+}
+
+func (j *watchJournal) NoteDirty(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.dirty[path] {
+		return
+	}
+	j.dirty[path] = true
+	j.appendf("dirty\t%s\n", strconv.Quote(path))
+}
+
+// Dirty returns the paths changed since the last snapshot.
+func (j *watchJournal) Dirty() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var paths []string
+	for path := range j.dirty {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (j *watchJournal) CachedPutResult(pwd, filename string, fi os.FileInfo) (*client.PutResult, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	key := cacheKey(pwd, filename)
+	val, ok := j.files[key]
+	if !ok || val.Fingerprint != fileInfoToFingerprint(fi) || j.dirty[key] {
+		return nil, ErrCacheMiss
+	}
+	pr := val.Result
+	return &pr, nil
+}
+
+func (j *watchJournal) AddCachedPutResult(pwd, filename string, fi os.FileInfo, pr *client.PutResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	key := cacheKey(pwd, filename)
+	val := fileInfoPutRes{fileInfoToFingerprint(fi), *pr}
+	j.files[key] = val
+	j.appendf("file\t%s\t%s\t%s/%d\n", strconv.Quote(key), val.Fingerprint, val.Result.BlobRef, val.Result.Size)
+}
+
+// Forget drops the put results of path, and of its tree if it was a
+// directory.
+func (j *watchJournal) Forget(path string, dir bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if dir {
+		j.forget(path)
+	} else {
+		delete(j.files, path)
+	}
+	j.appendf("gone\t%s\n", strconv.Quote(path))
+}
+
+func (j *watchJournal) forget(path string) {
+	delete(j.files, path)
+	prefix := path + string(filepath.Separator)
+	for p := range j.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(j.files, p)
+		}
+	}
+}
+
+// Retain drops the put results of the paths not kept, e.g. of the
+// files deleted while camput wasn't running, and compacts the journal.
+func (j *watchJournal) Retain(keep func(path string) bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for path := range j.files {
+		if !keep(path) {
+			delete(j.files, path)
+		}
+	}
+	j.af.Close()
+	return j.compact()
+}
+
+func (j *watchJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.af.Close()
+}
+
+// watchDir uploads dir, then keeps uploading its changes.  The
+// permanode is created on the first run only, unless snapshotOf gives
+// an existing one.
+func (c *fileCmd) watchDir(up *Uploader, dir string, snapshotOf *blobref.BlobRef) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	fi, err := up.stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory.", dir)
+	}
+	journal, err := openWatchJournal(watchJournalFile(dir, up.Server(), client.KeyId()))
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+	up.statCache = journal
+
+	if pn := journal.Permanode(); pn != nil && snapshotOf != nil && pn.String() != snapshotOf.String() {
+		return fmt.Errorf("%q is already watched as the permanode %s, not %s", dir, pn, snapshotOf)
+	}
+	if journal.Permanode() == nil && snapshotOf != nil {
+		journal.SetPermanode(snapshotOf)
+		c.setPermanodeAttrs(up, snapshotOf)
+	} else if journal.Permanode() == nil {
+		permaNode, err := up.UploadNewPermanode()
+		if err != nil {
+			return fmt.Errorf("Uploading permanode: %v", err)
+		}
+		journal.SetPermanode(permaNode.BlobRef)
+		c.setPermanodeAttrs(up, permaNode.BlobRef)
+	} else if c.name != "" || c.tag != "" {
+		log.Printf("Not setting the name and tags of the existing permanode %s", journal.Permanode())
+	}
+	handleResult("permanode", &client.PutResult{BlobRef: journal.Permanode()}, nil)
+
+	dw, err := newDirWatcher()
+	if err != nil {
+		return err
+	}
+	defer dw.Close()
+	w := &watcher{
+		up:       up,
+		root:     dir,
+		debounce: c.watchDebounce,
+		journal:  journal,
+		dw:       dw,
+		cacheDir: osutil.CacheDir(),
+		entries:  make(map[string]watchEntry),
+	}
+	return w.run()
+}
+
+// watchMaxDelay bounds how long a continuously changing tree delays
+// its snapshot, in debounce periods.
+const watchMaxDelay = 10
+
+// A watcher keeps a directory backed up: once the tree is uploaded,
+// it uploads again the paths reported changed by its dirWatcher,
+// then the directories up to the root, and sets the new root as the
+// camliContent of the permanode.
+type watcher struct {
+	up       *Uploader
+	root     string // absolute
+	debounce time.Duration
+	journal  *watchJournal
+	dw       dirWatcher
+	cacheDir string // changes there are camput's own; ignored
+
+	// entries are the uploaded paths of the tree.
+	entries map[string]watchEntry
+}
+
+type watchEntry struct {
+	pr  *client.PutResult
+	dir bool
+}
+
+// resultNode returns a node for path, already uploaded as pr.
+func resultNode(path string, fi os.FileInfo, pr *client.PutResult) *node {
+	n := &node{fullPath: path, fi: fi}
+	n.cond.L = &n.mu
+	n.SetPutResult(pr, nil)
+	return n
+}
+
+// run uploads the tree and snapshots it, then snapshots the changes
+// until watching fails.
+func (w *watcher) run() error {
+	if err := w.uploadTree(w.root, w.up.exclude.forTree(w.root)); err != nil {
+		return err
+	}
+	err := w.journal.Retain(func(path string) bool {
+		_, ok := w.entries[path]
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+	// The changes noted but not snapshotted before a restart.
+	pending := make(map[string]bool)
+	for _, path := range w.journal.Dirty() {
+		pending[path] = true
+	}
+	if err := w.snapshot(pending); err != nil {
+		return err
+	}
+	pending = make(map[string]bool)
+
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+	var first time.Time // of the pending changes
+	for {
+		select {
+		case path, ok := <-w.dw.Changes():
+			if !ok {
+				return fmt.Errorf("watching %s stopped", w.root)
+			}
+			if path == "" {
+				path = w.root
+			}
+			if !w.inTree(path) {
+				continue
+			}
+			if ex := w.up.exclude; ex != nil && ex.ignoreFile != "" && filepath.Base(path) == ex.ignoreFile {
+				// The exclude rules changed: look at all the directory again.
+				path = filepath.Dir(path)
+			}
+			pending[path] = true
+			w.journal.NoteDirty(path)
+			if first.IsZero() {
+				first = time.Now()
+			}
+			wait := w.debounce
+			if max := first.Add(watchMaxDelay * w.debounce).Sub(time.Now()); max < wait {
+				wait = max
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			if err := w.snapshot(pending); err != nil {
+				log.Printf("watch: snapshot of %s failed, will retry: %v", w.root, err)
+				timer.Reset(w.debounce)
+				continue
+			}
+			pending = make(map[string]bool)
+			first = time.Time{}
+		}
+	}
+}
+
+// inTree reports whether path is in the watched tree, and not in
+// camput's cache directory.
+func (w *watcher) inTree(path string) bool {
+	if path == w.cacheDir || strings.HasPrefix(path, w.cacheDir+string(filepath.Separator)) {
+		return false
+	}
+	return path == w.root || strings.HasPrefix(path, w.root+string(filepath.Separator))
+}
+
+// snapshot uploads the changed paths and their parent directories,
+// and points the permanode at the new root, if it changed.
+func (w *watcher) snapshot(changed map[string]bool) error {
+	dirs := make(map[string]bool)
+	for path := range changed {
+		if err := w.update(path); err != nil {
+			return err
+		}
+		for path != w.root {
+			path = filepath.Dir(path)
+			dirs[path] = true
+		}
+	}
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	// A directory sorts before its subdirectories, so in reverse
+	// order they're done before it.
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	for _, dir := range sorted {
+		if err := w.uploadDir(dir); err != nil {
+			return err
+		}
+	}
+
+	root, ok := w.entries[w.root]
+	if !ok {
+		return fmt.Errorf("%s is gone", w.root)
+	}
+	if last := w.journal.Snapshot(); last != nil && last.String() == root.pr.BlobRef.String() {
+		w.journal.NoteSnapshot(root.pr.BlobRef)
+		return nil
+	}
+	permanode := w.journal.Permanode()
+	put, err := w.up.UploadAndSignMap(schema.NewSetAttributeClaim(permanode, "camliContent", root.pr.BlobRef.String()))
+	if err != nil {
+		return err
+	}
+	vlog.Printf("Watch snapshot of %s: %s, claim %s", w.root, root.pr.BlobRef, put.BlobRef)
+	w.journal.NoteSnapshot(root.pr.BlobRef)
+	return nil
+}
+
+// update uploads again path, forgetting it if it's gone.
+func (w *watcher) update(path string) error {
+	ex := w.up.exclude.forTree(w.root)
+	if path != w.root {
+		var ok bool
+		var err error
+		ex, ok, err = w.dirExcluder(filepath.Dir(path))
+		if os.IsNotExist(err) || (err == nil && !ok) {
+			w.forget(path, true)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fi, err := w.up.lstat(path)
+	if os.IsNotExist(err) {
+		w.forget(path, true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if path != w.root && ex.excluded(path, fi) != "" {
+		w.forget(path, true)
+		return nil
+	}
+	if fi.IsDir() {
+		return w.uploadTree(path, ex)
+	}
+	pr, err := w.up.uploadNode(&node{fullPath: path, fi: fi})
+	if err == schema.ErrUnimplemented {
+		vlog.Printf("Not backing up %s: unsupported file type", path)
+		w.forget(path, true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w.journal.AddCachedPutResult(w.up.pwd, path, fi, pr)
+	w.entries[path] = watchEntry{pr: pr}
+	return nil
+}
+
+// uploadTree uploads the tree at dir, watching its directories.  ex
+// is the excluder of dir's siblings.
+func (w *watcher) uploadTree(dir string, ex *dirExcluder) error {
+	t := w.up.NewTreeUpload(dir)
+	t.exclude = ex
+	t.DirHook = w.dw.Watch
+	t.Start()
+	if _, err := t.Wait(); err != nil {
+		return err
+	}
+	w.forget(dir, false)
+	var add func(n *node)
+	add = func(n *node) {
+		pr, _ := n.PutResult()
+		w.entries[n.fullPath] = watchEntry{pr: pr, dir: n.fi.IsDir()}
+		for _, c := range n.children {
+			add(c)
+		}
+	}
+	add(t.root)
+	return nil
+}
+
+// uploadDir uploads the directory schema blob of dir, from the
+// current put results of its entries.
+func (w *watcher) uploadDir(dir string) error {
+	fi, err := w.up.lstat(dir)
+	if os.IsNotExist(err) {
+		w.forget(dir, true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ex, ok, err := w.dirExcluder(dir)
+	if os.IsNotExist(err) || (err == nil && !ok) {
+		w.forget(dir, true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := w.up.open(dir)
+	if err != nil {
+		return err
+	}
+	fis, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	sort.Sort(byFileName(fis))
+	n := &node{fullPath: dir, fi: fi}
+	for _, cfi := range fis {
+		path := filepath.Join(dir, cfi.Name())
+		if ex.excluded(path, cfi) != "" {
+			w.forget(path, true)
+			continue
+		}
+		e, ok := w.entries[path]
+		if !ok {
+			// Its change wasn't reported (yet?).
+			if err := w.update(path); err != nil {
+				return err
+			}
+			if e, ok = w.entries[path]; !ok {
+				continue
+			}
+		}
+		n.children = append(n.children, resultNode(path, cfi, e.pr))
+	}
+	pr, err := w.up.uploadNode(n)
+	if err != nil {
+		return err
+	}
+	w.entries[dir] = watchEntry{pr: pr, dir: true}
+	return nil
+}
+
+// dirExcluder returns the excluder of the entries of dir, a directory
+// of the tree, or false if dir is excluded.
+func (w *watcher) dirExcluder(dir string) (ex *dirExcluder, ok bool, err error) {
+	rel, err := filepath.Rel(w.root, dir)
+	if err != nil {
+		return nil, false, err
+	}
+	ex, err = w.up.exclude.forTree(w.root).enter(w.root)
+	if err != nil || rel == "." {
+		return ex, err == nil, err
+	}
+	path := w.root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		path = filepath.Join(path, name)
+		fi, err := w.up.lstat(path)
+		if err != nil {
+			return nil, false, err
+		}
+		if ex.excluded(path, fi) != "" {
+			return nil, false, nil
+		}
+		if ex, err = ex.enter(path); err != nil {
+			return nil, false, err
+		}
+	}
+	return ex, true, nil
+}
+
+// forget drops path, and its tree if it was a directory.  If path is
+// gone, the journal forgets it too.
+func (w *watcher) forget(path string, gone bool) {
+	e, ok := w.entries[path]
+	if !ok {
+		return
+	}
+	delete(w.entries, path)
+	if gone {
+		w.journal.Forget(path, e.dir)
+	}
+	if !e.dir {
+		return
+	}
+	prefix := path + string(filepath.Separator)
+	for p := range w.entries {
+		if strings.HasPrefix(p, prefix) {
+			delete(w.entries, p)
+		}
+	}
+}
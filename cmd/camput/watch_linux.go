@@ -0,0 +1,114 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MODIFY | syscall.IN_MOVE_SELF |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DONT_FOLLOW | syscall.IN_ONLYDIR
+
+// inotifyWatcher is the dirWatcher of Linux, using inotify(7).
+type inotifyWatcher struct {
+	f       *os.File
+	changes chan string
+
+	mu   sync.Mutex
+	dirs map[int32]string // by watch descriptor
+}
+
+func newDirWatcher() (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan string, buffered),
+		dirs:    make(map[int32]string),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Watch(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wd, err := syscall.InotifyAddWatch(int(w.f.Fd()), dir, inotifyMask)
+	if err != nil {
+		if err == syscall.ENOSPC {
+			log.Printf("Can't watch %s: too many watches; raise /proc/sys/fs/inotify/max_user_watches", dir)
+		}
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	w.dirs[int32(wd)] = dir
+	return nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.f.Close()
+}
+
+func (w *inotifyWatcher) readEvents() {
+	defer close(w.changes)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			log.Printf("Reading inotify events: %v", err)
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+int(ev.Len)]), "\x00")
+			off += int(ev.Len)
+			w.event(ev.Wd, ev.Mask, name)
+		}
+	}
+}
+
+func (w *inotifyWatcher) event(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.changes <- ""
+		return
+	}
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+	// Events on a watched directory itself are also reported by
+	// its parent, with its name.
+	if !ok || name == "" {
+		return
+	}
+	w.changes <- filepath.Join(dir, name)
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/handlers"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign"
+)
+
+func TestWatchJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camput-watch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "journal")
+	j, err := openWatchJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pn := blobref.SHA1FromString("permanode")
+	snap := blobref.SHA1FromString("snapshot")
+	j.SetPermanode(pn)
+	j.AddCachedPutResult("/", "/a\tb", fi, &client.PutResult{BlobRef: blobref.SHA1FromString("a"), Size: 1})
+	j.AddCachedPutResult("/", "/d/c", fi, &client.PutResult{BlobRef: blobref.SHA1FromString("c"), Size: 2})
+	j.NoteDirty("/a\tb")
+	j.NoteSnapshot(snap)
+	j.NoteDirty("/d/c")
+	j.Forget("/d", true)
+	j.Close()
+
+	for i := 0; i < 2; i++ { // reading the log, then the compacted journal
+		j, err = openWatchJournal(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := j.Permanode(); got == nil || got.String() != pn.String() {
+			t.Errorf("permanode = %v; want %v", got, pn)
+		}
+		if got := j.Snapshot(); got == nil || got.String() != snap.String() {
+			t.Errorf("snapshot = %v; want %v", got, snap)
+		}
+		if got := j.Dirty(); len(got) != 1 || got[0] != "/d/c" {
+			t.Errorf("dirty = %q; want [/d/c]", got)
+		}
+		if pr, err := j.CachedPutResult("/", "/a\tb", fi); err != nil || pr.Size != 1 {
+			t.Errorf("cached put result of /a\\tb = %v, %v", pr, err)
+		}
+		if _, err := j.CachedPutResult("/", "/d/c", fi); err != ErrCacheMiss {
+			t.Errorf("put result of a forgotten file still cached")
+		}
+		j.Close()
+	}
+}
+
+func TestWatchJournalFile(t *testing.T) {
+	name := watchJournalFile("/home/foo", "http://a", "KEY")
+	if name != watchJournalFile("/home/foo", "http://a", "KEY") {
+		t.Errorf("journal name of a watch isn't stable")
+	}
+	for _, other := range [][3]string{
+		{"/home/bar", "http://a", "KEY"},
+		{"/home/foo", "http://b", "KEY"},
+		{"/home/foo", "http://a", ""},
+	} {
+		if watchJournalFile(other[0], other[1], other[2]) == name {
+			t.Errorf("watch of %q shares its journal with /home/foo on http://a as KEY", other)
+		}
+	}
+}
+
+type configuredStorage struct {
+	blobserver.Storage
+	config *blobserver.Config
+}
+
+func (s *configuredStorage) Config() *blobserver.Config {
+	return s.config
+}
+
+// fakeDirWatcher records the watched directories; changes are given
+// to the watcher by the test.
+type fakeDirWatcher struct {
+	watched map[string]bool
+}
+
+func (w *fakeDirWatcher) Watch(dir string) error {
+	w.watched[dir] = true
+	return nil
+}
+
+func (w *fakeDirWatcher) Changes() <-chan string { return nil }
+func (w *fakeDirWatcher) Close() error           { return nil }
+
+func TestWatcherSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camput-watch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mkdir := func(name string) string {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(name, 0700); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	write := func(name, contents string) string {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	// A blobserver, and the client configuration to sign claims.
+	ds, err := localdisk.New(mkdir("blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sto := &configuredStorage{Storage: ds, config: &blobserver.Config{Writable: true, Readable: true}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/camli/stat", handlers.CreateStatHandler(sto))
+	mux.HandleFunc("/camli/upload", handlers.CreateUploadHandler(sto))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	sto.config.URLBase = ts.URL
+
+	secRing, err := filepath.Abs("../../pkg/jsonsign/testdata/test-secring.gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDir := mkdir("config")
+	mkdir("config/keyblobs")
+	write("config/config", `{"keyId": "26F5ABDA", "secretRing": "`+secRing+`", "selfPubKeyDir": "`+filepath.Join(configDir, "keyblobs")+`"}`)
+	defer os.Setenv("CAMLI_CONFIG_DIR", os.Getenv("CAMLI_CONFIG_DIR"))
+	os.Setenv("CAMLI_CONFIG_DIR", configDir)
+
+	c := client.New(ts.URL)
+	c.SetLogger(nil)
+	if err := c.SetupAuthFromConfig(jsonconfig.Obj{"auth": "none"}); err != nil {
+		t.Fatal(err)
+	}
+	up := &Uploader{
+		Client: c,
+		pwd:    dir,
+		entityFetcher: &jsonsign.CachingEntityFetcher{
+			Fetcher: &jsonsign.FileEntityFetcher{File: secRing},
+		},
+	}
+
+	root := mkdir("tree")
+	write("tree/a", "a")
+	mkdir("tree/sub")
+	write("tree/sub/b", "b")
+	journal, err := openWatchJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	pn, err := up.UploadNewPermanode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.SetPermanode(pn.BlobRef)
+	up.statCache = journal
+	up.exclude = newExcluder(nil, nil)
+	up.exclude.ignoreFile = ".camliignore"
+	dw := &fakeDirWatcher{watched: make(map[string]bool)}
+	w := &watcher{
+		up:       up,
+		root:     root,
+		journal:  journal,
+		dw:       dw,
+		cacheDir: filepath.Join(dir, "cache"),
+		entries:  make(map[string]watchEntry),
+	}
+
+	// fullUpload returns the root of a new upload of the whole tree,
+	// which the snapshots must match.
+	fullUpload := func() string {
+		tu := up.NewTreeUpload(root)
+		tu.Start()
+		pr, err := tu.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pr.BlobRef.String()
+	}
+	snapshot := func(step string, changed ...string) string {
+		m := make(map[string]bool)
+		for _, path := range changed {
+			m[path] = true
+		}
+		if err := w.snapshot(m); err != nil {
+			t.Fatalf("%s: snapshot: %v", step, err)
+		}
+		got := journal.Snapshot().String()
+		if want := fullUpload(); got != want {
+			t.Errorf("%s: snapshot %s; want %s", step, got, want)
+		}
+		return got
+	}
+
+	if err := w.uploadTree(root, up.exclude.forTree(root)); err != nil {
+		t.Fatal(err)
+	}
+	if !dw.watched[root] || !dw.watched[filepath.Join(root, "sub")] {
+		t.Errorf("watched directories = %v", dw.watched)
+	}
+	snap := snapshot("initial upload")
+
+	// Make the new contents visible even with a coarse mtime.
+	time.Sleep(10 * time.Millisecond)
+	changed := write("tree/sub/b", "bb")
+	if s := snapshot("changed file", changed); s == snap {
+		t.Errorf("snapshot unchanged after a change")
+	}
+
+	mkdir("tree/new")
+	write("tree/new/c", "c")
+	snapshot("new directory", filepath.Join(root, "new"))
+	if !dw.watched[filepath.Join(root, "new")] {
+		t.Errorf("new directory not watched")
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	snapshot("removed directory", filepath.Join(root, "sub"))
+	if _, ok := w.entries[changed]; ok {
+		t.Errorf("removed file %s still in the tree", changed)
+	}
+	if _, err := journal.CachedPutResult(dir, changed, nil); err != ErrCacheMiss {
+		t.Errorf("removed file %s still in the journal", changed)
+	}
+
+	tmp := write("tree/new/c.tmp", "tmp")
+	write("tree/.camliignore", "*.tmp")
+	snapshot("new ignore file", root)
+	if _, ok := w.entries[tmp]; ok {
+		t.Errorf("excluded file %s in the tree", tmp)
+	}
+	write("tree/new/d.tmp", "tmp")
+	snapshot("new excluded file", filepath.Join(root, "new", "d.tmp"))
+}
+
+func TestDirWatcher(t *testing.T) {
+	dw, err := newDirWatcher()
+	if err != nil {
+		t.Skipf("no dirWatcher: %v", err)
+	}
+	defer dw.Close()
+	dir, err := ioutil.TempDir("", "camput-watch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := dw.Watch(dir); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "foo")
+	if err := ioutil.WriteFile(name, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case path := <-dw.Changes():
+		if path != name {
+			t.Errorf("changed path %q; want %q", path, name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the change")
+	}
+}
@@ -53,6 +53,7 @@ func usage(err string) {
 }
 
 func main() {
+	client.AddLimitFlags()
 	flag.Parse()
 
 	if *flagSrc == "" {
@@ -70,6 +71,9 @@ func main() {
 	sc.SetupAuth()
 	dc := client.New(*flagDest)
 	dc.SetupAuth()
+	limits := client.ConfigLimits()
+	sc.SetLimits(limits)
+	dc.SetLimits(limits)
 
 	var logger *log.Logger = nil
 	if *flagVerbose {
@@ -0,0 +1,158 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The camtool binary holds the maintenance commands of a Camlistore
+// server's blobs, such as garbage collection.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"camlistore.org/pkg/client"
+)
+
+var (
+	flagVerbose = flag.Bool("verbose", false, "extra debug logging")
+)
+
+var ErrUsage = UsageError("invalid command usage")
+
+type UsageError string
+
+func (ue UsageError) Error() string {
+	return "Usage error: " + string(ue)
+}
+
+type CommandRunner interface {
+	Usage()
+	RunCommand(args []string) error
+}
+
+type Exampler interface {
+	Examples() []string
+}
+
+var modeCommand = make(map[string]CommandRunner)
+var modeFlags = make(map[string]*flag.FlagSet)
+
+func RegisterCommand(mode string, makeCmd func(Flags *flag.FlagSet) CommandRunner) {
+	if _, dup := modeCommand[mode]; dup {
+		log.Fatalf("duplicate command %q registered", mode)
+	}
+	flags := flag.NewFlagSet(mode+" options", flag.ContinueOnError)
+	flags.Usage = func() {}
+	modeFlags[mode] = flags
+	modeCommand[mode] = makeCmd(flags)
+}
+
+func errf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+func usage(msg string) {
+	if msg != "" {
+		errf("Error: %v\n", msg)
+	}
+	errf(`
+Usage: camtool [globalopts] <mode> [commandopts] [commandargs]
+
+Examples:
+`)
+	var modes []string
+	for mode := range modeCommand {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		errf("\n")
+		if ex, ok := modeCommand[mode].(Exampler); ok {
+			for _, example := range ex.Examples() {
+				errf("  camtool %s %s\n", mode, example)
+			}
+		} else {
+			errf("  camtool %s ...\n", mode)
+		}
+	}
+	errf(`
+For mode-specific help:
+
+  camtool <mode> -help
+
+Global options:
+`)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+// newClient returns a client of the configured server.
+func newClient() *client.Client {
+	cc := client.NewOrFail()
+	if !*flagVerbose {
+		cc.SetLogger(nil)
+	}
+	return cc
+}
+
+func hasFlags(flags *flag.FlagSet) bool {
+	any := false
+	flags.VisitAll(func(*flag.Flag) {
+		any = true
+	})
+	return any
+}
+
+func main() {
+	client.AddFlags()
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage("No mode given.")
+	}
+
+	mode := flag.Arg(0)
+	cmd, ok := modeCommand[mode]
+	if !ok {
+		usage(fmt.Sprintf("Unknown mode %q", mode))
+	}
+
+	cmdFlags := modeFlags[mode]
+	err := cmdFlags.Parse(flag.Args()[1:])
+	if err != nil {
+		err = ErrUsage
+	} else {
+		err = cmd.RunCommand(cmdFlags.Args())
+	}
+	if ue, isUsage := err.(UsageError); isUsage {
+		errf("%s\n", ue)
+		cmd.Usage()
+		errf("\nGlobal options:\n")
+		flag.PrintDefaults()
+
+		if hasFlags(cmdFlags) {
+			errf("\nMode-specific options for mode %q:\n", mode)
+			cmdFlags.PrintDefaults()
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/blobserver/remote"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/fsck"
+)
+
+type fsckCmd struct {
+	dir        string
+	quarantine bool
+	repairFrom string
+}
+
+func init() {
+	RegisterCommand("fsck", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(fsckCmd)
+		flags.StringVar(&cmd.dir, "dir", "", "If non-empty, check this local blob directory (a \"filesystem\" storage) instead of the server.")
+		flags.BoolVar(&cmd.quarantine, "quarantine", false, "Move the damaged blobs to the quarantine partition. Requires -dir.")
+		flags.StringVar(&cmd.repairFrom, "repair-from", "", "If non-empty, the URL of a server to fetch good copies of the damaged blobs from.")
+		return cmd
+	})
+}
+
+func (c *fsckCmd) Usage() {
+	fmt.Fprintf(os.Stderr, `Usage: camtool fsck [opts]
+
+Fetches every blob of the server, or of a local blob directory, and
+reports the ones not matching their blobref.
+`)
+}
+
+func (c *fsckCmd) Examples() []string {
+	return []string{
+		"",
+		"-dir=/var/camlistore/blobs -quarantine -repair-from=http://replica:3179/bs",
+	}
+}
+
+func (c *fsckCmd) RunCommand(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	if c.quarantine && c.dir == "" {
+		return UsageError("-quarantine requires -dir")
+	}
+	checker := &fsck.Checker{
+		Quarantine: c.quarantine,
+		Report: func(p *fsck.Problem) {
+			fmt.Println(p)
+		},
+	}
+	if c.dir != "" {
+		sto, err := localdisk.New(c.dir)
+		if err != nil {
+			return err
+		}
+		checker.Storage = sto
+	} else {
+		checker.Storage = remote.NewFromClient(newClient())
+	}
+	if c.repairFrom != "" {
+		cc := client.New(c.repairFrom)
+		// As camsync does, the repair server is expected to take the
+		// credentials of the configured one.
+		if err := cc.SetupAuth(); err != nil {
+			return fmt.Errorf("setting up auth for %s: %v", c.repairFrom, err)
+		}
+		if !*flagVerbose {
+			cc.SetLogger(nil)
+		}
+		checker.RepairFrom = cc
+	}
+	st, err := checker.Run()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d blobs (%d bytes) checked; %d problems, %d quarantined, %d repaired\n",
+		st.Blobs, st.Bytes, st.Problems, st.Quarantined, st.Repaired)
+	if st.Problems > st.Repaired {
+		return errors.New("damaged blobs found")
+	}
+	return nil
+}
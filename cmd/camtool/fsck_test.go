@@ -0,0 +1,92 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/test"
+)
+
+func TestFsckRepairWithAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camtool-fsck-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configDir := filepath.Join(dir, "config")
+	blobDir := filepath.Join(dir, "blobs")
+	for _, d := range []string{configDir, blobDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(configDir, "config"), []byte(`{"auth": "userpass:joe:ponies"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("CAMLI_CONFIG_DIR", os.Getenv("CAMLI_CONFIG_DIR"))
+	os.Setenv("CAMLI_CONFIG_DIR", configDir)
+
+	sto, err := localdisk.New(blobDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &test.Blob{Contents: "good"}
+	if _, err := sto.ReceiveBlob(b.BlobRef(), b.Reader()); err != nil {
+		t.Fatal(err)
+	}
+	var file string
+	filepath.Walk(blobDir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Name() == localdisk.BlobFileBaseName(b.BlobRef()) {
+			file = path
+		}
+		return nil
+	})
+	if err := ioutil.WriteFile(file, []byte("rotten"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server with the good copy requires the configured auth.
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "joe" || pass != "ponies" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path != "/camli/"+b.BlobRef().String() {
+			http.NotFound(rw, req)
+			return
+		}
+		io.Copy(rw, strings.NewReader(b.Contents))
+	}))
+	defer ts.Close()
+
+	cmd := &fsckCmd{dir: blobDir, repairFrom: ts.URL}
+	if err := cmd.RunCommand(nil); err != nil {
+		t.Fatalf("fsck with repair: %v", err)
+	}
+	if got, err := ioutil.ReadFile(file); err != nil || string(got) != b.Contents {
+		t.Errorf("blob after repair = %q, %v; want %q", got, err, b.Contents)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver/remote"
+	"camlistore.org/pkg/gc"
+)
+
+type gcCmd struct {
+	dryRun   bool
+	grace    time.Duration
+	keepFile string
+	state    string
+}
+
+func init() {
+	RegisterCommand("gc", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(gcCmd)
+		flags.BoolVar(&cmd.dryRun, "n", false, "Dry run: only report the blobs that would be removed.")
+		flags.DurationVar(&cmd.grace, "grace", 24*time.Hour, "How long a blob must have been unreachable before being removed.")
+		flags.StringVar(&cmd.keepFile, "keep", "", "If non-empty, a file of blobrefs to keep, one per line, in addition to the command arguments.")
+		flags.StringVar(&cmd.state, "state", "", "The file recording since when blobs have been unreachable, between runs. Required with a non-zero -grace.")
+		return cmd
+	})
+}
+
+func (c *gcCmd) Usage() {
+	fmt.Fprintf(os.Stderr, `Usage: camtool gc [opts] [<blobref to keep>...]
+
+Removes the blobs of the server that aren't reachable from any signed
+blob (permanode, claim or share), nor from the blobs to keep.
+`)
+}
+
+func (c *gcCmd) Examples() []string {
+	return []string{
+		"-n -grace=0",
+		"-state=$HOME/.camli/gc-state -keep=$HOME/.camli/gc-keep",
+	}
+}
+
+func (c *gcCmd) RunCommand(args []string) error {
+	keep := blobref.ParseMulti(args)
+	for i, br := range keep {
+		if br == nil {
+			return UsageError(fmt.Sprintf("invalid blobref %q", args[i]))
+		}
+	}
+	if c.keepFile != "" {
+		refs, err := readKeepFile(c.keepFile)
+		if err != nil {
+			return err
+		}
+		keep = append(keep, refs...)
+	}
+	if c.grace > 0 && c.state == "" {
+		return UsageError("-state is required with a non-zero -grace")
+	}
+
+	col := &gc.Collector{
+		Storage:     remote.NewFromClient(newClient()),
+		Keep:        keep,
+		GracePeriod: c.grace,
+		StateFile:   c.state,
+		DryRun:      c.dryRun,
+	}
+	res, err := col.Run()
+	if err != nil {
+		return err
+	}
+	verb := "removed"
+	if c.dryRun {
+		verb = "would remove"
+	}
+	for _, ref := range gc.SortedRefs(res.Removed) {
+		fmt.Printf("%s %s\n", verb, ref)
+	}
+	var size int64
+	for _, sb := range res.Removed {
+		size += sb.Size
+	}
+	if *flagVerbose {
+		for _, ref := range gc.SortedRefs(res.Pending) {
+			fmt.Printf("pending %s\n", ref)
+		}
+	}
+	fmt.Printf("%d blobs, %d reachable; %s %d blobs (%d bytes); %d unreachable within the grace period\n",
+		res.Blobs, res.Reachable, verb, len(res.Removed), size, len(res.Pending))
+	return nil
+}
+
+// readKeepFile returns the blobrefs listed in file, one per line.
+// Blank lines and lines starting with '#' are ignored.
+func readKeepFile(file string) ([]*blobref.BlobRef, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var refs []*blobref.BlobRef
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		br := blobref.Parse(line)
+		if br == nil {
+			return nil, fmt.Errorf("%s: invalid blobref %q", file, line)
+		}
+		refs = append(refs, br)
+	}
+	return refs, scanner.Err()
+}
@@ -18,6 +18,7 @@ package blobref
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -27,9 +28,56 @@ import (
 var kBlobRefPattern *regexp.Regexp = regexp.MustCompile(`^([a-z0-9]+)-([a-f0-9]+)$`)
 
 var supportedDigests = map[string]func() hash.Hash{
-	"sha1": func() hash.Hash {
-		return sha1.New()
-	},
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+}
+
+// RegisterDigest adds the digest hashName, whose hex digests are
+// hexSize long and computed by the hashes of fn, to the supported
+// ones. It must be called before any blobref is used, typically from
+// an init function.
+func RegisterDigest(hashName string, hexSize int, fn func() hash.Hash) {
+	if !kBlobRefPattern.MatchString(hashName + "-0") {
+		panic("blobref: invalid digest name " + hashName)
+	}
+	supportedDigests[hashName] = fn
+	kExpectedDigestSize[hashName] = hexSize
+}
+
+// defaultDigest is the digest of the blobrefs of new blobs.
+var defaultDigest = "sha1"
+
+// SetDefaultDigest sets the digest used for the blobrefs of new
+// blobs, such as the ones written by the schema package. It's meant
+// to be called once, at startup, from a configuration.
+//
+// The blobrefs of public keys don't follow it: they stay sha1, computed
+// with SHA1FromString. A key's blobref is its owner's identity, the
+// camliSigner of every claim and the owner the index and searches are
+// scoped to, so a key hashed with a new digest would be a new signer,
+// orphaning the claims already signed. Moving keys to another digest
+// would first need the index to treat both blobrefs of a key as the
+// same signer. The jsonsign package takes the signer blobref from the
+// signed JSON, whatever its digest.
+func SetDefaultDigest(hashName string) error {
+	if _, ok := supportedDigests[hashName]; !ok {
+		return fmt.Errorf("blobref: unsupported digest %q", hashName)
+	}
+	defaultDigest = hashName
+	return nil
+}
+
+// DefaultDigest returns the name of the digest of new blobs,
+// e.g. "sha1".
+func DefaultDigest() string {
+	return defaultDigest
+}
+
+// NewHash returns a hash of the default digest, to compute the
+// blobref of a new blob with FromHash(DefaultDigest(), h).
+func NewHash() hash.Hash {
+	return supportedDigests[defaultDigest]()
 }
 
 // BlobRef is an immutable reference to a blob.
@@ -144,8 +192,10 @@ func (o *BlobRef) Sum32() uint32 {
 }
 
 var kExpectedDigestSize = map[string]int{
-	"md5":  32,
-	"sha1": 40,
+	"md5":    32,
+	"sha1":   40,
+	"sha224": 56,
+	"sha256": 64,
 }
 
 func newBlob(hashName, digest string) *BlobRef {
@@ -167,12 +217,21 @@ func FromHash(hashfunc string, h hash.Hash) *BlobRef {
 	return newBlob(hashfunc, fmt.Sprintf("%x", h.Sum(nil)))
 }
 
+// SHA1FromString returns the sha1 blobref of s. It's what public key
+// blobrefs are computed with; see SetDefaultDigest.
 func SHA1FromString(s string) *BlobRef {
 	s1 := sha1.New()
 	s1.Write([]byte(s))
 	return FromHash("sha1", s1)
 }
 
+// FromString returns the blobref of s with the default digest.
+func FromString(s string) *BlobRef {
+	h := NewHash()
+	io.WriteString(h, s)
+	return FromHash(DefaultDigest(), h)
+}
+
 // FromPattern takes a pattern and if it matches 's' with two exactly two valid
 // submatches, returns a BlobRef, else returns nil.
 func FromPattern(r *regexp.Regexp, s string) *BlobRef {
@@ -64,6 +64,49 @@ func TestNotSupported(t *testing.T) {
 	}
 }
 
+func TestModernDigests(t *testing.T) {
+	tests := []struct {
+		ref string
+		ok  bool
+	}{
+		{"sha224-0808f64e60d58979fcb676c96ec938270dea42445aeefcd3a4e6f8db", true},
+		{"sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", true},
+		{"sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7", false}, // short
+		{"sha256-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", false},                       // a sha1 digest
+	}
+	for _, tt := range tests {
+		br := Parse(tt.ref)
+		if (br != nil) != tt.ok {
+			t.Errorf("Parse(%q) = %v; want ok = %v", tt.ref, br, tt.ok)
+			continue
+		}
+		if br == nil {
+			continue
+		}
+		Expect(t, br.IsSupported(), tt.ref+" should be supported")
+		hash := br.Hash()
+		hash.Write([]byte("foo"))
+		if !br.HashMatches(hash) {
+			t.Errorf("Expected hash of bytes 'foo' to match %s", tt.ref)
+		}
+	}
+}
+
+func TestDefaultDigest(t *testing.T) {
+	defer SetDefaultDigest(DefaultDigest())
+	if err := SetDefaultDigest("md5"); err == nil {
+		t.Errorf("SetDefaultDigest(md5) succeeded; want an error")
+	}
+	if err := SetDefaultDigest("sha256"); err != nil {
+		t.Fatal(err)
+	}
+	want := "sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	ExpectString(t, want, FromString("foo").String(), "FromString with sha256")
+	h := NewHash()
+	h.Write([]byte("foo"))
+	ExpectString(t, want, FromHash(DefaultDigest(), h).String(), "NewHash with sha256")
+}
+
 func TestSum32(t *testing.T) {
 	refStr := "sha1-0000000000000000000000000000000000000012"
 	br := Parse(refStr)
@@ -144,6 +144,13 @@ func (df *DirFetcher) Fetch(b *BlobRef) (file ReadSeekCloser, size int64, err er
 	return
 }
 
+// cryptoDigests are the blobref digest names of the crypto hashes.
+var cryptoDigests = map[crypto.Hash]string{
+	crypto.SHA1:   "sha1",
+	crypto.SHA224: "sha224",
+	crypto.SHA256: "sha256",
+}
+
 // MemoryStore stores blobs in memory and is a Fetcher and
 // StreamingFetcher. Its zero value is usable.
 type MemoryStore struct {
@@ -152,12 +159,13 @@ type MemoryStore struct {
 }
 
 func (s *MemoryStore) AddBlob(hashtype crypto.Hash, data string) (*BlobRef, error) {
-	if hashtype != crypto.SHA1 {
+	hashName, ok := cryptoDigests[hashtype]
+	if !ok {
 		return nil, errors.New("blobref: unsupported hash type")
 	}
 	hash := hashtype.New()
 	hash.Write([]byte(data))
-	bstr := fmt.Sprintf("sha1-%x", hash.Sum(nil))
+	bstr := fmt.Sprintf("%s-%x", hashName, hash.Sum(nil))
 	s.lk.Lock()
 	defer s.lk.Unlock()
 	if s.m == nil {
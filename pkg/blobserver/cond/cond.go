@@ -14,13 +14,45 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+/*
+Package cond registers the "cond" conditional blobserver storage type,
+which receives blobs into different storages depending on conditions
+on the blobs.
+
+Example low-level config, keeping schema blobs and small blobs on a
+local disk, and sending large media chunks to S3:
+
+	"/bs-routed/": {
+	    "handler": "storage-cond",
+	    "handlerArgs": {
+	        "write": {
+	            "if": {"or": ["isSchema", {"maxSize": 65536}]},
+	            "then": "/bs-ssd/",
+	            "else": {
+	                "if": {"or": [{"mimeType": "image/*"}, {"mimeType": "video/*"}]},
+	                "then": "/sto-s3/",
+	                "else": "/bs-disk/"
+	            }
+	        },
+	        "read": "/bs-all/",
+	        "remove": "/bs-all/"
+	    }
+	},
+
+The "then" and "else" targets are either storage prefixes or nested
+conditions. The conditions are "isSchema", or one of the objects
+{"and": [...]}, {"or": [...]}, {"not": ...}, {"minSize": n},
+{"maxSize": n}, {"mimeType": type}, {"camliType": type} and
+{"signer": keyId}. MIME types are sniffed from the beginning of the
+blob, so only the first chunk of a file has one. The signer of a blob
+is only known once its signature is verified, using the public key
+from the "read" storage.
+*/
 package cond
 
 import (
 	"bytes"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
 	"time"
@@ -28,7 +60,6 @@ import (
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/jsonconfig"
-	"camlistore.org/pkg/schema"
 )
 
 const buffered = 8
@@ -70,18 +101,18 @@ func newFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (storage blobserve
 		return nil, err
 	}
 
+	sto.read, err = ld.GetStorage(read)
+	if err != nil {
+		return
+	}
+
 	if receive != nil {
-		sto.storageForReceive, err = buildStorageForReceive(ld, receive)
+		sto.storageForReceive, err = buildStorageForReceive(ld, receive, sto.read)
 		if err != nil {
 			return
 		}
 	}
 
-	sto.read, err = ld.GetStorage(read)
-	if err != nil {
-		return
-	}
-
 	if remove != "" {
 		sto.remove, err = ld.GetStorage(remove)
 		if err != nil {
@@ -91,59 +122,66 @@ func newFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (storage blobserve
 	return sto, nil
 }
 
-func buildStorageForReceive(ld blobserver.Loader, confOrString interface{}) (storageFunc, error) {
+// buildStorageForReceive returns the function choosing the storage of
+// each blob received, from a storage prefix or a condition object.
+// fetcher is where the conditions fetch public keys from.
+func buildStorageForReceive(ld blobserver.Loader, confOrString interface{}, fetcher blobref.StreamingFetcher) (storageFunc, error) {
+	pick, err := buildTarget(ld, confOrString, fetcher)
+	if err != nil {
+		return nil, err
+	}
+	return func(src io.Reader) (blobserver.Storage, []byte, error) {
+		p := &blobPeek{src: src}
+		dest, err := pick(p)
+		return dest, p.buf.Bytes(), err
+	}, nil
+}
+
+// A target picks the storage of a blob.
+type target func(p *blobPeek) (blobserver.Storage, error)
+
+func buildTarget(ld blobserver.Loader, confOrString interface{}, fetcher blobref.StreamingFetcher) (target, error) {
 	// Static configuration from a string
 	if s, ok := confOrString.(string); ok {
 		sto, err := ld.GetStorage(s)
 		if err != nil {
 			return nil, err
 		}
-		f := func(io.Reader) (blobserver.Storage, []byte, error) {
-			return sto, nil, nil
-		}
-		return f, nil
+		return func(*blobPeek) (blobserver.Storage, error) {
+			return sto, nil
+		}, nil
 	}
 
 	conf := jsonconfig.Obj(confOrString.(map[string]interface{}))
 
-	ifStr := conf.RequiredString("if")
-	// TODO: let 'then' and 'else' point to not just strings but either
-	// a string or a JSON object with another condition, and then
-	// call buildStorageForReceive on it recursively
-	thenTarget := conf.RequiredString("then")
-	elseTarget := conf.RequiredString("else")
+	ifConf := conf.RequiredStringOrObject("if")
+	thenConf := conf.RequiredStringOrObject("then")
+	elseConf := conf.RequiredStringOrObject("else")
 	if err := conf.Validate(); err != nil {
 		return nil, err
 	}
-	thenSto, err := ld.GetStorage(thenTarget)
+	cond, err := parseCondition(ifConf, fetcher)
 	if err != nil {
 		return nil, err
 	}
-	elseSto, err := ld.GetStorage(elseTarget)
+	thenTarget, err := buildTarget(ld, thenConf, fetcher)
 	if err != nil {
 		return nil, err
 	}
-
-	switch ifStr {
-	case "isSchema":
-		return isSchemaPicker(thenSto, elseSto), nil
+	elseTarget, err := buildTarget(ld, elseConf, fetcher)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("cond: unsupported 'if' type of %q", ifStr)
-}
-
-func isSchemaPicker(thenSto, elseSto blobserver.Storage) storageFunc {
-	return func(src io.Reader) (dest blobserver.Storage, overRead []byte, err error) {
-		var buf bytes.Buffer
-		var ss schema.Superset
-		if err = json.NewDecoder(io.TeeReader(src, &buf)).Decode(&ss); err != nil {
-			return elseSto, buf.Bytes(), nil
-		}
-		if ss.Type == "" {
-			// json, but not schema, so use the else path.
-			return elseSto, buf.Bytes(), nil
+	return func(p *blobPeek) (blobserver.Storage, error) {
+		ok, err := cond(p)
+		switch {
+		case err != nil:
+			return nil, err
+		case ok:
+			return thenTarget(p)
 		}
-		return thenSto, buf.Bytes(), nil
-	}
+		return elseTarget(p)
+	}, nil
 }
 
 func (sto *condStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err error) {
@@ -155,7 +193,11 @@ func (sto *condStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb bl
 		source = io.MultiReader(bytes.NewBuffer(overRead), source)
 	}
 	destSto = blobserver.MaybeWrapContext(destSto, sto.ctx)
-	return destSto.ReceiveBlob(b, source)
+	sb, err = destSto.ReceiveBlob(b, source)
+	if err == nil {
+		sto.GetBlobHub().NotifyBlobReceived(b)
+	}
+	return
 }
 
 func (sto *condStorage) RemoveBlobs(blobs []*blobref.BlobRef) error {
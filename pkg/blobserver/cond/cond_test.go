@@ -0,0 +1,207 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cond
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/test"
+)
+
+type namedStorage struct {
+	blobserver.NoImplStorage
+	name string
+}
+
+type fakeLoader struct {
+	blobserver.Loader
+}
+
+func (fakeLoader) GetStorage(prefix string) (blobserver.Storage, error) {
+	return &namedStorage{name: prefix}, nil
+}
+
+const testSecRing = "../../jsonsign/testdata/test-secring.gpg"
+
+// signedClaim returns a claim signed by the test key, and a fetcher
+// of its public key.
+func signedClaim(t *testing.T) (string, blobref.StreamingFetcher) {
+	ent, err := jsonsign.EntityFromSecring("26F5ABDA", testSecRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := &test.Blob{Contents: armored}
+	keys := new(test.Fetcher)
+	keys.AddBlob(pubKey)
+
+	m := schema.NewSetAttributeClaim(blobref.SHA1FromString("pn"), "title", "x")
+	m["camliSigner"] = pubKey.BlobRef().String()
+	unsigned, err := schema.MapToCamliJSON(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := &jsonsign.SignRequest{
+		UnsignedJson:  unsigned,
+		Fetcher:       keys,
+		EntityFetcher: &jsonsign.FileEntityFetcher{File: testSecRing},
+	}
+	signed, err := sr.Sign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed, keys
+}
+
+func TestConditions(t *testing.T) {
+	claim, keys := signedClaim(t)
+	file, err := schema.MapToCamliJSON(schema.NewFileMap("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpeg := "\xff\xd8\xff\xe0" + strings.Repeat("x", 100)
+	big := strings.Repeat("y", 1000)
+	// A schema blob over 1 MB.
+	bigSchema := `{"camliVersion": 1, "camliType": "static-set", "members": [` +
+		strings.Repeat(`"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", `, 25000) +
+		`"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"]}`
+	huge := strings.Repeat("z", 2<<20)
+
+	const config = `{
+		"if": {"or": ["isSchema", {"maxSize": 100}]},
+		"then": {
+			"if": {"and": [{"camliType": "claim"}, {"signer": "26f5abda"}]},
+			"then": "/claims/",
+			"else": "/ssd/"
+		},
+		"else": {
+			"if": {"not": {"mimeType": "image/*"}},
+			"then": {
+				"if": {"minSize": 1000},
+				"then": "/big/",
+				"else": "/disk/"
+			},
+			"else": "/s3/"
+		}
+	}`
+	var conf map[string]interface{}
+	if err := json.Unmarshal([]byte(config), &conf); err != nil {
+		t.Fatal(err)
+	}
+	pick, err := buildStorageForReceive(fakeLoader{}, conf, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, contents, want string
+	}{
+		{"signed claim", claim, "/claims/"},
+		{"file schema", file, "/ssd/"},
+		{"small blob", "small", "/ssd/"},
+		{"jpeg", jpeg, "/s3/"},
+		{"big blob", big, "/big/"},
+		{"medium blob", big[:500], "/disk/"},
+		{"big schema", bigSchema, "/ssd/"},
+		{"huge blob", huge, "/big/"},
+		{"not quite schema", `{"camliType": "file"} ` + big[:200], "/disk/"},
+	}
+	for _, tt := range tests {
+		src := strings.NewReader(tt.contents)
+		dest, overRead, err := pick(src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := dest.(*namedStorage).name; got != tt.want {
+			t.Errorf("%s: picked %s; want %s", tt.name, got, tt.want)
+		}
+		rest, _ := ioutil.ReadAll(src)
+		if got := string(overRead) + string(rest); got != tt.contents {
+			t.Errorf("%s: over-read %d bytes and rest %d bytes don't make up the blob", tt.name, len(overRead), len(rest))
+		}
+		// Blobs that can't be schema blobs are only read as far
+		// as the other conditions need.
+		if tt.contents[0] != '{' && len(overRead) > mimeSniffSize {
+			t.Errorf("%s: over-read %d bytes", tt.name, len(overRead))
+		}
+	}
+
+	for _, bad := range []string{
+		`{"if": "isBig", "then": "/a/", "else": "/b/"}`,
+		`{"if": {"minSize": 1, "maxSize": 2}, "then": "/a/", "else": "/b/"}`,
+		`{"if": {"and": []}, "then": "/a/", "else": "/b/"}`,
+		`{"if": {"minSize": "big"}, "then": "/a/", "else": "/b/"}`,
+		`{"if": "isSchema", "then": "/a/"}`,
+	} {
+		conf = nil
+		if err := json.Unmarshal([]byte(bad), &conf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := buildStorageForReceive(fakeLoader{}, conf, keys); err == nil {
+			t.Errorf("no error for config %s", bad)
+		}
+	}
+}
+
+// diskLoader loads the same storage for every prefix.
+type diskLoader struct {
+	blobserver.Loader
+	sto blobserver.Storage
+}
+
+func (ld diskLoader) GetStorage(prefix string) (blobserver.Storage, error) {
+	return ld.sto, nil
+}
+
+func TestCondConformance(t *testing.T) {
+	test.RunStorageTests(t, func(t *testing.T) (blobserver.Storage, func()) {
+		dir, err := ioutil.TempDir("", "cond-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds, err := localdisk.New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sto, err := newFromConfig(diskLoader{sto: ds}, jsonconfig.Obj{
+			"write": map[string]interface{}{
+				"if":   map[string]interface{}{"maxSize": float64(4)},
+				"then": "/bs/",
+				"else": "/bs/",
+			},
+			"read":   "/bs/",
+			"remove": "/bs/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sto, func() { os.RemoveAll(dir) }
+	})
+}
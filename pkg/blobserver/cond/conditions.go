@@ -0,0 +1,273 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cond
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/magic"
+	"camlistore.org/pkg/schema"
+)
+
+// mimeSniffSize is how much of a blob is sniffed for its MIME type.
+const mimeSniffSize = 1024
+
+// blobPeek reads the beginning of a blob being received, as far as
+// needed by the conditions evaluated on it. The bytes read are kept
+// in buf, to be received before the rest of src.
+type blobPeek struct {
+	src io.Reader
+	buf bytes.Buffer
+	eof bool
+
+	ssDone bool
+	ss     *schema.Superset // nil if not a schema blob
+}
+
+// peek returns the first n bytes of the blob, or fewer if the blob
+// is shorter, and possibly more if already read.
+func (p *blobPeek) peek(n int) ([]byte, error) {
+	if p.buf.Len() < n && !p.eof {
+		_, err := io.CopyN(&p.buf, p.src, int64(n-p.buf.Len()))
+		if err == io.EOF {
+			p.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return p.buf.Bytes(), nil
+}
+
+// superset returns the blob's schema superset, or nil if the blob
+// isn't a schema blob.
+//
+// Only blobs starting with a '{' are decoded, as far as they're valid
+// JSON: all of a schema blob, whatever its size, but little of the
+// other blobs.
+func (p *blobPeek) superset() (*schema.Superset, error) {
+	if p.ssDone {
+		return p.ss, nil
+	}
+	b, err := p.peek(1)
+	if err != nil {
+		return nil, err
+	}
+	p.ssDone = true
+	if len(b) == 0 || b[0] != '{' {
+		return nil, nil
+	}
+	r := &peekReader{p: p}
+	d := json.NewDecoder(r)
+	ss := new(schema.Superset)
+	err = d.Decode(ss)
+	if err == nil {
+		// Nothing but white space may follow.
+		if err = d.Decode(new(json.RawMessage)); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errors.New("trailing data")
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err == nil && ss.Type != "" {
+		p.ss = ss
+	}
+	return p.ss, nil
+}
+
+// peekReader reads the blob of p from its start, reading the bytes not
+// read yet into p.buf.
+type peekReader struct {
+	p   *blobPeek
+	off int
+	err error // error reading p.src
+}
+
+func (r *peekReader) Read(b []byte) (int, error) {
+	if r.off < r.p.buf.Len() {
+		n := copy(b, r.p.buf.Bytes()[r.off:])
+		r.off += n
+		return n, nil
+	}
+	if r.p.eof {
+		return 0, io.EOF
+	}
+	n, err := r.p.src.Read(b)
+	r.p.buf.Write(b[:n])
+	r.off += n
+	if err == io.EOF {
+		r.p.eof = true
+	} else if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// A condition reports whether a blob satisfies it.
+type condition func(p *blobPeek) (bool, error)
+
+// parseCondition returns the condition described by v, either a
+// string naming a predicate or an object with exactly one of the keys:
+//
+//	"and", "or": a list of conditions
+//	"not": a condition
+//	"minSize", "maxSize": a size in bytes, inclusive
+//	"mimeType": a sniffed MIME type, like "image/jpeg", or "image/*"
+//	"camliType": a schema blob type, like "claim", "file" or "bytes"
+//	"signer": the GPG key id of the verified signer of a signed blob
+//
+// fetcher is where the public keys of signers are fetched from.
+func parseCondition(v interface{}, fetcher blobref.StreamingFetcher) (condition, error) {
+	switch v := v.(type) {
+	case string:
+		switch v {
+		case "isSchema":
+			return isSchema, nil
+		}
+		return nil, fmt.Errorf("cond: unsupported 'if' type of %q", v)
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return nil, fmt.Errorf("cond: condition %v must have exactly one key", v)
+		}
+		for key, arg := range v {
+			return parsePredicate(key, arg, fetcher)
+		}
+	}
+	return nil, fmt.Errorf("cond: condition %v isn't a string or an object", v)
+}
+
+func parsePredicate(key string, arg interface{}, fetcher blobref.StreamingFetcher) (condition, error) {
+	switch key {
+	case "and", "or":
+		list, ok := arg.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("cond: %q needs a non-empty list of conditions", key)
+		}
+		var conds []condition
+		for _, v := range list {
+			c, err := parseCondition(v, fetcher)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, c)
+		}
+		return combine(conds, key == "and"), nil
+	case "not":
+		c, err := parseCondition(arg, fetcher)
+		if err != nil {
+			return nil, err
+		}
+		return func(p *blobPeek) (bool, error) {
+			ok, err := c(p)
+			return !ok, err
+		}, nil
+	case "minSize", "maxSize":
+		f, ok := arg.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return nil, fmt.Errorf("cond: %q needs a size in bytes", key)
+		}
+		n := int(f)
+		if key == "minSize" {
+			return func(p *blobPeek) (bool, error) {
+				b, err := p.peek(n)
+				return len(b) >= n, err
+			}, nil
+		}
+		return func(p *blobPeek) (bool, error) {
+			b, err := p.peek(n + 1)
+			return len(b) <= n, err
+		}, nil
+	}
+
+	s, ok := arg.(string)
+	if !ok || s == "" {
+		return nil, fmt.Errorf("cond: %q needs a string", key)
+	}
+	switch key {
+	case "mimeType":
+		return func(p *blobPeek) (bool, error) {
+			b, err := p.peek(mimeSniffSize)
+			if err != nil {
+				return false, err
+			}
+			if len(b) > mimeSniffSize {
+				b = b[:mimeSniffSize]
+			}
+			return mimeMatches(magic.MimeType(b), s), nil
+		}, nil
+	case "camliType":
+		return func(p *blobPeek) (bool, error) {
+			ss, err := p.superset()
+			return ss != nil && ss.Type == s, err
+		}, nil
+	case "signer":
+		keyId := strings.ToUpper(s)
+		return func(p *blobPeek) (bool, error) {
+			ss, err := p.superset()
+			if err != nil || ss == nil || ss.Signer == "" {
+				return false, err
+			}
+			vr := jsonsign.NewVerificationRequest(p.buf.String(), fetcher)
+			if !vr.Verify() {
+				return false, nil
+			}
+			// Key ids can be given in their short or long form.
+			return strings.HasSuffix(vr.SignerKeyId, keyId), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("cond: unsupported condition %q", key)
+}
+
+func isSchema(p *blobPeek) (bool, error) {
+	ss, err := p.superset()
+	return ss != nil, err
+}
+
+// combine returns the conjunction (and is true) or the disjunction of
+// conds, evaluated lazily in order.
+func combine(conds []condition, and bool) condition {
+	return func(p *blobPeek) (bool, error) {
+		for _, c := range conds {
+			ok, err := c(p)
+			if err != nil {
+				return false, err
+			}
+			if ok != and {
+				return ok, nil
+			}
+		}
+		return and, nil
+	}
+}
+
+// mimeMatches reports whether mimeType matches pattern, which can end
+// in "/*" to match all the subtypes of a type.
+func mimeMatches(mimeType, pattern string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mimeType, pattern[:len(pattern)-1])
+	}
+	return mimeType == pattern
+}
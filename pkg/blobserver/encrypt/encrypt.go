@@ -0,0 +1,450 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package encrypt registers the "encrypt" blobserver storage type, which
+encrypts blobs before storing them in another, untrusted, storage.
+
+Each blob is encrypted with AES-256 in GCM mode, together with its
+plaintext blobref, and stored in the backend under the blobref of the
+ciphertext, so the backend sees neither the contents nor the blobrefs
+of the blobs. The nonce is derived from the plaintext blobref with an
+HMAC, so the same blob always encrypts to the same ciphertext and is
+only stored once.
+
+Which ciphertext holds which blob is recorded in a local index (see
+camlistore.org/pkg/index/leveldb), so stats and enumerations don't
+touch the backend. If the index is lost, it is rebuilt from the
+ciphertexts when the storage is next opened.
+
+Example low-level config:
+
+	"/enc-s3/": {
+	    "handler": "storage-encrypt",
+	    "handlerArgs": {
+	        "backend": "/s3/",
+	        "key": "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+	        "metaIndex": "/home/camli/enc-s3-index"
+	    }
+	},
+
+The key is 32 bytes, in hex. Without it, the blobs can't be recovered.
+*/
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/leveldb"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+const (
+	// maxBlobSize is the size of the largest blob accepted.
+	maxBlobSize = 16 << 20
+
+	// version is the first byte of the ciphertexts, for future
+	// changes of the format.
+	version = 1
+
+	// rebuildEnumerateLimit is how many blobs are asked from the
+	// backend per enumeration when rebuilding the index.
+	rebuildEnumerateLimit = 1000
+)
+
+// Index rows:
+//
+//	enc|<plaintext blobref> = "<ciphertext blobref> <plaintext size>"
+const keyEnc = "enc|"
+
+type storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	backend blobserver.Storage
+	index   index.IndexStorage
+	aead    cipher.AEAD
+	hmacKey []byte // to derive the nonces
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
+	var (
+		backendPrefix = config.RequiredString("backend")
+		keyHex        = config.RequiredString("key")
+		metaIndex     = config.RequiredString("metaIndex")
+	)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encrypt: key must be 32 bytes, in hex")
+	}
+	backend, err := ld.GetStorage(backendPrefix)
+	if err != nil {
+		return nil, err
+	}
+	is, err := leveldb.NewStorage(metaIndex)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: error opening index: %v", err)
+	}
+	return newStorage(backend, is, key)
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("encrypt", blobserver.StorageConstructor(newFromConfig))
+}
+
+// newStorage returns a storage encrypting blobs with key into backend,
+// and recording them in is. If is is empty but backend isn't, is is
+// rebuilt first.
+func newStorage(backend blobserver.Storage, is index.IndexStorage, key []byte) (*storage, error) {
+	// Use separate keys for encryption and nonces.
+	block, err := aes.NewCipher(subKey(key, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		backend:                   backend,
+		index:                     is,
+		aead:                      aead,
+		hmacKey:                   subKey(key, "nonce"),
+	}
+	empty, err := s.indexEmpty()
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		if err := s.RebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func subKey(key []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, purpose)
+	return h.Sum(nil)
+}
+
+func encKey(br *blobref.BlobRef) string {
+	return keyEnc + br.String()
+}
+
+func (s *storage) indexEmpty() (bool, error) {
+	it := s.index.Find(keyEnc)
+	empty := !it.Next() || !strings.HasPrefix(it.Key(), keyEnc)
+	return empty, it.Close()
+}
+
+// encrypt returns the ciphertext of the blob br with contents data.
+func (s *storage) encrypt(br *blobref.BlobRef, data []byte) []byte {
+	mac := hmac.New(sha256.New, s.hmacKey)
+	io.WriteString(mac, br.String())
+	nonce := mac.Sum(nil)[:s.aead.NonceSize()]
+
+	plain := make([]byte, 0, len(br.String())+1+len(data))
+	plain = append(plain, br.String()...)
+	plain = append(plain, '\n')
+	plain = append(plain, data...)
+
+	out := make([]byte, 0, 1+len(nonce)+len(plain)+s.aead.Overhead())
+	out = append(out, version)
+	out = append(out, nonce...)
+	return s.aead.Seal(out, nonce, plain, nil)
+}
+
+// decrypt returns the blobref and contents of the blob encrypted in
+// ciphertext.
+func (s *storage) decrypt(ciphertext []byte) (*blobref.BlobRef, []byte, error) {
+	ns := s.aead.NonceSize()
+	if len(ciphertext) < 1+ns || ciphertext[0] != version {
+		return nil, nil, errors.New("encrypt: not an encrypted blob")
+	}
+	nonce := ciphertext[1 : 1+ns]
+	plain, err := s.aead.Open(nil, nonce, ciphertext[1+ns:], nil)
+	if err != nil {
+		return nil, nil, errors.New("encrypt: can't decrypt blob; wrong key?")
+	}
+	i := bytes.IndexByte(plain, '\n')
+	if i < 0 {
+		return nil, nil, errors.New("encrypt: decrypted blob lacks a blobref")
+	}
+	br := blobref.Parse(string(plain[:i]))
+	if br == nil {
+		return nil, nil, errors.New("encrypt: decrypted blob has a bad blobref")
+	}
+	return br, plain[i+1:], nil
+}
+
+// lookup returns the blobref of the ciphertext of br, and its plaintext
+// size, or os.ErrNotExist.
+func (s *storage) lookup(br *blobref.BlobRef) (*blobref.BlobRef, int64, error) {
+	v, err := s.index.Get(encKey(br))
+	if err == index.ErrNotFound {
+		return nil, 0, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseEncValue(v)
+}
+
+func parseEncValue(v string) (*blobref.BlobRef, int64, error) {
+	f := strings.Split(v, " ")
+	if len(f) != 2 {
+		return nil, 0, fmt.Errorf("encrypt: bad index value %q", v)
+	}
+	cbr := blobref.Parse(f[0])
+	size, err := strconv.ParseInt(f[1], 10, 64)
+	if cbr == nil || err != nil {
+		return nil, 0, fmt.Errorf("encrypt: bad index value %q", v)
+	}
+	return cbr, size, nil
+}
+
+func encValue(cbr *blobref.BlobRef, size int64) string {
+	return cbr.String() + " " + strconv.FormatInt(size, 10)
+}
+
+func (s *storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error) {
+	return s.Fetch(br)
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (s *storage) Fetch(br *blobref.BlobRef) (blobref.ReadSeekCloser, int64, error) {
+	cbr, _, err := s.lookup(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, _, err := s.backend.FetchStreaming(cbr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+	ciphertext, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	pbr, data, err := s.decrypt(ciphertext)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v (fetching %v as %v)", err, br, cbr)
+	}
+	if pbr.String() != br.String() || !hashMatches(br, data) {
+		return nil, 0, fmt.Errorf("encrypt: %v decrypts to the wrong blob", cbr)
+	}
+	return nopCloser{bytes.NewReader(data)}, int64(len(data)), nil
+}
+
+func hashMatches(br *blobref.BlobRef, data []byte) bool {
+	h := br.Hash()
+	if h == nil {
+		return false
+	}
+	h.Write(data)
+	return br.HashMatches(h)
+}
+
+func (s *storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	h := br.Hash()
+	if h == nil {
+		return blobref.SizedBlobRef{}, fmt.Errorf("encrypt: unsupported blobref %v", br)
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(h, &buf), io.LimitReader(source, maxBlobSize+1))
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	if n > maxBlobSize {
+		return blobref.SizedBlobRef{}, fmt.Errorf("encrypt: blob %v bigger than %d bytes", br, maxBlobSize)
+	}
+	if !br.HashMatches(h) {
+		return blobref.SizedBlobRef{}, blobserver.ErrCorruptBlob
+	}
+
+	ciphertext := s.encrypt(br, buf.Bytes())
+	ch := br.Hash()
+	ch.Write(ciphertext)
+	cbr := blobref.FromHash(br.HashName(), ch)
+	if _, err := s.backend.ReceiveBlob(cbr, bytes.NewReader(ciphertext)); err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	if err := s.index.Set(encKey(br), encValue(cbr, n)); err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	s.GetBlobHub().NotifyBlobReceived(br)
+	return blobref.SizedBlobRef{BlobRef: br, Size: n}, nil
+}
+
+func (s *storage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
+	for _, br := range blobs {
+		_, size, err := s.lookup(br)
+		if err == os.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dest <- blobref.SizedBlobRef{BlobRef: br, Size: size}
+	}
+	return nil
+}
+
+func (s *storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit int, wait time.Duration) error {
+	defer close(dest)
+	it := s.index.Find(keyEnc + after)
+	n := 0
+	for n < limit && it.Next() {
+		key := it.Key()
+		if !strings.HasPrefix(key, keyEnc) {
+			break
+		}
+		ref := key[len(keyEnc):]
+		if ref == after {
+			continue
+		}
+		br := blobref.Parse(ref)
+		_, size, err := parseEncValue(it.Value())
+		if br == nil || err != nil {
+			it.Close()
+			return fmt.Errorf("encrypt: bad index row %q = %q", key, it.Value())
+		}
+		dest <- blobref.SizedBlobRef{BlobRef: br, Size: size}
+		n++
+	}
+	return it.Close()
+}
+
+func (s *storage) RemoveBlobs(blobs []*blobref.BlobRef) error {
+	var cbrs []*blobref.BlobRef
+	bm := s.index.BeginBatch()
+	for _, br := range blobs {
+		cbr, _, err := s.lookup(br)
+		if err == os.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cbrs = append(cbrs, cbr)
+		bm.Delete(encKey(br))
+	}
+	if err := s.backend.RemoveBlobs(cbrs); err != nil {
+		return err
+	}
+	return s.index.CommitBatch(bm)
+}
+
+// RebuildIndex recreates the local index from the ciphertexts in the
+// backend. Blobs of the backend that can't be decrypted are skipped.
+func (s *storage) RebuildIndex() error {
+	bm := s.index.BeginBatch()
+	it := s.index.Find(keyEnc)
+	for it.Next() && strings.HasPrefix(it.Key(), keyEnc) {
+		bm.Delete(it.Key())
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	if err := s.index.CommitBatch(bm); err != nil {
+		return err
+	}
+
+	n := 0
+	after := ""
+	for {
+		ch := make(chan blobref.SizedBlobRef, rebuildEnumerateLimit)
+		errch := make(chan error, 1)
+		go func(after string) {
+			errch <- s.backend.EnumerateBlobs(ch, after, rebuildEnumerateLimit, 0)
+		}(after)
+		var refs []*blobref.BlobRef
+		for sb := range ch {
+			refs = append(refs, sb.BlobRef)
+		}
+		if err := <-errch; err != nil {
+			return fmt.Errorf("encrypt: error enumerating backend: %v", err)
+		}
+		if len(refs) == 0 {
+			break
+		}
+		after = refs[len(refs)-1].String()
+
+		bm := s.index.BeginBatch()
+		for _, cbr := range refs {
+			br, size, err := s.decryptBlob(cbr)
+			if err != nil {
+				log.Printf("encrypt: skipping backend blob %v: %v", cbr, err)
+				continue
+			}
+			bm.Set(encKey(br), encValue(cbr, size))
+			n++
+		}
+		if err := s.index.CommitBatch(bm); err != nil {
+			return err
+		}
+	}
+	if n > 0 {
+		log.Printf("encrypt: rebuilt index of %d blobs", n)
+	}
+	return nil
+}
+
+// decryptBlob fetches and decrypts the backend blob cbr, returning the
+// blobref and size of the blob it holds.
+func (s *storage) decryptBlob(cbr *blobref.BlobRef) (*blobref.BlobRef, int64, error) {
+	rc, _, err := s.backend.FetchStreaming(cbr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+	ciphertext, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	br, data, err := s.decrypt(ciphertext)
+	if err != nil {
+		return nil, 0, err
+	}
+	return br, int64(len(data)), nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encrypt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/index/leveldb"
+	"camlistore.org/pkg/test"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func enumerateAll(t *testing.T, sto blobserver.Storage) []blobref.SizedBlobRef {
+	ch := make(chan blobref.SizedBlobRef)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- sto.EnumerateBlobs(ch, "", 1000, 0)
+	}()
+	var sbs []blobref.SizedBlobRef
+	for sb := range ch {
+		sbs = append(sbs, sb)
+	}
+	if err := <-errch; err != nil {
+		t.Fatalf("EnumerateBlobs: %v", err)
+	}
+	return sbs
+}
+
+func TestEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backendDir := filepath.Join(dir, "backend")
+	if err := os.Mkdir(backendDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := localdisk.New(backendDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEncrypt := func(indexDir string) *storage {
+		is, err := leveldb.NewStorage(filepath.Join(dir, indexDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := newStorage(backend, is, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := newEncrypt("index")
+
+	secret := &test.Blob{Contents: "the secret plans"}
+	other := &test.Blob{Contents: "more secret plans"}
+	for _, b := range []*test.Blob{secret, other, secret} {
+		sb, err := s.ReceiveBlob(b.BlobRef(), b.Reader())
+		if err != nil {
+			t.Fatalf("ReceiveBlob: %v", err)
+		}
+		b.AssertMatches(t, &sb)
+	}
+
+	// The backend sees neither the contents nor the blobrefs.
+	backendBlobs := enumerateAll(t, backend)
+	if len(backendBlobs) != 2 {
+		t.Fatalf("backend has %d blobs; want 2", len(backendBlobs))
+	}
+	for _, sb := range backendBlobs {
+		if sb.BlobRef.String() == secret.BlobRef().String() || sb.BlobRef.String() == other.BlobRef().String() {
+			t.Errorf("backend stores blob %v under its plaintext blobref", sb.BlobRef)
+		}
+		rc, _, err := backend.FetchStreaming(sb.BlobRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if strings.Contains(string(b), "secret") || strings.Contains(string(b), secret.BlobRef().String()) {
+			t.Errorf("backend blob %v has plaintext: %q", sb.BlobRef, b)
+		}
+	}
+
+	rc, size, err := s.FetchStreaming(secret.BlobRef())
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != secret.Contents || size != secret.Size() {
+		t.Errorf("Fetch = %q, %d; want %q, %d", b, size, secret.Contents, secret.Size())
+	}
+
+	// A fresh index is rebuilt from the backend.
+	s = newEncrypt("index2")
+	sbs := enumerateAll(t, s)
+	if len(sbs) != 2 {
+		t.Fatalf("rebuilt index has %d blobs; want 2", len(sbs))
+	}
+	for _, sb := range sbs {
+		if sb.BlobRef.String() == secret.BlobRef().String() {
+			secret.AssertMatches(t, &sb)
+		}
+	}
+
+	if err := s.RemoveBlobs([]*blobref.BlobRef{secret.BlobRef()}); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	ch := make(chan blobref.SizedBlobRef, 2)
+	if err := s.StatBlobs(ch, []*blobref.BlobRef{secret.BlobRef(), other.BlobRef()}, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var got []string
+	for sb := range ch {
+		got = append(got, sb.BlobRef.String())
+	}
+	if len(got) != 1 || got[0] != other.BlobRef().String() {
+		t.Errorf("after removal, StatBlobs = %q; want only %v", got, other.BlobRef())
+	}
+	if n := len(enumerateAll(t, backend)); n != 1 {
+		t.Errorf("after removal, backend has %d blobs; want 1", n)
+	}
+
+	// The wrong key can't read anything.
+	is, err := leveldb.NewStorage(filepath.Join(dir, "index3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := newStorage(backend, is, []byte("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(enumerateAll(t, wrong)); n != 0 {
+		t.Errorf("storage with the wrong key enumerated %d blobs", n)
+	}
+}
+
+func TestEncryptConformance(t *testing.T) {
+	test.RunStorageTests(t, func(t *testing.T) (blobserver.Storage, func()) {
+		dir, err := ioutil.TempDir("", "encrypt-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		backendDir := filepath.Join(dir, "backend")
+		if err := os.Mkdir(backendDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		backend, err := localdisk.New(backendDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		is, err := leveldb.NewStorage(filepath.Join(dir, "index"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := newStorage(backend, is, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, func() { os.RemoveAll(dir) }
+	})
+}
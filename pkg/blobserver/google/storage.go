@@ -14,11 +14,34 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+/*
+Package google registers the "googlestorage" blobserver storage type,
+storing blobs as objects in a Google Storage bucket, named by their
+blobref.
+
+The OAuth credentials can be obtained with the camgsinit command.
+
+Example low-level config:
+
+	"/gs/": {
+	    "handler": "storage-googlestorage",
+	    "handlerArgs": {
+	        "bucket": "camlistore-blobs",
+	        "auth": {
+	            "client_id": "xxxxx.apps.googleusercontent.com",
+	            "client_secret": "xxxxx",
+	            "refresh_token": "xxxxx"
+	        }
+	    }
+	},
+*/
 package google
 
 import (
-	"errors"
+	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
 	"time"
 
 	"camlistore.org/pkg/blobref"
@@ -54,30 +77,80 @@ func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (blobserver.Stora
 }
 
 func (gs *Storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit int, wait time.Duration) error {
-	// TODO: Implement stub
+	defer close(dest)
+	objs, err := gs.client.EnumerateObjects(gs.bucket, after, uint(limit))
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		br := blobref.Parse(obj.Key)
+		if br == nil {
+			// Not a blob, e.g. the "test-" objects of the
+			// googlestorage tests.
+			continue
+		}
+		dest <- blobref.SizedBlobRef{BlobRef: br, Size: obj.Size}
+	}
 	return nil
 }
 
 func (gs *Storage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
-	// TODO: Implement stub
-	return blobref.SizedBlobRef{}, nil
+	// The blob is buffered to verify it before it's stored, and
+	// to resend it if the OAuth token needs a refresh.
+	var buf bytes.Buffer
+	hash := blob.Hash()
+	size, err := io.Copy(io.MultiWriter(hash, &buf), source)
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	if !blob.HashMatches(hash) {
+		return blobref.SizedBlobRef{}, blobserver.ErrCorruptBlob
+	}
+	obj := &googlestorage.Object{Bucket: gs.bucket, Key: blob.String()}
+	shouldRetry, err := gs.client.PutObject(obj, ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
+	if shouldRetry {
+		_, err = gs.client.PutObject(obj, ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
+	}
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	gs.hub.NotifyBlobReceived(blob)
+	return blobref.SizedBlobRef{BlobRef: blob, Size: size}, nil
 }
 
 func (gs *Storage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
-	// TODO: Implement stub
-	return errors.New("TODO: implement StatBlobs")
+	// TODO: do n stats in parallel
+	for _, br := range blobs {
+		size, exists, err := gs.client.StatObject(&googlestorage.Object{Bucket: gs.bucket, Key: br.String()})
+		if err != nil {
+			return err
+		}
+		if exists {
+			dest <- blobref.SizedBlobRef{BlobRef: br, Size: size}
+		}
+	}
+	return nil
 }
 
 func (gs *Storage) FetchStreaming(blob *blobref.BlobRef) (io.ReadCloser, int64, error) {
-	// TODO: Implement stub
-	return nil, 0, errors.New("TODO: implement FetchStreaming")
+	return gs.client.GetObject(&googlestorage.Object{Bucket: gs.bucket, Key: blob.String()})
 }
 
 func (gs *Storage) RemoveBlobs(blobs []*blobref.BlobRef) error {
-	// TODO: Implement stub
-	return errors.New("TODO: implement RemoveBlobs")
+	var reterr error
+	for _, br := range blobs {
+		err := gs.client.DeleteObject(&googlestorage.Object{Bucket: gs.bucket, Key: br.String()})
+		if err != nil && err != os.ErrNotExist {
+			reterr = err
+		}
+	}
+	return reterr
 }
 
 func (gs *Storage) GetBlobHub() blobserver.BlobHub {
 	return gs.hub
 }
+
+func init() {
+	blobserver.RegisterStorageConstructor("googlestorage", blobserver.StorageConstructor(newFromConfig))
+}
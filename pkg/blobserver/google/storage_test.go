@@ -0,0 +1,146 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/googlestorage"
+	"camlistore.org/pkg/test"
+	"camlistore.org/third_party/code.google.com/p/goauth2/oauth"
+)
+
+// fakeGS is an http.RoundTripper answering, from memory, the
+// requests of the Google Storage client.
+type fakeGS struct {
+	mu      sync.Mutex
+	objects map[string][]byte // "bucket/key" -> contents
+}
+
+func response(req *http.Request, code int, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    code,
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Header:        http.Header{"Content-Length": {strconv.Itoa(len(body))}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func (f *fakeGS) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if req.URL.Host != "commondatastorage.googleapis.com" || req.Header.Get("Authorization") == "" {
+		return response(req, http.StatusBadRequest, nil), nil
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case req.Method == "GET" && strings.HasSuffix(name, "/"):
+		return f.list(req, strings.TrimSuffix(name, "/"))
+	case req.Method == "GET" || req.Method == "HEAD":
+		b, ok := f.objects[name]
+		if !ok {
+			return response(req, http.StatusNotFound, nil), nil
+		}
+		res := response(req, http.StatusOK, b)
+		if req.Method == "HEAD" {
+			res.Body = ioutil.NopCloser(strings.NewReader(""))
+		}
+		return res, nil
+	case req.Method == "PUT":
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		f.objects[name] = b
+		return response(req, http.StatusOK, nil), nil
+	case req.Method == "DELETE":
+		if _, ok := f.objects[name]; !ok {
+			return response(req, http.StatusNotFound, nil), nil
+		}
+		delete(f.objects, name)
+		return response(req, http.StatusNoContent, nil), nil
+	}
+	return response(req, http.StatusMethodNotAllowed, nil), nil
+}
+
+func (f *fakeGS) list(req *http.Request, bucket string) (*http.Response, error) {
+	marker := req.URL.Query().Get("marker")
+	maxKeys := -1
+	if s := req.URL.Query().Get("max-keys"); s != "" {
+		var err error
+		if maxKeys, err = strconv.Atoi(s); err != nil {
+			return response(req, http.StatusBadRequest, nil), nil
+		}
+	}
+	var keys []string
+	for name := range f.objects {
+		if key := strings.TrimPrefix(name, bucket+"/"); key != name && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if maxKeys >= 0 && len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+	}
+	type item struct {
+		Key  string
+		Size int
+	}
+	res := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []item
+	}{}
+	for _, key := range keys {
+		res.Contents = append(res.Contents, item{key, len(f.objects[bucket+"/"+key])})
+	}
+	b, err := xml.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return response(req, http.StatusOK, b), nil
+}
+
+func TestGoogleStorage(t *testing.T) {
+	test.RunStorageTests(t, func(t *testing.T) (blobserver.Storage, func()) {
+		transport := &oauth.Transport{
+			Config:    &oauth.Config{},
+			Token:     &oauth.Token{AccessToken: "token"},
+			Transport: &fakeGS{objects: make(map[string][]byte)},
+		}
+		return &Storage{
+			hub:    &blobserver.SimpleBlobHub{},
+			bucket: "camlistore-test",
+			client: googlestorage.NewClient(transport),
+		}, nil
+	})
+}
@@ -0,0 +1,393 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+)
+
+// ResumableDir is the directory where the partially received blobs
+// of resumable uploads are kept until they're finalized. Partial
+// blobs are named by their blobref, which makes them safe to share
+// between the storages of a server. Servers set it from the
+// "resumableDir" of their config, next to their blobs; the default
+// under the temp dir is for tests and configs without one.
+var ResumableDir = filepath.Join(os.TempDir(), "camli-resumable")
+
+const (
+	// resumablePath is what comes after "/camli/" in the URLs of
+	// resumable uploads, before the blobref.
+	resumablePath = "upload-resumable/"
+
+	// maxResumableSize is the largest blob accepted by resumable
+	// uploads, as advertised in the "maxUploadSize" of responses.
+	maxResumableSize = 2147483647
+
+	// resumableExpiry is how long an untouched partial blob is kept.
+	resumableExpiry = 24 * time.Hour
+)
+
+var contentRangePattern = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+var (
+	resumableMu   sync.Mutex
+	resumableBusy = make(map[string]bool) // blobref -> being written or finalized
+)
+
+// CreateResumableUploadHandler returns the handler of the resumable
+// upload protocol, as described in doc/protocol/blob-upload-resume.txt.
+func CreateResumableUploadHandler(storage blobserver.BlobReceiveConfiger) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleResumableUpload(conn, req, storage)
+	}
+}
+
+func handleResumableUpload(conn http.ResponseWriter, req *http.Request, blobReceiver blobserver.BlobReceiveConfiger) {
+	if w, ok := blobReceiver.(blobserver.ContextWrapper); ok {
+		blobReceiver = wrapReceiveConfiger(w, req, blobReceiver)
+	}
+
+	idx := strings.LastIndex(req.URL.Path, "/camli/"+resumablePath)
+	if idx == -1 {
+		httputil.ErrorRouting(conn, req)
+		return
+	}
+	ref := blobref.Parse(req.URL.Path[idx+len("/camli/"+resumablePath):])
+	if ref == nil {
+		httputil.BadRequestError(conn, "Malformed resumable upload URL.")
+		return
+	}
+	if !ref.IsSupported() {
+		httputil.BadRequestError(conn, "unsupported object hash function")
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		size, offset, err := partialStatus(ref)
+		if os.IsNotExist(err) {
+			http.Error(conn, "No upload in progress for "+ref.String(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			httputil.ServerError(conn, err)
+			return
+		}
+		returnResumableStatus(conn, ref, size, offset)
+	case "POST":
+		switch req.FormValue("mode") {
+		case "begin":
+			beginResumable(conn, req, ref)
+		case "finalize":
+			finalizeResumable(conn, req, ref, blobReceiver)
+		default:
+			httputil.BadRequestError(conn, "Unsupported mode.")
+		}
+	case "PUT":
+		putResumable(conn, req, ref)
+	default:
+		httputil.BadRequestError(conn, "Invalid method.")
+	}
+}
+
+// lockPartial marks ref's partial blob as busy, returning false if it
+// already was.
+func lockPartial(ref *blobref.BlobRef) bool {
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	if resumableBusy[ref.String()] {
+		return false
+	}
+	resumableBusy[ref.String()] = true
+	return true
+}
+
+func unlockPartial(ref *blobref.BlobRef) {
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	delete(resumableBusy, ref.String())
+}
+
+func partialPath(ref *blobref.BlobRef, size int64) string {
+	return filepath.Join(ResumableDir, fmt.Sprintf("%s-%d.partial", ref, size))
+}
+
+// findPartial returns the path and the announced size of ref's
+// partial blob, or an os.IsNotExist error if there's none.
+func findPartial(ref *blobref.BlobRef) (path string, size int64, err error) {
+	matches, err := filepath.Glob(filepath.Join(ResumableDir, ref.String()+"-*.partial"))
+	if err != nil {
+		return "", 0, err
+	}
+	if len(matches) == 0 {
+		return "", 0, os.ErrNotExist
+	}
+	path = matches[0]
+	sizeStr := strings.TrimSuffix(path[len(filepath.Join(ResumableDir, ref.String()))+1:], ".partial")
+	size, err = strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("bogus partial blob file name %q", path)
+	}
+	return path, size, nil
+}
+
+// partialStatus returns the announced size of ref's partial blob and
+// how many of its bytes have been received.
+func partialStatus(ref *blobref.BlobRef) (size, offset int64, err error) {
+	path, size, err := findPartial(ref)
+	if err != nil {
+		return 0, 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, fi.Size(), nil
+}
+
+func returnResumableStatus(conn http.ResponseWriter, ref *blobref.BlobRef, size, offset int64) {
+	ret := make(map[string]interface{})
+	ret["blobRef"] = ref.String()
+	ret["size"] = size
+	ret["offset"] = offset
+	httputil.ReturnJson(conn, ret)
+}
+
+// returnResumableBusy replies to a request on ref's upload while
+// another request holds it. The reply is a conflict with the upload's
+// status and "busy" set, so clients wait for the other request and
+// resume instead of failing.
+func returnResumableBusy(conn http.ResponseWriter, ref *blobref.BlobRef) {
+	size, offset, err := partialStatus(ref)
+	if err != nil && !os.IsNotExist(err) {
+		httputil.ServerError(conn, err)
+		return
+	}
+	ret := make(map[string]interface{})
+	ret["blobRef"] = ref.String()
+	ret["size"] = size
+	ret["offset"] = offset
+	ret["busy"] = true
+	conn.WriteHeader(http.StatusConflict)
+	httputil.ReturnJson(conn, ret)
+}
+
+func beginResumable(conn http.ResponseWriter, req *http.Request, ref *blobref.BlobRef) {
+	size, err := strconv.ParseInt(req.FormValue("size"), 10, 64)
+	if err != nil || size < 0 {
+		httputil.BadRequestError(conn, "Missing or invalid size.")
+		return
+	}
+	if size > maxResumableSize {
+		httputil.RequestEntityTooLargeError(conn)
+		return
+	}
+	if !lockPartial(ref) {
+		returnResumableBusy(conn, ref)
+		return
+	}
+	defer unlockPartial(ref)
+
+	removeExpiredPartials()
+	if err := os.MkdirAll(ResumableDir, 0700); err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	path, oldSize, err := findPartial(ref)
+	switch {
+	case err == nil && oldSize != size:
+		// A different size for the same blobref; at least one of
+		// them is bogus, so start over with the new one.
+		os.Remove(path)
+	case err != nil && !os.IsNotExist(err):
+		httputil.ServerError(conn, err)
+		return
+	}
+	f, err := os.OpenFile(partialPath(ref, size), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	returnResumableStatus(conn, ref, size, fi.Size())
+}
+
+func putResumable(conn http.ResponseWriter, req *http.Request, ref *blobref.BlobRef) {
+	m := contentRangePattern.FindStringSubmatch(req.Header.Get("Content-Range"))
+	if m == nil {
+		httputil.BadRequestError(conn, "Missing or invalid Content-Range.")
+		return
+	}
+	start, _ := strconv.ParseInt(m[1], 10, 64)
+	end, _ := strconv.ParseInt(m[2], 10, 64)
+	total, _ := strconv.ParseInt(m[3], 10, 64)
+	if end < start || end >= total {
+		httputil.BadRequestError(conn, "Invalid Content-Range.")
+		return
+	}
+	if !lockPartial(ref) {
+		returnResumableBusy(conn, ref)
+		return
+	}
+	defer unlockPartial(ref)
+
+	path, size, err := findPartial(ref)
+	if os.IsNotExist(err) {
+		http.Error(conn, "No upload in progress for "+ref.String(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	if total != size {
+		httputil.BadRequestError(conn, "Content-Range total differs from the size the upload began with.")
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	offset := fi.Size()
+	if start != offset {
+		// The client is out of sync, e.g. after a lost response.
+		// Tell it where to resume from.
+		conn.WriteHeader(http.StatusConflict)
+		returnResumableStatus(conn, ref, size, offset)
+		return
+	}
+	// Whatever arrives is kept, even if the connection breaks
+	// before the end of the range: the client resumes after it.
+	n, err := io.Copy(f, io.LimitReader(req.Body, end-start+1))
+	offset += n
+	if err != nil {
+		log.Printf("Resumable upload of %v interrupted at offset %d: %v", ref, offset, err)
+		httputil.ServerError(conn, err)
+		return
+	}
+	returnResumableStatus(conn, ref, size, offset)
+}
+
+func finalizeResumable(conn http.ResponseWriter, req *http.Request, ref *blobref.BlobRef, blobReceiver blobserver.BlobReceiveConfiger) {
+	if !lockPartial(ref) {
+		returnResumableBusy(conn, ref)
+		return
+	}
+	defer unlockPartial(ref)
+
+	path, size, err := findPartial(ref)
+	if os.IsNotExist(err) {
+		http.Error(conn, "No upload in progress for "+ref.String(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	if fi.Size() != size {
+		conn.WriteHeader(http.StatusConflict)
+		returnResumableStatus(conn, ref, size, fi.Size())
+		return
+	}
+
+	// Verify the digest first, so a bogus partial blob is dropped
+	// and the client starts over, instead of failing forever.
+	h := ref.Hash()
+	if _, err := io.Copy(h, f); err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	if !ref.HashMatches(h) {
+		os.Remove(path)
+		httputil.BadRequestError(conn, "Received bytes don't match the blobref; upload discarded.")
+		return
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	blobGot, err := blobReceiver.ReceiveBlob(ref, f)
+	if err != nil {
+		httputil.ServerError(conn, fmt.Errorf("error receiving blob %v: %v", ref, err))
+		return
+	}
+	os.Remove(path)
+	log.Printf("Received blob %v by resumable upload", blobGot)
+
+	ret := commonUploadResponse(blobReceiver, req)
+	ret["received"] = []map[string]interface{}{
+		{"blobRef": blobGot.BlobRef.String(), "size": blobGot.Size},
+	}
+	httputil.ReturnJson(conn, ret)
+}
+
+// removeExpiredPartials removes the partial blobs untouched for
+// longer than resumableExpiry. It's called with no lock held on
+// them, so it skips the busy ones.
+func removeExpiredPartials() {
+	matches, _ := filepath.Glob(filepath.Join(ResumableDir, "*.partial"))
+	for _, path := range matches {
+		fi, err := os.Stat(path)
+		if err != nil || time.Since(fi.ModTime()) < resumableExpiry {
+			continue
+		}
+		name := filepath.Base(path)
+		ref := blobref.Parse(name[:strings.LastIndex(name, "-")])
+		if ref == nil || !lockPartial(ref) {
+			continue
+		}
+		os.Remove(path)
+		unlockPartial(ref)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+// refusingReceiver fails the test if any blob reaches it.
+type refusingReceiver struct {
+	t *testing.T
+}
+
+func (r refusingReceiver) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	r.t.Errorf("unexpected ReceiveBlob of %v", br)
+	return blobref.SizedBlobRef{}, nil
+}
+
+func (r refusingReceiver) Config() *blobserver.Config {
+	return &blobserver.Config{}
+}
+
+func TestResumableConflictAndCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-resumable-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := ResumableDir
+	defer func() { ResumableDir = oldDir }()
+	ResumableDir = dir
+
+	br := blobref.SHA1FromString("foobar")
+	url := "http://example.com/camli/upload-resumable/" + br.String()
+	do := func(method, contentRange, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if contentRange != "" {
+			req.Header.Set("Content-Range", contentRange)
+		}
+		wr := httptest.NewRecorder()
+		wr.Code = 200 // default
+		handleResumableUpload(wr, req, refusingReceiver{t})
+		return wr
+	}
+
+	if wr := do("GET", "", ""); wr.Code != http.StatusNotFound {
+		t.Errorf("status before begin: code %d; want 404", wr.Code)
+	}
+	if wr := do("POST", "", "mode=begin&size=6"); wr.Code != 200 || !strings.Contains(wr.Body.String(), `"offset": 0`) {
+		t.Fatalf("begin: code %d, body %q", wr.Code, wr.Body)
+	}
+	if wr := do("PUT", "bytes 0-2/6", "foo"); wr.Code != 200 || !strings.Contains(wr.Body.String(), `"offset": 3`) {
+		t.Fatalf("PUT of the first half: code %d, body %q", wr.Code, wr.Body)
+	}
+	// A request while another one holds the upload is told to wait.
+	lockPartial(br)
+	if wr := do("PUT", "bytes 3-5/6", "baz"); wr.Code != http.StatusConflict || !strings.Contains(wr.Body.String(), `"busy": true`) || !strings.Contains(wr.Body.String(), `"offset": 3`) {
+		t.Errorf("PUT while busy: code %d, body %q", wr.Code, wr.Body)
+	}
+	unlockPartial(br)
+	// A range not starting at the offset is told where to resume.
+	if wr := do("PUT", "bytes 0-2/6", "foo"); wr.Code != http.StatusConflict || !strings.Contains(wr.Body.String(), `"offset": 3`) {
+		t.Errorf("PUT at a wrong offset: code %d, body %q", wr.Code, wr.Body)
+	}
+	if wr := do("POST", "", "mode=finalize"); wr.Code != http.StatusConflict {
+		t.Errorf("finalize of an incomplete upload: code %d; want 409", wr.Code)
+	}
+	if wr := do("PUT", "bytes 3-5/6", "baz"); wr.Code != 200 || !strings.Contains(wr.Body.String(), `"offset": 6`) {
+		t.Fatalf("PUT of the second half: code %d, body %q", wr.Code, wr.Body)
+	}
+	if wr := do("POST", "", "mode=finalize"); wr.Code != http.StatusBadRequest {
+		t.Errorf("finalize of a corrupt upload: code %d; want 400", wr.Code)
+	}
+	if wr := do("GET", "", ""); wr.Code != http.StatusNotFound {
+		t.Errorf("status of a discarded upload: code %d; want 404", wr.Code)
+	}
+}
@@ -177,6 +177,7 @@ func commonUploadResponse(configer blobserver.Configer, req *http.Request) map[s
 		// something different here just to make it obvious that this
 		// isn't a well-known URL and accidentally encourage lazy clients.
 		ret["uploadUrl"] = config.URLBase + "/camli/upload"
+		ret["resumableUploadUrl"] = config.URLBase + "/camli/" + strings.TrimSuffix(resumablePath, "/")
 	} else {
 		ret["uploadUrl"] = "(configer.Config is nil)"
 	}
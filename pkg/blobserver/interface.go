@@ -72,6 +72,14 @@ type QueueCreator interface {
 	CreateQueue(name string) (Storage, error)
 }
 
+// Quarantiner is implemented by Storage interfaces which can move a
+// blob out of the way while keeping its contents for inspection, such
+// as a blob found corrupt by fsck. A quarantined blob is no longer
+// fetched, statted or enumerated.
+type Quarantiner interface {
+	Quarantine(blob *blobref.BlobRef) error
+}
+
 type MaxEnumerateConfig interface {
 	// Returns the max that this storage interface is capable
 	// of enumerating at once.
@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -191,3 +192,37 @@ func TestEnumerateIsSorted(t *testing.T) {
 		}
 	}
 }
+
+func TestEnumerateMixedDigests(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	defer blobref.SetDefaultDigest(blobref.DefaultDigest())
+	var want []string
+	for _, hashName := range []string{"sha256", "sha1", "sha224"} {
+		ExpectNil(t, blobref.SetDefaultDigest(hashName), "setting digest")
+		for _, s := range []string{"foo", "bar"} {
+			br := blobref.FromString(s)
+			_, err := ds.ReceiveBlob(br, strings.NewReader(s))
+			ExpectNil(t, err, "receiving "+br.String())
+			want = append(want, br.String())
+		}
+	}
+	sort.Strings(want)
+
+	for i, after := range []string{"", want[2]} {
+		ch := make(chan blobref.SizedBlobRef)
+		errCh := make(chan error)
+		go func() {
+			errCh <- ds.EnumerateBlobs(ch, after, 100, 0)
+		}()
+		var got []string
+		for sb := range ch {
+			got = append(got, sb.BlobRef.String())
+		}
+		ExpectNil(t, <-errCh, "EnumerateBlobs return value")
+		if w := want[i*3:]; strings.Join(got, " ") != strings.Join(w, " ") {
+			t.Errorf("after %q: got %v; want %v", after, got, w)
+		}
+	}
+}
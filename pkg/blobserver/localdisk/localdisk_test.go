@@ -20,6 +20,7 @@ import (
 	. "camlistore.org/pkg/test/asserts"
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/test"
 	"crypto/sha1"
 	"fmt"
 	"io"
@@ -206,3 +207,10 @@ func TestMissingGetReturnsNoEnt(t *testing.T) {
 		t.Errorf("expected nil blob; got a value")
 	}
 }
+
+func TestLocaldisk(t *testing.T) {
+	test.RunStorageTests(t, func(t *testing.T) (blobserver.Storage, func()) {
+		ds := NewStorage(t)
+		return ds, func() { cleanUp(ds) }
+	})
+}
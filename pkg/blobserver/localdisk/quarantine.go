@@ -0,0 +1,44 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"fmt"
+	"os"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// quarantinePartition is the partition holding quarantined blobs.
+const quarantinePartition = "quarantine"
+
+// Quarantine moves blob into the quarantine partition, where it's
+// kept for inspection but no longer served.
+func (ds *DiskStorage) Quarantine(blob *blobref.BlobRef) error {
+	if ds.partition != "" {
+		return fmt.Errorf("localdisk: can't quarantine from queue %q", ds.partition)
+	}
+	dir := ds.blobDirectory(quarantinePartition, blob)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	err := os.Rename(ds.blobPath("", blob), ds.blobPath(quarantinePartition, blob))
+	if errorIsNoEnt(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,758 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package packed registers the "packed" blobserver storage type, which
+appends blobs to large pack files instead of writing a file per blob,
+sparing inodes and making backups of the storage faster.
+
+The pack files are append-only. Where each blob lives is recorded in a
+LevelDB-style index (see camlistore.org/pkg/index/leveldb) in the
+"index" subdirectory. Removed blobs are only marked dead in the index;
+their space is reclaimed by compacting the storage (see Compact and the
+campack command).
+
+Each blob in a pack file is preceded by a header line of the form
+"camlipack <blobref> <size>\n", so pack files can be inspected without
+the index, and the index rebuilt from them (see Reindex). The index is
+rebuilt when the storage is opened with pack files but no index.
+
+The directory is locked while the storage is open, so a server and
+campack can't use it at the same time.
+
+Example low-level config:
+
+	"/bs/": {
+	    "handler": "storage-packed",
+	    "handlerArgs": {
+	        "path": "/home/camli/packed",
+	        "maxPackSize": 536870912
+	    }
+	},
+*/
+package packed
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/leveldb"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/osutil"
+)
+
+const (
+	// defaultMaxPackSize is the size after which a new pack file is
+	// started.
+	defaultMaxPackSize = 512 << 20
+
+	// maxBlobSize is the size of the largest blob accepted.
+	maxBlobSize = 16 << 20
+
+	packPrefix = "pack-"
+	packSuffix = ".camlipack"
+)
+
+// Index keys. Pack numbers and offsets are zero-padded, so the rows
+// of a pack sort in offset order.
+//
+//	blob|<blobref>            = "<pack> <offset> <size>" (offset of the data, after the header)
+//	pack|<pack>|<offset>      = "<blobref>"
+//	dead|<pack>               = bytes of removed blobs in the pack, headers included
+const (
+	keyBlob = "blob|"
+	keyPack = "pack|"
+	keyDead = "dead|"
+)
+
+// Storage is a blobserver.Storage storing blobs in pack files.
+type Storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	dir         string
+	maxPackSize int64
+	index       index.IndexStorage
+	lock        io.Closer
+
+	mu      sync.Mutex // guards the following, and writes to the index
+	cur     *os.File   // pack file being appended to; nil until the first write
+	curPack int        // number of cur, or of the next pack if cur is nil
+	curSize int64
+}
+
+var _ blobserver.Storage = (*Storage)(nil)
+
+// New returns a packed Storage in the directory dir, creating it if
+// needed. Pack files are started anew once bigger than maxPackSize;
+// zero means the default of 512 MB.
+//
+// The storage can't be opened by more than one process at a time; New
+// fails if dir is in use. If dir has pack files but no index, the index
+// is rebuilt from them first.
+func New(dir string, maxPackSize int64) (*Storage, error) {
+	if maxPackSize <= 0 {
+		maxPackSize = defaultMaxPackSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := osutil.LockFile(filepath.Join(dir, "LOCK"))
+	if err != nil {
+		return nil, fmt.Errorf("packed: error locking %s, in use by another process? %v", dir, err)
+	}
+	is, err := leveldb.NewStorage(filepath.Join(dir, "index"))
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("packed: error opening index: %v", err)
+	}
+	s := &Storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		dir:                       dir,
+		maxPackSize:               maxPackSize,
+		index:                     is,
+		lock:                      lock,
+	}
+	if err := s.open(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// open picks the number of the next pack, and rebuilds a missing
+// index.
+func (s *Storage) open() error {
+	packs, err := listPacks(s.dir)
+	if err != nil {
+		return err
+	}
+	// Never append to an existing pack: its tail may have been
+	// torn by a crash.
+	s.curPack = 1
+	if len(packs) == 0 {
+		return nil
+	}
+	s.curPack = packs[len(packs)-1] + 1
+
+	it := s.index.Find("")
+	empty := !it.Next()
+	if err := it.Close(); err != nil {
+		return err
+	}
+	if !empty {
+		return nil
+	}
+	log.Printf("packed: %s has pack files but no index; rebuilding it", s.dir)
+	_, err = s.Reindex()
+	return err
+}
+
+func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
+	var (
+		path        = config.RequiredString("path")
+		maxPackSize = config.OptionalInt("maxPackSize", 0)
+	)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return New(path, int64(maxPackSize))
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("packed", blobserver.StorageConstructor(newFromConfig))
+}
+
+func packName(n int) string {
+	return fmt.Sprintf("%s%08d%s", packPrefix, n, packSuffix)
+}
+
+func (s *Storage) packPath(n int) string {
+	return filepath.Join(s.dir, packName(n))
+}
+
+// listPacks returns the numbers of the pack files in dir, sorted.
+func listPacks(dir string) ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(dir, packPrefix+"*"+packSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var packs []int
+	for _, name := range names {
+		base := filepath.Base(name)
+		n, err := strconv.Atoi(base[len(packPrefix) : len(base)-len(packSuffix)])
+		if err != nil {
+			continue
+		}
+		packs = append(packs, n)
+	}
+	sort.Ints(packs)
+	return packs, nil
+}
+
+func blobKey(br *blobref.BlobRef) string {
+	return keyBlob + br.String()
+}
+
+func packKey(pack int, offset int64) string {
+	return fmt.Sprintf("%s%08d|%016d", keyPack, pack, offset)
+}
+
+func deadKey(pack int) string {
+	return fmt.Sprintf("%s%08d", keyDead, pack)
+}
+
+// location is where a blob's data is.
+type location struct {
+	pack   int
+	offset int64
+	size   int64
+}
+
+func (l location) String() string {
+	return fmt.Sprintf("%d %d %d", l.pack, l.offset, l.size)
+}
+
+// headerSize returns the size of the header preceding the data.
+func (l location) headerSize(br *blobref.BlobRef) int64 {
+	return int64(len(header(br, l.size)))
+}
+
+func header(br *blobref.BlobRef, size int64) string {
+	return fmt.Sprintf("camlipack %s %d\n", br, size)
+}
+
+func parseLocation(v string) (l location, err error) {
+	f := strings.Split(v, " ")
+	if len(f) != 3 {
+		return l, fmt.Errorf("packed: bad index value %q", v)
+	}
+	l.pack, err = strconv.Atoi(f[0])
+	if err == nil {
+		l.offset, err = strconv.ParseInt(f[1], 10, 64)
+	}
+	if err == nil {
+		l.size, err = strconv.ParseInt(f[2], 10, 64)
+	}
+	if err != nil {
+		return l, fmt.Errorf("packed: bad index value %q", v)
+	}
+	return l, nil
+}
+
+// locate returns where br is, or os.ErrNotExist.
+func (s *Storage) locate(br *blobref.BlobRef) (location, error) {
+	v, err := s.index.Get(blobKey(br))
+	if err == index.ErrNotFound {
+		return location{}, os.ErrNotExist
+	}
+	if err != nil {
+		return location{}, err
+	}
+	return parseLocation(v)
+}
+
+func (s *Storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error) {
+	return s.Fetch(br)
+}
+
+// packReader is a blob's section of a pack file.
+type packReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r *packReader) Close() error {
+	return r.f.Close()
+}
+
+func (s *Storage) Fetch(br *blobref.BlobRef) (blobref.ReadSeekCloser, int64, error) {
+	l, err := s.locate(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(s.packPath(l.pack))
+	if os.IsNotExist(err) {
+		// Compact moved it meanwhile.
+		if l, err = s.locate(br); err != nil {
+			return nil, 0, err
+		}
+		f, err = os.Open(s.packPath(l.pack))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return &packReader{io.NewSectionReader(f, l.offset, l.size), f}, l.size, nil
+}
+
+func (s *Storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	var buf bytes.Buffer
+	h := br.Hash()
+	if h == nil {
+		return blobref.SizedBlobRef{}, fmt.Errorf("packed: unsupported blobref %v", br)
+	}
+	n, err := io.Copy(io.MultiWriter(h, &buf), io.LimitReader(source, maxBlobSize+1))
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	if n > maxBlobSize {
+		return blobref.SizedBlobRef{}, fmt.Errorf("packed: blob %v bigger than %d bytes", br, maxBlobSize)
+	}
+	if !br.HashMatches(h) {
+		return blobref.SizedBlobRef{}, blobserver.ErrCorruptBlob
+	}
+
+	s.mu.Lock()
+	_, err = s.locate(br)
+	if err == os.ErrNotExist {
+		var l location
+		l, err = s.appendBlob(br, buf.Bytes())
+		if err == nil {
+			bm := s.index.BeginBatch()
+			indexLocation(bm, br, l)
+			err = s.index.CommitBatch(bm)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	s.GetBlobHub().NotifyBlobReceived(br)
+	return blobref.SizedBlobRef{BlobRef: br, Size: n}, nil
+}
+
+// appendBlob writes br to the current pack, returning where. The
+// caller indexes it.
+//
+// s.mu must be held.
+func (s *Storage) appendBlob(br *blobref.BlobRef, data []byte) (location, error) {
+	if s.cur != nil && s.curSize >= s.maxPackSize {
+		if err := s.sealCurrent(); err != nil {
+			return location{}, err
+		}
+	}
+	if s.cur == nil {
+		f, err := os.OpenFile(s.packPath(s.curPack), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return location{}, err
+		}
+		s.cur, s.curSize = f, 0
+	}
+	hdr := header(br, int64(len(data)))
+	rec := make([]byte, 0, len(hdr)+len(data))
+	rec = append(rec, hdr...)
+	rec = append(rec, data...)
+	if _, err := s.cur.Write(rec); err != nil {
+		// Don't leave a partial record that later appends would
+		// follow.
+		s.cur.Truncate(s.curSize)
+		s.cur.Seek(s.curSize, os.SEEK_SET)
+		return location{}, err
+	}
+	if err := s.cur.Sync(); err != nil {
+		return location{}, err
+	}
+	l := location{pack: s.curPack, offset: s.curSize + int64(len(hdr)), size: int64(len(data))}
+	s.curSize += int64(len(rec))
+	return l, nil
+}
+
+func indexLocation(bm index.BatchMutation, br *blobref.BlobRef, l location) {
+	bm.Set(blobKey(br), l.String())
+	bm.Set(packKey(l.pack, l.offset), br.String())
+}
+
+// sealCurrent closes the current pack; the next write starts a new one.
+//
+// s.mu must be held.
+func (s *Storage) sealCurrent() error {
+	if s.cur == nil {
+		return nil
+	}
+	err := s.cur.Close()
+	s.cur = nil
+	s.curPack++
+	return err
+}
+
+func (s *Storage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
+	for _, br := range blobs {
+		l, err := s.locate(br)
+		if err == os.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dest <- blobref.SizedBlobRef{BlobRef: br, Size: l.size}
+	}
+	return nil
+}
+
+func (s *Storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit int, wait time.Duration) error {
+	defer close(dest)
+	it := s.index.Find(keyBlob + after)
+	n := 0
+	for n < limit && it.Next() {
+		key := it.Key()
+		if !strings.HasPrefix(key, keyBlob) {
+			break
+		}
+		ref := key[len(keyBlob):]
+		if ref == after {
+			continue
+		}
+		br := blobref.Parse(ref)
+		l, err := parseLocation(it.Value())
+		if br == nil || err != nil {
+			it.Close()
+			return fmt.Errorf("packed: bad index row %q = %q", key, it.Value())
+		}
+		dest <- blobref.SizedBlobRef{BlobRef: br, Size: l.size}
+		n++
+	}
+	return it.Close()
+}
+
+// RemoveBlobs marks the blobs as removed. Their space is reclaimed
+// by Compact.
+func (s *Storage) RemoveBlobs(blobs []*blobref.BlobRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dead := make(map[int]int64)
+	bm := s.index.BeginBatch()
+	for _, br := range blobs {
+		l, err := s.locate(br)
+		if err == os.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		bm.Delete(blobKey(br))
+		bm.Delete(packKey(l.pack, l.offset))
+		dead[l.pack] += l.headerSize(br) + l.size
+	}
+	for pack, n := range dead {
+		cur, err := s.deadBytes(pack)
+		if err != nil {
+			return err
+		}
+		bm.Set(deadKey(pack), strconv.FormatInt(cur+n, 10))
+	}
+	return s.index.CommitBatch(bm)
+}
+
+// deadBytes returns the bytes of removed blobs in pack.
+func (s *Storage) deadBytes(pack int) (int64, error) {
+	v, err := s.index.Get(deadKey(pack))
+	if err == index.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// CompactStats is what Compact did.
+type CompactStats struct {
+	Packs        int   // pack files rewritten
+	Blobs        int   // live blobs copied
+	BytesFreed   int64 // disk space reclaimed
+	BytesCopied  int64
+	PacksSkipped int // packs left alone
+}
+
+// Compact rewrites the pack files holding removed blobs, copying their
+// live blobs to new packs, and deletes them. Packs smaller than a
+// quarter of the maximum pack size are rewritten too, merged with each
+// other, when that makes fewer packs. The pack being written to is
+// sealed first, so it is compacted too.
+//
+// Writes to the storage block while Compact runs; reads don't.
+func (s *Storage) Compact() (*CompactStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.sealCurrent(); err != nil {
+		return nil, err
+	}
+	packs, err := listPacks(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	stats := new(CompactStats)
+	var (
+		dirty, small []int // packs with removed blobs; small packs without
+		sizes        = make(map[int]int64)
+		live         int64 // bytes the rewritten packs keep
+		smallLive    int64
+	)
+	for _, pack := range packs {
+		fi, err := os.Stat(s.packPath(pack))
+		if err != nil {
+			return stats, err
+		}
+		dead, err := s.deadBytes(pack)
+		if err != nil {
+			return stats, err
+		}
+		sizes[pack] = fi.Size()
+		switch {
+		case dead > 0:
+			dirty = append(dirty, pack)
+			live += fi.Size() - dead
+		case fi.Size() < s.maxPackSize/4:
+			small = append(small, pack)
+			smallLive += fi.Size()
+		default:
+			stats.PacksSkipped++
+		}
+	}
+	// Rewriting the small packs only helps if their blobs fit in
+	// fewer packs than they take now.
+	packsOf := func(n int64) int { return int((n + s.maxPackSize - 1) / s.maxPackSize) }
+	if len(small) > 0 && packsOf(live+smallLive) < len(dirty)+len(small) {
+		dirty = append(dirty, small...)
+	} else {
+		stats.PacksSkipped += len(small)
+	}
+	sort.Ints(dirty)
+	for _, pack := range dirty {
+		copied, err := s.compactPack(pack, stats)
+		if err != nil {
+			return stats, fmt.Errorf("packed: error compacting %s: %v", packName(pack), err)
+		}
+		stats.Packs++
+		stats.BytesFreed += sizes[pack] - copied
+	}
+	return stats, nil
+}
+
+// compactPack copies the live blobs of pack to the current pack, then
+// deletes pack. It returns the bytes copied.
+//
+// s.mu must be held.
+func (s *Storage) compactPack(pack int, stats *CompactStats) (copied int64, err error) {
+	prefix := fmt.Sprintf("%s%08d|", keyPack, pack)
+	var live []*blobref.BlobRef
+	it := s.index.Find(prefix)
+	for it.Next() {
+		if !strings.HasPrefix(it.Key(), prefix) {
+			break
+		}
+		br := blobref.Parse(it.Value())
+		if br == nil {
+			it.Close()
+			return 0, fmt.Errorf("bad index row %q = %q", it.Key(), it.Value())
+		}
+		live = append(live, br)
+	}
+	if err := it.Close(); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(s.packPath(pack))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	for _, br := range live {
+		l, err := s.locate(br)
+		if err != nil {
+			return copied, err
+		}
+		data, err := ioutil.ReadAll(io.NewSectionReader(f, l.offset, l.size))
+		if err != nil {
+			return copied, err
+		}
+		h := br.Hash()
+		h.Write(data)
+		if !br.HashMatches(h) {
+			return copied, fmt.Errorf("blob %v is corrupt", br)
+		}
+		nl, err := s.appendBlob(br, data)
+		if err != nil {
+			return copied, err
+		}
+		bm := s.index.BeginBatch()
+		bm.Delete(packKey(l.pack, l.offset))
+		indexLocation(bm, br, nl)
+		if err := s.index.CommitBatch(bm); err != nil {
+			return copied, err
+		}
+		copied += l.headerSize(br) + l.size
+		stats.Blobs++
+		stats.BytesCopied += l.size
+	}
+	if err := os.Remove(s.packPath(pack)); err != nil {
+		return copied, err
+	}
+	return copied, s.index.Delete(deadKey(pack))
+}
+
+// Reindex rebuilds the index from the headers of the pack files, for
+// when it's lost or corrupt, and returns the number of blobs found. A
+// pack's scan stops at its first torn or corrupt record. The removed
+// blobs still in packs, not yet compacted away, come back.
+//
+// Writes to the storage block while Reindex runs.
+func (s *Storage) Reindex() (blobs int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.sealCurrent(); err != nil {
+		return 0, err
+	}
+	if err := s.clearIndex(); err != nil {
+		return 0, err
+	}
+	packs, err := listPacks(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, pack := range packs {
+		n, err := s.reindexPack(pack)
+		blobs += n
+		if err != nil {
+			return blobs, fmt.Errorf("packed: error reindexing %s: %v", packName(pack), err)
+		}
+	}
+	return blobs, nil
+}
+
+// clearIndex deletes all the rows of the index.
+//
+// s.mu must be held.
+func (s *Storage) clearIndex() error {
+	for {
+		var keys []string
+		it := s.index.Find("")
+		for len(keys) < 1000 && it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Close(); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		bm := s.index.BeginBatch()
+		for _, k := range keys {
+			bm.Delete(k)
+		}
+		if err := s.index.CommitBatch(bm); err != nil {
+			return err
+		}
+	}
+}
+
+// reindexPack indexes the blobs of pack from their headers, checking
+// their data.
+//
+// s.mu must be held.
+func (s *Storage) reindexPack(pack int) (blobs int, err error) {
+	f, err := os.Open(s.packPath(pack))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	bm := s.index.BeginBatch()
+	for {
+		br, size, n, err := readHeader(r)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			h := br.Hash()
+			_, err = io.CopyN(h, r, size)
+			if err == nil && !br.HashMatches(h) {
+				err = fmt.Errorf("blob %v is corrupt", br)
+			}
+		}
+		if err != nil {
+			log.Printf("packed: ignoring %s from offset %d: %v", packName(pack), offset, err)
+			break
+		}
+		l := location{pack: pack, offset: offset + n, size: size}
+		indexLocation(bm, br, l)
+		offset = l.offset + size
+		blobs++
+		if blobs%1000 == 0 {
+			if err := s.index.CommitBatch(bm); err != nil {
+				return blobs, err
+			}
+			bm = s.index.BeginBatch()
+		}
+	}
+	return blobs, s.index.CommitBatch(bm)
+}
+
+// readHeader reads a blob's header line, returning its blobref, the
+// size of its data and the size of the header. It returns io.EOF at
+// the end of the pack.
+func readHeader(r *bufio.Reader) (br *blobref.BlobRef, size, n int64, err error) {
+	line, err := r.ReadSlice('\n')
+	if err == io.EOF && len(line) == 0 {
+		return nil, 0, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("bad header %q: %v", line, err)
+	}
+	f := strings.Split(strings.TrimSuffix(string(line), "\n"), " ")
+	if len(f) == 3 && f[0] == "camlipack" {
+		br = blobref.Parse(f[1])
+		size, err = strconv.ParseInt(f[2], 10, 64)
+	}
+	if br == nil || err != nil || size < 0 || size > maxBlobSize || br.Hash() == nil {
+		return nil, 0, 0, fmt.Errorf("bad header %q", line)
+	}
+	return br, size, int64(len(line)), nil
+}
+
+// Close closes the pack being written to and the index, and unlocks
+// the directory.
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.sealCurrent()
+	if c, ok := s.index.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if s.lock != nil {
+		if lerr := s.lock.Close(); err == nil {
+			err = lerr
+		}
+		s.lock = nil
+	}
+	return err
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/test"
+)
+
+func newTestStorage(t *testing.T, maxPackSize int64) (s *Storage, dir string) {
+	dir, err := ioutil.TempDir("", "packed-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = New(dir, maxPackSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func testBlobs(n int) []*test.Blob {
+	var blobs []*test.Blob
+	for i := 0; i < n; i++ {
+		blobs = append(blobs, &test.Blob{Contents: fmt.Sprintf("blob number %d", i)})
+	}
+	return blobs
+}
+
+func enumerate(t *testing.T, s blobserver.Storage, after string, limit int) []string {
+	ch := make(chan blobref.SizedBlobRef)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- s.EnumerateBlobs(ch, after, limit, 0)
+	}()
+	var refs []string
+	for sb := range ch {
+		refs = append(refs, sb.BlobRef.String())
+	}
+	if err := <-errch; err != nil {
+		t.Fatalf("EnumerateBlobs: %v", err)
+	}
+	return refs
+}
+
+func fetchString(t *testing.T, s blobserver.Storage, br *blobref.BlobRef) string {
+	rc, _, err := s.FetchStreaming(br)
+	if err != nil {
+		t.Fatalf("Fetch(%v): %v", br, err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %v: %v", br, err)
+	}
+	return string(b)
+}
+
+func numPacks(t *testing.T, dir string) int {
+	packs, err := listPacks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(packs)
+}
+
+func TestPacked(t *testing.T) {
+	s, dir := newTestStorage(t, 100)
+	defer os.RemoveAll(dir)
+
+	blobs := testBlobs(10)
+	var refs []string
+	for _, b := range blobs {
+		sb, err := s.ReceiveBlob(b.BlobRef(), b.Reader())
+		if err != nil {
+			t.Fatalf("ReceiveBlob: %v", err)
+		}
+		b.AssertMatches(t, &sb)
+		refs = append(refs, b.BlobRef().String())
+	}
+	sort.Strings(refs)
+	// Receiving a blob again doesn't store it twice.
+	if _, err := s.ReceiveBlob(blobs[0].BlobRef(), blobs[0].Reader()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReceiveBlob(blobs[0].BlobRef(), strings.NewReader("corrupt")); err != blobserver.ErrCorruptBlob {
+		t.Errorf("ReceiveBlob of corrupt blob = %v; want ErrCorruptBlob", err)
+	}
+	if n := numPacks(t, dir); n < 2 {
+		t.Errorf("%d pack files; want several", n)
+	}
+
+	if got := enumerate(t, s, "", 100); !reflect.DeepEqual(got, refs) {
+		t.Errorf("enumerated %q; want %q", got, refs)
+	}
+	if got := enumerate(t, s, refs[3], 2); !reflect.DeepEqual(got, refs[4:6]) {
+		t.Errorf("enumerated after %s: %q; want %q", refs[3], got, refs[4:6])
+	}
+
+	rsc, size, err := s.Fetch(blobs[5].BlobRef())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != blobs[5].Size() {
+		t.Errorf("size = %d; want %d", size, blobs[5].Size())
+	}
+	if _, err := rsc.Seek(5, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(rsc); string(b) != blobs[5].Contents[5:] {
+		t.Errorf("read after seek %q; want %q", b, blobs[5].Contents[5:])
+	}
+	rsc.Close()
+
+	// Remove half the blobs, and compact.
+	var removed []*blobref.BlobRef
+	for i := 0; i < len(blobs); i += 2 {
+		removed = append(removed, blobs[i].BlobRef())
+	}
+	if err := s.RemoveBlobs(removed); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	ch := make(chan blobref.SizedBlobRef, len(blobs))
+	if err := s.StatBlobs(ch, []*blobref.BlobRef{blobs[0].BlobRef(), blobs[1].BlobRef()}, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	if sb, ok := <-ch; !ok || sb.BlobRef.String() != blobs[1].BlobRef().String() {
+		t.Errorf("StatBlobs returned %v; want only %v", sb, blobs[1].BlobRef())
+	}
+	if _, ok := <-ch; ok {
+		t.Errorf("StatBlobs returned a removed blob")
+	}
+
+	stats, err := s.Compact()
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if stats.Blobs != 5 || stats.BytesFreed <= 0 {
+		t.Errorf("Compact stats = %+v; want 5 blobs copied and bytes freed", stats)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything left survives reopening.
+	s, err = New(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := enumerate(t, s, "", 100); len(got) != 5 {
+		t.Errorf("after compaction, enumerated %q; want 5 blobs", got)
+	}
+	for i, b := range blobs {
+		if i%2 == 0 {
+			if _, _, err := s.FetchStreaming(b.BlobRef()); err != os.ErrNotExist {
+				t.Errorf("Fetch of removed blob %d = %v; want ErrNotExist", i, err)
+			}
+			continue
+		}
+		if got := fetchString(t, s, b.BlobRef()); got != b.Contents {
+			t.Errorf("blob %d = %q; want %q", i, got, b.Contents)
+		}
+	}
+}
+
+func TestCompactSmallPacks(t *testing.T) {
+	s, dir := newTestStorage(t, 1000)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	compact := func(wantPacks, wantFiles int) {
+		stats, err := s.Compact()
+		if err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+		if stats.Packs != wantPacks {
+			t.Errorf("Compact rewrote %d packs; want %d", stats.Packs, wantPacks)
+		}
+		if n := numPacks(t, dir); n != wantFiles {
+			t.Errorf("%d pack files after compaction; want %d", n, wantFiles)
+		}
+	}
+	blobs := testBlobs(2)
+	if _, err := s.ReceiveBlob(blobs[0].BlobRef(), blobs[0].Reader()); err != nil {
+		t.Fatal(err)
+	}
+	// A lone small pack is left alone, every time.
+	compact(0, 1)
+	compact(0, 1)
+
+	// Two are merged, once.
+	if _, err := s.ReceiveBlob(blobs[1].BlobRef(), blobs[1].Reader()); err != nil {
+		t.Fatal(err)
+	}
+	compact(2, 1)
+	compact(0, 1)
+	for _, b := range blobs {
+		if got := fetchString(t, s, b.BlobRef()); got != b.Contents {
+			t.Errorf("blob = %q; want %q", got, b.Contents)
+		}
+	}
+}
+
+func TestLocked(t *testing.T) {
+	s, dir := newTestStorage(t, 100)
+	defer os.RemoveAll(dir)
+	if _, err := New(dir, 100); err == nil {
+		t.Fatal("second New on an open directory succeeded")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(dir, 100)
+	if err != nil {
+		t.Fatalf("New after Close: %v", err)
+	}
+	s.Close()
+}
+
+func TestRecoverIndex(t *testing.T) {
+	s, dir := newTestStorage(t, 100)
+	defer os.RemoveAll(dir)
+
+	blobs := testBlobs(10)
+	var refs []string
+	for _, b := range blobs {
+		if _, err := s.ReceiveBlob(b.BlobRef(), b.Reader()); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, b.BlobRef().String())
+	}
+	sort.Strings(refs)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the index, and tear the tail of the last pack.
+	if err := os.RemoveAll(filepath.Join(dir, "index")); err != nil {
+		t.Fatal(err)
+	}
+	packs, err := listPacks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, packName(packs[len(packs)-1])), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(f, "camlipack %s 100\ntorn", blobs[0].BlobRef())
+	f.Close()
+
+	s, err = New(dir, 100)
+	if err != nil {
+		t.Fatalf("reopening without an index: %v", err)
+	}
+	defer s.Close()
+	check := func() {
+		if got := enumerate(t, s, "", 100); !reflect.DeepEqual(got, refs) {
+			t.Errorf("enumerated %q; want %q", got, refs)
+		}
+		for _, b := range blobs {
+			if got := fetchString(t, s, b.BlobRef()); got != b.Contents {
+				t.Errorf("blob = %q; want %q", got, b.Contents)
+			}
+		}
+	}
+	check()
+
+	// An explicit reindex replaces the index rows, and compaction
+	// still works afterwards.
+	if n, err := s.Reindex(); err != nil || n != len(blobs) {
+		t.Errorf("Reindex = %d, %v; want %d blobs", n, err, len(blobs))
+	}
+	check()
+	if err := s.RemoveBlobs([]*blobref.BlobRef{blobs[0].BlobRef()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if got := enumerate(t, s, "", 100); len(got) != len(blobs)-1 {
+		t.Errorf("after compaction, enumerated %q; want %d blobs", got, len(blobs)-1)
+	}
+}
+
+func TestPackedConformance(t *testing.T) {
+	test.RunStorageTests(t, func(t *testing.T) (blobserver.Storage, func()) {
+		s, dir := newTestStorage(t, 10)
+		return s, func() { os.RemoveAll(dir) }
+	})
+}
@@ -36,7 +36,10 @@ type remoteStorage struct {
 var _ = blobserver.Storage((*remoteStorage)(nil))
 
 func NewFromClient(c *client.Client) blobserver.Storage {
-	return &remoteStorage{client: c}
+	return &remoteStorage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		client:                    c,
+	}
 }
 
 func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err error) {
@@ -52,7 +55,8 @@ func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserv
 		return nil, err
 	}
 	sto := &remoteStorage{
-		client: client,
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		client:                    client,
 	}
 	if !skipStartupCheck {
 		// TODO: do a server stat or something to check password
@@ -83,6 +87,7 @@ func (sto *remoteStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (
 		outerr = err
 		return
 	}
+	sto.GetBlobHub().NotifyBlobReceived(blob)
 	return pr.SizedBlobRef(), nil
 }
 
@@ -0,0 +1,82 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remote
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/handlers"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/test"
+)
+
+type configuredStorage struct {
+	blobserver.Storage
+	config *blobserver.Config
+}
+
+func (s *configuredStorage) Config() *blobserver.Config {
+	return s.config
+}
+
+// newTestRemote returns a remote storage talking to a local
+// blobserver, itself backed by a localdisk storage.
+func newTestRemote(t *testing.T) (blobserver.Storage, func()) {
+	dir, err := ioutil.TempDir("", "camli-remote-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := localdisk.New(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	sto := &configuredStorage{
+		Storage: ds,
+		config:  &blobserver.Config{Writable: true, Readable: true, IsQueue: true},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/camli/enumerate-blobs", handlers.CreateEnumerateHandler(sto))
+	mux.HandleFunc("/camli/stat", handlers.CreateStatHandler(sto))
+	mux.HandleFunc("/camli/upload", handlers.CreateUploadHandler(sto))
+	mux.HandleFunc("/camli/remove", handlers.CreateRemoveHandler(sto))
+	mux.Handle("/camli/", &handlers.GetHandler{Fetcher: sto, AllowGlobalAccess: true})
+	ts := httptest.NewServer(mux)
+	sto.config.URLBase = ts.URL
+
+	c := client.New(ts.URL)
+	c.SetLogger(nil)
+	if err := c.SetupAuthFromConfig(jsonconfig.Obj{"auth": "none"}); err != nil {
+		t.Fatal(err)
+	}
+	return NewFromClient(c), func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	test.RunStorageTests(t, newTestRemote)
+}
@@ -14,15 +14,55 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+/*
+Package replica registers the "replica" blobserver storage type,
+providing synchronous replication to one or more backends.
+
+Reads are spread over the backends at random, in proportion to their
+read weight (1 by default; 0 to never read from a backend). Backends
+failing are backed off from, and tried last until they recover. With
+"readRepair", a blob only found on a later backend is written back to
+the backends that missed it. It's off by default, as backends such as
+indexes can't be read from, and would be written every blob read.
+
+A write succeeds once "minWritesForSuccess" backends (all of them by
+default) have the blob, including every backend listed in
+"requiredBackends".
+
+Example low-level config:
+
+	"/repl/": {
+	    "handler": "storage-replica",
+	    "handlerArgs": {
+	        "backends": ["/b1/", "/b2/", "/b3/"],
+	        "minWritesForSuccess": 2,
+	        "requiredBackends": ["/b1/"],
+	        "readWeights": {"/b1/": 3, "/b2/": 1, "/b3/": 0},
+	        "readRepair": true
+	    }
+	},
+
+The "replica-status" handler shows the health of each backend:
+
+	"/repl-status/": {
+	    "handler": "replica-status",
+	    "handlerArgs": {
+	        "storage": "/repl/"
+	    }
+	},
+*/
 package replica
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"os"
 	"time"
 
 	"camlistore.org/pkg/blobref"
@@ -39,11 +79,22 @@ type replicaStorage struct {
 
 	replicaPrefixes []string
 	replicas        []blobserver.Storage
+	readWeights     []int
+	health          []*health // shared by the context-wrapped copies
+
+	// Whether blobs missing from some replicas are written back
+	// to them when read.
+	readRepair bool
 
 	// Minimum number of writes that must succeed before
 	// acknowledging success to the client.
 	minWritesForSuccess int
 
+	// Whether each replica's write must succeed, whatever
+	// minWritesForSuccess, and the number of such replicas.
+	required  []bool
+	nRequired int
+
 	ctx *http.Request // optional per-request context
 }
 
@@ -78,6 +129,19 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobser
 	sto.replicaPrefixes = config.RequiredList("backends")
 	nReplicas := len(sto.replicaPrefixes)
 	sto.minWritesForSuccess = config.OptionalInt("minWritesForSuccess", nReplicas)
+	sto.readRepair = config.OptionalBool("readRepair", false)
+	requiredPrefixes := config.OptionalList("requiredBackends")
+	weights := config.OptionalObject("readWeights")
+	sto.readWeights = make([]int, nReplicas)
+	for i, prefix := range sto.replicaPrefixes {
+		sto.readWeights[i] = weights.OptionalInt(prefix, 1)
+		if sto.readWeights[i] < 0 {
+			return nil, fmt.Errorf("replica: negative read weight for %s", prefix)
+		}
+	}
+	if err := weights.Validate(); err != nil {
+		return nil, err
+	}
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -87,32 +151,122 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobser
 	if sto.minWritesForSuccess == 0 {
 		sto.minWritesForSuccess = nReplicas
 	}
+	sto.required = make([]bool, nReplicas)
+	for _, required := range requiredPrefixes {
+		found := false
+		for i, prefix := range sto.replicaPrefixes {
+			if prefix == required && !sto.required[i] {
+				sto.required[i] = true
+				sto.nRequired++
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("replica: required backend %s isn't a backend", required)
+		}
+	}
 	sto.replicas = make([]blobserver.Storage, nReplicas)
+	sto.health = make([]*health, nReplicas)
 	for i, prefix := range sto.replicaPrefixes {
 		replicaSto, err := ld.GetStorage(prefix)
 		if err != nil {
 			return nil, err
 		}
 		sto.replicas[i] = replicaSto
+		sto.health[i] = new(health)
 	}
 	return sto, nil
 }
 
-func (sto *replicaStorage) weightedRandomReplicas() []blobserver.Storage {
-	// TODO: implement something actually weighted or random.
-	return sto.replicas
+// weightedRandomReplicas returns the indexes of the replicas to read
+// from, in the order to try them: the healthy ones in a random order
+// weighted by their read weight, then the backed off ones. Replicas
+// with a zero weight aren't read from.
+func (sto *replicaStorage) weightedRandomReplicas() []int {
+	var healthy, down []int
+	total := 0
+	now := time.Now()
+	for i, w := range sto.readWeights {
+		switch {
+		case w == 0:
+		case sto.health[i].isDown(now):
+			down = append(down, i)
+		default:
+			healthy = append(healthy, i)
+			total += w
+		}
+	}
+	order := make([]int, 0, len(healthy)+len(down))
+	for len(healthy) > 0 {
+		n := rand.Intn(total)
+		for j, i := range healthy {
+			if n -= sto.readWeights[i]; n < 0 {
+				order = append(order, i)
+				total -= sto.readWeights[i]
+				healthy = append(healthy[:j], healthy[j+1:]...)
+				break
+			}
+		}
+	}
+	return append(order, down...)
 }
 
 func (sto *replicaStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err error) {
-	for _, replica := range sto.weightedRandomReplicas() {
-		file, size, err = replica.FetchStreaming(b)
-		if err == nil {
-			return
+	replicas := sto.wrappedReplicas()
+	var missed []int // replicas not having b
+	for _, i := range sto.weightedRandomReplicas() {
+		start := time.Now()
+		file, size, err = replicas[i].FetchStreaming(b)
+		switch {
+		case err == nil:
+			sto.health[i].record(time.Since(start), nil)
+			if len(missed) == 0 || !sto.readRepair {
+				return
+			}
+			return sto.repair(b, file, missed)
+		case err == os.ErrNotExist:
+			sto.health[i].record(time.Since(start), nil)
+			missed = append(missed, i)
+		default:
+			sto.health[i].record(time.Since(start), err)
 		}
 	}
+	if err == nil {
+		err = os.ErrNotExist
+	}
 	return
 }
 
+// repair reads b from file, writes it in the background to the missed
+// replicas, and returns its contents.
+func (sto *replicaStorage) repair(b *blobref.BlobRef, file io.ReadCloser, missed []int) (io.ReadCloser, int64, error) {
+	defer file.Close()
+	var buf bytes.Buffer
+	h := b.Hash()
+	if h == nil {
+		return nil, 0, fmt.Errorf("replica: unsupported digest of %v", b)
+	}
+	if _, err := io.Copy(io.MultiWriter(&buf, h), file); err != nil {
+		return nil, 0, err
+	}
+	if !b.HashMatches(h) {
+		return nil, 0, blobserver.ErrCorruptBlob
+	}
+	contents := buf.Bytes()
+	replicas := sto.wrappedReplicas()
+	for _, i := range missed {
+		go func(i int) {
+			if _, err := replicas[i].ReceiveBlob(b, bytes.NewReader(contents)); err != nil {
+				log.Printf("replica: read repair of %v to %s: %v", b, sto.replicaPrefixes[i], err)
+				sto.health[i].record(0, err)
+				return
+			}
+			sto.health[i].repaired()
+		}(i)
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), nil
+}
+
 func (sto *replicaStorage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
 	if wait > 0 {
 		// TODO: handle wait in-memory, waiting on the blobhub, not going
@@ -165,6 +319,7 @@ func (sto *replicaStorage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*
 }
 
 type sizedBlobAndError struct {
+	idx int
 	sb  blobref.SizedBlobRef
 	err error
 }
@@ -182,16 +337,17 @@ func (sto *replicaStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (xx
 		// like &MoveOrDieWriter{Writer: wpipe[idx], HeartbeatSec: 10}
 	}
 	upResult := make(chan sizedBlobAndError, nReplicas)
-	uploadToReplica := func(source io.Reader, s blobserver.Storage) {
-		s = blobserver.MaybeWrapContext(s, sto.ctx)
+	uploadToReplica := func(idx int, source io.Reader, s blobserver.Storage) {
+		start := time.Now()
 		sb, err := s.ReceiveBlob(b, source)
+		sto.health[idx].record(time.Since(start), err)
 		if err != nil {
 			io.Copy(ioutil.Discard, source)
 		}
-		upResult <- sizedBlobAndError{sb, err}
+		upResult <- sizedBlobAndError{idx, sb, err}
 	}
 	for idx, replica := range sto.wrappedReplicas() {
-		go uploadToReplica(rpipe[idx], replica)
+		go uploadToReplica(idx, rpipe[idx], replica)
 	}
 	size, err := io.Copy(io.MultiWriter(writer...), source)
 	if err != nil {
@@ -200,13 +356,16 @@ func (sto *replicaStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (xx
 	for idx := range sto.replicas {
 		wpipe[idx].Close()
 	}
-	nSuccess, nFailures := 0, 0
+	nSuccess, nFailures, nRequired := 0, 0, 0
 	for _ = range sto.replicas {
 		res := <-upResult
 		switch {
 		case res.err == nil && res.sb.Size == size:
 			nSuccess++
-			if nSuccess == sto.minWritesForSuccess {
+			if sto.required[res.idx] {
+				nRequired++
+			}
+			if nSuccess >= sto.minWritesForSuccess && nRequired == sto.nRequired {
 				sto.GetBlobHub().NotifyBlobReceived(b)
 				return res.sb, nil
 			}
@@ -222,6 +381,9 @@ func (sto *replicaStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (xx
 		log.Printf("replica: receiving blob, %d successes, %d failures; last error = %v",
 			nSuccess, nFailures, err)
 	}
+	if err == nil {
+		err = fmt.Errorf("replica: only %d of the %d writes needed succeeded", nSuccess, sto.minWritesForSuccess)
+	}
 	return
 }
 
@@ -236,7 +398,7 @@ func (sto *replicaStorage) RemoveBlobs(blobs []*blobref.BlobRef) error {
 	}
 	var reterr error
 	nSuccess := 0
-	for _ = range errch {
+	for _ = range sto.replicas {
 		if err := <-errch; err != nil {
 			reterr = err
 		} else {
@@ -0,0 +1,196 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replica
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/test"
+)
+
+// flakyStorage is a localdisk storage whose fetches fail when broken,
+// and whose writes fail when brokenWrites.
+type flakyStorage struct {
+	*localdisk.DiskStorage
+	broken       bool
+	brokenWrites bool
+}
+
+func (s *flakyStorage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	if s.brokenWrites {
+		return blobref.SizedBlobRef{}, errors.New("broken")
+	}
+	return s.DiskStorage.ReceiveBlob(br, source)
+}
+
+func (s *flakyStorage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error) {
+	if s.broken {
+		return nil, 0, errors.New("broken")
+	}
+	return s.DiskStorage.FetchStreaming(br)
+}
+
+func newTestReplica(t *testing.T, weights ...int) (*replicaStorage, []*flakyStorage, func()) {
+	sto := &replicaStorage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		readWeights:               weights,
+		readRepair:                true,
+		minWritesForSuccess:       len(weights),
+	}
+	var dirs []string
+	var backends []*flakyStorage
+	for i := range weights {
+		dir, err := ioutil.TempDir("", "replica-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+		ds, err := localdisk.New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, &flakyStorage{DiskStorage: ds})
+		sto.replicaPrefixes = append(sto.replicaPrefixes, fmt.Sprintf("/r%d/", i+1))
+		sto.replicas = append(sto.replicas, backends[i])
+		sto.health = append(sto.health, new(health))
+		sto.required = append(sto.required, false)
+	}
+	return sto, backends, func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func requests(h *health) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+func TestWeightedReads(t *testing.T) {
+	sto, _, cleanup := newTestReplica(t, 3, 1, 0)
+	defer cleanup()
+	first := make(map[int]int)
+	const n = 1000
+	for i := 0; i < n; i++ {
+		order := sto.weightedRandomReplicas()
+		if len(order) != 2 {
+			t.Fatalf("read order %v; want the 2 replicas with a non-zero weight", order)
+		}
+		first[order[0]]++
+	}
+	if first[0] < n*6/10 || first[0] > n*9/10 {
+		t.Errorf("replica of weight 3 read first %d times out of %d; want about 3/4", first[0], n)
+	}
+}
+
+func TestReadRepairAndBackoff(t *testing.T) {
+	sto, backends, cleanup := newTestReplica(t, 1, 1, 1)
+	defer cleanup()
+	b := &test.Blob{Contents: "only on the second replica"}
+	if _, err := backends[1].ReceiveBlob(b.BlobRef(), b.Reader()); err != nil {
+		t.Fatal(err)
+	}
+	backends[2].broken = true
+
+	rc, size, err := sto.FetchStreaming(b.BlobRef())
+	if err != nil {
+		t.Fatalf("FetchStreaming: %v", err)
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(got) != b.Contents || size != b.Size() {
+		t.Errorf("fetched %q (size %d); want %q", got, size, b.Contents)
+	}
+
+	// Unless the second replica was read first, the first was
+	// repaired in the background.
+	if requests(sto.health[0]) > 0 && requests(sto.health[1]) > 0 {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, _, err := backends[0].DiskStorage.FetchStreaming(b.BlobRef()); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("first replica not read-repaired")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The broken replica is tried last once it failed.
+	for i := 0; i < 100 && !sto.health[2].isDown(time.Now()); i++ {
+		if _, _, err := sto.FetchStreaming(b.BlobRef()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if order := sto.weightedRandomReplicas(); order[len(order)-1] != 2 {
+		t.Errorf("read order %v; want the broken replica last", order)
+	}
+	if !sto.health[2].isDown(time.Now()) {
+		t.Errorf("broken replica isn't backed off from")
+	}
+}
+
+func TestRequiredBackend(t *testing.T) {
+	sto, backends, cleanup := newTestReplica(t, 1, 1, 1, 1)
+	defer cleanup()
+	// As genconfig does for localdisk and three remotes.
+	sto.minWritesForSuccess = 3
+	sto.required[0], sto.nRequired = true, 1
+
+	blobs := []*test.Blob{{Contents: "one"}, {Contents: "two"}, {Contents: "three"}}
+	receive := func(b *test.Blob) error {
+		_, err := sto.ReceiveBlob(b.BlobRef(), b.Reader())
+		return err
+	}
+
+	// A write failing on localdisk fails, though a majority of the
+	// others succeeded.
+	backends[0].brokenWrites = true
+	if err := receive(blobs[0]); err == nil {
+		t.Errorf("ReceiveBlob succeeded with the required backend failing")
+	}
+	backends[0].brokenWrites = false
+
+	// Writes succeed without one remote, but not two.
+	backends[3].brokenWrites = true
+	if err := receive(blobs[1]); err != nil {
+		t.Errorf("ReceiveBlob with one remote failing: %v", err)
+	}
+	backends[2].brokenWrites = true
+	if err := receive(blobs[2]); err == nil {
+		t.Errorf("ReceiveBlob succeeded with two remotes failing")
+	}
+}
+
+func TestReplicaConformance(t *testing.T) {
+	test.RunStorageTests(t, func(t *testing.T) (blobserver.Storage, func()) {
+		sto, _, cleanup := newTestReplica(t, 1, 1)
+		return sto, cleanup
+	})
+}
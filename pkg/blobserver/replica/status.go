@@ -0,0 +1,138 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replica
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// health tracks the requests to a replica, to back off from it while
+// it's failing and to show on the status page.
+type health struct {
+	mu           sync.Mutex
+	requests     int64
+	errors       int64
+	repairs      int64 // blobs written back by read repair
+	totalLatency time.Duration
+	lastErr      error
+	lastErrTime  time.Time
+
+	// backoff is how long the replica is considered down after
+	// its next error; it doubles with each consecutive error.
+	backoff   time.Duration
+	downUntil time.Time
+}
+
+func (h *health) record(latency time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests++
+	h.totalLatency += latency
+	if err == nil {
+		h.backoff = 0
+		h.downUntil = time.Time{}
+		return
+	}
+	h.errors++
+	h.lastErr, h.lastErrTime = err, time.Now()
+	switch {
+	case h.backoff == 0:
+		h.backoff = minBackoff
+	case h.backoff < maxBackoff:
+		h.backoff *= 2
+		if h.backoff > maxBackoff {
+			h.backoff = maxBackoff
+		}
+	}
+	h.downUntil = h.lastErrTime.Add(h.backoff)
+}
+
+func (h *health) repaired() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.repairs++
+}
+
+// isDown reports whether the replica is being backed off from at now.
+func (h *health) isDown(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return now.Before(h.downUntil)
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("replica-status", newStatusFromConfig)
+}
+
+type statusHandler struct {
+	name string
+	sto  *replicaStorage
+}
+
+func newStatusFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	name := conf.RequiredString("storage")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	sto, err := ld.GetStorage(name)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := sto.(*replicaStorage)
+	if !ok {
+		return nil, fmt.Errorf("Prefix %s (type %T) is not a replica storage", name, sto)
+	}
+	return &statusHandler{name, rs}, nil
+}
+
+func (sh *statusHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(rw, "<h1>%s Replica Status</h1>", html.EscapeString(sh.name))
+	fmt.Fprintf(rw, "<table border='1' cellpadding='3'><tr><th>Backend</th><th>Read weight</th>"+
+		"<th>Requests</th><th>Errors</th><th>Mean latency</th><th>Read repairs</th><th>Status</th></tr>")
+	now := time.Now()
+	for i, h := range sh.sto.health {
+		h.mu.Lock()
+		var latency time.Duration
+		if h.requests > 0 {
+			latency = h.totalLatency / time.Duration(h.requests)
+		}
+		status := "ok"
+		if now.Before(h.downUntil) {
+			status = fmt.Sprintf("backed off until %s", h.downUntil.UTC().Format(time.RFC3339))
+		}
+		if h.lastErr != nil {
+			status += fmt.Sprintf("; last error at %s: %v", h.lastErrTime.UTC().Format(time.RFC3339), h.lastErr)
+		}
+		fmt.Fprintf(rw, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%v</td><td>%d</td><td>%s</td></tr>\n",
+			html.EscapeString(sh.sto.replicaPrefixes[i]), sh.sto.readWeights[i],
+			h.requests, h.errors, latency, h.repairs, html.EscapeString(status))
+		h.mu.Unlock()
+	}
+	fmt.Fprintf(rw, "</table>")
+}
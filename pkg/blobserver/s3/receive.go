@@ -117,5 +117,6 @@ func (sto *s3Storage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (outs
 	if err != nil {
 		return zero, err
 	}
+	sto.GetBlobHub().NotifyBlobReceived(blob)
 	return blobref.SizedBlobRef{BlobRef: blob, Size: size}, nil
 }
@@ -0,0 +1,139 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/misc/amazon/s3"
+	"camlistore.org/pkg/test"
+)
+
+// fakeS3 is an http.RoundTripper answering, from memory, the
+// requests of the S3 client.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte // "bucket/key" -> contents
+}
+
+func response(req *http.Request, code int, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    code,
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Header:        http.Header{"Content-Length": {strconv.Itoa(len(body))}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func (f *fakeS3) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if !strings.HasSuffix(req.URL.Host, ".s3.amazonaws.com") {
+		return response(req, http.StatusBadRequest, nil), nil
+	}
+	bucket := strings.TrimSuffix(req.URL.Host, ".s3.amazonaws.com")
+	key := strings.TrimPrefix(req.URL.Path, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case req.Method == "GET" && key == "":
+		return f.list(req, bucket)
+	case req.Method == "GET" || req.Method == "HEAD":
+		b, ok := f.objects[bucket+"/"+key]
+		if !ok {
+			return response(req, http.StatusNotFound, nil), nil
+		}
+		res := response(req, http.StatusOK, b)
+		if req.Method == "HEAD" {
+			res.Body = ioutil.NopCloser(strings.NewReader(""))
+		}
+		return res, nil
+	case req.Method == "PUT":
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		f.objects[bucket+"/"+key] = b
+		return response(req, http.StatusOK, nil), nil
+	case req.Method == "DELETE":
+		delete(f.objects, bucket+"/"+key)
+		return response(req, http.StatusNoContent, nil), nil
+	}
+	return response(req, http.StatusMethodNotAllowed, nil), nil
+}
+
+func (f *fakeS3) list(req *http.Request, bucket string) (*http.Response, error) {
+	marker := req.URL.Query().Get("marker")
+	maxKeys, err := strconv.Atoi(req.URL.Query().Get("max-keys"))
+	if err != nil {
+		return response(req, http.StatusBadRequest, nil), nil
+	}
+	var keys []string
+	for name := range f.objects {
+		if key := strings.TrimPrefix(name, bucket+"/"); key != name && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+	}
+	type item struct {
+		Key  string
+		Size int
+	}
+	res := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []item
+	}{}
+	for _, key := range keys {
+		res.Contents = append(res.Contents, item{key, len(f.objects[bucket+"/"+key])})
+	}
+	b, err := xml.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return response(req, http.StatusOK, b), nil
+}
+
+func TestS3(t *testing.T) {
+	test.RunStorageTests(t, func(t *testing.T) (blobserver.Storage, func()) {
+		client := &s3.Client{
+			Auth:       &s3.Auth{AccessKey: "key", SecretAccessKey: "secret"},
+			HttpClient: &http.Client{Transport: &fakeS3{objects: make(map[string][]byte)}},
+		}
+		return &s3Storage{
+			SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+			s3Client:                  client,
+			bucket:                    "camlistore-test",
+		}, nil
+	})
+}
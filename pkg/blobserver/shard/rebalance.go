@@ -0,0 +1,208 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// rebalanceBatch is how many blobs of a shard are enumerated at once
+// while rebalancing.
+const rebalanceBatch = 1000
+
+// RebalanceStats are the counts of a rebalancing.
+type RebalanceStats struct {
+	Blobs  int64 // blobs enumerated, including the ones moved to a shard not yet enumerated
+	Moved  int64
+	Bytes  int64 // bytes moved
+	Errors int64
+}
+
+// rebalance moves the blobs of each shard that belong to another
+// shard to that shard. Errors moving a blob are logged and counted,
+// and the blob is left where it is. Without errors, the rebalance is
+// no longer pending.
+func (sto *shardStorage) rebalance(progress func(RebalanceStats)) (RebalanceStats, error) {
+	var st RebalanceStats
+	for sn, s := range sto.shards {
+		after := ""
+		for {
+			ch := make(chan blobref.SizedBlobRef, rebalanceBatch)
+			errch := make(chan error, 1)
+			go func(after string) {
+				errch <- s.EnumerateBlobs(ch, after, rebalanceBatch, 0)
+			}(after)
+			var sbs []blobref.SizedBlobRef
+			for sb := range ch {
+				sbs = append(sbs, sb)
+			}
+			if err := <-errch; err != nil {
+				return st, fmt.Errorf("shard: error enumerating %s: %v", sto.shardPrefixes[sn], err)
+			}
+			if len(sbs) == 0 {
+				break
+			}
+			for _, sb := range sbs {
+				st.Blobs++
+				if dst := int(sto.shardNum(sb.BlobRef)); dst != sn {
+					if err := sto.move(sb.BlobRef, sn, dst); err != nil {
+						log.Printf("shard: error moving %v from %s to %s: %v",
+							sb.BlobRef, sto.shardPrefixes[sn], sto.shardPrefixes[dst], err)
+						st.Errors++
+					} else {
+						st.Moved++
+						st.Bytes += sb.Size
+					}
+				}
+				if progress != nil {
+					progress(st)
+				}
+			}
+			after = sbs[len(sbs)-1].BlobRef.String()
+		}
+	}
+	if st.Errors == 0 {
+		sto.rebalanceMu.Lock()
+		sto.pending = false
+		sto.rebalanceMu.Unlock()
+	}
+	return st, nil
+}
+
+// move copies b from shard src to shard dst, then removes it from src.
+func (sto *shardStorage) move(b *blobref.BlobRef, src, dst int) error {
+	rc, _, err := sto.shards[src].FetchStreaming(b)
+	if err != nil {
+		return err
+	}
+	_, err = sto.shards[dst].ReceiveBlob(b, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	return sto.shards[src].RemoveBlobs([]*blobref.BlobRef{b})
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("shard-rebalance", newRebalanceFromConfig)
+}
+
+// rebalanceHandler shows the progress of the rebalancing of a shard
+// storage, and starts it on POST.
+type rebalanceHandler struct {
+	name string
+	sto  *shardStorage
+}
+
+func newRebalanceFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	name := conf.RequiredString("storage")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	sto, err := ld.GetStorage(name)
+	if err != nil {
+		return nil, err
+	}
+	ss, ok := sto.(*shardStorage)
+	if !ok {
+		return nil, fmt.Errorf("Prefix %s (type %T) is not a shard storage", name, sto)
+	}
+	ss.rebStatus = "not started"
+	// The handler is there because the blobs may have to be moved.
+	ss.pending = true
+	return &rebalanceHandler{name, ss}, nil
+}
+
+func (rh *rebalanceHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	sto := rh.sto
+	if req.Method == "POST" {
+		if req.FormValue("mode") != "rebalance" {
+			http.Error(rw, "unsupported POST mode", http.StatusBadRequest)
+			return
+		}
+		if err := sto.startRebalance(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(rw, req, req.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	sto.rebalanceMu.Lock()
+	defer sto.rebalanceMu.Unlock()
+	fmt.Fprintf(rw, "<h1>%s Rebalance</h1><p><b>Current status: </b>%s</p>",
+		html.EscapeString(rh.name), html.EscapeString(sto.rebStatus))
+	fmt.Fprintf(rw, "<h2>Stats:</h2><ul>")
+	fmt.Fprintf(rw, "<li>Blobs checked: %d</li>", sto.rebStats.Blobs)
+	fmt.Fprintf(rw, "<li>Blobs moved: %d</li>", sto.rebStats.Moved)
+	fmt.Fprintf(rw, "<li>Bytes moved: %d</li>", sto.rebStats.Bytes)
+	fmt.Fprintf(rw, "<li>Errors: %d</li>", sto.rebStats.Errors)
+	fmt.Fprintf(rw, "</ul>")
+	if !sto.rebalancing {
+		fmt.Fprintf(rw, "<form method='post'><input type='hidden' name='mode' value='rebalance'>"+
+			"<input type='submit' value='Move the blobs of %s to their shard'></form>",
+			html.EscapeString(rh.name))
+	}
+}
+
+func (sto *shardStorage) setRebalanceStatus(s string, args ...interface{}) {
+	s = time.Now().UTC().Format(time.RFC3339) + ": " + fmt.Sprintf(s, args...)
+	sto.rebalanceMu.Lock()
+	defer sto.rebalanceMu.Unlock()
+	sto.rebStatus = s
+}
+
+func (sto *shardStorage) startRebalance() error {
+	sto.rebalanceMu.Lock()
+	defer sto.rebalanceMu.Unlock()
+	if sto.rebalancing {
+		return errors.New("Rebalance already in progress")
+	}
+	sto.rebalancing = true
+	sto.rebStats = RebalanceStats{}
+	go sto.runRebalance()
+	return nil
+}
+
+func (sto *shardStorage) runRebalance() {
+	defer func() {
+		sto.rebalanceMu.Lock()
+		defer sto.rebalanceMu.Unlock()
+		sto.rebalancing = false
+	}()
+	sto.setRebalanceStatus("Rebalancing")
+	st, err := sto.rebalance(func(st RebalanceStats) {
+		sto.rebalanceMu.Lock()
+		defer sto.rebalanceMu.Unlock()
+		sto.rebStats = st
+	})
+	if err != nil {
+		log.Printf("shard: rebalance failed: %v", err)
+		sto.setRebalanceStatus("Rebalance failed: %v", err)
+		return
+	}
+	sto.setRebalanceStatus("Rebalance done; %d blobs moved, %d errors", st.Moved, st.Errors)
+}
@@ -14,11 +14,52 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+/*
+Package shard registers the "shard" blobserver storage type, spreading
+blobs over several backends.
+
+In the default "modulo" mode, a blob goes to the backend numbered its
+hash modulo the number of backends, so adding a backend moves almost
+every blob. In the "rendezvous" mode, each blob goes to the backend
+with the highest weighted score for it (weighted rendezvous hashing),
+so adding a backend only moves the blobs it now wins, in proportion to
+its weight, and a backend of weight 0 receives no blobs.
+
+The mode or the backends can be changed while the blobs in their old
+location are moved by the "shard-rebalance" handler. While a storage
+has such a handler, the blobs not found on their backend are looked for
+on the other ones, until a rebalance moved every blob to its backend.
+
+Example low-level config:
+
+	"/sharded/": {
+	    "handler": "storage-shard",
+	    "handlerArgs": {
+	        "backends": ["/s1/", "/s2/", "/s3/"],
+	        "mode": "rendezvous",
+	        "weights": {"/s1/": 2, "/s2/": 1, "/s3/": 1}
+	    }
+	},
+
+	"/sharded-rebalance/": {
+	    "handler": "shard-rebalance",
+	    "handlerArgs": {
+	        "storage": "/sharded/"
+	    }
+	},
+*/
 package shard
 
 import (
+	"crypto/sha1"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"camlistore.org/pkg/blobref"
@@ -26,11 +67,23 @@ import (
 	"camlistore.org/pkg/jsonconfig"
 )
 
+const buffered = 8
+
 type shardStorage struct {
 	*blobserver.SimpleBlobHubPartitionMap
 
 	shardPrefixes []string
 	shards        []blobserver.Storage
+
+	// weights are the weights of the shards in the rendezvous
+	// mode, or nil in the modulo mode.
+	weights []float64
+
+	rebalanceMu sync.Mutex // protects following
+	pending     bool       // blobs may not be on their shard yet
+	rebalancing bool
+	rebStatus   string
+	rebStats    RebalanceStats
 }
 
 func (sto *shardStorage) GetBlobHub() blobserver.BlobHub {
@@ -42,9 +95,34 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobser
 		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
 	}
 	sto.shardPrefixes = config.RequiredList("backends")
+	mode := config.OptionalString("mode", "modulo")
+	weights := config.OptionalObject("weights")
+	if mode == "rendezvous" {
+		total := 0
+		for _, prefix := range sto.shardPrefixes {
+			w := weights.OptionalInt(prefix, 1)
+			if w < 0 {
+				return nil, fmt.Errorf("shard: negative weight for %s", prefix)
+			}
+			sto.weights = append(sto.weights, float64(w))
+			total += w
+		}
+		if err := weights.Validate(); err != nil {
+			return nil, err
+		}
+		if total == 0 {
+			return nil, errors.New("shard: need at least one shard with a non-zero weight")
+		}
+	}
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
+	switch {
+	case mode != "modulo" && mode != "rendezvous":
+		return nil, fmt.Errorf("shard: unknown mode %q", mode)
+	case mode == "modulo" && len(weights) > 0:
+		return nil, errors.New(`shard: weights require the "rendezvous" mode`)
+	}
 	if len(sto.shardPrefixes) == 0 {
 		return nil, errors.New("shard: need at least one shard")
 	}
@@ -64,11 +142,74 @@ func (sto *shardStorage) shard(b *blobref.BlobRef) blobserver.Storage {
 }
 
 func (sto *shardStorage) shardNum(b *blobref.BlobRef) uint32 {
+	if sto.weights != nil {
+		return uint32(sto.shardOrder(b)[0])
+	}
 	return b.Sum32() % uint32(len(sto.shards))
 }
 
+// shardOrder returns the numbers of all the shards, the one b belongs
+// to first, followed by the ones to look for b in if it's not there
+// (yet).
+func (sto *shardStorage) shardOrder(b *blobref.BlobRef) []int {
+	order := make([]int, len(sto.shards))
+	for i := range order {
+		order[i] = i
+	}
+	if sto.weights == nil {
+		sn := int(b.Sum32() % uint32(len(sto.shards)))
+		order[0], order[sn] = sn, 0
+		return order
+	}
+	scores := make([]float64, len(sto.shards))
+	for i := range scores {
+		scores[i] = sto.score(i, b)
+	}
+	sort.Sort(byScore{order, scores})
+	return order
+}
+
+// score returns the weighted rendezvous hashing score of b on shard
+// sn: -weight/ln(u), with u uniform in (0, 1) from the hash of the
+// shard's prefix and b.
+func (sto *shardStorage) score(sn int, b *blobref.BlobRef) float64 {
+	h := sha1.New()
+	io.WriteString(h, sto.shardPrefixes[sn])
+	io.WriteString(h, " ")
+	io.WriteString(h, b.String())
+	x := binary.BigEndian.Uint64(h.Sum(nil)[:8])
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return -sto.weights[sn] / math.Log(u)
+}
+
+type byScore struct {
+	order  []int
+	scores []float64
+}
+
+func (s byScore) Len() int           { return len(s.order) }
+func (s byScore) Less(i, j int) bool { return s.scores[s.order[i]] > s.scores[s.order[j]] }
+func (s byScore) Swap(i, j int)      { s.order[i], s.order[j] = s.order[j], s.order[i] }
+
+// rebalancePending reports whether blobs may be on a shard other than
+// theirs, so they should be looked for on the other shards too.
+func (sto *shardStorage) rebalancePending() bool {
+	sto.rebalanceMu.Lock()
+	defer sto.rebalanceMu.Unlock()
+	return sto.pending
+}
+
 func (sto *shardStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err error) {
-	return sto.shard(b).FetchStreaming(b)
+	if !sto.rebalancePending() {
+		return sto.shard(b).FetchStreaming(b)
+	}
+	for _, sn := range sto.shardOrder(b) {
+		file, size, err = sto.shards[sn].FetchStreaming(b)
+		if err != os.ErrNotExist {
+			return
+		}
+	}
+	return
 }
 
 func (sto *shardStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err error) {
@@ -103,16 +244,78 @@ func (sto *shardStorage) batchedShards(blobs []*blobref.BlobRef, fn func(blobser
 	return reterr
 }
 
+// RemoveBlobs removes blobs from their shards, or from all the shards
+// while a rebalance is pending, as they may not have been moved to
+// their shard yet.
 func (sto *shardStorage) RemoveBlobs(blobs []*blobref.BlobRef) error {
-	return sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) error {
-		return s.RemoveBlobs(blobs)
-	})
+	if !sto.rebalancePending() {
+		return sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) error {
+			return s.RemoveBlobs(blobs)
+		})
+	}
+	ch := make(chan error, len(sto.shards))
+	for _, s := range sto.shards {
+		go func(s blobserver.Storage) {
+			ch <- s.RemoveBlobs(blobs)
+		}(s)
+	}
+	var reterr error
+	for _ = range sto.shards {
+		if err := <-ch; err != nil {
+			reterr = err
+		}
+	}
+	return reterr
 }
 
+// StatBlobs stats blobs on their shards, then, while a rebalance is
+// pending, the ones not found there on the other shards.
 func (sto *shardStorage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
-	return sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) error {
-		return s.StatBlobs(dest, blobs, wait)
+	var mu sync.Mutex
+	found := make(map[string]bool)
+	ch := make(chan blobref.SizedBlobRef, buffered)
+	done := make(chan bool)
+	go func() {
+		for sb := range ch {
+			mu.Lock()
+			dup := found[sb.BlobRef.String()]
+			found[sb.BlobRef.String()] = true
+			mu.Unlock()
+			if !dup {
+				dest <- sb
+			}
+		}
+		done <- true
+	}()
+	err := sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) error {
+		return s.StatBlobs(ch, blobs, wait)
 	})
+	if err == nil && len(sto.shards) > 1 && sto.rebalancePending() {
+		var missing []*blobref.BlobRef
+		mu.Lock()
+		for _, b := range blobs {
+			if !found[b.String()] {
+				missing = append(missing, b)
+			}
+		}
+		mu.Unlock()
+		if len(missing) > 0 {
+			errch := make(chan error, len(sto.shards))
+			for _, s := range sto.shards {
+				go func(s blobserver.Storage) {
+					errch <- s.StatBlobs(ch, missing, 0)
+				}(s)
+			}
+			for _ = range sto.shards {
+				if serr := <-errch; serr != nil {
+					err = serr
+				}
+			}
+		}
+	}
+	close(ch)
+	<-done
+	return err
 }
 
 func (sto *shardStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit int, wait time.Duration) error {
@@ -0,0 +1,177 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/test"
+)
+
+func newTestShards(t *testing.T, n int) ([]blobserver.Storage, func()) {
+	var dirs []string
+	var shards []blobserver.Storage
+	for i := 0; i < n; i++ {
+		dir, err := ioutil.TempDir("", "shard-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+		ds, err := localdisk.New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, ds)
+	}
+	return shards, func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func newShardStorage(shards []blobserver.Storage, weights []float64) *shardStorage {
+	sto := &shardStorage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		shards:                    shards,
+		weights:                   weights,
+	}
+	for i := range shards {
+		sto.shardPrefixes = append(sto.shardPrefixes, fmt.Sprintf("/s%d/", i+1))
+	}
+	return sto
+}
+
+func stat(t *testing.T, sto blobserver.Storage, blobs []*test.Blob) int {
+	var refs []*blobref.BlobRef
+	for _, b := range blobs {
+		refs = append(refs, b.BlobRef())
+	}
+	ch := make(chan blobref.SizedBlobRef, len(blobs)*2)
+	if err := sto.StatBlobs(ch, refs, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	return n
+}
+
+func TestRebalance(t *testing.T) {
+	shards, cleanup := newTestShards(t, 4)
+	defer cleanup()
+	var blobs []*test.Blob
+	for i := 0; i < 200; i++ {
+		blobs = append(blobs, &test.Blob{Contents: fmt.Sprintf("blob %d", i)})
+	}
+
+	// Start with 2 shards in the modulo mode...
+	sto := newShardStorage(shards[:2], nil)
+	for _, b := range blobs {
+		if _, err := sto.ReceiveBlob(b.BlobRef(), b.Reader()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ... then switch to 3 shards in the rendezvous mode. Only the
+	// blobs on their new shard are found, unless a rebalance is
+	// pending.
+	sto = newShardStorage(shards[:3], []float64{1, 1, 1})
+	if n := stat(t, sto, blobs); n == len(blobs) {
+		t.Fatalf("with no rebalance pending, statted all %d blobs", n)
+	}
+	sto.pending = true
+	if n := stat(t, sto, blobs); n != len(blobs) {
+		t.Fatalf("before rebalance, statted %d blobs; want %d", n, len(blobs))
+	}
+	rc, _, err := sto.FetchStreaming(blobs[0].BlobRef())
+	if err != nil {
+		t.Fatalf("before rebalance, fetch: %v", err)
+	}
+	rc.Close()
+	st, err := sto.rebalance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Blobs < int64(len(blobs)) || st.Errors != 0 || st.Moved == 0 {
+		t.Fatalf("rebalance stats = %+v", st)
+	}
+	if sto.rebalancePending() {
+		t.Errorf("rebalance still pending after a rebalance without errors")
+	}
+	for _, b := range blobs {
+		sn := int(sto.shardNum(b.BlobRef()))
+		for i, s := range sto.shards {
+			_, _, err := s.FetchStreaming(b.BlobRef())
+			if (err == nil) != (i == sn) {
+				t.Fatalf("after rebalance, fetch of %v from shard %d (owner %d): %v", b.BlobRef(), i, sn, err)
+			}
+		}
+	}
+
+	// Adding a 4th shard only moves the blobs it now owns, about a
+	// quarter of them.
+	sto = newShardStorage(shards, []float64{1, 1, 1, 1})
+	sto.pending = true
+	if st, err = sto.rebalance(nil); err != nil {
+		t.Fatal(err)
+	}
+	if st.Moved < 25 || st.Moved > 75 {
+		t.Errorf("adding a 4th shard moved %d blobs of %d; want about a quarter", st.Moved, len(blobs))
+	}
+	if n := stat(t, sto, blobs); n != len(blobs) {
+		t.Errorf("statted %d blobs; want %d", n, len(blobs))
+	}
+
+	// A shard of weight 0 is drained.
+	sto = newShardStorage(shards, []float64{1, 1, 1, 0})
+	sto.pending = true
+	if st, err = sto.rebalance(nil); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan blobref.SizedBlobRef, 1)
+	if err := shards[3].EnumerateBlobs(ch, "", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sb, ok := <-ch; ok {
+		t.Errorf("drained shard still has %v", sb.BlobRef)
+	}
+}
+
+func TestShardConformance(t *testing.T) {
+	modes := map[string][]float64{
+		"modulo":     nil,
+		"rendezvous": {1, 2},
+	}
+	for name, weights := range modes {
+		weights := weights
+		t.Run(name, func(t *testing.T) {
+			test.RunStorageTests(t, func(t *testing.T) (blobserver.Storage, func()) {
+				shards, cleanup := newTestShards(t, 2)
+				return newShardStorage(shards, weights), cleanup
+			})
+		})
+	}
+}
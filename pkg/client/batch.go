@@ -0,0 +1,177 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"sync"
+)
+
+// A batcher uploads small blobs together: the blobs given while a
+// batch is being sent make the next batch, stated and uploaded with
+// one request each. A lone upload isn't delayed.
+type batcher struct {
+	c   *Client
+	max int64 // bytes of blobs per batch
+
+	mu      sync.Mutex
+	queue   []*batchItem
+	sending bool // whether a goroutine is sending the queue
+}
+
+type batchItem struct {
+	pr   *PutResult
+	data []byte
+	errc chan error // receives the result of the upload
+}
+
+// upload uploads data, the contents of pr's blob, in a batch.
+func (b *batcher) upload(pr *PutResult, data []byte) (*PutResult, error) {
+	it := &batchItem{pr: pr, data: data, errc: make(chan error, 1)}
+	b.mu.Lock()
+	b.queue = append(b.queue, it)
+	if !b.sending {
+		b.sending = true
+		go b.send()
+	}
+	b.mu.Unlock()
+	if err := <-it.errc; err != nil {
+		return nil, err
+	}
+	return it.pr, nil
+}
+
+// send sends the queued blobs, batch after batch, until the queue is
+// empty.
+func (b *batcher) send() {
+	for {
+		b.mu.Lock()
+		if len(b.queue) == 0 {
+			b.sending = false
+			b.mu.Unlock()
+			return
+		}
+		n, size := 0, int64(0)
+		for n < len(b.queue) && (n == 0 || size+int64(len(b.queue[n].data)) <= b.max) {
+			size += int64(len(b.queue[n].data))
+			n++
+		}
+		batch := append([]*batchItem(nil), b.queue[:n]...)
+		b.queue = b.queue[n:]
+		b.mu.Unlock()
+		b.c.uploadBatch(batch)
+	}
+}
+
+// uploadBatch uploads the blobs of batch that the server doesn't
+// have, in a single multipart POST.
+func (c *Client) uploadBatch(batch []*batchItem) {
+	fail := func(items []*batchItem, err error) {
+		c.log.Print(err.Error())
+		for _, it := range items {
+			it.errc <- err
+		}
+	}
+
+	var refs []string
+	seen := make(map[string]bool)
+	for _, it := range batch {
+		if br := it.pr.BlobRef.String(); !seen[br] {
+			seen[br] = true
+			refs = append(refs, br)
+		}
+	}
+	stat, err := c.statForUpload(refs)
+	if err != nil {
+		fail(batch, err)
+		return
+	}
+
+	// A blob given twice is uploaded once, and its other uploads
+	// are skipped, or fail with it.
+	var missing []*batchItem
+	dups := make(map[string][]*batchItem)
+	for _, it := range batch {
+		br := it.pr.BlobRef.String()
+		if _, ok := stat.HaveMap[br]; ok {
+			it.pr.Skipped = true
+			it.errc <- nil
+			continue
+		}
+		if _, ok := dups[br]; ok {
+			it.pr.Skipped = true
+			dups[br] = append(dups[br], it)
+			continue
+		}
+		dups[br] = []*batchItem{}
+		missing = append(missing, it)
+	}
+	if len(missing) == 0 {
+		return
+	}
+	for _, it := range missing {
+		missing = append(missing, dups[it.pr.BlobRef.String()]...)
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, it := range missing {
+		br := it.pr.BlobRef.String()
+		if it.pr.Skipped {
+			continue
+		}
+		part, err := w.CreateFormFile(br, br)
+		if err == nil {
+			_, err = part.Write(it.data)
+		}
+		if err != nil {
+			fail(missing, err)
+			return
+		}
+	}
+	if err := w.Close(); err != nil {
+		fail(missing, err)
+		return
+	}
+
+	req := c.newRequest("POST", stat.uploadUrl)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Body = ioutil.NopCloser(&body)
+	req.ContentLength = int64(body.Len())
+	resp, err := c.doReq(req)
+	if err != nil {
+		fail(missing, err)
+		return
+	}
+	ures, err := c.uploadResponse(stat.uploadUrl, resp)
+	if err != nil {
+		fail(missing, err)
+		return
+	}
+	errs := make(map[string]error)
+	for _, it := range missing {
+		br := it.pr.BlobRef.String()
+		err, ok := errs[br]
+		if !ok {
+			_, err = c.uploadResult(it.pr, ures)
+			errs[br] = err
+		}
+		it.errc <- err
+	}
+}
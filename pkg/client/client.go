@@ -25,14 +25,27 @@ import (
 	"sync"
 
 	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
 )
 
 type Client struct {
-	server   string // URL prefix before "/camli/"
-	authMode auth.AuthMode
+	server       string // URL prefix before "/camli/"
+	searchServer string // URL prefix of the search handler, before "/camli/search/"; optional
+	authMode     auth.AuthMode
 
 	httpClient *http.Client
 
+	// resumableMin is the size from which blobs are uploaded with
+	// the resumable protocol, if the server supports it. Zero means
+	// defaultResumableMin.
+	resumableMin int64
+
+	limits  Limits
+	limiter *limiter // nil for no limits
+	batcher *batcher // nil unless small blobs are uploaded in batches
+
+	missingHook func(*blobref.BlobRef) // optional; see SetMissingBlobHook
+
 	statsMutex sync.Mutex
 	stats      Stats
 
@@ -69,21 +82,53 @@ func New(server string) *Client {
 	}
 }
 
+// SetSearchServer sets the URL prefix of the search handler, before
+// "/camli/search/", e.g. "http://localhost:3179/my-search".
+func (c *Client) SetSearchServer(server string) {
+	c.searchServer = cleanServer(server)
+}
+
 func (c *Client) SetHttpClient(client *http.Client) {
 	c.httpClient = client
 }
 
+// Server returns the URL prefix of the blob server, before "/camli/".
+func (c *Client) Server() string {
+	return c.server
+}
+
+// SetMissingBlobHook sets fn to be called with each blob the server
+// reports it doesn't have: those missing from its stat responses, and
+// those it answers a fetch of with a 404. It lets callers invalidate
+// what they remember of the server. fn may be called concurrently.
+func (c *Client) SetMissingBlobHook(fn func(*blobref.BlobRef)) {
+	c.missingHook = fn
+}
+
+func (c *Client) noteMissing(br *blobref.BlobRef) {
+	if c.missingHook != nil && br != nil {
+		c.missingHook(br)
+	}
+}
+
 func NewOrFail() *Client {
 	log := log.New(os.Stderr, "", log.Ldate|log.Ltime)
 	c := &Client{
-		server:     blobServerOrDie(),
-		httpClient: http.DefaultClient,
-		log:        log,
+		server:       blobServerOrDie(),
+		searchServer: searchServer(),
+		httpClient:   http.DefaultClient,
+		log:          log,
 	}
 	err := c.SetupAuth()
 	if err != nil {
 		log.Fatal(err)
 	}
+	c.SetLimits(ConfigLimits())
+	if name := hashName(); name != "" {
+		if err := blobref.SetDefaultDigest(name); err != nil {
+			log.Fatal(err)
+		}
+	}
 	return c
 }
 
@@ -36,10 +36,32 @@ import (
 // "server" and "password" keys.
 //
 // A main binary must call AddFlags to expose these.
-var flagServer *string
+var (
+	flagServer       *string
+	flagSearchServer *string
+	flagHash         *string
+
+	flagMaxConns     *int
+	flagUploadRate   *string
+	flagDownloadRate *string
+	flagBatchSize    *int64
+)
 
 func AddFlags() {
 	flagServer = flag.String("blobserver", "", "camlistore blob server")
+	flagSearchServer = flag.String("searchserver", "", "camlistore search handler URL; optional")
+	flagHash = flag.String("hash", "", "digest of the new blobrefs, such as sha1 or sha256; optional")
+	AddLimitFlags()
+}
+
+// AddLimitFlags adds the flags overriding the Limits of the
+// configuration file, as returned by ConfigLimits. AddFlags adds
+// them too.
+func AddLimitFlags() {
+	flagMaxConns = flag.Int("maxconns", 0, "maximum number of concurrent HTTP requests per server; 0 for no limit")
+	flagUploadRate = flag.String("uploadrate", "", "upload rate limit in bytes per second, such as 512K, or a daily schedule such as 1M,09:00-18:00=128K; 0 for no limit")
+	flagDownloadRate = flag.String("downloadrate", "", "download rate limit, like -uploadrate")
+	flagBatchSize = flag.Int64("batchsize", 0, "if positive, upload small blobs together in POSTs of up to this many bytes")
 }
 
 func ConfigFilePath() string {
@@ -88,6 +110,76 @@ func blobServerOrDie() string {
 	return server
 }
 
+// searchServer returns the URL prefix of the search handler, from the
+// flag or the "searchServer" config key, or the empty string if none
+// is configured.
+func searchServer() string {
+	if flagSearchServer != nil && *flagSearchServer != "" {
+		return cleanServer(*flagSearchServer)
+	}
+	configOnce.Do(parseConfig)
+	server, _ := config["searchServer"].(string)
+	if server == "" {
+		return ""
+	}
+	return cleanServer(server)
+}
+
+// hashName returns the digest to create new blobrefs with, from the
+// flag or the "hash" config key, or the empty string if none is
+// configured.
+func hashName() string {
+	if flagHash != nil && *flagHash != "" {
+		return *flagHash
+	}
+	configOnce.Do(parseConfig)
+	name, _ := config["hash"].(string)
+	return name
+}
+
+// KeyId returns the GPG key ID of the configured identity, from the
+// "keyId" config key, or the empty string if there's none.
+func KeyId() string {
+	configOnce.Do(parseConfig)
+	keyId, _ := config["keyId"].(string)
+	return keyId
+}
+
+// ConfigLimits returns the Limits of the clients, from the flags or
+// the "maxConns", "uploadRate", "downloadRate" and "batchSize" config
+// keys.
+func ConfigLimits() Limits {
+	configOnce.Do(parseConfig)
+	var l Limits
+	if flagMaxConns != nil && *flagMaxConns != 0 {
+		l.MaxConns = *flagMaxConns
+	} else if n, ok := config["maxConns"].(float64); ok {
+		l.MaxConns = int(n)
+	}
+	if flagBatchSize != nil && *flagBatchSize != 0 {
+		l.BatchSize = *flagBatchSize
+	} else if n, ok := config["batchSize"].(float64); ok {
+		l.BatchSize = int64(n)
+	}
+	rate := func(flagValue *string, key string) *RateSchedule {
+		s, _ := config[key].(string)
+		if flagValue != nil && *flagValue != "" {
+			s = *flagValue
+		}
+		if s == "" {
+			return nil
+		}
+		rs, err := ParseRateSchedule(s)
+		if err != nil {
+			log.Fatalf("Invalid %q in %q or flags: %v", key, ConfigFilePath(), err)
+		}
+		return rs
+	}
+	l.UploadRate = rate(flagUploadRate, "uploadRate")
+	l.DownloadRate = rate(flagDownloadRate, "downloadRate")
+	return l
+}
+
 func (c *Client) SetupAuth() error {
 	configOnce.Do(parseConfig)
 	return c.SetupAuthFromConfig(config)
@@ -169,6 +261,7 @@ func SignerPublicKeyBlobref() *blobref.BlobRef {
 		return nil
 	}
 
+	// Not the default digest: this must match the server's signer.
 	br := blobref.SHA1FromString(armored)
 
 	pubFile := filepath.Join(selfPubKeyDir, br.String()+".camli")
@@ -189,3 +282,20 @@ func (c *Client) GetBlobFetcher() blobref.SeekFetcher {
 	// Use blobref.NewSeriesFetcher(...all configured fetch paths...)
 	return blobref.NewConfigDirFetcher()
 }
+
+// ExcludePatterns returns the "exclude" list of the configuration
+// file: the gitignore-style patterns of the files camput shouldn't
+// upload.
+func ExcludePatterns() []string {
+	configOnce.Do(parseConfig)
+	list, _ := config["exclude"].([]interface{})
+	var patterns []string
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			patterns = append(patterns, s)
+		} else {
+			log.Printf("Ignoring non-string %v in the \"exclude\" list of %s", v, ConfigFilePath())
+		}
+	}
+	return patterns
+}
@@ -67,7 +67,7 @@ func (c *Client) EnumerateBlobsOpts(ch chan<- blobref.SizedBlobRef, opts Enumera
 		url_ := fmt.Sprintf("%s/camli/enumerate-blobs?after=%s&limit=%d&maxwaitsec=%d",
 			c.server, url.QueryEscape(after), enumerateBatchSize, waitSec)
 		req := c.newRequest("GET", url_)
-		resp, err := c.httpClient.Do(req)
+		resp, err := c.doReq(req)
 		if err != nil {
 			return error("http request", err)
 		}
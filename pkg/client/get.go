@@ -22,6 +22,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"os"
 
 	"camlistore.org/pkg/blobref"
 )
@@ -48,17 +50,24 @@ func (c *Client) FetchVia(b *blobref.BlobRef, v []*blobref.BlobRef) (io.ReadClos
 	}
 
 	req := c.newRequest("GET", url)
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doReq(req)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		c.noteMissing(b)
+		return nil, 0, os.ErrNotExist
+	}
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, 0, errors.New(fmt.Sprintf("Got status code %d from blobserver for %s", resp.StatusCode, b))
 	}
 
 	size := resp.ContentLength
 	if size == -1 {
+		resp.Body.Close()
 		return nil, 0, errors.New("blobserver didn't return a Content-Length for blob")
 	}
 
@@ -0,0 +1,298 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits bounds the network use of a client. The zero Limits imposes
+// no limit.
+type Limits struct {
+	// MaxConns is the maximum number of concurrent HTTP requests,
+	// if positive. A request lasts until its response body is
+	// closed.
+	MaxConns int
+
+	// UploadRate and DownloadRate, if non-nil, limit the bytes
+	// per second of the request and response bodies.
+	UploadRate, DownloadRate *RateSchedule
+
+	// BatchSize, if positive, is the maximum size of the multipart
+	// POSTs uploading small blobs together, instead of one request
+	// each. Blobs are small up to smallBlobSize, or BatchSize if
+	// smaller.
+	BatchSize int64
+}
+
+// smallBlobSize is the size up to which blobs may be batched.
+const smallBlobSize = 64 << 10
+
+// SetLimits sets the limits of the client's network use. It must be
+// called before the client is used.
+func (c *Client) SetLimits(l Limits) {
+	c.limits = l
+	lim := &limiter{}
+	if l.MaxConns > 0 {
+		lim.conns = make(chan bool, l.MaxConns)
+	}
+	if l.UploadRate != nil {
+		lim.upload = newTokenBucket(l.UploadRate)
+	}
+	if l.DownloadRate != nil {
+		lim.download = newTokenBucket(l.DownloadRate)
+	}
+	c.limiter = lim
+	c.batcher = nil
+	if l.BatchSize > 0 {
+		c.batcher = &batcher{c: c, max: l.BatchSize}
+	}
+}
+
+// Limits returns the limits set by SetLimits.
+func (c *Client) Limits() Limits {
+	return c.limits
+}
+
+// A RateSchedule is a rate limit in bytes per second, which may
+// depend on the time of day.
+type RateSchedule struct {
+	Default int64 // outside of the Periods; zero for no limit
+	Periods []RatePeriod
+}
+
+// A RatePeriod is a daily period with its own rate limit.
+type RatePeriod struct {
+	// Start and End are the times of day, local time, since
+	// midnight. An End before Start wraps around midnight.
+	Start, End time.Duration
+	Rate       int64 // zero for no limit
+}
+
+// ParseRateSchedule parses a comma-separated list of rates in bytes
+// per second, with an optional K, M or G suffix. A rate alone is the
+// default one, and a rate after a period of the day applies in that
+// period:
+//
+//	512K
+//	1M,09:00-18:00=128K
+//	22:00-06:00=0,64K     (unlimited at night)
+//
+// The empty string and "0" mean no limit.
+func ParseRateSchedule(s string) (*RateSchedule, error) {
+	rs := new(RateSchedule)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.Index(item, "=")
+		if eq < 0 {
+			rate, err := parseRate(item)
+			if err != nil {
+				return nil, err
+			}
+			rs.Default = rate
+			continue
+		}
+		period, rateStr := item[:eq], item[eq+1:]
+		dash := strings.Index(period, "-")
+		if dash < 0 {
+			return nil, fmt.Errorf("client: invalid period %q in rate %q; want HH:MM-HH:MM", period, s)
+		}
+		var (
+			p   RatePeriod
+			err error
+		)
+		if p.Start, err = parseTimeOfDay(period[:dash]); err != nil {
+			return nil, err
+		}
+		if p.End, err = parseTimeOfDay(period[dash+1:]); err != nil {
+			return nil, err
+		}
+		if p.Rate, err = parseRate(rateStr); err != nil {
+			return nil, err
+		}
+		rs.Periods = append(rs.Periods, p)
+	}
+	return rs, nil
+}
+
+func parseRate(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("client: invalid rate %q", s)
+	}
+	return n * mult, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("client: invalid time of day %q; want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// RateAt returns the rate limit at t, or zero if there's none. The
+// first period including t wins.
+func (rs *RateSchedule) RateAt(t time.Time) int64 {
+	t = t.Local()
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	for _, p := range rs.Periods {
+		in := p.Start <= tod && tod < p.End
+		if p.End < p.Start {
+			in = tod >= p.Start || tod < p.End
+		}
+		if in {
+			return p.Rate
+		}
+	}
+	return rs.Default
+}
+
+// A tokenBucket paces transfers at the rate of its schedule, allowing
+// bursts of up to a second's worth of bytes.
+type tokenBucket struct {
+	sched *RateSchedule
+	now   func() time.Time    // time.Now, but for tests
+	sleep func(time.Duration) // time.Sleep, but for tests
+
+	mu     sync.Mutex
+	tokens float64 // negative when transfers are waiting
+	last   time.Time
+}
+
+func newTokenBucket(sched *RateSchedule) *tokenBucket {
+	return &tokenBucket{sched: sched, now: time.Now, sleep: time.Sleep}
+}
+
+// wait blocks until n more bytes may be transferred.
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	now := b.now()
+	rate := float64(b.sched.RateAt(now))
+	if rate <= 0 {
+		b.tokens, b.last = 0, now
+		b.mu.Unlock()
+		return
+	}
+	if !b.last.IsZero() {
+		b.tokens += rate * now.Sub(b.last).Seconds()
+	}
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay > 0 {
+		b.sleep(delay)
+	}
+}
+
+// A limiter enforces the Limits of a client on its requests.
+type limiter struct {
+	conns    chan bool    // a slot per request in progress; nil for no limit
+	upload   *tokenBucket // nil for no limit
+	download *tokenBucket // nil for no limit
+}
+
+// doReq sends req within the client's limits: it waits for a free
+// request slot, which the response body frees when closed, and paces
+// the request and response bodies at the rate limits.
+func (c *Client) doReq(req *http.Request) (*http.Response, error) {
+	l := c.limiter
+	if l == nil {
+		return c.httpClient.Do(req)
+	}
+	if l.conns != nil {
+		l.conns <- true
+	}
+	release := func() {
+		if l.conns != nil {
+			<-l.conns
+		}
+	}
+	if req.Body != nil && l.upload != nil {
+		req.Body = &throttledBody{rc: req.Body, b: l.upload}
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &throttledBody{rc: resp.Body, b: l.download, onClose: release}
+	return resp, nil
+}
+
+// throttledChunk is the most bytes read at once from a throttled
+// body, to keep its pace smooth.
+const throttledChunk = 32 << 10
+
+// A throttledBody paces the reads of an HTTP body with a token bucket.
+type throttledBody struct {
+	rc      io.ReadCloser
+	b       *tokenBucket // nil for no limit
+	onClose func()       // optional; called once
+
+	closeOnce sync.Once
+}
+
+func (t *throttledBody) Read(p []byte) (int, error) {
+	if t.b == nil {
+		return t.rc.Read(p)
+	}
+	if len(p) > throttledChunk {
+		p = p[:throttledChunk]
+	}
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		t.b.wait(n)
+	}
+	return n, err
+}
+
+func (t *throttledBody) Close() error {
+	err := t.rc.Close()
+	t.closeOnce.Do(func() {
+		if t.onClose != nil {
+			t.onClose()
+		}
+	})
+	return err
+}
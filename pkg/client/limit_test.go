@@ -0,0 +1,267 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/handlers"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+func TestParseRateSchedule(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want *RateSchedule // nil for an error
+	}{
+		{"", &RateSchedule{}},
+		{"0", &RateSchedule{}},
+		{"512", &RateSchedule{Default: 512}},
+		{"512K", &RateSchedule{Default: 512 << 10}},
+		{"1M, 09:00-18:30=128k", &RateSchedule{Default: 1 << 20, Periods: []RatePeriod{
+			{9 * time.Hour, 18*time.Hour + 30*time.Minute, 128 << 10},
+		}}},
+		{"22:00-06:00=0,64K", &RateSchedule{Default: 64 << 10, Periods: []RatePeriod{
+			{22 * time.Hour, 6 * time.Hour, 0},
+		}}},
+		{"-1", nil},
+		{"1X", nil},
+		{"09:00=1K", nil},
+		{"09:00-25:00=1K", nil},
+	} {
+		got, err := ParseRateSchedule(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v; want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	rs, _ := ParseRateSchedule("1M,09:00-18:00=128K,22:00-06:00=0")
+	for hour, want := range map[int]int64{3: 0, 8: 1 << 20, 9: 128 << 10, 17: 128 << 10, 18: 1 << 20, 23: 0} {
+		at := time.Date(2012, 10, 16, hour, 30, 0, 0, time.Local)
+		if got := rs.RateAt(at); got != want {
+			t.Errorf("rate at %d:30 = %d; want %d", hour, got, want)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2012, 10, 16, 12, 0, 0, 0, time.Local)
+	var slept time.Duration
+	b := newTokenBucket(&RateSchedule{Default: 100, Periods: []RatePeriod{{13 * time.Hour, 14 * time.Hour, 0}}})
+	b.now = func() time.Time { return now }
+	b.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	// The bucket starts empty.
+	b.wait(50)
+	b.wait(100)
+	if slept != 1500*time.Millisecond {
+		t.Errorf("slept %v for 150 bytes at 100 bytes/s; want 1.5s", slept)
+	}
+
+	// Idle time fills it, up to a second's worth.
+	slept = 0
+	now = now.Add(time.Minute)
+	b.wait(100)
+	if slept != 0 {
+		t.Errorf("slept %v after idling", slept)
+	}
+	b.wait(50)
+	if slept != 500*time.Millisecond {
+		t.Errorf("slept %v for a burst of 150 bytes; want 0.5s", slept)
+	}
+
+	// No limit from 13:00 to 14:00.
+	slept = 0
+	now = time.Date(2012, 10, 16, 13, 30, 0, 0, time.Local)
+	b.wait(1 << 20)
+	if slept != 0 {
+		t.Errorf("slept %v without a limit", slept)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		conns, peak int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		conns++
+		if conns > peak {
+			peak = conns
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		conns--
+		mu.Unlock()
+		rw.Header().Set("Content-Length", "3")
+		rw.Write([]byte("foo"))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL)
+	c.SetLogger(nil)
+	if err := c.SetupAuthFromConfig(jsonconfig.Obj{"auth": "none"}); err != nil {
+		t.Fatal(err)
+	}
+	c.SetLimits(Limits{MaxConns: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, _, err := c.FetchStreaming(blobref.SHA1FromString("foo"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(rc)
+			rc.Close()
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Errorf("%d concurrent requests; want 2", peak)
+	}
+}
+
+func TestBatchUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-batch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sto := &configuredStorage{Storage: ds, config: &blobserver.Config{Writable: true, Readable: true}}
+
+	const n = 20
+	var (
+		c       *Client
+		mu      sync.Mutex
+		uploads int
+	)
+	upload := handlers.CreateUploadHandler(sto)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/camli/stat", handlers.CreateStatHandler(sto))
+	mux.HandleFunc("/camli/upload", func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		uploads++
+		first := uploads == 1
+		mu.Unlock()
+		if first {
+			// Let the other uploads queue up for the next batch.
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+				c.batcher.mu.Lock()
+				queued := len(c.batcher.queue)
+				c.batcher.mu.Unlock()
+				if queued == n {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		upload(rw, req)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	sto.config.URLBase = ts.URL
+
+	c = New(ts.URL)
+	c.SetLogger(nil)
+	if err := c.SetupAuthFromConfig(jsonconfig.Obj{"auth": "none"}); err != nil {
+		t.Fatal(err)
+	}
+	c.SetLimits(Limits{BatchSize: 1 << 20})
+
+	// A first blob, then n more while it's being uploaded, one of
+	// them twice.
+	contents := func(i int) string {
+		if i == n {
+			i = 1
+		}
+		return fmt.Sprintf("blob %d", i)
+	}
+	var wg sync.WaitGroup
+	results := make([]*PutResult, n+1)
+	for i := 0; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pr, err := c.Upload(NewUploadHandleFromString(contents(i)))
+			if err != nil {
+				t.Errorf("upload %d: %v", i, err)
+			}
+			results[i] = pr
+		}(i)
+		if i == 0 {
+			for {
+				mu.Lock()
+				started := uploads > 0
+				mu.Unlock()
+				if started {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	wg.Wait()
+	if uploads != 2 {
+		t.Errorf("%d upload requests; want 2", uploads)
+	}
+	for i := 0; i < n; i++ {
+		br := blobref.FromString(contents(i))
+		rc, _, err := ds.FetchStreaming(br)
+		if err != nil {
+			t.Errorf("blob %d not uploaded: %v", i, err)
+			continue
+		}
+		rc.Close()
+	}
+	if results[1] == nil || results[n] == nil || results[1].Skipped == results[n].Skipped {
+		t.Errorf("results of the blob given twice: %+v and %+v; want one skipped", results[1], results[n])
+	}
+
+	pr, err := c.Upload(NewUploadHandleFromString(contents(0)))
+	if err != nil || !pr.Skipped {
+		t.Errorf("upload of an existing blob = %+v, %v; want skipped", pr, err)
+	}
+}
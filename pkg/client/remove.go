@@ -54,7 +54,7 @@ func (c *Client) RemoveBlobs(blobs []*blobref.BlobRef) error {
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	c.authMode.AddAuthHeader(req)
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doReq(req)
 
 	if err != nil {
 		return errors.New(fmt.Sprintf("Got status code %d from blobserver for remove %s", resp.StatusCode, params.Encode()))
@@ -62,6 +62,7 @@ func (c *Client) RemoveBlobs(blobs []*blobref.BlobRef) error {
 
 	// The only valid HTTP responses are 200.
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return errors.New(fmt.Sprintf("Invalid http response %d in remove response", resp.StatusCode))
 	}
 
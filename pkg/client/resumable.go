@@ -0,0 +1,187 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultResumableMin is the size from which blobs are uploaded
+	// with the resumable protocol by default.
+	defaultResumableMin = 4 << 20
+
+	// resumableChunkSize is how many bytes are sent per PUT of a
+	// resumable upload.
+	resumableChunkSize = 1 << 20
+
+	// maxResumableRetries is how many times in a row a resumable
+	// upload is resumed without making progress before giving up.
+	maxResumableRetries = 5
+
+	// maxResumableBusyWaits is how many times in a row a resumable
+	// upload waits for another request on the same blob, which the
+	// server reports as busy, before giving up.
+	maxResumableBusyWaits = 60
+)
+
+// resumableBackoff is the wait before the first retry of a failed
+// resumable upload request, doubled at each retry.
+var resumableBackoff = time.Second
+
+// SetResumableThreshold sets the size from which blobs are uploaded
+// with the resumable upload protocol, when the server supports it,
+// so an interrupted upload continues where it stopped instead of
+// starting over. A negative size disables resumable uploads.
+func (c *Client) SetResumableThreshold(size int64) {
+	c.resumableMin = size
+}
+
+func (c *Client) resumableThreshold() int64 {
+	switch {
+	case c.resumableMin == 0:
+		return defaultResumableMin
+	case c.resumableMin < 0:
+		return 1<<63 - 1
+	}
+	return c.resumableMin
+}
+
+// resumableStatus is a server's state of a resumable upload.
+type resumableStatus struct {
+	Size   int64 `json:"size"`
+	Offset int64 `json:"offset"`
+	Busy   bool  `json:"busy"` // another request holds the upload
+}
+
+// uploadResumable uploads pr's blob, read from body, with the
+// resumable upload protocol at the server's base URL baseURL,
+// continuing after the bytes the server already has.
+func (c *Client) uploadResumable(pr *PutResult, body io.ReadSeeker, baseURL string) (*PutResult, error) {
+	blobURL := baseURL + "/" + pr.BlobRef.String()
+
+	st, err := c.resumablePost(blobURL, url.Values{"mode": {"begin"}, "size": {fmt.Sprint(pr.Size)}})
+	if err != nil {
+		return nil, fmt.Errorf("client: error beginning resumable upload of %v: %v", pr.BlobRef, err)
+	}
+	if st.Offset > 0 {
+		c.log.Printf("Resuming upload of %v at byte %d of %d", pr.BlobRef, st.Offset, pr.Size)
+	}
+
+	offset, retries, busyWaits := st.Offset, 0, 0
+	for offset < pr.Size {
+		st, err := c.resumablePut(blobURL, body, offset, pr.Size)
+		if err == nil && st.Busy {
+			// E.g. the server is still reading the body of a
+			// request we gave up on. That's no failure of ours.
+			busyWaits++
+			if busyWaits > maxResumableBusyWaits {
+				return nil, fmt.Errorf("client: giving up resumable upload of %v: busy on the server", pr.BlobRef)
+			}
+			time.Sleep(resumableBackoff)
+			continue
+		}
+		busyWaits = 0
+		if err != nil {
+			retries++
+			if retries > maxResumableRetries {
+				return nil, fmt.Errorf("client: giving up resumable upload of %v at byte %d: %v", pr.BlobRef, offset, err)
+			}
+			c.log.Printf("Upload of %v interrupted at byte %d (%v); retrying", pr.BlobRef, offset, err)
+			time.Sleep(resumableBackoff << uint(retries-1))
+			// The server may have received part of the chunk.
+			if st, err = c.resumableGet(blobURL); err != nil {
+				continue
+			}
+		}
+		if st.Offset > offset {
+			retries = 0
+		}
+		offset = st.Offset
+	}
+
+	req := c.newRequest("POST", blobURL)
+	form := "mode=finalize"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = ioutil.NopCloser(strings.NewReader(form))
+	req.ContentLength = int64(len(form))
+	resp, err := c.doReq(req)
+	if err != nil {
+		return nil, fmt.Errorf("client: error finalizing resumable upload of %v: %v", pr.BlobRef, err)
+	}
+	ures, err := c.jsonFromResponse("resumable upload", resp)
+	if err != nil {
+		return nil, fmt.Errorf("client: error finalizing resumable upload of %v: %v", pr.BlobRef, err)
+	}
+	return c.uploadResult(pr, ures)
+}
+
+func (c *Client) resumablePost(blobURL string, form url.Values) (*resumableStatus, error) {
+	req := c.newRequest("POST", blobURL)
+	body := form.Encode()
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return c.doResumable(req)
+}
+
+func (c *Client) resumableGet(blobURL string) (*resumableStatus, error) {
+	return c.doResumable(c.newRequest("GET", blobURL))
+}
+
+// resumablePut sends the chunk of body starting at offset.
+func (c *Client) resumablePut(blobURL string, body io.ReadSeeker, offset, size int64) (*resumableStatus, error) {
+	if _, err := body.Seek(offset, 0); err != nil {
+		return nil, err
+	}
+	n := size - offset
+	if n > resumableChunkSize {
+		n = resumableChunkSize
+	}
+	req := c.newRequest("PUT", blobURL)
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size))
+	req.Body = ioutil.NopCloser(io.LimitReader(body, n))
+	req.ContentLength = n
+	return c.doResumable(req)
+}
+
+// doResumable does a resumable upload request, returning the status
+// of the upload in the response. A conflict is a success: its
+// response tells the client where to resume from, or that the upload
+// is busy.
+func (c *Client) doResumable(req *http.Request) (*resumableStatus, error) {
+	resp, err := c.doReq(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return nil, fmt.Errorf("%s response had http status %d", req.Method, resp.StatusCode)
+	}
+	st := new(resumableStatus)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(st); err != nil {
+		return nil, ResponseFormatError(err)
+	}
+	return st, nil
+}
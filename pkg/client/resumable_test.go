@@ -0,0 +1,144 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/handlers"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+type configuredStorage struct {
+	blobserver.Storage
+	config *blobserver.Config
+}
+
+func (s *configuredStorage) Config() *blobserver.Config {
+	return s.config
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestUploadResumable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-resumable-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir, oldBackoff := handlers.ResumableDir, resumableBackoff
+	defer func() {
+		handlers.ResumableDir, resumableBackoff = oldDir, oldBackoff
+	}()
+	handlers.ResumableDir = filepath.Join(dir, "partial")
+	resumableBackoff = time.Millisecond
+
+	blobDir := filepath.Join(dir, "blobs")
+	if err := os.Mkdir(blobDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := localdisk.New(blobDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sto := &configuredStorage{Storage: ds, config: &blobserver.Config{Writable: true, Readable: true}}
+
+	// The first PUT breaks after 1000 bytes, like a flaky link, and
+	// the second one finds the upload busy.
+	var (
+		mu   sync.Mutex
+		puts int
+	)
+	resumable := handlers.CreateResumableUploadHandler(sto)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/camli/stat", handlers.CreateStatHandler(sto))
+	mux.HandleFunc("/camli/upload-resumable/", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "PUT" {
+			mu.Lock()
+			puts++
+			n := puts
+			mu.Unlock()
+			switch n {
+			case 1:
+				req.Body = ioutil.NopCloser(io.MultiReader(io.LimitReader(req.Body, 1000), brokenReader{}))
+			case 2:
+				rw.WriteHeader(http.StatusConflict)
+				io.WriteString(rw, `{"size": 100000, "offset": 1000, "busy": true}`)
+				return
+			}
+		}
+		resumable(rw, req)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	sto.config.URLBase = ts.URL
+
+	c := New(ts.URL)
+	c.SetLogger(nil)
+	if err := c.SetupAuthFromConfig(jsonconfig.Obj{"auth": "none"}); err != nil {
+		t.Fatal(err)
+	}
+	c.SetResumableThreshold(1)
+
+	data := strings.Repeat("0123456789", 10000)
+	pr, err := c.Upload(NewUploadHandleFromString(data))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if pr.Skipped || pr.Size != int64(len(data)) {
+		t.Errorf("Upload result = %+v", pr)
+	}
+	if puts != 3 {
+		t.Errorf("%d PUT requests; want 3", puts)
+	}
+
+	br := blobref.FromString(data)
+	rc, size, err := ds.FetchStreaming(br)
+	if err != nil {
+		t.Fatalf("blob not in storage: %v", err)
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if size != int64(len(data)) || string(got) != data {
+		t.Errorf("stored blob of %d bytes differs from the uploaded one", size)
+	}
+	if partials, _ := filepath.Glob(filepath.Join(handlers.ResumableDir, "*")); len(partials) != 0 {
+		t.Errorf("partial blobs left behind: %v", partials)
+	}
+
+	pr, err = c.Upload(NewUploadHandleFromString(data))
+	if err != nil || !pr.Skipped {
+		t.Errorf("second Upload = %+v, %v; want skipped", pr, err)
+	}
+}
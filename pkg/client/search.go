@@ -0,0 +1,110 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// ErrNoSearchServer is returned by the methods querying the search
+// server when the client doesn't have one.
+var ErrNoSearchServer = errors.New("client: no search server configured")
+
+// PermanodeAttrs returns the current attributes of the permanode pn, as
+// described by the search server.
+func (c *Client) PermanodeAttrs(pn *blobref.BlobRef) (url.Values, error) {
+	if c.searchServer == "" {
+		return nil, ErrNoSearchServer
+	}
+	req := c.newRequest("GET", fmt.Sprintf("%s/camli/search/describe?blobref=%s", c.searchServer, pn))
+	resp, err := c.doReq(req)
+	if err != nil {
+		return nil, err
+	}
+	jmap, err := c.jsonFromResponse("describe", resp)
+	if err != nil {
+		return nil, err
+	}
+	if errStr, ok := jmap["error"].(string); ok {
+		return nil, fmt.Errorf("client: error describing %s: %s", pn, errStr)
+	}
+
+	attrs := make(url.Values)
+	des, _ := jmap[pn.String()].(map[string]interface{})
+	perm, _ := des["permanode"].(map[string]interface{})
+	if perm == nil {
+		return nil, fmt.Errorf("client: %s is not a known permanode", pn)
+	}
+	jattrs, _ := perm["attr"].(map[string]interface{})
+	for attr, vals := range jattrs {
+		vl, _ := vals.([]interface{})
+		for _, v := range vl {
+			if s, ok := v.(string); ok {
+				attrs.Add(attr, s)
+			}
+		}
+	}
+	return attrs, nil
+}
+
+// A Snapshot is one of the successive camliContent values of a
+// permanode, such as the tree of one "camput file -snapshot" backup.
+type Snapshot struct {
+	Claim   *blobref.BlobRef // the claim setting Content
+	Date    time.Time        // of the claim
+	Content *blobref.BlobRef
+}
+
+// Snapshots returns the snapshots of the permanode pn, oldest first.
+func (c *Client) Snapshots(pn *blobref.BlobRef) ([]*Snapshot, error) {
+	if c.searchServer == "" {
+		return nil, ErrNoSearchServer
+	}
+	req := c.newRequest("GET", fmt.Sprintf("%s/camli/search/snapshots?permanode=%s", c.searchServer, pn))
+	resp, err := c.doReq(req)
+	if err != nil {
+		return nil, err
+	}
+	jmap, err := c.jsonFromResponse("snapshots", resp)
+	if err != nil {
+		return nil, err
+	}
+	if errStr, ok := jmap["error"].(string); ok {
+		return nil, fmt.Errorf("client: error listing the snapshots of %s: %s", pn, errStr)
+	}
+
+	jsnaps, _ := jmap["snapshots"].([]interface{})
+	snaps := make([]*Snapshot, 0, len(jsnaps))
+	for _, js := range jsnaps {
+		m, _ := js.(map[string]interface{})
+		claim, _ := m["claim"].(string)
+		date, _ := m["date"].(string)
+		content, _ := m["content"].(string)
+		snap := &Snapshot{Claim: blobref.Parse(claim), Content: blobref.Parse(content)}
+		snap.Date, err = time.Parse(time.RFC3339, date)
+		if err != nil || snap.Claim == nil || snap.Content == nil {
+			return nil, fmt.Errorf("client: invalid snapshot of %s in search response: %v", pn, js)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
@@ -62,6 +62,7 @@ type statResponse struct {
 	uploadUrl                  string
 	uploadUrlExpirationSeconds int
 	canLongPoll                bool
+	resumableUploadUrl         string // optional
 }
 
 type ResponseFormatError error
@@ -120,6 +121,10 @@ func parseStatResponse(r io.Reader) (sr *statResponse, outerr error) {
 		s.canLongPoll = v
 	}
 
+	if v, ok := jmap["resumableUploadUrl"].(string); ok {
+		s.resumableUploadUrl = v
+	}
+
 	alreadyHave, ok := jmap["stat"].([]interface{})
 	if !ok {
 		return nil, newResFormatError("no 'stat' key in stat response")
@@ -149,13 +154,14 @@ func parseStatResponse(r io.Reader) (sr *statResponse, outerr error) {
 }
 
 func NewUploadHandleFromString(data string) *UploadHandle {
-	bref := blobref.SHA1FromString(data)
+	bref := blobref.FromString(data)
 	r := strings.NewReader(data)
 	return &UploadHandle{BlobRef: bref, Size: int64(len(data)), Contents: r}
 }
 
 func (c *Client) jsonFromResponse(requestName string, resp *http.Response) (map[string]interface{}, error) {
 	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
 		log.Printf("After %s request, failed to JSON from response; status code is %d", requestName, resp.StatusCode)
 		io.Copy(os.Stderr, resp.Body)
 		return nil, errors.New(fmt.Sprintf("After %s request, HTTP response code is %d; no JSON to parse.", requestName, resp.StatusCode))
@@ -202,7 +208,7 @@ func (c *Client) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.Bl
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.ContentLength = int64(len(bodyStr))
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doReq(req)
 	if err != nil {
 		return fmt.Errorf("stat HTTP error: %v", err)
 	}
@@ -219,6 +225,11 @@ func (c *Client) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.Bl
 		return err
 	}
 
+	for _, br := range blobs {
+		if _, ok := stat.HaveMap[br.String()]; !ok {
+			c.noteMissing(br)
+		}
+	}
 	for _, sb := range stat.HaveMap {
 		dest <- sb
 	}
@@ -237,7 +248,7 @@ func readerAndSize(h *UploadHandle) (io.Reader, int64, error) {
 	if err != nil {
 		return nil, 0, err
 	}
-	return &b, n, nil
+	return bytes.NewReader(b.Bytes()), n, nil
 }
 
 func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
@@ -259,33 +270,25 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 
 	blobrefStr := h.BlobRef.String()
 
-	// Pre-upload.  Check whether the blob already exists on the
-	// server and if not, the URL to upload it to.
-	url_ := fmt.Sprintf("%s/camli/stat", c.server)
-	requestBody := "camliversion=1&blob1=" + blobrefStr
-	req := c.newRequest("POST", url_)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Body = ioutil.NopCloser(strings.NewReader(requestBody))
-	req.ContentLength = int64(len(requestBody))
-	req.TransferEncoding = nil
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return errorf("stat http error: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return errorf("stat response had http status %d", resp.StatusCode)
+	pr := &PutResult{BlobRef: h.BlobRef, Size: bodySize}
+	if c.batcher != nil && bodySize <= smallBlobSize && bodySize <= c.batcher.max {
+		data, err := ioutil.ReadAll(bodyReader)
+		if closer, ok := h.Contents.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c.batcher.upload(pr, data)
 	}
 
-	stat, err := parseStatResponse(resp.Body)
+	// Pre-upload.  Check whether the blob already exists on the
+	// server and if not, the URL to upload it to.
+	stat, err := c.statForUpload([]string{blobrefStr})
 	if err != nil {
-		return nil, err
+		return errorf("%v", err)
 	}
-	resp.Body.Close()
 
-	pr := &PutResult{BlobRef: h.BlobRef, Size: bodySize}
 	if _, ok := stat.HaveMap[blobrefStr]; ok {
 		pr.Skipped = true
 		if closer, ok := h.Contents.(io.Closer); ok {
@@ -294,6 +297,12 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 		return pr, nil
 	}
 
+	if stat.resumableUploadUrl != "" && bodySize >= c.resumableThreshold() {
+		if rs, ok := bodyReader.(io.ReadSeeker); ok {
+			return c.uploadResumable(pr, rs, stat.resumableUploadUrl)
+		}
+	}
+
 	pipeReader, pipeWriter := io.Pipe()
 	multipartWriter := multipart.NewWriter(pipeWriter)
 
@@ -315,47 +324,106 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 	// TODO(bradfitz): verbosity levels. make this VLOG(2) or something. it's noisy:
 	// c.log.Printf("Uploading %s to URL: %s", blobrefStr, stat.uploadUrl)
 
-	req = c.newRequest("POST", stat.uploadUrl)
+	req := c.newRequest("POST", stat.uploadUrl)
 	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
 	req.Body = ioutil.NopCloser(pipeReader)
 	req.ContentLength = multipartOverhead + bodySize + int64(len(blobrefStr))*2
 	req.TransferEncoding = nil
-	resp, err = c.httpClient.Do(req)
+	resp, err := c.doReq(req)
 	if err != nil {
 		return errorf("upload http error: %v", err)
 	}
-	defer resp.Body.Close()
 
 	// check error from earlier copy
 	if err := <-copyResult; err != nil {
+		resp.Body.Close()
 		return errorf("failed to copy contents into multipart writer: %v", err)
 	}
 
+	ures, err := c.uploadResponse(stat.uploadUrl, resp)
+	if err != nil {
+		return errorf("%v", err)
+	}
+	return c.uploadResult(pr, ures)
+}
+
+// statForUpload stats the blobs before uploading them, to learn
+// which ones the server has and where to upload the others.
+func (c *Client) statForUpload(blobs []string) (*statResponse, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "camliversion=1")
+	for n, blob := range blobs {
+		fmt.Fprintf(&buf, "&blob%d=%s", n+1, blob)
+	}
+	requestBody := buf.String()
+	req := c.newRequest("POST", fmt.Sprintf("%s/camli/stat", c.server))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = ioutil.NopCloser(strings.NewReader(requestBody))
+	req.ContentLength = int64(len(requestBody))
+	req.TransferEncoding = nil
+
+	resp, err := c.doReq(req)
+	if err != nil {
+		return nil, fmt.Errorf("stat http error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("stat response had http status %d", resp.StatusCode)
+	}
+	stat, err := parseStatResponse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		if _, ok := stat.HaveMap[blob]; !ok {
+			c.noteMissing(blobref.Parse(blob))
+		}
+	}
+	return stat, nil
+}
+
+// uploadResponse returns the JSON response of an upload POST to
+// uploadURL, following its redirect if any.
+func (c *Client) uploadResponse(uploadURL string, resp *http.Response) (map[string]interface{}, error) {
 	// The only valid HTTP responses are 200 and 303.
 	if resp.StatusCode != 200 && resp.StatusCode != 303 {
-		return errorf("invalid http response %d in upload response", resp.StatusCode)
+		resp.Body.Close()
+		return nil, fmt.Errorf("invalid http response %d in upload response", resp.StatusCode)
 	}
 
 	if resp.StatusCode == 303 {
+		resp.Body.Close()
 		otherLocation := resp.Header.Get("Location")
 		if otherLocation == "" {
-			return errorf("303 without a Location")
+			return nil, errors.New("303 without a Location")
 		}
-		baseUrl, _ := url.Parse(stat.uploadUrl)
+		baseUrl, _ := url.Parse(uploadURL)
 		absUrl, err := baseUrl.Parse(otherLocation)
 		if err != nil {
-			return errorf("303 Location URL relative resolve error: %v", err)
+			return nil, fmt.Errorf("303 Location URL relative resolve error: %v", err)
 		}
 		otherLocation = absUrl.String()
 		resp, err = http.Get(otherLocation)
 		if err != nil {
-			return errorf("error following 303 redirect after upload: %v", err)
+			return nil, fmt.Errorf("error following 303 redirect after upload: %v", err)
 		}
 	}
 
 	ures, err := c.jsonFromResponse("upload", resp)
 	if err != nil {
-		return errorf("json parse from upload error: %v", err)
+		return nil, fmt.Errorf("json parse from upload error: %v", err)
+	}
+	return ures, nil
+}
+
+// uploadResult returns pr once the upload response ures confirms
+// that the server received pr's blob.
+func (c *Client) uploadResult(pr *PutResult, ures map[string]interface{}) (*PutResult, error) {
+	errorf := func(msg string, arg ...interface{}) (*PutResult, error) {
+		err := fmt.Errorf(msg, arg...)
+		c.log.Print(err.Error())
+		return nil, err
 	}
 
 	errorText, ok := ures["errorText"].(string)
@@ -368,7 +436,8 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 		return errorf("upload json validity error: no 'received'")
 	}
 
-	expectedSize := bodySize
+	blobrefStr := pr.BlobRef.String()
+	expectedSize := pr.Size
 
 	for _, rit := range received {
 		it, ok := rit.(map[string]interface{})
@@ -386,9 +455,6 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 					c.stats.Uploads.Blobs++
 					c.stats.Uploads.Bytes += expectedSize
 					c.statsMutex.Unlock()
-					if pr.Size == -1 {
-						pr.Size = expectedSize
-					}
 					return pr, nil
 				} else {
 					return errorf("Server got blob, but reports wrong length (%v; we sent %d)",
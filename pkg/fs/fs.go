@@ -51,6 +51,10 @@ type CamliFileSystem struct {
 	// permissions to 0600/0700.
 	IgnoreOwners bool
 
+	// srv, if non-nil, is where the changes to a mutable file system
+	// are stored. See NewMutableCamliFileSystem in mut.go.
+	srv Server
+
 	blobToSchema *lru.Cache // ~map[blobstring]*schema.Superset
 	nameToBlob   *lru.Cache // ~map[string]*blobref.BlobRef
 	nameToAttr   *lru.Cache // ~map[string]*fuse.Attr
@@ -0,0 +1,609 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// Server is what a mutable CamliFileSystem needs from the Camlistore
+// server it stores its changes on, on top of fetching blobs.
+type Server interface {
+	// StatReceiver receives the chunks and schema blobs of written
+	// files.
+	blobserver.StatReceiver
+
+	// UploadAndSignMap signs the schema map m with the user's
+	// identity and uploads it.
+	UploadAndSignMap(m map[string]interface{}) (*blobref.BlobRef, error)
+
+	// PermanodeAttrs returns the current attributes of the
+	// permanode pn.
+	PermanodeAttrs(pn *blobref.BlobRef) (url.Values, error)
+}
+
+// In a mutable file system, each directory and file is a permanode.
+// A directory's entries are its "camliPath:<name>" attributes, which
+// point to their permanodes, and a file's contents are the "file"
+// schema blob its "camliContent" attribute points to.
+const pathAttrPrefix = "camliPath:"
+
+// NewMutableCamliFileSystem returns a read/write CamliFileSystem whose
+// root directory is the permanode root. Changes are uploaded to srv as
+// they're made.
+func NewMutableCamliFileSystem(fetcher blobref.SeekFetcher, srv Server, root *blobref.BlobRef) *CamliFileSystem {
+	fs := newCamliFileSystem(fetcher)
+	fs.srv = srv
+	fs.root = &mutDir{fs: fs, permanode: root, name: "/"}
+	return fs
+}
+
+// newPermanode creates a new permanode and returns its blobref.
+func (fs *CamliFileSystem) newPermanode() (*blobref.BlobRef, error) {
+	return fs.srv.UploadAndSignMap(schema.NewUnsignedPermanode())
+}
+
+// claim uploads a signed claim, built by one of the schema.New*Claim
+// functions.
+func (fs *CamliFileSystem) claim(m map[string]interface{}) error {
+	_, err := fs.srv.UploadAndSignMap(m)
+	return err
+}
+
+// mutDir is a mutable directory, backed by a permanode.
+type mutDir struct {
+	fs        *CamliFileSystem
+	permanode *blobref.BlobRef
+	name      string // for logging
+
+	mu       sync.Mutex
+	children map[string]fuse.Node // *mutDir or *mutFile; nil until populated
+	mtime    time.Time
+}
+
+func (n *mutDir) Attr() fuse.Attr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return fuse.Attr{
+		Mode:  os.ModeDir | 0700,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Mtime: n.mtime,
+	}
+}
+
+// populate loads the directory entries from the permanode's
+// attributes, once.
+//
+// TODO: refresh them now and then, to see changes made elsewhere.
+//
+// n.mu must be held.
+func (n *mutDir) populate() error {
+	if n.children != nil {
+		return nil
+	}
+	attrs, err := n.fs.srv.PermanodeAttrs(n.permanode)
+	if err != nil {
+		return err
+	}
+	children := make(map[string]fuse.Node)
+	for attr, vals := range attrs {
+		if !strings.HasPrefix(attr, pathAttrPrefix) || len(vals) == 0 {
+			continue
+		}
+		name := attr[len(pathAttrPrefix):]
+		pn := blobref.Parse(vals[0])
+		if pn == nil {
+			continue
+		}
+		child, err := n.fs.newMutNode(pn, name)
+		if err != nil {
+			log.Printf("mutable fs: error loading %q (%v) in %v: %v", name, pn, n.permanode, err)
+			continue
+		}
+		children[name] = child
+	}
+	n.children = children
+	return nil
+}
+
+// newMutNode returns the node for the permanode pn: a file if it has
+// a camliContent, else a directory.
+func (fs *CamliFileSystem) newMutNode(pn *blobref.BlobRef, name string) (fuse.Node, error) {
+	attrs, err := fs.srv.PermanodeAttrs(pn)
+	if err != nil {
+		return nil, err
+	}
+	content := blobref.Parse(attrs.Get("camliContent"))
+	if content == nil {
+		return &mutDir{fs: fs, permanode: pn, name: name}, nil
+	}
+	ss, err := fs.fetchSchemaSuperset(content)
+	if err != nil {
+		return nil, err
+	}
+	return &mutFile{
+		fs:        fs,
+		permanode: pn,
+		name:      name,
+		content:   content,
+		size:      int64(ss.SumPartsSize()),
+		mtime:     ss.ModTime(),
+	}, nil
+}
+
+func (n *mutDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.populate(); err != nil {
+		log.Printf("mutable fs: error reading directory %v: %v", n.permanode, err)
+		return nil, fuse.EIO
+	}
+	var names []string
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dirents := make([]fuse.Dirent, 0, len(names))
+	for _, name := range names {
+		dirents = append(dirents, fuse.Dirent{Name: name})
+	}
+	return dirents, nil
+}
+
+func (n *mutDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.populate(); err != nil {
+		log.Printf("mutable fs: error reading directory %v: %v", n.permanode, err)
+		return nil, fuse.EIO
+	}
+	child, ok := n.children[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return child, nil
+}
+
+// addChild creates a new permanode and links it as name in n.
+//
+// n.mu must be held and n populated.
+func (n *mutDir) addChild(name string) (*blobref.BlobRef, fuse.Error) {
+	if _, ok := n.children[name]; ok {
+		return nil, fuse.Errno(syscall.EEXIST)
+	}
+	pn, err := n.fs.newPermanode()
+	if err != nil {
+		log.Printf("mutable fs: error creating permanode for %q: %v", name, err)
+		return nil, fuse.EIO
+	}
+	if err := n.fs.claim(schema.NewSetAttributeClaim(n.permanode, pathAttrPrefix+name, pn.String())); err != nil {
+		log.Printf("mutable fs: error linking %q in %v: %v", name, n.permanode, err)
+		return nil, fuse.EIO
+	}
+	n.mtime = time.Now()
+	return pn, nil
+}
+
+func (n *mutDir) Mkdir(req *fuse.MkdirRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.populate(); err != nil {
+		return nil, fuse.EIO
+	}
+	pn, ferr := n.addChild(req.Name)
+	if ferr != nil {
+		return nil, ferr
+	}
+	child := &mutDir{
+		fs:        n.fs,
+		permanode: pn,
+		name:      req.Name,
+		children:  make(map[string]fuse.Node),
+		mtime:     time.Now(),
+	}
+	n.children[req.Name] = child
+	return child, nil
+}
+
+func (n *mutDir) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr fuse.Intr) (fuse.Node, fuse.Handle, fuse.Error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.populate(); err != nil {
+		return nil, nil, fuse.EIO
+	}
+	pn, ferr := n.addChild(req.Name)
+	if ferr != nil {
+		return nil, nil, ferr
+	}
+	child := &mutFile{
+		fs:        n.fs,
+		permanode: pn,
+		name:      req.Name,
+		mtime:     time.Now(),
+	}
+	h, err := child.newHandle(true, true)
+	if err != nil {
+		log.Printf("mutable fs: error creating %q: %v", req.Name, err)
+		return nil, nil, fuse.EIO
+	}
+	n.children[req.Name] = child
+	return child, h, nil
+}
+
+func (n *mutDir) Remove(req *fuse.RemoveRequest, intr fuse.Intr) fuse.Error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.populate(); err != nil {
+		return fuse.EIO
+	}
+	child, ok := n.children[req.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+	if dir, isDir := child.(*mutDir); isDir {
+		if !req.Dir {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		dir.mu.Lock()
+		err := dir.populate()
+		empty := len(dir.children) == 0
+		dir.mu.Unlock()
+		if err != nil {
+			return fuse.EIO
+		}
+		if !empty {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	} else if req.Dir {
+		return errNotDir
+	}
+	if err := n.fs.claim(schema.NewDelAttributeClaim(n.permanode, pathAttrPrefix+req.Name)); err != nil {
+		log.Printf("mutable fs: error removing %q from %v: %v", req.Name, n.permanode, err)
+		return fuse.EIO
+	}
+	delete(n.children, req.Name)
+	n.mtime = time.Now()
+	return nil
+}
+
+func (n *mutDir) Rename(req *fuse.RenameRequest, newDir fuse.Node, intr fuse.Intr) fuse.Error {
+	nd, ok := newDir.(*mutDir)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	n.mu.Lock()
+	err := n.populate()
+	child, ok := n.children[req.OldName]
+	n.mu.Unlock()
+	if err != nil {
+		return fuse.EIO
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+	pn := child.(interface {
+		permanodeRef() *blobref.BlobRef
+	}).permanodeRef()
+
+	// Link the new name before unlinking the old one, so the
+	// node is always reachable.
+	nd.mu.Lock()
+	if err := nd.populate(); err != nil {
+		nd.mu.Unlock()
+		return fuse.EIO
+	}
+	if err := n.fs.claim(schema.NewSetAttributeClaim(nd.permanode, pathAttrPrefix+req.NewName, pn.String())); err != nil {
+		nd.mu.Unlock()
+		log.Printf("mutable fs: error linking %q in %v: %v", req.NewName, nd.permanode, err)
+		return fuse.EIO
+	}
+	nd.children[req.NewName] = child
+	nd.mtime = time.Now()
+	nd.mu.Unlock()
+
+	if nd == n && req.NewName == req.OldName {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.fs.claim(schema.NewDelAttributeClaim(n.permanode, pathAttrPrefix+req.OldName)); err != nil {
+		log.Printf("mutable fs: error unlinking %q from %v: %v", req.OldName, n.permanode, err)
+		return fuse.EIO
+	}
+	delete(n.children, req.OldName)
+	n.mtime = time.Now()
+	return nil
+}
+
+func (n *mutDir) permanodeRef() *blobref.BlobRef { return n.permanode }
+
+// mutFile is a mutable file, backed by a permanode.
+type mutFile struct {
+	fs        *CamliFileSystem
+	permanode *blobref.BlobRef
+	name      string // the name it was created or found with
+
+	mu      sync.Mutex
+	content *blobref.BlobRef // "file" schema blob; nil if never written
+	size    int64
+	mtime   time.Time
+}
+
+func (n *mutFile) permanodeRef() *blobref.BlobRef { return n.permanode }
+
+func (n *mutFile) Attr() fuse.Attr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return fuse.Attr{
+		Mode:  0600,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Size:  uint64(n.size),
+		Mtime: n.mtime,
+	}
+}
+
+func (n *mutFile) Open(req *fuse.OpenRequest, res *fuse.OpenResponse, intr fuse.Intr) (fuse.Handle, fuse.Error) {
+	writable := req.Flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	h, err := n.newHandle(writable, req.Flags&syscall.O_TRUNC != 0)
+	if err != nil {
+		log.Printf("mutable fs: error opening %v: %v", n.permanode, err)
+		return nil, fuse.EIO
+	}
+	return h, nil
+}
+
+func (n *mutFile) Setattr(req *fuse.SetattrRequest, res *fuse.SetattrResponse, intr fuse.Intr) fuse.Error {
+	if req.Valid&fuse.SetattrSize != 0 {
+		h, err := n.newHandle(true, req.Size == 0)
+		if err == nil {
+			err = h.tmp.Truncate(int64(req.Size))
+		}
+		if err == nil {
+			h.dirty = true
+			err = h.close()
+		}
+		if err != nil {
+			log.Printf("mutable fs: error truncating %v: %v", n.permanode, err)
+			return fuse.EIO
+		}
+	}
+	res.AttrValid = 1 * time.Minute
+	res.Attr = n.Attr()
+	return nil
+}
+
+// reader returns a reader of the file's current contents, from
+// offset on. The chunks before offset aren't fetched.
+func (n *mutFile) reader(offset int64) (io.Reader, error) {
+	n.mu.Lock()
+	content := n.content
+	n.mu.Unlock()
+	if content == nil {
+		return strings.NewReader(""), nil
+	}
+	ss, err := n.fs.fetchSchemaSuperset(content)
+	if err != nil {
+		return nil, err
+	}
+	fr, err := ss.NewFileReader(n.fs.fetcher)
+	if err != nil {
+		return nil, err
+	}
+	fr.Skip(uint64(offset))
+	return fr, nil
+}
+
+// newHandle returns a handle to read, and if writable, write the
+// file. Writable handles work on a temporary copy of the file, which
+// starts empty if trunc.
+func (n *mutFile) newHandle(writable, trunc bool) (*mutFileHandle, error) {
+	h := &mutFileHandle{f: n}
+	if !writable {
+		return h, nil
+	}
+	tmp, err := ioutil.TempFile("", "camli-fuse")
+	if err != nil {
+		return nil, err
+	}
+	h.tmp = tmp
+	if trunc {
+		h.dirty = true
+		return h, nil
+	}
+	r, err := n.reader(0)
+	if err == nil {
+		_, err = io.Copy(tmp, r)
+	}
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+	return h, nil
+}
+
+// setContent uploads the contents of r as the new file contents, and
+// points the permanode's camliContent at them.
+func (n *mutFile) setContent(r io.Reader) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cr := &countingReader{r: r}
+	br, err := schema.WriteFileMapRolling(n.fs.srv, schema.NewFileMap(n.name), cr)
+	if err != nil {
+		return err
+	}
+	if err := n.fs.claim(schema.NewSetAttributeClaim(n.permanode, "camliContent", br.String())); err != nil {
+		return err
+	}
+	n.content, n.size, n.mtime = br, cr.n, time.Now()
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// mutFileHandle is an open mutFile.
+type mutFileHandle struct {
+	f *mutFile
+
+	mu    sync.Mutex
+	tmp   *os.File // nil if read-only
+	dirty bool     // tmp has changes not uploaded yet
+}
+
+func (h *mutFileHandle) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fuse.Intr) fuse.Error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buf := make([]byte, req.Size)
+	var n int
+	var err error
+	if h.tmp != nil {
+		n, err = h.tmp.ReadAt(buf, req.Offset)
+	} else {
+		var r io.Reader
+		r, err = h.f.reader(req.Offset)
+		if err == nil {
+			// TODO: like nodeReader, don't make a new
+			// FileReader for each read.
+			n, err = io.ReadFull(r, buf)
+		}
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Printf("mutable fs: error reading %v at %d: %v", h.f.permanode, req.Offset, err)
+		return fuse.EIO
+	}
+	res.Data = buf[:n]
+	return nil
+}
+
+func (h *mutFileHandle) Write(req *fuse.WriteRequest, res *fuse.WriteResponse, intr fuse.Intr) fuse.Error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tmp == nil {
+		return fuse.Errno(syscall.EBADF)
+	}
+	n, err := h.tmp.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		log.Printf("mutable fs: error writing %v: %v", h.f.permanode, err)
+		return fuse.EIO
+	}
+	h.dirty = true
+	res.Size = n
+	return nil
+}
+
+// WriteAll replaces the whole contents of the file. It's used by the
+// fuse package for files written sequentially after being created or
+// truncated.
+func (h *mutFileHandle) WriteAll(data []byte, intr fuse.Intr) fuse.Error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tmp == nil {
+		return fuse.Errno(syscall.EBADF)
+	}
+	err := h.tmp.Truncate(0)
+	if err == nil {
+		_, err = h.tmp.WriteAt(data, 0)
+	}
+	if err != nil {
+		log.Printf("mutable fs: error writing %v: %v", h.f.permanode, err)
+		return fuse.EIO
+	}
+	h.dirty = true
+	return nil
+}
+
+func (h *mutFileHandle) Flush(req *fuse.FlushRequest, intr fuse.Intr) fuse.Error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.upload(); err != nil {
+		log.Printf("mutable fs: error uploading %v: %v", h.f.permanode, err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (h *mutFileHandle) Release(req *fuse.ReleaseRequest, intr fuse.Intr) fuse.Error {
+	if err := h.close(); err != nil {
+		log.Printf("mutable fs: error uploading %v: %v", h.f.permanode, err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// upload uploads the temporary copy of the file, if it changed.
+//
+// h.mu must be held.
+func (h *mutFileHandle) upload() error {
+	if !h.dirty {
+		return nil
+	}
+	if _, err := h.tmp.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if err := h.f.setContent(h.tmp); err != nil {
+		return err
+	}
+	h.dirty = false
+	return nil
+}
+
+// close uploads the pending changes and releases the handle.
+func (h *mutFileHandle) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tmp == nil {
+		return nil
+	}
+	err := h.upload()
+	h.release()
+	return err
+}
+
+// release removes the temporary copy of the file.
+func (h *mutFileHandle) release() {
+	if h.tmp != nil {
+		h.tmp.Close()
+		os.Remove(h.tmp.Name())
+		h.tmp = nil
+	}
+}
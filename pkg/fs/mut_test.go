@@ -0,0 +1,225 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/test"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// fakeServer is an in-memory Server. Its claims aren't signed, and
+// are applied to the permanodes' attributes as they're uploaded.
+type fakeServer struct {
+	test.Fetcher
+
+	mu    sync.Mutex
+	attrs map[string]url.Values // permanode -> attributes
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{attrs: make(map[string]url.Values)}
+}
+
+func (s *fakeServer) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	b, err := ioutil.ReadAll(source)
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	s.AddBlob(&test.Blob{Contents: string(b)})
+	return blobref.SizedBlobRef{BlobRef: br, Size: int64(len(b))}, nil
+}
+
+func (s *fakeServer) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
+	for _, br := range blobs {
+		if rc, size, err := s.Fetch(br); err == nil {
+			rc.Close()
+			dest <- blobref.SizedBlobRef{BlobRef: br, Size: size}
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) UploadAndSignMap(m map[string]interface{}) (*blobref.BlobRef, error) {
+	json, err := schema.MapToCamliJSON(m)
+	if err != nil {
+		return nil, err
+	}
+	b := &test.Blob{Contents: json}
+	s.AddBlob(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m["camliType"] {
+	case "permanode":
+		s.attrs[b.BlobRef().String()] = make(url.Values)
+	case "claim":
+		attrs := s.attrs[m["permaNode"].(string)]
+		attr, _ := m["attribute"].(string)
+		switch m["claimType"] {
+		case "set-attribute":
+			attrs.Set(attr, m["value"].(string))
+		case "del-attribute":
+			attrs.Del(attr)
+		}
+	}
+	return b.BlobRef(), nil
+}
+
+func (s *fakeServer) PermanodeAttrs(pn *blobref.BlobRef) (url.Values, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs, ok := s.attrs[pn.String()]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	dup := make(url.Values)
+	for k, v := range attrs {
+		dup[k] = append([]string(nil), v...)
+	}
+	return dup, nil
+}
+
+func readDirNames(t *testing.T, n fuse.Node) []string {
+	dirents, err := n.(*mutDir).ReadDir(nil)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	names := []string{}
+	for _, de := range dirents {
+		names = append(names, de.Name)
+	}
+	return names
+}
+
+func TestMutableFS(t *testing.T) {
+	srv := newFakeServer()
+	root, err := srv.UploadAndSignMap(schema.NewUnsignedPermanode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewMutableCamliFileSystem(srv, srv, root)
+	rootDir := fs.root.(*mutDir)
+
+	dirNode, ferr := rootDir.Mkdir(&fuse.MkdirRequest{Name: "dir"}, nil)
+	if ferr != nil {
+		t.Fatalf("Mkdir: %v", ferr)
+	}
+	if _, err := rootDir.Mkdir(&fuse.MkdirRequest{Name: "dir"}, nil); err != fuse.Errno(syscall.EEXIST) {
+		t.Errorf("second Mkdir = %v; want EEXIST", err)
+	}
+	dir := dirNode.(*mutDir)
+	_, h, ferr := dir.Create(&fuse.CreateRequest{Name: "a.txt"}, &fuse.CreateResponse{}, nil)
+	if ferr != nil {
+		t.Fatalf("Create: %v", ferr)
+	}
+	fh := h.(*mutFileHandle)
+	if err := fh.WriteAll([]byte("hello"), nil); err != nil {
+		t.Fatalf("WriteAll: %v", err)
+	}
+	if err := fh.Flush(&fuse.FlushRequest{}, nil); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := fh.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	// A fresh file system on the same server sees the changes.
+	fs = NewMutableCamliFileSystem(srv, srv, root)
+	rootDir = fs.root.(*mutDir)
+	if got, want := readDirNames(t, rootDir), []string{"dir"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("root entries = %q; want %q", got, want)
+	}
+	dirNode, ferr = rootDir.Lookup("dir", nil)
+	if ferr != nil {
+		t.Fatalf("Lookup(dir): %v", ferr)
+	}
+	fileNode, ferr := dirNode.(*mutDir).Lookup("a.txt", nil)
+	if ferr != nil {
+		t.Fatalf("Lookup(a.txt): %v", ferr)
+	}
+	file := fileNode.(*mutFile)
+	if size := file.Attr().Size; size != 5 {
+		t.Errorf("size = %d; want 5", size)
+	}
+	h, ferr = file.Open(&fuse.OpenRequest{Flags: uint32(os.O_RDONLY)}, &fuse.OpenResponse{}, nil)
+	if ferr != nil {
+		t.Fatalf("Open: %v", ferr)
+	}
+	res := &fuse.ReadResponse{}
+	if err := h.(*mutFileHandle).Read(&fuse.ReadRequest{Offset: 1, Size: 10}, res, nil); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(res.Data) != "ello" {
+		t.Errorf("read %q; want %q", res.Data, "ello")
+	}
+
+	// Overwrite the middle of the file.
+	h, ferr = file.Open(&fuse.OpenRequest{Flags: uint32(os.O_RDWR)}, &fuse.OpenResponse{}, nil)
+	if ferr != nil {
+		t.Fatalf("Open for writing: %v", ferr)
+	}
+	fh = h.(*mutFileHandle)
+	if err := fh.Write(&fuse.WriteRequest{Offset: 1, Data: []byte("ipp")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := fh.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	r, err := file.reader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "hippo" {
+		t.Errorf("contents = %q; want %q", b, "hippo")
+	}
+	r, err = file.reader(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "po" {
+		t.Errorf("contents from offset 3 = %q; want %q", b, "po")
+	}
+
+	ferr = rootDir.Remove(&fuse.RemoveRequest{Name: "dir", Dir: true}, nil)
+	if ferr != fuse.Errno(syscall.ENOTEMPTY) {
+		t.Errorf("Remove of non-empty dir = %v; want ENOTEMPTY", ferr)
+	}
+	if err := dirNode.(*mutDir).Rename(&fuse.RenameRequest{OldName: "a.txt", NewName: "b.txt"}, rootDir, nil); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := rootDir.Remove(&fuse.RemoveRequest{Name: "dir", Dir: true}, nil); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	fs = NewMutableCamliFileSystem(srv, srv, root)
+	if got, want := readDirNames(t, fs.root), []string{"b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("root entries = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fsck verifies that the blobs of a storage still match their
+// blobrefs, to find the blobs damaged after they were received (bit
+// rot on disk, truncated objects in S3, ...), and optionally
+// quarantines and repairs them.
+package fsck
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+// enumerateLimit is how many blobs are asked from the storage per
+// enumeration.
+const enumerateLimit = 1000
+
+// Kind is the kind of a Problem.
+type Kind string
+
+const (
+	// Missing is a blob enumerated but not found when fetched.
+	Missing Kind = "missing"
+	// Unreadable is a blob that failed to be fetched or read.
+	Unreadable Kind = "unreadable"
+	// Empty is a blob with no contents, other than the empty blob.
+	Empty Kind = "zero-length"
+	// Corrupt is a blob whose contents don't match its blobref.
+	Corrupt Kind = "corrupt"
+)
+
+// A Problem is a damaged blob found by a Checker.
+type Problem struct {
+	BlobRef *blobref.BlobRef
+	Size    int64 // as enumerated
+	Kind    Kind
+	Err     error // for Missing and Unreadable blobs
+
+	Quarantined bool
+	Repaired    bool
+	FixErr      error // the error quarantining or repairing the blob, if any
+}
+
+func (p *Problem) String() string {
+	s := fmt.Sprintf("%s: %s", p.BlobRef, p.Kind)
+	if p.Err != nil {
+		s += fmt.Sprintf(" (%v)", p.Err)
+	}
+	if p.Quarantined {
+		s += "; quarantined"
+	}
+	if p.Repaired {
+		s += "; repaired"
+	}
+	if p.FixErr != nil {
+		s += fmt.Sprintf("; fix failed: %v", p.FixErr)
+	}
+	return s
+}
+
+// Stats are the counts of a check.
+type Stats struct {
+	Blobs       int64
+	Bytes       int64
+	Problems    int64
+	Quarantined int64
+	Repaired    int64
+}
+
+// A Checker checks the blobs of a storage.
+type Checker struct {
+	Storage blobserver.Storage
+
+	// Quarantine, if true, moves the damaged blobs out of the way.
+	// Storage must implement blobserver.Quarantiner.
+	Quarantine bool
+
+	// RepairFrom, if non-nil, is where good copies of the damaged
+	// blobs are fetched from, such as a replica or a remote server.
+	RepairFrom blobref.StreamingFetcher
+
+	// Report, if non-nil, is called with each problem found, after
+	// any quarantine or repair.
+	Report func(*Problem)
+
+	// Progress, if non-nil, is called after each blob checked with
+	// the stats so far.
+	Progress func(Stats)
+}
+
+// Run checks all the blobs of c.Storage. The error is only about the
+// failure to carry the check on; the damaged blobs are reported to
+// c.Report and counted in the returned stats.
+func (c *Checker) Run() (Stats, error) {
+	var st Stats
+	if _, ok := c.Storage.(blobserver.Quarantiner); c.Quarantine && !ok {
+		return st, fmt.Errorf("fsck: storage (type %T) doesn't support quarantine", c.Storage)
+	}
+	after := ""
+	for {
+		ch := make(chan blobref.SizedBlobRef, enumerateLimit)
+		errch := make(chan error, 1)
+		go func(after string) {
+			errch <- c.Storage.EnumerateBlobs(ch, after, enumerateLimit, 0)
+		}(after)
+		var sbs []blobref.SizedBlobRef
+		for sb := range ch {
+			sbs = append(sbs, sb)
+		}
+		if err := <-errch; err != nil {
+			return st, fmt.Errorf("fsck: error enumerating blobs: %v", err)
+		}
+		if len(sbs) == 0 {
+			return st, nil
+		}
+		for _, sb := range sbs {
+			st.Blobs++
+			st.Bytes += sb.Size
+			if p := c.check(sb); p != nil {
+				c.fix(p)
+				st.Problems++
+				if p.Quarantined {
+					st.Quarantined++
+				}
+				if p.Repaired {
+					st.Repaired++
+				}
+				if c.Report != nil {
+					c.Report(p)
+				}
+			}
+			if c.Progress != nil {
+				c.Progress(st)
+			}
+		}
+		after = sbs[len(sbs)-1].BlobRef.String()
+	}
+}
+
+// check re-hashes the blob sb, returning its problem if any.
+func (c *Checker) check(sb blobref.SizedBlobRef) *Problem {
+	p := &Problem{BlobRef: sb.BlobRef, Size: sb.Size}
+	h := sb.BlobRef.Hash()
+	if h == nil {
+		p.Kind, p.Err = Unreadable, errors.New("unsupported digest")
+		return p
+	}
+	rc, _, err := c.Storage.FetchStreaming(sb.BlobRef)
+	if err == os.ErrNotExist {
+		p.Kind = Missing
+		return p
+	}
+	if err != nil {
+		p.Kind, p.Err = Unreadable, err
+		return p
+	}
+	defer rc.Close()
+	n, err := io.Copy(h, rc)
+	switch {
+	case err != nil:
+		p.Kind, p.Err = Unreadable, err
+	case sb.BlobRef.HashMatches(h):
+		return nil
+	case n == 0:
+		p.Kind = Empty
+	default:
+		p.Kind = Corrupt
+	}
+	return p
+}
+
+// fix quarantines and repairs p's blob, as configured.
+func (c *Checker) fix(p *Problem) {
+	if c.Quarantine && p.Kind != Missing {
+		if p.FixErr = c.Storage.(blobserver.Quarantiner).Quarantine(p.BlobRef); p.FixErr != nil {
+			return
+		}
+		p.Quarantined = true
+	}
+	if c.RepairFrom != nil {
+		p.FixErr = c.repair(p)
+		p.Repaired = p.FixErr == nil
+	}
+}
+
+// repair stores in c.Storage a good copy of p's blob from c.RepairFrom.
+// The damaged copy is moved out of the way first, as storages may skip
+// receiving the blobs they already have, and the blob is checked again
+// once received.
+func (c *Checker) repair(p *Problem) error {
+	br := p.BlobRef
+	rc, _, err := c.RepairFrom.FetchStreaming(br)
+	if err != nil {
+		return fmt.Errorf("fetching good copy: %v", err)
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	h := br.Hash()
+	n, err := io.Copy(io.MultiWriter(h, &buf), rc)
+	if err != nil {
+		return fmt.Errorf("fetching good copy: %v", err)
+	}
+	if !br.HashMatches(h) {
+		return errors.New("copy to repair from is corrupt too")
+	}
+	if p.Kind != Missing && !p.Quarantined {
+		if q, ok := c.Storage.(blobserver.Quarantiner); ok {
+			err = q.Quarantine(br)
+			p.Quarantined = err == nil
+		} else {
+			err = c.Storage.RemoveBlobs([]*blobref.BlobRef{br})
+		}
+		if err != nil {
+			return fmt.Errorf("removing damaged copy: %v", err)
+		}
+	}
+	if _, err := c.Storage.ReceiveBlob(br, &buf); err != nil {
+		return err
+	}
+	if q := c.check(blobref.SizedBlobRef{BlobRef: br, Size: n}); q != nil {
+		return fmt.Errorf("blob still %s after repair", q.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsck
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/test"
+)
+
+// blobFile returns the file of br in the localdisk storage at root.
+func blobFile(t *testing.T, root string, br *blobref.BlobRef) string {
+	var file string
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Name() == localdisk.BlobFileBaseName(br) {
+			file = path
+		}
+		return nil
+	})
+	if file == "" {
+		t.Fatalf("no file for %v", br)
+	}
+	return file
+}
+
+func TestChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sto, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := &test.Blob{Contents: "good"}
+	rotten := &test.Blob{Contents: "rotten"}
+	truncated := &test.Blob{Contents: "truncated"}
+	replica := new(test.Fetcher)
+	for _, b := range []*test.Blob{good, rotten, truncated} {
+		if _, err := sto.ReceiveBlob(b.BlobRef(), b.Reader()); err != nil {
+			t.Fatal(err)
+		}
+		replica.AddBlob(b)
+	}
+	if err := ioutil.WriteFile(blobFile(t, dir, rotten.BlobRef()), []byte("rottem"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blobFile(t, dir, truncated.BlobRef()), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	problems := make(map[string]*Problem)
+	c := &Checker{
+		Storage: sto,
+		Report: func(p *Problem) {
+			problems[p.BlobRef.String()] = p
+		},
+	}
+	st, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Blobs != 3 || st.Problems != 2 {
+		t.Errorf("stats = %+v; want 3 blobs, 2 problems", st)
+	}
+	if p := problems[rotten.BlobRef().String()]; p == nil || p.Kind != Corrupt {
+		t.Errorf("rotten blob problem = %v; want corrupt", p)
+	}
+	if p := problems[truncated.BlobRef().String()]; p == nil || p.Kind != Empty {
+		t.Errorf("truncated blob problem = %v; want zero-length", p)
+	}
+
+	c.Quarantine = true
+	c.RepairFrom = replica
+	problems = make(map[string]*Problem)
+	if st, err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if st.Problems != 2 || st.Quarantined != 2 || st.Repaired != 2 {
+		t.Errorf("stats = %+v; want 2 problems quarantined and repaired", st)
+	}
+	quarantined, err := ioutil.ReadFile(filepath.Join(sto.PartitionRoot("quarantine"), blobFile(t, dir, rotten.BlobRef())[len(dir):]))
+	if err != nil || string(quarantined) != "rottem" {
+		t.Errorf("quarantined rotten blob = %q, %v", quarantined, err)
+	}
+
+	problems = make(map[string]*Problem)
+	if st, err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blobs != 3 || st.Problems != 0 {
+		t.Errorf("after repair, stats = %+v, problems %v", st, problems)
+	}
+}
+
+// skippingStorage is a storage without quarantine, which skips the
+// blobs it already has when receiving them.
+type skippingStorage struct {
+	blobserver.Storage
+	receives bool // whether ReceiveBlob stores anything at all
+}
+
+func (s *skippingStorage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	if rc, size, err := s.FetchStreaming(br); err == nil || !s.receives {
+		if err == nil {
+			rc.Close()
+		}
+		return blobref.SizedBlobRef{BlobRef: br, Size: size}, nil
+	}
+	return s.Storage.ReceiveBlob(br, source)
+}
+
+func TestRepairSkippingStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ld, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sto := &skippingStorage{Storage: ld, receives: true}
+	rotten := &test.Blob{Contents: "rotten"}
+	replica := new(test.Fetcher)
+	replica.AddBlob(rotten)
+	if _, err := sto.ReceiveBlob(rotten.BlobRef(), rotten.Reader()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blobFile(t, dir, rotten.BlobRef()), []byte("rottem"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var problem *Problem
+	c := &Checker{
+		Storage:    sto,
+		RepairFrom: replica,
+		Report:     func(p *Problem) { problem = p },
+	}
+	if st, err := c.Run(); err != nil || st.Repaired != 1 {
+		t.Fatalf("Run = %+v, %v; want 1 blob repaired (problem %v)", st, err, problem)
+	}
+	if st, err := c.Run(); err != nil || st.Problems != 0 {
+		t.Errorf("after repair, Run = %+v, %v; want no problems", st, err)
+	}
+
+	// A repair that doesn't take isn't reported as one.
+	if err := ioutil.WriteFile(blobFile(t, dir, rotten.BlobRef()), []byte("rottem"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sto.receives = false
+	problem = nil
+	if st, err := c.Run(); err != nil || st.Repaired != 0 || problem == nil || problem.FixErr == nil {
+		t.Errorf("Run with a storage dropping blobs = %+v, %v, problem %v; want a failed repair", st, err, problem)
+	}
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package gc finds and removes the blobs of a storage that nothing
+refers to anymore.
+
+The roots are the signed blobs (permanodes, claims and shares) and an
+explicit keep set. From them, a blob is reachable if it is:
+
+  - the signer's public key of a reachable signed blob,
+  - the permanode, target or blobref value of a reachable claim, unless
+    the claim was retracted by a "delete" claim of the same signer,
+  - a part of a reachable "file" or "bytes" schema blob,
+  - the entries of a reachable "directory", or
+  - a member of a reachable "static-set".
+
+Blobs being uploaded aren't reachable until the blob referencing them
+is, so unreachable blobs are only removed once they've been seen
+unreachable for a grace period, as recorded in a state file between
+runs.
+*/
+package gc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/schema"
+)
+
+const (
+	// enumerateLimit is how many blobs are asked from the storage per
+	// enumeration.
+	enumerateLimit = 1000
+
+	// removeBatch is how many blobs are removed per RemoveBlobs call.
+	removeBatch = 100
+)
+
+// A Collector collects the garbage of a storage.
+type Collector struct {
+	// Storage is the storage to remove garbage from. Reachability is
+	// computed from the blobs it holds, so it must hold all of them,
+	// not only a shard.
+	Storage blobserver.Storage
+
+	// Keep are additional roots, for blobs not referenced by any
+	// signed blob (e.g. files uploaded without a permanode).
+	Keep []*blobref.BlobRef
+
+	// GracePeriod is how long a blob must have been seen unreachable
+	// before it is removed. If non-zero, StateFile is required.
+	GracePeriod time.Duration
+
+	// StateFile is the file recording, between runs, since when the
+	// unreachable blobs have been.
+	StateFile string
+
+	// DryRun, if true, makes Run only report what it would remove.
+	DryRun bool
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Result is the outcome of a collection.
+type Result struct {
+	Blobs     int // blobs in the storage
+	Reachable int
+
+	// Removed are the unreachable blobs removed, or that would be
+	// removed in a dry run.
+	Removed []blobref.SizedBlobRef
+
+	// Pending are the unreachable blobs still in their grace period.
+	Pending []blobref.SizedBlobRef
+}
+
+// claimInfo is what marking needs to know of a claim.
+type claimInfo struct {
+	signer string
+	value  string // the blobref value of the claim, if any
+	target string // for "delete" claims
+}
+
+// marker holds the blob graph built while scanning the storage.
+type marker struct {
+	refs   map[string][]string   // blob -> blobs it references, claim values aside
+	claims map[string]*claimInfo // claims with a value, and delete claims
+	roots  []string
+	sizes  map[string]int64
+	order  []string // all blobs, in enumeration order
+}
+
+// Run marks the reachable blobs of c.Storage and sweeps the
+// unreachable ones past their grace period.
+func (c *Collector) Run() (*Result, error) {
+	if c.GracePeriod > 0 && c.StateFile == "" {
+		return nil, errors.New("gc: a grace period requires a state file")
+	}
+	now := time.Now
+	if c.Now != nil {
+		now = c.Now
+	}
+
+	m := &marker{
+		refs:   make(map[string][]string),
+		claims: make(map[string]*claimInfo),
+		sizes:  make(map[string]int64),
+	}
+	if err := m.scan(c.Storage); err != nil {
+		return nil, err
+	}
+	for _, br := range c.Keep {
+		m.roots = append(m.roots, br.String())
+	}
+	reachable := m.mark()
+
+	state, err := c.loadState()
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Blobs: len(m.order), Reachable: len(reachable)}
+	newState := make(map[string]int64)
+	var remove []*blobref.BlobRef
+	for _, ref := range m.order {
+		if reachable[ref] {
+			continue
+		}
+		sb := blobref.SizedBlobRef{BlobRef: blobref.Parse(ref), Size: m.sizes[ref]}
+		since, ok := state[ref]
+		if !ok {
+			since = now().Unix()
+		}
+		if now().Sub(time.Unix(since, 0)) < c.GracePeriod {
+			newState[ref] = since
+			res.Pending = append(res.Pending, sb)
+			continue
+		}
+		res.Removed = append(res.Removed, sb)
+		remove = append(remove, sb.BlobRef)
+	}
+	if c.DryRun {
+		return res, nil
+	}
+	for len(remove) > 0 {
+		n := len(remove)
+		if n > removeBatch {
+			n = removeBatch
+		}
+		if err := c.Storage.RemoveBlobs(remove[:n]); err != nil {
+			return res, fmt.Errorf("gc: error removing blobs: %v", err)
+		}
+		remove = remove[n:]
+	}
+	return res, c.saveState(newState)
+}
+
+// scan reads the schema blobs of sto to build the blob graph.
+func (m *marker) scan(sto blobserver.Storage) error {
+	after := ""
+	for {
+		ch := make(chan blobref.SizedBlobRef, enumerateLimit)
+		errch := make(chan error, 1)
+		go func(after string) {
+			errch <- sto.EnumerateBlobs(ch, after, enumerateLimit, 0)
+		}(after)
+		var sbs []blobref.SizedBlobRef
+		for sb := range ch {
+			sbs = append(sbs, sb)
+		}
+		if err := <-errch; err != nil {
+			return fmt.Errorf("gc: error enumerating blobs: %v", err)
+		}
+		if len(sbs) == 0 {
+			return nil
+		}
+		for _, sb := range sbs {
+			ref := sb.BlobRef.String()
+			m.order = append(m.order, ref)
+			m.sizes[ref] = sb.Size
+			if err := m.scanBlob(sto, sb.BlobRef); err != nil {
+				return err
+			}
+		}
+		after = sbs[len(sbs)-1].BlobRef.String()
+	}
+}
+
+func (m *marker) scanBlob(sto blobserver.Storage, br *blobref.BlobRef) error {
+	rc, _, err := sto.FetchStreaming(br)
+	if err == os.ErrNotExist {
+		// Removed since enumerated.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gc: error fetching %v: %v", br, err)
+	}
+	defer rc.Close()
+	// Only schema blobs matter, and they're JSON objects, so
+	// don't read the other blobs past their first byte. Schema
+	// blobs are decoded whole, however big: a big file or
+	// static-set only keeps its parts if they're all seen.
+	var first [1]byte
+	if _, err := io.ReadFull(rc, first[:]); err != nil || first[0] != '{' {
+		return nil
+	}
+	er := &errReader{r: io.MultiReader(bytes.NewReader(first[:]), rc)}
+	ss := new(schema.Superset)
+	if err := json.NewDecoder(er).Decode(ss); err != nil {
+		if er.err != nil {
+			return fmt.Errorf("gc: error reading %v: %v", br, er.err)
+		}
+		// Not JSON, so not a schema blob.
+		return nil
+	}
+
+	ref := br.String()
+	var refs []string
+	add := func(s string) {
+		if r := blobref.Parse(s); r != nil {
+			refs = append(refs, r.String())
+		}
+	}
+	if ss.Signer != "" {
+		m.roots = append(m.roots, ref)
+		add(ss.Signer)
+	}
+	switch ss.Type {
+	case "claim":
+		add(ss.Permanode)
+		ci := &claimInfo{signer: ss.Signer}
+		if blobref.Parse(ss.Value) != nil {
+			ci.value = ss.Value
+		}
+		if ss.ClaimType == "delete" {
+			ci.target = ss.Target
+		} else {
+			add(ss.Target)
+		}
+		if ci.value != "" || ci.target != "" {
+			m.claims[ref] = ci
+		}
+	case "file", "bytes":
+		for _, p := range ss.Parts {
+			if p.BlobRef != nil {
+				refs = append(refs, p.BlobRef.String())
+			}
+			if p.BytesRef != nil {
+				refs = append(refs, p.BytesRef.String())
+			}
+		}
+	case "directory":
+		add(ss.Entries)
+	case "static-set":
+		for _, member := range ss.Members {
+			add(member)
+		}
+	default:
+		add(ss.Target) // e.g. shares
+	}
+	if len(refs) > 0 {
+		m.refs[ref] = refs
+	}
+	return nil
+}
+
+// errReader records the error reading from r, other than io.EOF, to
+// tell it from an error decoding what was read.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err != nil && err != io.EOF {
+		er.err = err
+	}
+	return n, err
+}
+
+// mark returns the set of blobs reachable from the roots.
+func (m *marker) mark() map[string]bool {
+	// Claims retracted by their signer don't keep their values.
+	deleted := make(map[string]bool)
+	for _, ci := range m.claims {
+		if ci.target == "" {
+			continue
+		}
+		if t, ok := m.claims[ci.target]; ok && t.signer == ci.signer {
+			deleted[ci.target] = true
+		}
+	}
+
+	reachable := make(map[string]bool)
+	stack := append([]string(nil), m.roots...)
+	for len(stack) > 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reachable[ref] {
+			continue
+		}
+		reachable[ref] = true
+		stack = append(stack, m.refs[ref]...)
+		if ci, ok := m.claims[ref]; ok {
+			if ci.value != "" && !deleted[ref] {
+				stack = append(stack, ci.value)
+			}
+			if ci.target != "" {
+				stack = append(stack, ci.target)
+			}
+		}
+	}
+	// Only count the blobs actually in the storage.
+	for ref := range reachable {
+		if _, ok := m.sizes[ref]; !ok {
+			delete(reachable, ref)
+		}
+	}
+	return reachable
+}
+
+// loadState returns since when, in Unix seconds, the blobs have been
+// seen unreachable.
+func (c *Collector) loadState() (map[string]int64, error) {
+	state := make(map[string]int64)
+	if c.StateFile == "" {
+		return state, nil
+	}
+	b, err := ioutil.ReadFile(c.StateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("gc: error reading state file %s: %v", c.StateFile, err)
+	}
+	return state, nil
+}
+
+func (c *Collector) saveState(state map[string]int64) error {
+	if c.StateFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := c.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.StateFile)
+}
+
+// SortedRefs returns the blobrefs of sbs, sorted.
+func SortedRefs(sbs []blobref.SizedBlobRef) []string {
+	refs := make([]string, 0, len(sbs))
+	for _, sb := range sbs {
+		refs = append(refs, sb.BlobRef.String())
+	}
+	sort.Strings(refs)
+	return refs
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/schema"
+)
+
+type testStorage struct {
+	t   *testing.T
+	sto blobserver.Storage
+}
+
+func (ts testStorage) add(contents string) string {
+	br := blobref.SHA1FromString(contents)
+	if _, err := ts.sto.ReceiveBlob(br, strings.NewReader(contents)); err != nil {
+		ts.t.Fatal(err)
+	}
+	return br.String()
+}
+
+func (ts testStorage) addMap(m map[string]interface{}) string {
+	json, err := schema.MapToCamliJSON(m)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return ts.add(json)
+}
+
+// addSigned adds m as if signed by signer. Signatures aren't
+// verified by the collector.
+func (ts testStorage) addSigned(m map[string]interface{}, signer string) string {
+	m["camliSigner"] = signer
+	m["camliSig"] = "fake"
+	return ts.addMap(m)
+}
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobDir := filepath.Join(dir, "blobs")
+	if err := os.Mkdir(blobDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	sto, err := localdisk.New(blobDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := testStorage{t, sto}
+
+	pubKey := ts.add("-----BEGIN PGP PUBLIC KEY BLOCK-----\nfake\n")
+	pn := ts.addSigned(schema.NewUnsignedPermanode(), pubKey)
+
+	// A file set as the permanode's content: reachable.
+	chunk := ts.add("hello world")
+	file := schema.NewFileMap("a.txt")
+	if err := schema.PopulateParts(file, 11, []schema.BytesPart{{Size: 11, BlobRef: blobref.Parse(chunk)}}); err != nil {
+		t.Fatal(err)
+	}
+	fileRef := ts.addMap(file)
+	ts.addSigned(schema.NewSetAttributeClaim(blobref.Parse(pn), "camliContent", fileRef), pubKey)
+
+	// A file whose claim was deleted: unreachable.
+	oldChunk := ts.add("old contents")
+	oldClaim := ts.addSigned(schema.NewSetAttributeClaim(blobref.Parse(pn), "camliContent", oldChunk), pubKey)
+	ts.addSigned(schema.NewDeleteClaim(blobref.Parse(oldClaim)), pubKey)
+
+	// A directory kept explicitly.
+	dirChunk := ts.add("in a directory")
+	dirFile := schema.NewFileMap("b.txt")
+	if err := schema.PopulateParts(dirFile, 14, []schema.BytesPart{{Size: 14, BlobRef: blobref.Parse(dirChunk)}}); err != nil {
+		t.Fatal(err)
+	}
+	entries := new(schema.StaticSet)
+	entries.Add(blobref.Parse(ts.addMap(dirFile)))
+	dirMap := schema.NewCommonFilenameMap("dir")
+	schema.PopulateDirectoryMap(dirMap, blobref.Parse(ts.addMap(entries.Map())))
+	kept := ts.addMap(dirMap)
+
+	orphan := ts.add("nobody refers to me")
+
+	now := time.Unix(1e9, 0)
+	c := &Collector{
+		Storage:     sto,
+		Keep:        []*blobref.BlobRef{blobref.Parse(kept)},
+		GracePeriod: time.Hour,
+		StateFile:   filepath.Join(dir, "state"),
+		DryRun:      true,
+		Now:         func() time.Time { return now },
+	}
+	wantGarbage := []string{oldChunk, orphan}
+	sort.Strings(wantGarbage)
+
+	res, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := SortedRefs(res.Pending); !reflect.DeepEqual(got, wantGarbage) {
+		t.Errorf("pending = %q; want %q", got, wantGarbage)
+	}
+	if len(res.Removed) != 0 {
+		t.Errorf("removed %v within the grace period", res.Removed)
+	}
+	if res.Reachable != res.Blobs-2 {
+		t.Errorf("%d reachable of %d blobs; want all but 2", res.Reachable, res.Blobs)
+	}
+
+	// The dry run recorded nothing, so the grace period starts now.
+	c.DryRun = false
+	if res, err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Removed) != 0 || len(res.Pending) != 2 {
+		t.Errorf("first run removed %d, %d pending; want 0, 2", len(res.Removed), len(res.Pending))
+	}
+
+	now = now.Add(2 * time.Hour)
+	if res, err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := SortedRefs(res.Removed); !reflect.DeepEqual(got, wantGarbage) {
+		t.Errorf("removed = %q; want %q", got, wantGarbage)
+	}
+	for _, ref := range wantGarbage {
+		if _, _, err := sto.FetchStreaming(blobref.Parse(ref)); err != os.ErrNotExist {
+			t.Errorf("fetching removed %s = %v; want ErrNotExist", ref, err)
+		}
+	}
+	if _, _, err := sto.FetchStreaming(blobref.Parse(dirChunk)); err != nil {
+		t.Errorf("kept directory's chunk was removed: %v", err)
+	}
+
+	if res, err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Removed)+len(res.Pending) != 0 {
+		t.Errorf("after collection, removed %v, pending %v", res.Removed, res.Pending)
+	}
+}
+
+func TestCollectorBigSchemaBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sto, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := testStorage{t, sto}
+
+	// A static-set of over 1MB, its last member the only one
+	// present.
+	member := ts.add("member of a big set")
+	set := new(schema.StaticSet)
+	for i := 0; i < 25000; i++ {
+		set.Add(blobref.SHA1FromString(fmt.Sprintf("absent member %d", i)))
+	}
+	set.Add(blobref.Parse(member))
+	setJSON, err := schema.MapToCamliJSON(set.Map())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setJSON) <= 1<<20 {
+		t.Fatalf("static-set is only %d bytes", len(setJSON))
+	}
+	setRef := ts.add(setJSON)
+
+	c := &Collector{
+		Storage: sto,
+		Keep:    []*blobref.BlobRef{blobref.Parse(setRef)},
+		DryRun:  true,
+	}
+	res, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Removed)+len(res.Pending) != 0 || res.Reachable != 2 {
+		t.Errorf("removed %v, pending %v, %d reachable; want the set and its member reachable",
+			res.Removed, res.Pending, res.Reachable)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 
@@ -109,6 +110,7 @@ func (gsa *Client) simpleRequest(method, url_ string) (resp *http.Response, err
 // Fetch a GS object.
 // Bucket and Key fields are trusted to be valid.
 // Returns (object reader, object size, err).  Reader must be closed.
+// err is os.ErrNotExist if there's no such object.
 func (gsa *Client) GetObject(obj *Object) (io.ReadCloser, int64, error) {
 	log.Printf("Fetching object from Google Storage: %s/%s\n", obj.Bucket, obj.Key)
 
@@ -117,7 +119,12 @@ func (gsa *Client) GetObject(obj *Object) (io.ReadCloser, int64, error) {
 		return nil, 0, fmt.Errorf("GS GET request failed: %v\n", err)
 	}
 
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, 0, os.ErrNotExist
+	}
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		return nil, 0, fmt.Errorf("GS GET request failed status: %v\n", resp.Status)
 	}
 
@@ -178,6 +185,7 @@ func (gsa *Client) PutObject(obj *Object, content io.ReadCloser) (shouldRetry bo
 
 // Removes a GS object.
 // Bucket and Key values are trusted to be valid.
+// err is os.ErrNotExist if there's no such object.
 func (gsa *Client) DeleteObject(obj *Object) (err error) {
 	log.Printf("Deleting %v/%v\n", obj.Bucket, obj.Key)
 
@@ -186,7 +194,12 @@ func (gsa *Client) DeleteObject(obj *Object) (err error) {
 	if err != nil {
 		return
 	}
-	if resp.StatusCode != http.StatusNoContent {
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+	case http.StatusNotFound:
+		err = os.ErrNotExist
+	default:
 		err = fmt.Errorf("Bad delete response code: %v", resp.Status)
 	}
 	return
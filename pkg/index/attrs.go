@@ -0,0 +1,158 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/search"
+)
+
+// keyIndexedAttrs is the key under which the index remembers which
+// attributes its signerattrvalue rows were populated for.
+const keyIndexedAttrs = "indexedattrs"
+
+// defaultIndexedAttrs is the value of keyIndexedAttrs for an index
+// populated with the search.IsIndexedAttribute whitelist.
+const defaultIndexedAttrs = ""
+
+// IsIndexedAttribute reports whether claims on attr are indexed for
+// PermanodeOfSignerAttrValue and SearchPermanodesWithAttr.
+func (x *Index) IsIndexedAttribute(attr string) bool {
+	if x.allAttrs {
+		return true
+	}
+	if x.attrs == nil {
+		return search.IsIndexedAttribute(attr)
+	}
+	return x.attrs[attr]
+}
+
+// SetIndexedAttributes sets the attributes indexed for
+// PermanodeOfSignerAttrValue and SearchPermanodesWithAttr. An attribute
+// of "*" indexes all of them. If attrs is empty, the default whitelist
+// of search.IsIndexedAttribute is used.
+//
+// If the index was populated with a different set of attributes, its
+// signer/attribute/value rows are rebuilt from the claims it already
+// has, so newly indexed attributes are searchable for existing claims.
+func (x *Index) SetIndexedAttributes(attrs []string) error {
+	x.allAttrs, x.attrs = false, nil
+	if len(attrs) > 0 {
+		x.attrs = make(map[string]bool)
+	}
+	for _, attr := range attrs {
+		if attr == "*" {
+			x.allAttrs = true
+		}
+		x.attrs[attr] = true
+	}
+
+	want := x.indexedAttrsString()
+	have, err := x.s.Get(keyIndexedAttrs)
+	if err == ErrNotFound {
+		have, err = defaultIndexedAttrs, nil
+	}
+	if err != nil {
+		return err
+	}
+	if have == want {
+		return nil
+	}
+	return x.reindexAttributes()
+}
+
+// indexedAttrsString returns the canonical form of the indexed
+// attributes, as stored under keyIndexedAttrs.
+func (x *Index) indexedAttrsString() string {
+	if x.allAttrs {
+		return "*"
+	}
+	if x.attrs == nil {
+		return defaultIndexedAttrs
+	}
+	var attrs []string
+	for attr := range x.attrs {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	return strings.Join(attrs, ",")
+}
+
+// reindexAttributes rebuilds the signerattrvalue rows for the currently
+// indexed attributes from the claim rows, leaving out the claims
+// retracted by "delete" claims.
+func (x *Index) reindexAttributes() error {
+	bm := x.s.BeginBatch()
+	nDel, nSet := 0, 0
+
+	it := x.queryPrefixString(keySignerAttrValue.name + "|")
+	for it.Next() {
+		keyPart := strings.Split(it.Key(), "|")
+		if len(keyPart) < 3 || !x.IsIndexedAttribute(urld(keyPart[2])) {
+			bm.Delete(it.Key())
+			nDel++
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	it = x.queryPrefixString("claim|")
+	for it.Next() {
+		keyPart := strings.Split(it.Key(), "|")
+		valPart := strings.Split(it.Value(), "|")
+		if len(keyPart) < 5 || len(valPart) < 3 {
+			continue
+		}
+		// The rows of "delete" claims are for GetOwnerClaims only.
+		if urld(valPart[0]) == "delete" {
+			continue
+		}
+		attr := urld(valPart[1])
+		if !x.IsIndexedAttribute(attr) {
+			continue
+		}
+		pn, keyId, claimDate, claimRef := keyPart[1], keyPart[2], keyPart[3], keyPart[4]
+		if br := blobref.Parse(claimRef); br != nil {
+			deleted, err := x.isDeleted(br, keyId)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			if deleted {
+				continue
+			}
+		}
+		bm.Set(keySignerAttrValue.Key(keyId, attr, urld(valPart[2]), claimDate, claimRef),
+			keySignerAttrValue.Val(pn))
+		nSet++
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	bm.Set(keyIndexedAttrs, x.indexedAttrsString())
+	if err := x.s.CommitBatch(bm); err != nil {
+		return err
+	}
+	log.Printf("index: reindexed attributes %q; %d rows removed, %d set", x.indexedAttrsString(), nDel, nSet)
+	return nil
+}
@@ -40,6 +40,11 @@ for search operations:
  * Other:
    "meta:<blobref>" == "<size>|<mimetype>"
    "have:<blobref>" == "<size>" (used for enumeration, which doesn't need mime type)
+   "deleted|<claim-blobref>|<delete-claim-blobref>" == "<keyid of the delete claim's signer>"
+   "missing|<missing-blobref>|<blobref>" == "1" (blobref needs missing-blobref to be
+     fully indexed, and is re-indexed once it's received)
+   "indexedattrs" == "<comma-separated attrs>", or "*" for all, or "" for the default
+     whitelist (the attributes the signerattrvalue rows are populated for)
 
  * For GetOwnerClaims(permanode, signer):
    "claim|<permanode-blobref>|<keyid>|<date>|<claim-blobref>" => "<URL:type>|<URL:attr>|<URL:value>"
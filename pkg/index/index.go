@@ -22,6 +22,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"camlistore.org/pkg/blobref"
@@ -141,6 +142,28 @@ type Index struct {
 	// Used for fetching blobs to find the complete sha1s of file & bytes
 	// schema blobs.
 	BlobSource blobref.StreamingFetcher
+
+	// attrs and allAttrs are the attributes indexed for
+	// PermanodeOfSignerAttrValue. See SetIndexedAttributes.
+	attrs    map[string]bool
+	allAttrs bool
+
+	watchOnce sync.Once // guards starting watchBlobSource
+
+	// reindexMu is held for reading while indexing received blobs,
+	// and for writing by Reindex, briefly, to wait for the ones
+	// being indexed as it starts.
+	reindexMu sync.RWMutex
+
+	queueMu    sync.Mutex // guards the following
+	reindexing bool
+	queue      []queuedBlob // blobs received while reindexing, indexed after
+}
+
+// queuedBlob is a blob received while reindexing.
+type queuedBlob struct {
+	br   *blobref.BlobRef
+	data []byte
 }
 
 var _ blobserver.Storage = (*Index)(nil)
@@ -148,7 +171,7 @@ var _ search.Index = (*Index)(nil)
 
 func New(s IndexStorage) *Index {
 	return &Index{
-		s: s,
+		s:                         s,
 		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
 	}
 }
@@ -222,6 +245,7 @@ func (x *Index) GetRecentPermanodes(dest chan *search.Result, owner *blobref.Blo
 			BlobRef:     permaRef,
 			Signer:      owner, // TODO(bradfitz): kinda. usually. for now.
 			LastModTime: mTimeSec,
+			ClaimRef:    blobref.Parse(parts[3]),
 		}
 		sent++
 		if sent == limit {
@@ -21,13 +21,22 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/index"
 	"camlistore.org/pkg/index/indextest"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/test"
 )
 
 func TestReverseTimeString(t *testing.T) {
@@ -55,6 +64,290 @@ func TestFiles_Memory(t *testing.T) {
 	indextest.Files(t, index.ExpNewMemoryIndex)
 }
 
+func TestIndexedAttributes(t *testing.T) {
+	id := indextest.NewIndexDeps(index.ExpNewMemoryIndex())
+	pn := id.NewPermanode()
+	id.SetAttribute(pn, "foo", "foo1")
+	id.SetAttribute(pn, "bar", "bar1")
+
+	lookup := func(attr, val string) bool {
+		got, err := id.Index.PermanodeOfSignerAttrValue(id.SignerBlobRef, attr, val)
+		if err == os.ErrNotExist {
+			return false
+		}
+		if err != nil {
+			t.Fatalf("PermanodeOfSignerAttrValue(%q, %q) = %v", attr, val, err)
+		}
+		if got.String() != pn.String() {
+			t.Fatalf("PermanodeOfSignerAttrValue(%q, %q) = %q; want %q", attr, val, got, pn)
+		}
+		return true
+	}
+
+	if lookup("foo", "foo1") {
+		t.Errorf("foo found before being indexed")
+	}
+	if err := id.Index.SetIndexedAttributes([]string{"foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if !lookup("foo", "foo1") {
+		t.Errorf("foo not found after reindexing")
+	}
+	if lookup("bar", "bar1") {
+		t.Errorf("bar found but not indexed")
+	}
+
+	if err := id.Index.SetIndexedAttributes([]string{"*"}); err != nil {
+		t.Fatal(err)
+	}
+	id.SetAttribute(pn, "baz", "baz1")
+	if !lookup("bar", "bar1") || !lookup("baz", "baz1") {
+		t.Errorf("attributes not found with wildcard indexing")
+	}
+
+	if err := id.Index.SetIndexedAttributes(nil); err != nil {
+		t.Fatal(err)
+	}
+	if lookup("foo", "foo1") {
+		t.Errorf("foo still found after going back to the default attributes")
+	}
+}
+
+// fetcherStorage is a blobserver.Storage reading from a test.Fetcher.
+type fetcherStorage struct {
+	*blobserver.NoImplStorage
+	f *test.Fetcher
+}
+
+func (s fetcherStorage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error) {
+	return s.f.FetchStreaming(br)
+}
+
+func (s fetcherStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit int, wait time.Duration) error {
+	return s.f.EnumerateBlobs(dest, after, limit, wait)
+}
+
+func dumpRows(t *testing.T, s index.IndexStorage) map[string]string {
+	rows := make(map[string]string)
+	it := s.Find("")
+	for it.Next() {
+		rows[it.Key()] = it.Value()
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestReindex(t *testing.T) {
+	id := indextest.NewIndexDeps(index.ExpNewMemoryIndex())
+	pn := id.NewPermanode()
+	id.SetAttribute(pn, "camliRoot", "rootval")
+	id.SetAttribute(pn, "title", "some title")
+	id.UploadFile("foo.txt", "some file contents")
+
+	ix := index.ExpNewMemoryIndex()
+	ix.KeyFetcher = id.Index.KeyFetcher
+	ix.BlobSource = id.BlobSource
+	ix.Storage().Set("stale", "row")
+
+	passes := make(map[string]int)
+	err := ix.Reindex(fetcherStorage{&blobserver.NoImplStorage{}, id.BlobSource},
+		func(pass string, br *blobref.BlobRef, err error) {
+			if err != nil {
+				t.Errorf("error reindexing %s in pass %q: %v", br, pass, err)
+			}
+			passes[pass]++
+		})
+	if err != nil {
+		t.Fatalf("Reindex = %v", err)
+	}
+	want := map[string]int{
+		index.ReindexPassBlobs:  1, // the file chunk
+		index.ReindexPassSchema: 2, // the file and the permanode
+		index.ReindexPassClaims: 2,
+	}
+	if !reflect.DeepEqual(passes, want) {
+		t.Errorf("blobs reindexed per pass = %v; want %v", passes, want)
+	}
+
+	got, orig := dumpRows(t, ix.Storage()), dumpRows(t, id.Index.Storage())
+	if !reflect.DeepEqual(got, orig) {
+		t.Errorf("reindexed rows differ from the original index.\n got: %q\nwant: %q", got, orig)
+	}
+}
+
+func TestReceiveDuringReindex(t *testing.T) {
+	id := indextest.NewIndexDeps(index.ExpNewMemoryIndex())
+	id.UploadFile("foo.txt", "some file contents")
+
+	ix := index.ExpNewMemoryIndex()
+	ix.KeyFetcher = id.Index.KeyFetcher
+	ix.BlobSource = id.BlobSource
+
+	b := &test.Blob{Contents: "received during the reindexing"}
+	var once sync.Once
+	err := ix.Reindex(fetcherStorage{&blobserver.NoImplStorage{}, id.BlobSource},
+		func(pass string, br *blobref.BlobRef, err error) {
+			once.Do(func() {
+				// Uploads aren't blocked by the reindexing:
+				// the blob is held back until it's done.
+				done := make(chan error, 1)
+				go func() {
+					_, err := ix.ReceiveBlob(b.BlobRef(), b.Reader())
+					done <- err
+				}()
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Errorf("ReceiveBlob = %v", err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("ReceiveBlob blocked during Reindex")
+				}
+				if _, err := ix.Storage().Get("have:" + b.BlobRef().String()); err != index.ErrNotFound {
+					t.Errorf("blob received during the reindexing indexed before the end: %v", err)
+				}
+			})
+		})
+	if err != nil {
+		t.Fatalf("Reindex = %v", err)
+	}
+	if _, err := ix.Storage().Get("have:" + b.BlobRef().String()); err != nil {
+		t.Errorf("blob received during the reindexing not indexed: %v", err)
+	}
+}
+
+func TestDeleteClaim(t *testing.T) {
+	id := indextest.NewIndexDeps(index.ExpNewMemoryIndex())
+	pn := id.NewPermanode()
+	id.SetAttribute(pn, "title", "keep")
+	oops := id.SetAttribute(pn, "tag", "oops")
+	del := id.DeleteClaim(oops)
+
+	if got, err := id.Index.PermanodeOfSignerAttrValue(id.SignerBlobRef, "tag", "oops"); err != os.ErrNotExist {
+		t.Errorf("PermanodeOfSignerAttrValue of deleted claim = %v, %v; want ErrNotExist", got, err)
+	}
+	if got, err := id.Index.PermanodeOfSignerAttrValue(id.SignerBlobRef, "title", "keep"); err != nil || got.String() != pn.String() {
+		t.Errorf("PermanodeOfSignerAttrValue = %v, %v; want %v", got, err, pn)
+	}
+
+	cl, err := id.Index.GetOwnerClaims(pn, id.SignerBlobRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, c := range cl {
+		if c.BlobRef.String() == del.String() {
+			found = true
+			if c.Type != "delete" || c.Value != oops.String() {
+				t.Errorf("delete claim = %v; want type delete of %v", c, oops)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("delete claim %v not in GetOwnerClaims = %v", del, cl)
+	}
+}
+
+func TestDeleteClaimReindexAttributes(t *testing.T) {
+	id := indextest.NewIndexDeps(index.ExpNewMemoryIndex())
+	pn := id.NewPermanode()
+	id.DeleteClaim(id.SetAttribute(pn, "tag", "oops"))
+	id.SetAttribute(pn, "foo", "foo1")
+
+	for _, attrs := range [][]string{{"*"}, {"tag", "foo"}, nil} {
+		if err := id.Index.SetIndexedAttributes(attrs); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := id.Index.PermanodeOfSignerAttrValue(id.SignerBlobRef, "tag", "oops"); err != os.ErrNotExist {
+			t.Errorf("with attributes %q, PermanodeOfSignerAttrValue of deleted claim = %v, %v; want ErrNotExist", attrs, got, err)
+		}
+		for key := range dumpRows(t, id.Index.Storage()) {
+			if strings.HasPrefix(key, "signerattrvalue|") && strings.Split(key, "|")[2] == "" {
+				t.Errorf("with attributes %q, row of a delete claim indexed: %q", attrs, key)
+			}
+		}
+	}
+	if got, err := id.Index.PermanodeOfSignerAttrValue(id.SignerBlobRef, "foo", "foo1"); err != os.ErrNotExist {
+		t.Errorf("foo found with the default attributes: %v, %v", got, err)
+	}
+}
+
+func TestMissingChunk(t *testing.T) {
+	id := indextest.NewIndexDeps(index.ExpNewMemoryIndex())
+	contents := "some file contents"
+	chunk := &test.Blob{Contents: contents}
+
+	m := schema.NewFileMap("foo.txt")
+	schema.PopulateParts(m, int64(len(contents)), []schema.BytesPart{
+		schema.BytesPart{
+			Size:    uint64(len(contents)),
+			BlobRef: chunk.BlobRef(),
+		}})
+	fjson, err := schema.MapToCamliJSON(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := &test.Blob{Contents: fjson}
+	id.BlobSource.AddBlob(fb)
+	if _, err := id.Index.ReceiveBlob(fb.BlobRef(), fb.Reader()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := id.Index.GetFileInfo(fb.BlobRef()); err == nil {
+		t.Fatalf("GetFileInfo succeeded before the chunk was received")
+	}
+
+	id.BlobSource.AddBlob(chunk)
+	if _, err := id.Index.ReceiveBlob(chunk.BlobRef(), chunk.Reader()); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := id.Index.GetFileInfo(fb.BlobRef())
+	if err != nil {
+		t.Fatalf("GetFileInfo after receiving the chunk = %v", err)
+	}
+	if fi.Size != int64(len(contents)) {
+		t.Errorf("file size = %d; want %d", fi.Size, len(contents))
+	}
+	if rows := dumpRows(t, id.Index.Storage()); rows["missing|"+chunk.BlobRef().String()+"|"+fb.BlobRef().String()] != "" {
+		t.Errorf("missing row not deleted after the chunk was received")
+	}
+}
+
+func TestMissingSigner(t *testing.T) {
+	id := indextest.NewIndexDeps(index.ExpNewMemoryIndex())
+	keyFetcher := new(test.Fetcher)
+	id.Index.KeyFetcher = keyFetcher
+
+	pn := id.NewPermanode()
+	id.SetAttribute(pn, "title", "some title")
+	if cl, err := id.Index.GetOwnerClaims(pn, id.SignerBlobRef); err != nil || len(cl) != 0 {
+		t.Fatalf("GetOwnerClaims before the signer was received = %v, %v; want no claims", cl, err)
+	}
+
+	rc, _, err := id.PublicKeyFetcher.FetchStreaming(id.SignerBlobRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb := &test.Blob{Contents: string(pubKey)}
+	keyFetcher.AddBlob(kb)
+	if _, err := id.Index.ReceiveBlob(kb.BlobRef(), kb.Reader()); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := id.Index.GetOwnerClaims(pn, id.SignerBlobRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cl) != 1 || cl[0].Attr != "title" || cl[0].Value != "some title" {
+		t.Errorf("claims after receiving the signer = %v; want the title claim", cl)
+	}
+}
+
 var (
 	// those dirs are not packages implementing indexers,
 	// hence we do not want to check them.
@@ -81,6 +81,7 @@ func (id *IndexDeps) uploadAndSignMap(m map[string]interface{}) *blobref.BlobRef
 		panic("problem signing: " + err.Error())
 	}
 	tb := &test.Blob{Contents: signed}
+	id.BlobSource.AddBlob(tb)
 	_, err = id.Index.ReceiveBlob(tb.BlobRef(), tb.Reader())
 	if err != nil {
 		panic(fmt.Sprintf("problem indexing blob: %v\nblob was:\n%s", err, signed))
@@ -110,6 +111,13 @@ func (id *IndexDeps) SetAttribute(permaNode *blobref.BlobRef, attr, value string
 	return id.uploadAndSignMap(m)
 }
 
+// DeleteClaim signs and indexes a "delete" claim retracting claim.
+func (id *IndexDeps) DeleteClaim(claim *blobref.BlobRef) *blobref.BlobRef {
+	m := schema.NewDeleteClaim(claim)
+	m["claimDate"] = id.advanceTime()
+	return id.uploadAndSignMap(m)
+}
+
 func (id *IndexDeps) UploadFile(fileName string, contents string) (fileRef, wholeRef *blobref.BlobRef) {
 	cb := &test.Blob{Contents: contents}
 	id.BlobSource.AddBlob(cb)
@@ -273,6 +281,7 @@ func Index(t *testing.T, initIdx func() *index.Index) {
 				BlobRef:     pn,
 				Signer:      id.SignerBlobRef,
 				LastModTime: 1322443959,
+				ClaimRef:    rootClaim,
 			},
 		}
 		if !reflect.DeepEqual(got, want) {
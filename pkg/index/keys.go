@@ -173,6 +173,33 @@ var (
 		},
 	}
 
+	// keyMissing records that blob couldn't be fully indexed
+	// because it depends on missing, which hasn't been received yet.
+	keyMissing = &keyType{
+		"missing",
+		[]part{
+			{"missing", typeBlobRef},
+			{"blob", typeBlobRef},
+		},
+		[]part{
+			{"1", typeStr},
+		},
+	}
+
+	// keyDeleted records that claim was retracted by the "delete"
+	// claim deleter, signed by keyId. Deletions only apply to claims
+	// of the same signer.
+	keyDeleted = &keyType{
+		"deleted",
+		[]part{
+			{"claim", typeBlobRef},
+			{"deleter", typeBlobRef},
+		},
+		[]part{
+			{"keyId", typeKeyId},
+		},
+	}
+
 	keySignerAttrValue = &keyType{
 		"signerattrvalue",
 		[]part{
@@ -0,0 +1,889 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package leveldb provides an index.IndexStorage implementation on top of
+an embedded, on-disk LevelDB-style key/value store, so a single-user
+server can have a persistent index without running a database server.
+
+The vendored leveldb-go does not yet implement a full on-disk database,
+so this package builds one from its parts, the way LevelDB does: every
+committed mutation is appended to a journal in leveldb's record format
+and applied to a memdb skiplist. Once the journal reaches
+maxJournalSize, the memdb is written out as a new leveldb sstable and a
+fresh memdb and journal take over. Reads look in the memdbs, then in the
+tables from the newest one, reading the table blocks from disk as
+they're needed. Memory use is thus bounded by the journal size and the
+tables' block indexes, not by the size of the index.
+
+Tables are merged as they pile up: the newest ones are merged together
+with the older ones not more than twice as big as them, so each entry
+is rewritten a logarithmic number of times and there are few tables to
+look in. Deleted keys are kept as tombstones until their table is
+merged into the oldest one.
+
+The MANIFEST file lists the live tables, and a LOCK file keeps two
+processes from opening the same directory.
+
+Example low-level config:
+
+	"/index-leveldb/": {
+	    "handler": "storage-leveldbindexer",
+	    "handlerArgs": {
+	        "blobSource": "/bs/",
+	        "file": "/home/camli/index.leveldb"
+	    }
+	},
+*/
+package leveldb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/osutil"
+
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/db"
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/memdb"
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/record"
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/table"
+)
+
+const (
+	manifestName = "MANIFEST"
+	lockName     = "LOCK"
+)
+
+// maxJournalSize is the journal size after which the memdb is written
+// out as a table. Tests lower it.
+var maxJournalSize int64 = 4 << 20
+
+// Journal record operations.
+const (
+	opSet    = 's'
+	opDelete = 'd'
+)
+
+// The values in the memdbs and tables start with their kind, so a
+// deleted key shadows its value in the older tables.
+const (
+	kindValue     = 'v'
+	kindTombstone = 't'
+)
+
+// tableFile is a table of the storage.
+type tableFile struct {
+	num  uint64
+	size int64
+	r    *table.Reader
+
+	// refs counts the storage's table list and the open iterators
+	// using the table. It's guarded by storage.mu.
+	refs int
+}
+
+type storage struct {
+	dir  string
+	lock io.Closer
+
+	compactMu sync.Mutex // serializes the writing of tables
+
+	mu      sync.Mutex   // guards the following
+	mem     *memdb.MemDB // mutations of the current journal
+	imm     *memdb.MemDB // mutations being written out as a table, or nil
+	immLogs []uint64     // journals of imm
+	tables  []*tableFile // oldest first; replaced, not modified
+	journal *os.File     // nil once closed
+	jw      *record.Writer
+	jnum    uint64
+	jsize   int64 // bytes written to journal
+	nextNum uint64
+}
+
+var _ index.IndexStorage = (*storage)(nil)
+
+// NewStorage returns an IndexStorage implementation stored in the
+// directory dir, creating it if needed. The directory can only be
+// opened by one process at a time.
+func NewStorage(dir string) (index.IndexStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := osutil.LockFile(filepath.Join(dir, lockName))
+	if err != nil {
+		return nil, fmt.Errorf("leveldb index: error locking %s, in use by another process? %v", dir, err)
+	}
+	is := &storage{dir: dir, lock: lock}
+	if err := is.open(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return is, nil
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
+	var (
+		blobPrefix   = config.RequiredString("blobSource")
+		file         = config.RequiredString("file")
+		indexedAttrs = config.OptionalList("indexedAttributes")
+	)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	sto, err := ld.GetStorage(blobPrefix)
+	if err != nil {
+		return nil, err
+	}
+	is, err := NewStorage(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := index.New(is)
+	if err := ix.SetIndexedAttributes(indexedAttrs); err != nil {
+		return nil, err
+	}
+	ix.BlobSource = sto
+	// Good enough, for now:
+	ix.KeyFetcher = ix.BlobSource
+
+	return ix, nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("leveldbindexer", blobserver.StorageConstructor(newFromConfig))
+}
+
+func (is *storage) path(num uint64, ext string) string {
+	return filepath.Join(is.dir, fmt.Sprintf("%06d.%s", num, ext))
+}
+
+// open opens the tables of the manifest and replays the journals left
+// over into a new table, leaving a new empty journal open for
+// appending. Files that aren't in the manifest, from an interrupted
+// write of a table, are removed.
+func (is *storage) open() error {
+	nums, err := is.readManifest()
+	if err != nil {
+		return err
+	}
+	live := make(map[uint64]bool)
+	for _, num := range nums {
+		t, err := openTable(is.path(num, "sst"), num)
+		if err != nil {
+			return err
+		}
+		is.tables = append(is.tables, t)
+		live[num] = true
+	}
+
+	f, err := os.Open(is.dir)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	var logs []uint64
+	for _, name := range names {
+		ext := filepath.Ext(name)
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		if num >= is.nextNum {
+			is.nextNum = num + 1
+		}
+		switch {
+		case ext == ".log":
+			logs = append(logs, num)
+		case ext == ".sst" && !live[num]:
+			os.Remove(filepath.Join(is.dir, name))
+		}
+	}
+	sort.Sort(byNum(logs))
+
+	is.mem = memdb.New(nil)
+	for _, num := range logs {
+		if err := is.replayJournal(is.path(num, "log")); err != nil {
+			return err
+		}
+	}
+	is.imm, is.immLogs = is.mem, logs
+	is.mem = memdb.New(nil)
+	if err := is.flushImm(); err != nil {
+		return err
+	}
+	return is.newJournal()
+}
+
+func (is *storage) readManifest() ([]uint64, error) {
+	f, err := os.Open(filepath.Join(is.dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var nums []uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		num, err := strconv.ParseUint(sc.Text(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("leveldb index: corrupt %s line %q", manifestName, sc.Text())
+		}
+		nums = append(nums, num)
+	}
+	return nums, sc.Err()
+}
+
+// writeManifest atomically replaces the manifest with the list of
+// tables.
+func (is *storage) writeManifest(tables []*tableFile) error {
+	var buf bytes.Buffer
+	for _, t := range tables {
+		fmt.Fprintf(&buf, "%d\n", t.num)
+	}
+	tmpName := filepath.Join(is.dir, manifestName+".tmp")
+	if err := ioutil.WriteFile(tmpName, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := syncFile(tmpName); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(is.dir, manifestName))
+}
+
+func openTable(name string, num uint64) (*tableFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := table.NewReader(f, &db.Options{VerifyChecksums: true})
+	// The reader reports a bad table from its first use.
+	if err := r.Find(nil, nil).Close(); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("leveldb index: error opening %s: %v", name, err)
+	}
+	return &tableFile{num: num, size: fi.Size(), r: r, refs: 1}, nil
+}
+
+func (is *storage) replayJournal(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rr := record.NewReader(f)
+	for {
+		r, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			var rec []byte
+			rec, err = ioutil.ReadAll(r)
+			if err == nil {
+				err = is.applyRecord(rec)
+			}
+		}
+		if err != nil {
+			// A torn or corrupt tail is what we expect to find
+			// after a crash; everything before it was applied.
+			log.Printf("leveldb index: ignoring rest of journal %s: %v", name, err)
+			break
+		}
+	}
+	return nil
+}
+
+// applyRecord applies the mutations encoded in a journal record to
+// the memdb.
+func (is *storage) applyRecord(rec []byte) error {
+	errCorrupt := errors.New("corrupt journal record")
+	readString := func() ([]byte, bool) {
+		n, w := binary.Uvarint(rec)
+		if w <= 0 || uint64(len(rec)-w) < n {
+			return nil, false
+		}
+		s := rec[w : w+int(n)]
+		rec = rec[w+int(n):]
+		return s, true
+	}
+	for len(rec) > 0 {
+		op := rec[0]
+		rec = rec[1:]
+		key, ok := readString()
+		if !ok {
+			return errCorrupt
+		}
+		switch op {
+		case opSet:
+			value, ok := readString()
+			if !ok {
+				return errCorrupt
+			}
+			if err := is.set(key, value); err != nil {
+				return err
+			}
+		case opDelete:
+			if err := is.delete(key); err != nil {
+				return err
+			}
+		default:
+			return errCorrupt
+		}
+	}
+	return nil
+}
+
+func (is *storage) set(key, value []byte) error {
+	v := make([]byte, 1+len(value))
+	v[0] = kindValue
+	copy(v[1:], value)
+	return is.mem.Set(key, v, nil)
+}
+
+func (is *storage) delete(key []byte) error {
+	return is.mem.Set(key, []byte{kindTombstone}, nil)
+}
+
+// newJournal starts a new, empty journal.
+//
+// is.mu must be held, or is must not yet be shared.
+func (is *storage) newJournal() error {
+	num := is.nextNum
+	is.nextNum++
+	f, err := os.Create(is.path(num, "log"))
+	if err != nil {
+		return err
+	}
+	is.journal, is.jw, is.jnum, is.jsize = f, record.NewWriter(f), num, 0
+	return nil
+}
+
+// appendJournal writes rec as a single journal record, so the
+// mutations it holds are replayed all or nothing.
+//
+// is.mu must be held.
+func (is *storage) appendJournal(rec []byte) error {
+	w, err := is.jw.Next()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(rec); err != nil {
+		return err
+	}
+	if err := is.jw.Flush(); err != nil {
+		return err
+	}
+	is.jsize += int64(len(rec))
+	return nil
+}
+
+// flush writes the memdb out as a table once the journal is full, or
+// whenever it's not empty if force is true, then merges the tables
+// that piled up. The memdb and journal are replaced first, so writes
+// go on meanwhile.
+func (is *storage) flush(force bool) error {
+	is.compactMu.Lock()
+	defer is.compactMu.Unlock()
+	is.mu.Lock()
+	if is.journal == nil {
+		is.mu.Unlock()
+		return errClosed
+	}
+	if is.imm == nil && (is.jsize >= maxJournalSize || (force && is.jsize > 0)) {
+		old, oldNum := is.journal, is.jnum
+		if err := is.newJournal(); err != nil {
+			is.mu.Unlock()
+			return err
+		}
+		old.Close()
+		is.imm, is.immLogs = is.mem, append(is.immLogs, oldNum)
+		is.mem = memdb.New(nil)
+	}
+	is.mu.Unlock()
+	if err := is.flushImm(); err != nil {
+		return err
+	}
+	return is.mergeTables(force)
+}
+
+// flushImm writes is.imm out as a new table, if there's one, and
+// removes its journals.
+//
+// is.compactMu must be held, or is must not yet be shared.
+func (is *storage) flushImm() error {
+	is.mu.Lock()
+	imm := is.imm
+	num := is.nextNum
+	is.nextNum++
+	// Without older tables, tombstones have nothing to shadow.
+	dropTombstones := len(is.tables) == 0
+	is.mu.Unlock()
+	if imm == nil {
+		return nil
+	}
+
+	t, err := is.writeTable(num, imm.Find(nil, nil), dropTombstones)
+	if err != nil {
+		return err
+	}
+	is.mu.Lock()
+	tables := is.tables
+	if t != nil {
+		tables = append(append([]*tableFile(nil), is.tables...), t)
+		if err := is.writeManifest(tables); err != nil {
+			is.unref(t)
+			is.mu.Unlock()
+			return err
+		}
+	}
+	logs := is.immLogs
+	is.tables, is.imm, is.immLogs = tables, nil, nil
+	is.mu.Unlock()
+	for _, num := range logs {
+		os.Remove(is.path(num, "log"))
+	}
+	return nil
+}
+
+// mergeTables merges the newest tables together with the older ones
+// that aren't more than twice as big as them, or all the tables if
+// all is true.
+//
+// is.compactMu must be held.
+func (is *storage) mergeTables(all bool) error {
+	for {
+		is.mu.Lock()
+		ts := is.tables
+		num := is.nextNum
+		is.nextNum++
+		is.mu.Unlock()
+
+		k := len(ts) - 1
+		if k < 1 {
+			return nil
+		}
+		newer := ts[k].size
+		for k > 0 && (all || ts[k-1].size <= 2*newer) {
+			k--
+			newer += ts[k].size
+		}
+		if k == len(ts)-1 {
+			return nil
+		}
+		var its []db.Iterator
+		for i := len(ts) - 1; i >= k; i-- {
+			its = append(its, ts[i].r.Find(nil, nil))
+		}
+		t, err := is.writeTable(num, newMergeIter(its), k == 0)
+		if err != nil {
+			return err
+		}
+
+		// Only flushImm and mergeTables change the tables, and
+		// they hold compactMu, so is.tables is still ts.
+		is.mu.Lock()
+		tables := append([]*tableFile(nil), ts[:k]...)
+		if t != nil {
+			tables = append(tables, t)
+		}
+		if err := is.writeManifest(tables); err != nil {
+			if t != nil {
+				is.unref(t)
+			}
+			is.mu.Unlock()
+			return err
+		}
+		is.tables = tables
+		for _, old := range ts[k:] {
+			is.unref(old)
+		}
+		is.mu.Unlock()
+	}
+}
+
+// writeTable writes the entries of it, from a memdb or merged tables,
+// as the table numbered num. It returns a nil table if there was
+// nothing to write.
+func (is *storage) writeTable(num uint64, it db.Iterator, dropTombstones bool) (*tableFile, error) {
+	name := is.path(num, "sst")
+	f, err := os.Create(name)
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	w := table.NewWriter(f, nil)
+	n := 0
+	for it.Next() {
+		if dropTombstones && it.Value()[0] == kindTombstone {
+			continue
+		}
+		if err = w.Set(it.Key(), it.Value(), nil); err != nil {
+			break
+		}
+		n++
+	}
+	if cerr := it.Close(); err == nil {
+		err = cerr
+	}
+	// Closing the writer flushes and closes f.
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > 0 {
+		err = syncFile(name)
+	}
+	if err != nil || n == 0 {
+		os.Remove(name)
+		return nil, err
+	}
+	return openTable(name, num)
+}
+
+// unref drops a reference to t, closing and removing it after the
+// last one.
+//
+// is.mu must be held.
+func (is *storage) unref(t *tableFile) {
+	t.refs--
+	if t.refs > 0 {
+		return
+	}
+	t.r.Close()
+	if err := os.Remove(is.path(t.num, "sst")); err != nil {
+		log.Printf("leveldb index: error removing merged table: %v", err)
+	}
+}
+
+// Compact writes the journal out and merges all the tables into one,
+// reclaiming the space of deleted and overwritten entries.
+func (is *storage) Compact() error {
+	return is.flush(true)
+}
+
+// Close closes the journal and releases the directory. The storage
+// must not be used afterwards.
+func (is *storage) Close() error {
+	is.compactMu.Lock()
+	defer is.compactMu.Unlock()
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.journal == nil {
+		return nil
+	}
+	err := is.journal.Close()
+	is.journal, is.jw = nil, nil
+	// Tables in use by open iterators are only closed with them.
+	for _, t := range is.tables {
+		t.refs--
+		if t.refs == 0 {
+			t.r.Close()
+		}
+	}
+	is.tables = nil
+	if lerr := is.lock.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+var errClosed = errors.New("leveldb index: storage is closed")
+
+func syncFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func appendString(buf *bytes.Buffer, s string) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(s)))
+	buf.Write(lenBuf[:n])
+	buf.WriteString(s)
+}
+
+func appendSet(buf *bytes.Buffer, key, value string) {
+	buf.WriteByte(opSet)
+	appendString(buf, key)
+	appendString(buf, value)
+}
+
+func appendDelete(buf *bytes.Buffer, key string) {
+	buf.WriteByte(opDelete)
+	appendString(buf, key)
+}
+
+type byNum []uint64
+
+func (s byNum) Len() int           { return len(s) }
+func (s byNum) Less(i, j int) bool { return s[i] < s[j] }
+func (s byNum) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// snapshot is what reads look in, from the newest.
+type snapshot struct {
+	dbs    []db.DB
+	tables []*tableFile
+}
+
+// snapshot returns the memdbs and tables to read from, holding a
+// reference to the tables until release.
+func (is *storage) snapshot() *snapshot {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	s := &snapshot{dbs: []db.DB{is.mem}, tables: is.tables}
+	if is.imm != nil {
+		s.dbs = append(s.dbs, is.imm)
+	}
+	for i := len(is.tables) - 1; i >= 0; i-- {
+		t := is.tables[i]
+		t.refs++
+		s.dbs = append(s.dbs, t.r)
+	}
+	return s
+}
+
+func (is *storage) release(s *snapshot) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for _, t := range s.tables {
+		is.unrefOrClose(t)
+	}
+}
+
+// unrefOrClose is unref for a table that may have been dropped by
+// Close instead of a merge, and so must not be removed.
+//
+// is.mu must be held.
+func (is *storage) unrefOrClose(t *tableFile) {
+	if is.journal == nil {
+		t.refs--
+		if t.refs == 0 {
+			t.r.Close()
+		}
+		return
+	}
+	is.unref(t)
+}
+
+// mergeIter iterates over the union of several iterators, from the
+// newest. Of the entries of the same key, only the newest is
+// returned.
+type mergeIter struct {
+	its   []db.Iterator
+	valid []bool
+	key   []byte
+	value []byte
+	err   error
+}
+
+func newMergeIter(its []db.Iterator) *mergeIter {
+	m := &mergeIter{its: its, valid: make([]bool, len(its))}
+	for i, it := range its {
+		m.valid[i] = it.Next()
+	}
+	return m
+}
+
+func (m *mergeIter) Next() bool {
+	cur := -1
+	for i, it := range m.its {
+		if m.valid[i] && (cur < 0 || bytes.Compare(it.Key(), m.its[cur].Key()) < 0) {
+			cur = i
+		}
+	}
+	if cur < 0 {
+		m.key, m.value = nil, nil
+		return false
+	}
+	m.key = append(m.key[:0], m.its[cur].Key()...)
+	m.value = append(m.value[:0], m.its[cur].Value()...)
+	for i, it := range m.its {
+		if m.valid[i] && bytes.Equal(it.Key(), m.key) {
+			m.valid[i] = it.Next()
+		}
+	}
+	return true
+}
+
+func (m *mergeIter) Key() []byte   { return m.key }
+func (m *mergeIter) Value() []byte { return m.value }
+
+func (m *mergeIter) Close() error {
+	for _, it := range m.its {
+		if err := it.Close(); err != nil && m.err == nil {
+			m.err = err
+		}
+	}
+	return m.err
+}
+
+// iter is the index.Iterator of the storage: a mergeIter over a
+// snapshot, skipping the deleted keys.
+type iter struct {
+	is *storage
+	s  *snapshot
+	m  *mergeIter
+}
+
+func (it *iter) Next() bool {
+	for it.m.Next() {
+		if it.m.value[0] != kindTombstone {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *iter) Key() string {
+	return string(it.m.key)
+}
+
+func (it *iter) Value() string {
+	return string(it.m.value[1:])
+}
+
+func (it *iter) Close() error {
+	err := it.m.Close()
+	if it.s != nil {
+		it.is.release(it.s)
+		it.s = nil
+	}
+	return err
+}
+
+func (is *storage) Get(key string) (string, error) {
+	s := is.snapshot()
+	defer is.release(s)
+	for _, d := range s.dbs {
+		v, err := d.Get([]byte(key), nil)
+		if err == db.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if v[0] == kindTombstone {
+			break
+		}
+		return string(v[1:]), nil
+	}
+	return "", index.ErrNotFound
+}
+
+func (is *storage) Find(key string) index.Iterator {
+	s := is.snapshot()
+	its := make([]db.Iterator, len(s.dbs))
+	for i, d := range s.dbs {
+		its[i] = d.Find([]byte(key), nil)
+	}
+	return &iter{is: is, s: s, m: newMergeIter(its)}
+}
+
+func (is *storage) Set(key, value string) error {
+	b := is.BeginBatch()
+	b.Set(key, value)
+	return is.CommitBatch(b)
+}
+
+func (is *storage) Delete(key string) error {
+	b := is.BeginBatch()
+	b.Delete(key)
+	return is.CommitBatch(b)
+}
+
+func (is *storage) BeginBatch() index.BatchMutation {
+	return index.NewBatchMutation()
+}
+
+type batch interface {
+	Mutations() []index.Mutation
+}
+
+func (is *storage) CommitBatch(bm index.BatchMutation) error {
+	b, ok := bm.(batch)
+	if !ok {
+		return errors.New("invalid batch type")
+	}
+	muts := b.Mutations()
+	if len(muts) == 0 {
+		return nil
+	}
+	var rec bytes.Buffer
+	for _, m := range muts {
+		if m.IsDelete() {
+			appendDelete(&rec, m.Key())
+		} else {
+			appendSet(&rec, m.Key(), m.Value())
+		}
+	}
+
+	is.mu.Lock()
+	if is.journal == nil {
+		is.mu.Unlock()
+		return errClosed
+	}
+	if err := is.appendJournal(rec.Bytes()); err != nil {
+		is.mu.Unlock()
+		return err
+	}
+	for _, m := range muts {
+		var err error
+		if m.IsDelete() {
+			err = is.delete([]byte(m.Key()))
+		} else {
+			err = is.set([]byte(m.Key()), []byte(m.Value()))
+		}
+		if err != nil {
+			is.mu.Unlock()
+			return err
+		}
+	}
+	full := is.jsize >= maxJournalSize
+	is.mu.Unlock()
+	if full {
+		return is.flush(false)
+	}
+	return nil
+}
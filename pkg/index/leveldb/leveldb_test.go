@@ -0,0 +1,264 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leveldb_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/indextest"
+	"camlistore.org/pkg/index/leveldb"
+)
+
+type leveldbTester struct{}
+
+func (leveldbTester) test(t *testing.T, tfn func(*testing.T, func() *index.Index)) {
+	dir, err := ioutil.TempDir("", "leveldb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := 0
+	makeIndex := func() *index.Index {
+		n++
+		s, err := leveldb.NewStorage(filepath.Join(dir, strconv.Itoa(n)))
+		if err != nil {
+			t.Fatalf("opening test index: %v", err)
+		}
+		return index.New(s)
+	}
+	tfn(t, makeIndex)
+}
+
+func TestIndex_LevelDB(t *testing.T) {
+	leveldbTester{}.test(t, indextest.Index)
+}
+
+func TestPathsOfSignerTarget_LevelDB(t *testing.T) {
+	leveldbTester{}.test(t, indextest.PathsOfSignerTarget)
+}
+
+func TestFiles_LevelDB(t *testing.T) {
+	leveldbTester{}.test(t, indextest.Files)
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := leveldb.NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("foo", "bar")
+	s.Set("gone", "soon")
+	s.Delete("gone")
+	b := s.BeginBatch()
+	b.Set("a", "1")
+	b.Set("b", "2")
+	if err := s.CommitBatch(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory is locked while it's open.
+	if _, err := leveldb.NewStorage(dir); err == nil {
+		t.Fatal("second NewStorage on an open directory succeeded")
+	}
+
+	// Reopen it, as a restarted server would, from the journal.
+	if err := s.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = leveldb.NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"foo": "bar", "a": "1", "b": "2"} {
+		if got, err := s.Get(k); err != nil || got != want {
+			t.Errorf("Get(%q) = %q, %v; want %q", k, got, err, want)
+		}
+	}
+	if _, err := s.Get("gone"); err != index.ErrNotFound {
+		t.Errorf("Get of deleted key = %v; want ErrNotFound", err)
+	}
+
+	it := s.Find("")
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(keys), 3; got != want || keys[0] != "a" || keys[2] != "foo" {
+		t.Errorf("Find keys = %q; want [a b foo]", keys)
+	}
+}
+
+func TestCompactAndClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type storage interface {
+		index.IndexStorage
+		Compact() error
+		Close() error
+	}
+	s, err := leveldb.NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := s.(storage)
+	ls.Set("foo", "bar")
+	ls.Set("gone", "soon")
+	ls.Delete("gone")
+	if err := ls.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if tables, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(tables) != 1 {
+		t.Errorf("tables after compaction = %q; want one", tables)
+	}
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	for _, name := range logs {
+		if fi, err := os.Stat(name); err != nil || fi.Size() != 0 {
+			t.Errorf("journal after compaction: %v, %v; want empty", fi, err)
+		}
+	}
+	if err := ls.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Set("a", "1"); err == nil {
+		t.Errorf("Set after Close succeeded")
+	}
+
+	s, err = leveldb.NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get("foo"); err != nil || got != "bar" {
+		t.Errorf("Get(foo) after reopen = %q, %v", got, err)
+	}
+	if _, err := s.Get("gone"); err != index.ErrNotFound {
+		t.Errorf("Get of deleted key = %v; want ErrNotFound", err)
+	}
+}
+
+func TestManyTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leveldb.SetMaxJournalSize(4 << 10)
+	defer leveldb.SetMaxJournalSize(4 << 20)
+
+	s, err := leveldb.NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20000
+	key := func(i int) string { return fmt.Sprintf("key%06d", i) }
+	for i := 0; i < n; i++ {
+		if err := s.Set(key(i), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		// Overwrite and delete some of the keys in later tables.
+		if i%10 == 9 {
+			if err := s.Set(key(i-5), "new"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(key(i - 9)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The tables are merged as they're written, so there are few of
+	// them.
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(tables) == 0 || len(tables) > 20 {
+		t.Errorf("%d tables; want between 1 and 20", len(tables))
+	}
+
+	check := func(s index.IndexStorage) {
+		want := func(i int) (string, bool) {
+			switch i % 10 {
+			case 0:
+				return "", false
+			case 4:
+				return "new", true
+			}
+			return strconv.Itoa(i), true
+		}
+		for _, i := range []int{0, 1, 4, 5, 9999, 10004, n - 1} {
+			v, ok := want(i)
+			got, err := s.Get(key(i))
+			if !ok {
+				if err != index.ErrNotFound {
+					t.Errorf("Get(%q) = %q, %v; want ErrNotFound", key(i), got, err)
+				}
+				continue
+			}
+			if err != nil || got != v {
+				t.Errorf("Get(%q) = %q, %v; want %q", key(i), got, err, v)
+			}
+		}
+		it := s.Find("")
+		i := 0
+		for it.Next() {
+			v, ok := want(i)
+			for !ok {
+				i++
+				v, ok = want(i)
+			}
+			if it.Key() != key(i) || it.Value() != v {
+				t.Fatalf("Find entry %q = %q; want %q = %q", it.Key(), it.Value(), key(i), v)
+			}
+			i++
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if i != n {
+			t.Errorf("Find stopped before %q; want %q", key(i), key(n))
+		}
+	}
+	check(s)
+
+	if err := s.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = leveldb.NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(io.Closer).Close()
+	check(s)
+}
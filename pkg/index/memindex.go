@@ -40,6 +40,7 @@ func newMemoryIndex() *Index {
 
 func newMemoryIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
 	blobPrefix := config.RequiredString("blobSource")
+	indexedAttrs := config.OptionalList("indexedAttributes")
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -49,6 +50,9 @@ func newMemoryIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blob
 	}
 
 	ix := newMemoryIndex()
+	if err := ix.SetIndexedAttributes(indexedAttrs); err != nil {
+		return nil, err
+	}
 	ix.BlobSource = sto
 
 	// Good enough, for now:
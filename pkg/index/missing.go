@@ -0,0 +1,141 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+// Blobs can arrive in any order: a file schema blob before its chunks,
+// or a claim before its signer's public key. When indexing a blob fails
+// because such a dependency is missing, a keyMissing row is recorded,
+// and the blob is indexed again once the missing blob is received.
+
+// missTrackingFetcher is a SeekFetcher that remembers which blobs it
+// failed to fetch because they don't exist.
+type missTrackingFetcher struct {
+	blobref.SeekFetcher
+	missing []*blobref.BlobRef
+}
+
+func (f *missTrackingFetcher) Fetch(br *blobref.BlobRef) (blobref.ReadSeekCloser, int64, error) {
+	file, size, err := f.SeekFetcher.Fetch(br)
+	if err == os.ErrNotExist {
+		f.missing = append(f.missing, br)
+	}
+	return file, size, err
+}
+
+// noteMissing records in bm that br needs to be indexed again when the
+// blobs f failed to fetch are received.
+func (f *missTrackingFetcher) noteMissing(br *blobref.BlobRef, bm BatchMutation) {
+	for _, missing := range f.missing {
+		bm.Set(keyMissing.Key(missing, br), "1")
+	}
+}
+
+// isMissing reports whether br doesn't exist in fetcher.
+func (x *Index) isMissing(fetcher blobref.StreamingFetcher, br *blobref.BlobRef) bool {
+	if fetcher == nil {
+		return false
+	}
+	rc, _, err := fetcher.FetchStreaming(br)
+	if err != nil {
+		return err == os.ErrNotExist
+	}
+	rc.Close()
+	return false
+}
+
+// populateDependents indexes again the blobs that failed to index
+// because br was missing.
+func (x *Index) populateDependents(br *blobref.BlobRef) error {
+	var deps []*blobref.BlobRef
+	it := x.queryPrefix(keyMissing, br)
+	for it.Next() {
+		keyPart := strings.Split(it.Key(), "|")
+		if len(keyPart) < 3 {
+			continue
+		}
+		if dep := blobref.Parse(keyPart[2]); dep != nil {
+			deps = append(deps, dep)
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	for _, dep := range deps {
+		sniffer, err := x.sniffBlob(dep)
+		if err != nil {
+			// Keep the row; there's nothing to index yet.
+			log.Printf("index: error fetching %s to index again after receiving %s: %v", dep, br, err)
+			continue
+		}
+
+		bm := x.s.BeginBatch()
+		bm.Delete(keyMissing.Key(br, dep))
+		if err := x.populateMutation(dep, sniffer, bm); err != nil {
+			// Keep the row, and don't make dep's failure the
+			// error of receiving br.
+			log.Printf("index: error indexing %s again after receiving %s: %v", dep, br, err)
+			continue
+		}
+		if err := x.s.CommitBatch(bm); err != nil {
+			return err
+		}
+		log.Printf("index: indexed %s again after receiving %s", dep, br)
+	}
+	return nil
+}
+
+// watchBlobSource arranges for the blobs waiting on a missing
+// dependency to be indexed as soon as it's received by the blob source
+// or key fetcher, even if the index itself isn't sent the blob.
+func (x *Index) watchBlobSource() {
+	watched := make(map[blobserver.BlobHub]bool)
+	for _, fetcher := range []blobref.StreamingFetcher{x.BlobSource, x.KeyFetcher} {
+		sto, ok := fetcher.(blobserver.Storage)
+		if !ok || sto == blobserver.Storage(x) {
+			continue
+		}
+		hub := sto.GetBlobHub()
+		if hub == nil || watched[hub] {
+			continue
+		}
+		watched[hub] = true
+		ch := make(chan *blobref.BlobRef, 100)
+		hub.RegisterListener(ch)
+		go func() {
+			for br := range ch {
+				x.reindexMu.RLock()
+				// Reindex indexes all the blobs anyway.
+				if !x.isReindexing() {
+					if err := x.populateDependents(br); err != nil {
+						log.Printf("index: error indexing blobs waiting on %s: %v", br, err)
+					}
+				}
+				x.reindexMu.RUnlock()
+			}
+		}()
+	}
+}
@@ -114,6 +114,7 @@ func newMongoIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobs
 		Database:   config.RequiredString("database"),
 		Collection: collectionName,
 	}
+	indexedAttrs := config.OptionalList("indexedAttributes")
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -144,6 +145,10 @@ func newMongoIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobs
 		}
 	}
 
+	if err := ix.SetIndexedAttributes(indexedAttrs); err != nil {
+		return nil, err
+	}
+
 	return ix, err
 }
 
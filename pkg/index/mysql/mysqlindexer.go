@@ -61,11 +61,12 @@ func NewStorage(host, user, password, dbname string) (index.IndexStorage, error)
 
 func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
 	var (
-		blobPrefix = config.RequiredString("blobSource")
-		host       = config.OptionalString("host", "localhost")
-		user       = config.RequiredString("user")
-		password   = config.OptionalString("password", "")
-		database   = config.RequiredString("database")
+		blobPrefix   = config.RequiredString("blobSource")
+		host         = config.OptionalString("host", "localhost")
+		user         = config.RequiredString("user")
+		password     = config.OptionalString("password", "")
+		database     = config.RequiredString("database")
+		indexedAttrs = config.OptionalList("indexedAttributes")
 	)
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -98,6 +99,9 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 	}
 
 	ix := index.New(is)
+	if err := ix.SetIndexedAttributes(indexedAttrs); err != nil {
+		return nil, err
+	}
 	ix.BlobSource = sto
 	// Good enough, for now:
 	ix.KeyFetcher = ix.BlobSource
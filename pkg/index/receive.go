@@ -18,11 +18,11 @@ package index
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"strings"
 
 	"camlistore.org/pkg/blobref"
@@ -30,14 +30,58 @@ import (
 	"camlistore.org/pkg/jsonsign"
 	"camlistore.org/pkg/magic"
 	"camlistore.org/pkg/schema"
-	"camlistore.org/pkg/search"
 )
 
 func (ix *Index) GetBlobHub() blobserver.BlobHub {
 	return ix.SimpleBlobHubPartitionMap.GetBlobHub()
 }
 
+// ReceiveBlob indexes blobRef. While the index is being rebuilt by
+// Reindex, the blob is only verified and held in memory, and it's
+// indexed once Reindex is done.
 func (ix *Index) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (retsb blobref.SizedBlobRef, err error) {
+	ix.reindexMu.RLock()
+	if !ix.isReindexing() {
+		defer ix.reindexMu.RUnlock()
+		return ix.receiveBlob(blobRef, source)
+	}
+	ix.reindexMu.RUnlock()
+	return ix.queueBlob(blobRef, source)
+}
+
+func (ix *Index) isReindexing() bool {
+	ix.queueMu.Lock()
+	defer ix.queueMu.Unlock()
+	return ix.reindexing
+}
+
+// queueBlob verifies blobRef and queues it to be indexed after the
+// reindexing.
+func (ix *Index) queueBlob(blobRef *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	var buf bytes.Buffer
+	hash := blobRef.Hash()
+	written, err := io.Copy(io.MultiWriter(hash, &buf), source)
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	if !blobRef.HashMatches(hash) {
+		return blobref.SizedBlobRef{}, blobserver.ErrCorruptBlob
+	}
+	ix.queueMu.Lock()
+	if !ix.reindexing {
+		// It finished meanwhile.
+		ix.queueMu.Unlock()
+		return ix.ReceiveBlob(blobRef, &buf)
+	}
+	ix.queue = append(ix.queue, queuedBlob{blobRef, buf.Bytes()})
+	ix.queueMu.Unlock()
+	return blobref.SizedBlobRef{blobRef, written}, nil
+}
+
+// receiveBlob is ReceiveBlob, with reindexMu held or from Reindex.
+func (ix *Index) receiveBlob(blobRef *blobref.BlobRef, source io.Reader) (retsb blobref.SizedBlobRef, err error) {
+	ix.watchOnce.Do(ix.watchBlobSource)
+
 	sniffer := new(BlobSniffer)
 	hash := blobRef.Hash()
 	var written int64
@@ -67,6 +111,10 @@ func (ix *Index) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (retsb
 	mimeType := sniffer.MimeType()
 	log.Printf("indexer: received %s; type=%v; truncated=%v", blobRef, mimeType, sniffer.IsTruncated())
 
+	if err = ix.populateDependents(blobRef); err != nil {
+		return
+	}
+
 	return blobref.SizedBlobRef{blobRef, written}, nil
 }
 
@@ -101,12 +149,18 @@ func (ix *Index) populateMutation(br *blobref.BlobRef, sniffer *BlobSniffer, bm
 //      ss: the parsed file schema blob
 //      bm: keys to populate
 func (ix *Index) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset, bm BatchMutation) error {
-	seekFetcher, err := blobref.SeekerFromStreamingFetcher(ix.BlobSource)
+	seeker, err := blobref.SeekerFromStreamingFetcher(ix.BlobSource)
 	if err != nil {
 		return err
 	}
+	seekFetcher := &missTrackingFetcher{SeekFetcher: seeker}
 
-	sha1 := sha1.New()
+	// The whole file's blobref has the digest of its schema blob,
+	// the one the uploader used.
+	hash := blobRef.Hash()
+	if hash == nil {
+		return fmt.Errorf("index: unsupported digest of %v", blobRef)
+	}
 	fr, err := ss.NewFileReader(seekFetcher)
 	if err != nil {
 		// TODO(bradfitz): propagate up a transient failure
@@ -114,22 +168,24 @@ func (ix *Index) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset, bm
 		// future if blobs are only temporarily unavailable.
 		// Basically the same as the TODO just below.
 		log.Printf("index: error indexing file, creating NewFileReader %s: %v", blobRef, err)
+		seekFetcher.noteMissing(blobRef, bm)
 		return nil
 	}
 	mime, reader := magic.MimeTypeFromReader(fr)
-	size, err := io.Copy(sha1, reader)
+	size, err := io.Copy(hash, reader)
 	if err != nil {
-		// TODO: job scheduling system to retry this spaced
-		// out max n times.  Right now our options are
-		// ignoring this error (forever) or returning the
-		// error and making the indexing try again (likely
-		// forever failing).  Both options suck.  For now just
-		// log and act like all's okay.
+		// If it's because of missing chunks, the file is
+		// reindexed once they're received. Otherwise our
+		// options are ignoring this error (forever) or
+		// returning the error and making the indexing try
+		// again (likely forever failing).  Both options
+		// suck.  For now just log and act like all's okay.
 		log.Printf("index: error indexing file %s: %v", blobRef, err)
+		seekFetcher.noteMissing(blobRef, bm)
 		return nil
 	}
 
-	wholeRef := blobref.FromHash("sha1", sha1)
+	wholeRef := blobref.FromHash(blobRef.HashName(), hash)
 	bm.Set(keyWholeToFileRef.Key(wholeRef, blobRef), "1")
 	bm.Set(keyFileInfo.Key(blobRef), keyFileInfo.Val(size, ss.FileName, mime))
 	return nil
@@ -137,7 +193,7 @@ func (ix *Index) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset, bm
 
 func (ix *Index) populateClaim(br *blobref.BlobRef, ss *schema.Superset, sniffer *BlobSniffer, bm BatchMutation) error {
 	pnbr := blobref.Parse(ss.Permanode)
-	if pnbr == nil {
+	if pnbr == nil && ss.ClaimType != "delete" {
 		// Skip bogus claim with malformed permanode.
 		return nil
 	}
@@ -149,6 +205,12 @@ func (ix *Index) populateClaim(br *blobref.BlobRef, ss *schema.Superset, sniffer
 
 	vr := jsonsign.NewVerificationRequest(string(rawJson), ix.KeyFetcher)
 	if !vr.Verify() {
+		if signer := blobref.Parse(ss.Signer); signer != nil && ix.isMissing(ix.KeyFetcher, signer) {
+			// Verify again once we get the signer's public key.
+			log.Printf("index: claim %s signed by %s, which we don't have yet", br, signer)
+			bm.Set(keyMissing.Key(signer, br), "1")
+			return nil
+		}
 		// TODO(bradfitz): ask if the vr.Err.(jsonsign.Error).IsPermanent() and retry
 		// later if it's not permanent? or maybe do this up a level?
 		if vr.Err != nil {
@@ -161,12 +223,36 @@ func (ix *Index) populateClaim(br *blobref.BlobRef, ss *schema.Superset, sniffer
 
 	bm.Set("signerkeyid:"+vr.CamliSigner.String(), verifiedKeyId)
 
+	if ss.ClaimType == "delete" {
+		return ix.populateDeleteClaim(br, ss, verifiedKeyId, bm)
+	}
+
 	recentKey := keyRecentPermanode.Key(verifiedKeyId, ss.ClaimDate, br)
 	bm.Set(recentKey, pnbr.String())
 
 	claimKey := pipes("claim", pnbr, verifiedKeyId, ss.ClaimDate, br)
 	bm.Set(claimKey, pipes(urle(ss.ClaimType), urle(ss.Attribute), urle(ss.Value)))
 
+	deleted, err := ix.isDeleted(br, verifiedKeyId)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		// The claim was retracted before we got it; keep it
+		// out of the search rows.
+		return nil
+	}
+	for key, val := range ix.claimSearchRows(br, pnbr, ss, verifiedKeyId) {
+		bm.Set(key, val)
+	}
+	return nil
+}
+
+// claimSearchRows returns the rows, other than the "claim" and "recpn"
+// ones, populated for the claim br on the permanode pnbr, signed by
+// keyId.
+func (ix *Index) claimSearchRows(br, pnbr *blobref.BlobRef, ss *schema.Superset, keyId string) map[string]string {
+	rows := make(map[string]string)
 	if strings.HasPrefix(ss.Attribute, "camliPath:") {
 		targetRef := blobref.Parse(ss.Value)
 		if targetRef != nil {
@@ -183,23 +269,91 @@ func (ix *Index) populateClaim(br *blobref.BlobRef, ss *schema.Superset, sniffer
 			baseRef := pnbr
 			claimRef := br
 
-			key := keyPathBackward.Key(verifiedKeyId, targetRef, claimRef)
-			val := keyPathBackward.Val(ss.ClaimDate, baseRef, active, suffix)
-			bm.Set(key, val)
+			key := keyPathBackward.Key(keyId, targetRef, claimRef)
+			rows[key] = keyPathBackward.Val(ss.ClaimDate, baseRef, active, suffix)
 
-			key = keyPathForward.Key(verifiedKeyId, baseRef, suffix, ss.ClaimDate, claimRef)
-			val = keyPathForward.Val(active, targetRef)
-			bm.Set(key, val)
+			key = keyPathForward.Key(keyId, baseRef, suffix, ss.ClaimDate, claimRef)
+			rows[key] = keyPathForward.Val(active, targetRef)
 		}
 	}
 
-	if search.IsIndexedAttribute(ss.Attribute) {
-		key := keySignerAttrValue.Key(verifiedKeyId, ss.Attribute, ss.Value, ss.ClaimDate, br)
-		bm.Set(key, keySignerAttrValue.Val(pnbr))
+	if ix.IsIndexedAttribute(ss.Attribute) {
+		key := keySignerAttrValue.Key(keyId, ss.Attribute, ss.Value, ss.ClaimDate, br)
+		rows[key] = keySignerAttrValue.Val(pnbr)
+	}
+	return rows
+}
+
+// populateDeleteClaim populates the rows for br, a "delete" claim
+// signed by keyId, and removes the search rows of the claim it
+// retracts.
+//
+// The deleted claim's permanode gets a claim row for br, so
+// GetOwnerClaims returns the deletion along with the claim it deletes.
+func (ix *Index) populateDeleteClaim(br *blobref.BlobRef, ss *schema.Superset, keyId string, bm BatchMutation) error {
+	target := blobref.Parse(ss.Target)
+	if target == nil {
+		// Skip bogus claim with malformed target.
+		return nil
+	}
+	bm.Set(keyDeleted.Key(target, br), keyDeleted.Val(keyId))
+
+	sniffer, err := ix.sniffBlob(target)
+	if err == os.ErrNotExist {
+		log.Printf("index: delete claim %s of %s, which we don't have yet", br, target)
+		bm.Set(keyMissing.Key(target, br), "1")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tss, ok := sniffer.Superset()
+	if !ok || tss.Type != "claim" || blobref.Parse(tss.Permanode) == nil || tss.Signer != ss.Signer {
+		log.Printf("index: ignoring delete claim %s of %s, which isn't a permanode claim of the same signer", br, target)
+		return nil
+	}
+	pnbr := blobref.Parse(tss.Permanode)
+
+	recentKey := keyRecentPermanode.Key(keyId, ss.ClaimDate, br)
+	bm.Set(recentKey, pnbr.String())
+
+	claimKey := pipes("claim", pnbr, keyId, ss.ClaimDate, br)
+	bm.Set(claimKey, pipes(urle(ss.ClaimType), "", urle(target.String())))
+
+	for key := range ix.claimSearchRows(target, pnbr, tss, keyId) {
+		bm.Delete(key)
 	}
 	return nil
 }
 
+// isDeleted reports whether the claim br was retracted by a "delete"
+// claim signed by keyId.
+func (ix *Index) isDeleted(br *blobref.BlobRef, keyId string) (deleted bool, err error) {
+	it := ix.queryPrefix(keyDeleted, br)
+	defer closeIterator(it, &err)
+	for it.Next() {
+		if it.Value() == keyId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sniffBlob fetches br from the blob source and sniffs it.
+func (ix *Index) sniffBlob(br *blobref.BlobRef) (*BlobSniffer, error) {
+	rc, _, err := ix.BlobSource.FetchStreaming(br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	sniffer := new(BlobSniffer)
+	if _, err := io.Copy(sniffer, rc); err != nil {
+		return nil, err
+	}
+	sniffer.Parse()
+	return sniffer, nil
+}
+
 // pipes returns args separated by pipes
 func pipes(args ...interface{}) string {
 	var buf bytes.Buffer
@@ -0,0 +1,204 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+// Reindex passes, in the order they're run.
+const (
+	ReindexPassBlobs  = "blobs"  // chunks, public keys and other non-schema blobs
+	ReindexPassBytes  = "bytes"  // "bytes" schema blobs
+	ReindexPassSchema = "schema" // other schema blobs but claims: files, directories, permanodes...
+	ReindexPassClaims = "claims" // signed claims
+)
+
+// reindexEnumerateLimit is how many blobs are asked from the source
+// per enumeration.
+const reindexEnumerateLimit = 1000
+
+// ReindexProgressFunc is called by Reindex after each blob is indexed,
+// with the pass it was indexed in and the error indexing it, if any.
+type ReindexProgressFunc func(pass string, br *blobref.BlobRef, err error)
+
+// Reindex wipes the index and rebuilds it from all the blobs in src.
+//
+// Blobs are indexed in dependency order: first all the blobs that
+// aren't schema blobs (file chunks and public keys), then "bytes"
+// schema blobs, then the other schema blobs, and finally the claims.
+//
+// A blob failing to index doesn't stop the reindexing; it is reported
+// to progress, if non-nil. Reindex only returns an error if the index
+// can't be wiped or src can't be enumerated.
+//
+// The blobs received while Reindex runs are held in memory and indexed
+// once it's done, so uploads aren't blocked by it.
+func (x *Index) Reindex(src blobserver.Storage, progress ReindexProgressFunc) error {
+	x.queueMu.Lock()
+	if x.reindexing {
+		x.queueMu.Unlock()
+		return errors.New("index: already reindexing")
+	}
+	x.reindexing = true
+	x.queueMu.Unlock()
+	defer x.indexQueued()
+	// Wait for the blobs being indexed to be done, so they aren't
+	// indexed against the wiped index.
+	x.reindexMu.Lock()
+	x.reindexMu.Unlock()
+
+	if progress == nil {
+		progress = func(string, *blobref.BlobRef, error) {}
+	}
+	if err := x.wipe(); err != nil {
+		return fmt.Errorf("index: error wiping index before reindexing: %v", err)
+	}
+
+	var bytesRefs, schemaRefs, claimRefs []*blobref.BlobRef
+	err := enumerateAll(src, func(sb blobref.SizedBlobRef) {
+		br := sb.BlobRef
+		body, err := fetchAll(src, br)
+		if err != nil {
+			progress(ReindexPassBlobs, br, err)
+			return
+		}
+		sniffer := new(BlobSniffer)
+		sniffer.Write(body)
+		sniffer.Parse()
+		if camli, ok := sniffer.Superset(); ok {
+			switch camli.Type {
+			case "bytes":
+				bytesRefs = append(bytesRefs, br)
+			case "claim":
+				claimRefs = append(claimRefs, br)
+			default:
+				schemaRefs = append(schemaRefs, br)
+			}
+			return
+		}
+		_, err = x.receiveBlob(br, bytes.NewReader(body))
+		progress(ReindexPassBlobs, br, err)
+	})
+	if err != nil {
+		return fmt.Errorf("index: error enumerating blobs to reindex: %v", err)
+	}
+
+	for _, pass := range []struct {
+		name string
+		refs []*blobref.BlobRef
+	}{
+		{ReindexPassBytes, bytesRefs},
+		{ReindexPassSchema, schemaRefs},
+		{ReindexPassClaims, claimRefs},
+	} {
+		for _, br := range pass.refs {
+			rc, _, err := src.FetchStreaming(br)
+			if err == nil {
+				_, err = x.receiveBlob(br, rc)
+				rc.Close()
+			}
+			progress(pass.name, br, err)
+		}
+	}
+	return nil
+}
+
+// indexQueued indexes the blobs received while reindexing, until
+// there are none left, and ends the reindexing.
+func (x *Index) indexQueued() {
+	for {
+		x.queueMu.Lock()
+		queue := x.queue
+		x.queue = nil
+		if len(queue) == 0 {
+			x.reindexing = false
+			x.queueMu.Unlock()
+			return
+		}
+		x.queueMu.Unlock()
+		for _, b := range queue {
+			if _, err := x.receiveBlob(b.br, bytes.NewReader(b.data)); err != nil {
+				log.Printf("index: error indexing %v, received while reindexing: %v", b.br, err)
+			}
+		}
+	}
+}
+
+// wipe deletes all the rows of the index, but for the ones recording
+// its configuration.
+func (x *Index) wipe() error {
+	bm := x.s.BeginBatch()
+	n := 0
+	it := x.s.Find("")
+	for it.Next() {
+		if it.Key() == keyIndexedAttrs {
+			continue
+		}
+		bm.Delete(it.Key())
+		n++
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	if err := x.s.CommitBatch(bm); err != nil {
+		return err
+	}
+	log.Printf("index: wiped %d rows", n)
+	return nil
+}
+
+func fetchAll(src blobref.StreamingFetcher, br *blobref.BlobRef) ([]byte, error) {
+	rc, _, err := src.FetchStreaming(br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// enumerateAll calls fn for each blob in src, in order.
+func enumerateAll(src blobserver.Storage, fn func(blobref.SizedBlobRef)) error {
+	after := ""
+	for {
+		ch := make(chan blobref.SizedBlobRef, reindexEnumerateLimit)
+		errch := make(chan error, 1)
+		go func(after string) {
+			errch <- src.EnumerateBlobs(ch, after, reindexEnumerateLimit, 0)
+		}(after)
+		n := 0
+		for sb := range ch {
+			fn(sb)
+			after = sb.BlobRef.String()
+			n++
+		}
+		if err := <-errch; err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return nil
+}
@@ -57,8 +57,9 @@ func NewStorage(file string) (index.IndexStorage, error) {
 
 func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
 	var (
-		blobPrefix = config.RequiredString("blobSource")
-		file       = config.RequiredString("file")
+		blobPrefix   = config.RequiredString("blobSource")
+		file         = config.RequiredString("file")
+		indexedAttrs = config.OptionalList("indexedAttributes")
 	)
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -91,6 +92,9 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 	}
 
 	ix := index.New(is)
+	if err := ix.SetIndexedAttributes(indexedAttrs); err != nil {
+		return nil, err
+	}
 	ix.BlobSource = sto
 	// Good enough, for now:
 	ix.KeyFetcher = ix.BlobSource
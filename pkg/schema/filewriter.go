@@ -19,7 +19,6 @@ package schema
 import (
 	"bufio"
 	"bytes"
-	"crypto"
 	"fmt"
 	"io"
 	"log"
@@ -58,9 +57,9 @@ func WriteFileMap(bs blobserver.StatReceiver, fileMap map[string]interface{}, r
 			break
 		}
 
-		hash := crypto.SHA1.New()
+		hash := blobref.NewHash()
 		io.Copy(hash, bytes.NewBuffer(buf.Bytes()))
-		br := blobref.FromHash("sha1", hash)
+		br := blobref.FromHash(blobref.DefaultDigest(), hash)
 		hasBlob, err := serverHasBlob(bs, br)
 		if err != nil {
 			return nil, err
@@ -92,7 +91,7 @@ func WriteFileMap(bs blobserver.StatReceiver, fileMap map[string]interface{}, r
 	if err != nil {
 		return nil, err
 	}
-	br := blobref.SHA1FromString(json)
+	br := blobref.FromString(json)
 	sb, err := bs.ReceiveBlob(br, strings.NewReader(json))
 	if err != nil {
 		return nil, err
@@ -149,7 +148,7 @@ func WriteFileMapRolling(bs blobserver.StatReceiver, fileMap map[string]interfac
 	buf := new(bytes.Buffer)
 
 	uploadString := func(s string) (*blobref.BlobRef, error) {
-		br := blobref.SHA1FromString(s)
+		br := blobref.FromString(s)
 		hasIt, err := serverHasBlob(bs, br)
 		if err != nil {
 			return nil, err
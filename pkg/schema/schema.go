@@ -19,7 +19,6 @@ package schema
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -197,6 +196,8 @@ type Superset struct {
 	Attribute string `json:"attribute"`
 	Value     string `json:"value"`
 
+	Target string `json:"target"` // for shares and "delete" claims
+
 	// TODO: ditch both the FooBytes variants below. a string doesn't have to be UTF-8.
 
 	FileName      string        `json:"fileName"`
@@ -335,17 +336,17 @@ func (d *defaultStatHasher) Lstat(fileName string) (os.FileInfo, error) {
 }
 
 func (d *defaultStatHasher) Hash(fileName string) (*blobref.BlobRef, error) {
-	s1 := sha1.New()
+	h := blobref.NewHash()
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	_, err = io.Copy(s1, file)
+	_, err = io.Copy(h, file)
 	if err != nil {
 		return nil, err
 	}
-	return blobref.FromHash("sha1", s1), nil
+	return blobref.FromHash(blobref.DefaultDigest(), h), nil
 }
 
 type StaticSet struct {
@@ -536,6 +537,16 @@ func NewDelAttributeClaim(permaNode *blobref.BlobRef, attr string) map[string]in
 	return m
 }
 
+// NewDeleteClaim returns a claim retracting the claim target, which
+// must have been signed by the same signer.
+func NewDeleteClaim(target *blobref.BlobRef) map[string]interface{} {
+	m := newCamliMap(1, "claim")
+	m["claimType"] = "delete"
+	m["target"] = target.String()
+	m["claimDate"] = RFC3339FromTime(time.Now())
+	return m
+}
+
 // Types of ShareRefs
 const ShareHaveRef = "haveref"
 
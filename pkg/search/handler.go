@@ -100,7 +100,8 @@ func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	_ = req.Header.Get("X-PrefixHandler-PathBase")
 	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
 
-	if req.Method == "GET" {
+	switch req.Method {
+	case "GET":
 		switch suffix {
 		case "camli/search/recent":
 			sh.serveRecentPermanodes(rw, req)
@@ -114,6 +115,9 @@ func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		case "camli/search/claims":
 			sh.serveClaims(rw, req)
 			return
+		case "camli/search/snapshots":
+			sh.serveSnapshots(rw, req)
+			return
 		case "camli/search/files":
 			sh.serveFiles(rw, req)
 			return
@@ -124,6 +128,12 @@ func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			sh.serveSignerPaths(rw, req)
 			return
 		}
+	case "POST":
+		switch suffix {
+		case "camli/search/query":
+			sh.serveQuery(rw, req)
+			return
+		}
 	}
 
 	// TODO: discovery for the endpoints & better error message with link to discovery info
@@ -270,9 +280,59 @@ func (sh *Handler) serveClaims(rw http.ResponseWriter, req *http.Request) {
 	httputil.ReturnJson(rw, ret)
 }
 
+// serveSnapshots lists the successive camliContent values of a
+// permanode, oldest first, such as the trees of repeated
+// "camput file -snapshot" backups.
+func (sh *Handler) serveSnapshots(rw http.ResponseWriter, req *http.Request) {
+	ret := jsonMap()
+
+	pn := blobref.Parse(req.FormValue("permanode"))
+	if pn == nil {
+		http.Error(rw, "Missing or invalid 'permanode' param", 400)
+		return
+	}
+
+	claims, err := sh.index.GetOwnerClaims(pn, sh.owner)
+	if err != nil {
+		log.Printf("Error getting claims of %s: %v", pn.String(), err)
+		ret["error"] = err.Error()
+		ret["errorType"] = "server"
+		httputil.ReturnJson(rw, ret)
+		return
+	}
+	sort.Sort(claims)
+	deleted := make(map[string]bool)
+	for _, cl := range claims {
+		if cl.Type == "delete" {
+			deleted[cl.Value] = true
+		}
+	}
+	snapshots := jsonMapList()
+	for _, cl := range claims {
+		if cl.Attr != "camliContent" || cl.Value == "" || deleted[cl.BlobRef.String()] {
+			continue
+		}
+		if cl.Type != "set-attribute" && cl.Type != "add-attribute" {
+			continue
+		}
+		jsnap := jsonMap()
+		jsnap["claim"] = cl.BlobRef.String()
+		jsnap["date"] = cl.Date.Format(time.RFC3339)
+		jsnap["content"] = cl.Value
+		snapshots = append(snapshots, jsnap)
+	}
+	ret["snapshots"] = snapshots
+
+	httputil.ReturnJson(rw, ret)
+}
+
 type DescribeRequest struct {
 	sh *Handler
 
+	// At, if non-zero, is the time as of which permanodes are
+	// described: claims dated after it are ignored.
+	At time.Time
+
 	lk   sync.Mutex // protects following:
 	m    map[string]*DescribedBlob
 	done map[string]bool  // blobref -> described
@@ -638,6 +698,15 @@ func (sh *Handler) serveDescribe(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	dr := sh.NewDescribeRequest()
+	if at := req.FormValue("at"); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			ret["error"] = "Invalid 'at' param; expecting an RFC 3339 time"
+			ret["errorType"] = "input"
+			return
+		}
+		dr.At = t
+	}
 	dr.Describe(br, 4)
 	dr.PopulateJSON(ret)
 }
@@ -669,9 +738,6 @@ func (sh *Handler) serveFiles(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (dr *DescribeRequest) populatePermanodeFields(pi *DescribedPermanode, pn, signer *blobref.BlobRef, depth int) {
-	pi.Attr = make(url.Values)
-	attr := pi.Attr
-
 	claims, err := dr.sh.index.GetOwnerClaims(pn, signer)
 	if err != nil {
 		log.Printf("Error getting claims of %s: %v", pn.String(), err)
@@ -679,9 +745,51 @@ func (dr *DescribeRequest) populatePermanodeFields(pi *DescribedPermanode, pn, s
 		return
 	}
 
+	pi.Attr = attrsOfClaims(claims, dr.At)
+	attr := pi.Attr
+
+	// If the content permanode is now known, look up its type
+	if content, ok := attr["camliContent"]; ok && len(content) > 0 {
+		cbr := blobref.Parse(content[len(content)-1])
+		dr.Describe(cbr, depth-1)
+	}
+
+	// Resolve children
+	if members, ok := attr["camliMember"]; ok {
+		for _, member := range members {
+			membr := blobref.Parse(member)
+			if membr != nil {
+				dr.Describe(membr, depth-1)
+			}
+		}
+	}
+}
+
+// attrsOfClaims returns the attributes of a permanode, given all its
+// claims. If at is non-zero, only the claims up to at are applied.
+// Claims retracted by a "delete" claim are ignored.
+func attrsOfClaims(claims ClaimList, at time.Time) url.Values {
+	attr := make(url.Values)
 	sort.Sort(claims)
+
+	deleted := make(map[string]bool)
+	for _, cl := range claims {
+		if !at.IsZero() && cl.Date.After(at) {
+			break
+		}
+		if cl.Type == "delete" {
+			deleted[cl.Value] = true
+		}
+	}
+
 claimLoop:
 	for _, cl := range claims {
+		if !at.IsZero() && cl.Date.After(at) {
+			break
+		}
+		if cl.BlobRef != nil && deleted[cl.BlobRef.String()] {
+			continue
+		}
 		switch cl.Type {
 		case "del-attribute":
 			if cl.Value == "" {
@@ -717,22 +825,7 @@ claimLoop:
 			attr[cl.Attr] = append(sl, cl.Value)
 		}
 	}
-
-	// If the content permanode is now known, look up its type
-	if content, ok := attr["camliContent"]; ok && len(content) > 0 {
-		cbr := blobref.Parse(content[len(content)-1])
-		dr.Describe(cbr, depth-1)
-	}
-
-	// Resolve children
-	if members, ok := attr["camliMember"]; ok {
-		for _, member := range members {
-			membr := blobref.Parse(member)
-			if membr != nil {
-				dr.Describe(membr, depth-1)
-			}
-		}
-	}
+	return attr
 }
 
 func mustGet(req *http.Request, param string) string {
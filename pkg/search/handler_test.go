@@ -21,7 +21,10 @@ import (
 
 	"bytes"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/test"
@@ -120,3 +123,97 @@ func TestDescribe(t *testing.T) {
 		}
 	}
 }
+
+func TestDescribeAt(t *testing.T) {
+	idx := test.NewFakeIndex()
+	pn := blobref.MustParse("perma-123")
+	idx.AddMeta(pn, "application/json; camliType=permanode", 123)
+	idx.AddClaim(owner, pn, "set-attribute", "title", "old title") // at 1s
+	idx.AddClaim(owner, pn, "add-attribute", "tag", "foo")         // at 2s
+	idx.AddClaim(owner, pn, "set-attribute", "title", "new title") // at 3s
+	idx.AddClaim(owner, pn, "del-attribute", "tag", "")            // at 4s
+
+	h := NewHandler(idx, owner)
+	for _, tt := range []struct {
+		at    int64
+		title string
+		tag   string
+	}{
+		{0, "new title", ""},
+		{1, "old title", ""},
+		{2, "old title", "foo"},
+		{3, "new title", "foo"},
+	} {
+		dr := h.NewDescribeRequest()
+		if tt.at != 0 {
+			dr.At = time.Unix(tt.at, 0).UTC()
+		}
+		des, err := dr.DescribeSync(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attr := des.Permanode.Attr
+		if attr.Get("title") != tt.title || attr.Get("tag") != tt.tag {
+			t.Errorf("at %d: title = %q, tag = %q; want %q, %q", tt.at, attr.Get("title"), attr.Get("tag"), tt.title, tt.tag)
+		}
+	}
+}
+
+func TestDescribeDeleteClaim(t *testing.T) {
+	idx := test.NewFakeIndex()
+	pn := blobref.MustParse("perma-123")
+	idx.AddMeta(pn, "application/json; camliType=permanode", 123)
+	idx.AddClaim(owner, pn, "add-attribute", "tag", "foo")
+	oops := idx.AddClaim(owner, pn, "add-attribute", "tag", "oops")
+	member := idx.AddClaim(owner, pn, "add-attribute", "camliMember", "abc-555")
+	idx.AddClaim(owner, pn, "delete", "", oops.String())
+	idx.AddClaim(owner, pn, "delete", "", member.String())
+
+	h := NewHandler(idx, owner)
+	des, err := h.NewDescribeRequest().DescribeSync(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attr := des.Permanode.Attr
+	if got := attr["tag"]; len(got) != 1 || got[0] != "foo" {
+		t.Errorf("tags = %q; want [foo]", got)
+	}
+	if got := attr["camliMember"]; len(got) != 0 {
+		t.Errorf("members = %q; want none", got)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	idx := test.NewFakeIndex()
+	pn := blobref.MustParse("perma-123")
+	idx.AddMeta(pn, "application/json; camliType=permanode", 123)
+	first := idx.AddClaim(owner, pn, "set-attribute", "camliContent", "dir-1") // at 1s
+	idx.AddClaim(owner, pn, "set-attribute", "title", "backup")                // at 2s
+	oops := idx.AddClaim(owner, pn, "set-attribute", "camliContent", "dir-2")  // at 3s
+	third := idx.AddClaim(owner, pn, "set-attribute", "camliContent", "dir-3") // at 4s
+	idx.AddClaim(owner, pn, "delete", "", oops.String())                       // at 5s
+
+	req, err := http.NewRequest("GET", "/search/camli/search/snapshots?permanode=perma-123", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-PrefixHandler-PathSuffix", "camli/search/snapshots")
+	rr := httptest.NewRecorder()
+	NewHandler(idx, owner).ServeHTTP(rr, req)
+
+	var res struct {
+		Snapshots []map[string]string
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("bad response %q: %v", rr.Body.String(), err)
+	}
+	want := []map[string]string{
+		{"claim": first.String(), "date": "1970-01-01T00:00:01Z", "content": "dir-1"},
+		{"claim": third.String(), "date": "1970-01-01T00:00:04Z", "content": "dir-3"},
+	}
+	got, _ := json.Marshal(res.Snapshots)
+	wantJSON, _ := json.Marshal(want)
+	if !bytes.Equal(got, wantJSON) {
+		t.Errorf("snapshots = %s; want %s", got, wantJSON)
+	}
+}
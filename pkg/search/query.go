@@ -0,0 +1,497 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/httputil"
+)
+
+// maxQuerySize is the maximum size of a JSON query request body.
+const maxQuerySize = 1 << 20
+
+// QueryRequest is the JSON body POSTed to camli/search/query.
+type QueryRequest struct {
+	// Constraint is the root of the constraint tree the returned
+	// permanodes must satisfy. If nil, all permanodes match.
+	Constraint *Constraint `json:"constraint"`
+
+	// Limit is the maximum number of results. It is optional and
+	// capped to maxPermanodes.
+	Limit int `json:"limit,omitempty"`
+
+	// Continue, if non-empty, is the "continue" value of a previous
+	// response, to get the next page of results. It holds the date
+	// and the claim of the last permanode modification returned,
+	// so permanodes modified between pages don't shift the next
+	// page.
+	Continue string `json:"continue,omitempty"`
+
+	// Describe is the depth at which the results are described, as
+	// for camli/search/describe. Zero means no description.
+	Describe int `json:"describe,omitempty"`
+}
+
+// Constraint is a node of a query's constraint tree. Exactly one of its
+// fields must be set.
+type Constraint struct {
+	And []*Constraint `json:"and,omitempty"`
+	Or  []*Constraint `json:"or,omitempty"`
+	Not *Constraint   `json:"not,omitempty"`
+
+	Attr      *AttrConstraint    `json:"attr,omitempty"`
+	Content   *ContentConstraint `json:"content,omitempty"`
+	ClaimDate *TimeConstraint    `json:"claimDate,omitempty"`
+
+	// MemberOf matches the permanodes that are a camliMember of the
+	// given permanode.
+	MemberOf *blobref.BlobRef `json:"memberOf,omitempty"`
+}
+
+// AttrConstraint matches permanodes having a value of the attribute Name
+// equal to Equals, or starting with Prefix. If both are empty, any value
+// matches.
+type AttrConstraint struct {
+	Name   string `json:"name"`
+	Equals string `json:"equals,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// ContentConstraint matches permanodes by their camliContent. If the
+// content is a file, its MIME type and size are the ones of the file's
+// contents.
+type ContentConstraint struct {
+	MIMEType       string `json:"mimeType,omitempty"`
+	MIMETypePrefix string `json:"mimeTypePrefix,omitempty"` // e.g. "image/"
+	MinSize        int64  `json:"minSize,omitempty"`
+	MaxSize        int64  `json:"maxSize,omitempty"` // zero means no maximum
+}
+
+// TimeConstraint matches permanodes having at least one claim dated in
+// [After, Before). A zero time is unbounded.
+type TimeConstraint struct {
+	After  time.Time `json:"after"`
+	Before time.Time `json:"before"`
+}
+
+func (c *Constraint) check() error {
+	if c == nil {
+		return errors.New("nil constraint")
+	}
+	n := 0
+	for _, set := range []bool{
+		c.And != nil,
+		c.Or != nil,
+		c.Not != nil,
+		c.Attr != nil,
+		c.Content != nil,
+		c.ClaimDate != nil,
+		c.MemberOf != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("constraint must have exactly one field set, has %d", n)
+	}
+	for _, sub := range c.And {
+		if err := sub.check(); err != nil {
+			return err
+		}
+	}
+	for _, sub := range c.Or {
+		if err := sub.check(); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		return c.Not.check()
+	}
+	if c.Attr != nil && c.Attr.Name == "" {
+		return errors.New("attr constraint without a name")
+	}
+	return nil
+}
+
+// Query returns the permanodes of the handler's owner matching req,
+// from the most recently modified. It returns the continue value for
+// the next page, or "" if there are no more results.
+//
+// Only the permanodes' claims and their camliContent are looked at, so
+// queries work on any Index, at the price of examining every permanode
+// until enough results are found. The recent permanodes are asked from
+// the index in windows doubling in size, so a page only costs the
+// permanodes up to its end.
+func (sh *Handler) Query(req *QueryRequest) (results []*Result, cont string, err error) {
+	if req.Constraint != nil {
+		if err := req.Constraint.check(); err != nil {
+			return nil, "", err
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxPermanodes {
+		limit = maxPermanodes
+	}
+	var after *queryCursor
+	if req.Continue != "" {
+		if after, err = parseQueryCursor(req.Continue); err != nil {
+			return nil, "", err
+		}
+	}
+
+	qc := &queryContext{sh: sh, members: make(map[string]map[string]bool)}
+	for window := 2 * (limit + 1); ; window *= 2 {
+		var n int
+		results, cont, n, err = sh.queryWindow(qc, req.Constraint, after, limit, window)
+		if err != nil || cont != "" || n < window {
+			return results, cont, err
+		}
+	}
+}
+
+// queryWindow is Query over the window most recent permanodes. It also
+// returns how many permanodes the index sent: fewer than window if
+// there are no more.
+func (sh *Handler) queryWindow(qc *queryContext, c *Constraint, after *queryCursor, limit, window int) (results []*Result, cont string, n int, err error) {
+	if after != nil {
+		after.found = false
+	}
+	ch := make(chan *Result, buffered)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- sh.index.GetRecentPermanodes(ch, sh.owner, window)
+	}()
+
+	var last *Result
+	for res := range ch {
+		n++
+		if err != nil || cont != "" {
+			continue // drain
+		}
+		if after != nil && !after.passed(res) {
+			continue
+		}
+		var ok bool
+		ok, err = qc.matches(c, &permanodeInfo{br: res.BlobRef})
+		if err != nil || !ok {
+			continue
+		}
+		if len(results) == limit {
+			// One more match: there's a next page.
+			cont = newQueryCursor(last).String()
+			continue
+		}
+		results = append(results, res)
+		last = res
+	}
+	if ierr := <-errch; ierr != nil {
+		return nil, "", 0, ierr
+	}
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return results, cont, n, nil
+}
+
+// queryCursor is where a page of query results ended: the date and
+// the claim of the last permanode modification returned.
+type queryCursor struct {
+	modTime  int64  // seconds since epoch
+	claimRef string // or "" if unknown
+	found    bool   // the claim was met again
+}
+
+func newQueryCursor(res *Result) *queryCursor {
+	c := &queryCursor{modTime: res.LastModTime}
+	if res.ClaimRef != nil {
+		c.claimRef = res.ClaimRef.String()
+	}
+	return c
+}
+
+func parseQueryCursor(s string) (*queryCursor, error) {
+	date, claim := s, ""
+	if i := strings.Index(s, " "); i >= 0 {
+		date, claim = s[:i], s[i+1:]
+	}
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return nil, fmt.Errorf("invalid continue value %q", s)
+	}
+	return &queryCursor{modTime: t.Unix(), claimRef: claim}, nil
+}
+
+func (c *queryCursor) String() string {
+	s := time.Unix(c.modTime, 0).UTC().Format(time.RFC3339)
+	if c.claimRef != "" {
+		s += " " + c.claimRef
+	}
+	return s
+}
+
+// passed reports whether res, the next of the recent permanodes, comes
+// after the cursor. The ones modified later than the cursor's claim
+// were on a previous page, or were modified since and are left out,
+// instead of shifting the results. Within the cursor's second, the
+// results up to its claim are left out; if the claim isn't met again
+// (its permanode was modified since), all of them are.
+func (c *queryCursor) passed(res *Result) bool {
+	switch {
+	case c.found || res.LastModTime < c.modTime:
+		c.found = true
+		return true
+	case res.LastModTime > c.modTime:
+		return false
+	}
+	if res.ClaimRef != nil && res.ClaimRef.String() == c.claimRef {
+		c.found = true
+	}
+	return false
+}
+
+// queryContext holds the state shared by the evaluation of a query on
+// all the permanodes.
+type queryContext struct {
+	sh      *Handler
+	members map[string]map[string]bool // parent permanode -> its members
+}
+
+// permanodeInfo is what's known of a permanode being matched. Its
+// fields are loaded as they're needed.
+type permanodeInfo struct {
+	br     *blobref.BlobRef
+	claims ClaimList
+	attr   url.Values
+
+	contentDone bool
+	mimeType    string
+	size        int64
+}
+
+func (qc *queryContext) loadClaims(pi *permanodeInfo) error {
+	if pi.claims != nil {
+		return nil
+	}
+	claims, err := qc.sh.index.GetOwnerClaims(pi.br, qc.sh.owner)
+	if err != nil {
+		return err
+	}
+	if claims == nil {
+		claims = ClaimList{}
+	}
+	pi.claims = claims
+	pi.attr = attrsOfClaims(claims, time.Time{})
+	return nil
+}
+
+// loadContent finds the MIME type and size of pi's camliContent.
+// pi.mimeType is left empty if it has no known content.
+func (qc *queryContext) loadContent(pi *permanodeInfo) error {
+	if pi.contentDone {
+		return nil
+	}
+	if err := qc.loadClaims(pi); err != nil {
+		return err
+	}
+	pi.contentDone = true
+	content := pi.attr["camliContent"]
+	if len(content) == 0 {
+		return nil
+	}
+	cbr := blobref.Parse(content[len(content)-1])
+	if cbr == nil {
+		return nil
+	}
+	mime, size, err := qc.sh.index.GetBlobMimeType(cbr)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if mime == camliTypePrefix+"file" {
+		fi, err := qc.sh.index.GetFileInfo(cbr)
+		if err == os.ErrNotExist {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mime, size = fi.MimeType, fi.Size
+	}
+	pi.mimeType, pi.size = mime, size
+	return nil
+}
+
+func (qc *queryContext) isMember(parent, br *blobref.BlobRef) (bool, error) {
+	members, ok := qc.members[parent.String()]
+	if !ok {
+		claims, err := qc.sh.index.GetOwnerClaims(parent, qc.sh.owner)
+		if err != nil {
+			return false, err
+		}
+		members = make(map[string]bool)
+		for _, m := range attrsOfClaims(claims, time.Time{})["camliMember"] {
+			members[m] = true
+		}
+		qc.members[parent.String()] = members
+	}
+	return members[br.String()], nil
+}
+
+func (qc *queryContext) matches(c *Constraint, pi *permanodeInfo) (bool, error) {
+	switch {
+	case c == nil:
+		return true, nil
+	case c.And != nil:
+		for _, sub := range c.And {
+			if ok, err := qc.matches(sub, pi); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case c.Or != nil:
+		for _, sub := range c.Or {
+			if ok, err := qc.matches(sub, pi); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case c.Not != nil:
+		ok, err := qc.matches(c.Not, pi)
+		return !ok, err
+	case c.Attr != nil:
+		if err := qc.loadClaims(pi); err != nil {
+			return false, err
+		}
+		return c.Attr.matches(pi.attr[c.Attr.Name]), nil
+	case c.Content != nil:
+		if err := qc.loadContent(pi); err != nil {
+			return false, err
+		}
+		return pi.mimeType != "" && c.Content.matches(pi.mimeType, pi.size), nil
+	case c.ClaimDate != nil:
+		if err := qc.loadClaims(pi); err != nil {
+			return false, err
+		}
+		for _, cl := range pi.claims {
+			if c.ClaimDate.matches(cl.Date) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case c.MemberOf != nil:
+		return qc.isMember(c.MemberOf, pi.br)
+	}
+	return false, errors.New("empty constraint")
+}
+
+func (c *AttrConstraint) matches(values []string) bool {
+	for _, v := range values {
+		switch {
+		case c.Equals != "":
+			if v == c.Equals {
+				return true
+			}
+		case c.Prefix != "":
+			if strings.HasPrefix(v, c.Prefix) {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ContentConstraint) matches(mime string, size int64) bool {
+	if c.MIMEType != "" && mime != c.MIMEType {
+		return false
+	}
+	if c.MIMETypePrefix != "" && !strings.HasPrefix(mime, c.MIMETypePrefix) {
+		return false
+	}
+	if size < c.MinSize {
+		return false
+	}
+	if c.MaxSize != 0 && size > c.MaxSize {
+		return false
+	}
+	return true
+}
+
+func (c *TimeConstraint) matches(t time.Time) bool {
+	if !c.After.IsZero() && t.Before(c.After) {
+		return false
+	}
+	if !c.Before.IsZero() && !t.Before(c.Before) {
+		return false
+	}
+	return true
+}
+
+func (sh *Handler) serveQuery(rw http.ResponseWriter, req *http.Request) {
+	ret := jsonMap()
+	defer httputil.ReturnJson(rw, ret)
+
+	q := new(QueryRequest)
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxQuerySize)).Decode(q); err != nil {
+		ret["error"] = "Invalid query: " + err.Error()
+		ret["errorType"] = "input"
+		return
+	}
+	if q.Constraint != nil {
+		if err := q.Constraint.check(); err != nil {
+			ret["error"] = "Invalid query: " + err.Error()
+			ret["errorType"] = "input"
+			return
+		}
+	}
+
+	results, cont, err := sh.Query(q)
+	if err != nil {
+		ret["error"] = err.Error()
+		ret["errorType"] = "server"
+		return
+	}
+
+	dr := sh.NewDescribeRequest()
+	jresults := jsonMapList()
+	for _, res := range results {
+		dr.Describe(res.BlobRef, q.Describe)
+		jm := jsonMap()
+		jm["blobref"] = res.BlobRef.String()
+		jm["modtime"] = time.Unix(res.LastModTime, 0).UTC().Format(time.RFC3339)
+		jresults = append(jresults, jm)
+	}
+	ret["results"] = jresults
+	if cont != "" {
+		ret["continue"] = cont
+	}
+	dr.PopulateJSON(ret)
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search_test
+
+import (
+	. "camlistore.org/pkg/search"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/test"
+)
+
+// queryIndex returns a FakeIndex with, from the oldest to the most
+// recently modified:
+//
+//	perma-1: title "foo bar", content a JPEG file of 1000 bytes
+//	perma-2: title "foo", tag "x"
+//	perma-3: tag "y", content a blob of 10 bytes
+//	perma-5: members perma-1 and perma-3
+func queryIndex() *test.FakeIndex {
+	fi := test.NewFakeIndex()
+	pn1 := blobref.MustParse("perma-1")
+	fi.AddMeta(pn1, "application/json; camliType=permanode", 100)
+	fi.AddClaim(owner, pn1, "set-attribute", "title", "foo bar")
+	fi.AddClaim(owner, pn1, "set-attribute", "camliContent", "file-1")
+	fi.AddMeta(blobref.MustParse("file-1"), "application/json; camliType=file", 200)
+	fi.AddFileInfo(blobref.MustParse("file-1"), &FileInfo{Size: 1000, FileName: "a.jpg", MimeType: "image/jpeg"})
+
+	pn2 := blobref.MustParse("perma-2")
+	fi.AddMeta(pn2, "application/json; camliType=permanode", 100)
+	fi.AddClaim(owner, pn2, "set-attribute", "title", "foo")
+	fi.AddClaim(owner, pn2, "add-attribute", "tag", "x")
+
+	pn3 := blobref.MustParse("perma-3")
+	fi.AddClaim(owner, pn3, "add-attribute", "tag", "y")
+	fi.AddClaim(owner, pn3, "set-attribute", "camliContent", "blob-3")
+	fi.AddMeta(blobref.MustParse("blob-3"), "text/plain", 10)
+
+	set := blobref.MustParse("perma-5")
+	fi.AddClaim(owner, set, "add-attribute", "camliMember", "perma-1")
+	fi.AddClaim(owner, set, "add-attribute", "camliMember", "perma-3")
+	return fi
+}
+
+var queryTests = []struct {
+	name  string
+	query string // JSON constraint
+	want  []string
+}{
+	{"all", `null`, []string{"perma-5", "perma-3", "perma-2", "perma-1"}},
+	{"attr equals", `{"attr": {"name": "title", "equals": "foo"}}`, []string{"perma-2"}},
+	{"attr prefix", `{"attr": {"name": "title", "prefix": "foo"}}`, []string{"perma-2", "perma-1"}},
+	{"attr any value", `{"attr": {"name": "tag"}}`, []string{"perma-3", "perma-2"}},
+	{"and", `{"and": [{"attr": {"name": "title", "prefix": "foo"}}, {"attr": {"name": "tag"}}]}`, []string{"perma-2"}},
+	{"or", `{"or": [{"attr": {"name": "tag", "equals": "y"}}, {"attr": {"name": "title", "equals": "foo bar"}}]}`, []string{"perma-3", "perma-1"}},
+	{"not", `{"not": {"attr": {"name": "tag"}}}`, []string{"perma-5", "perma-1"}},
+	{"file mime type", `{"content": {"mimeTypePrefix": "image/"}}`, []string{"perma-1"}},
+	{"blob mime type", `{"content": {"mimeType": "text/plain"}}`, []string{"perma-3"}},
+	{"size range", `{"content": {"minSize": 5, "maxSize": 500}}`, []string{"perma-3"}},
+	{"member of", `{"memberOf": "perma-5"}`, []string{"perma-3", "perma-1"}},
+	{"claim date", `{"claimDate": {"after": "1970-01-01T00:00:05Z", "before": "1970-01-01T00:00:06Z"}}`, []string{"perma-3"}},
+}
+
+func resultRefs(results []*Result) []string {
+	refs := []string{}
+	for _, res := range results {
+		refs = append(refs, res.BlobRef.String())
+	}
+	return refs
+}
+
+func TestQuery(t *testing.T) {
+	h := NewHandler(queryIndex(), owner)
+	for _, tt := range queryTests {
+		q := new(QueryRequest)
+		if err := json.Unmarshal([]byte(tt.query), &q.Constraint); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		results, cont, err := h.Query(q)
+		if err != nil {
+			t.Errorf("%s: Query = %v", tt.name, err)
+			continue
+		}
+		if got := resultRefs(results); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+		if cont != "" {
+			t.Errorf("%s: continue = %q; want none", tt.name, cont)
+		}
+	}
+}
+
+func TestQueryInvalid(t *testing.T) {
+	h := NewHandler(queryIndex(), owner)
+	for _, query := range []string{
+		`{}`,
+		`{"attr": {"name": "title"}, "memberOf": "perma-5"}`,
+		`{"not": {"attr": {}}}`,
+	} {
+		q := new(QueryRequest)
+		if err := json.Unmarshal([]byte(query), &q.Constraint); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := h.Query(q); err == nil {
+			t.Errorf("Query(%s) succeeded; want an error", query)
+		}
+	}
+}
+
+func TestQueryPaging(t *testing.T) {
+	h := NewHandler(queryIndex(), owner)
+	var got []string
+	q := &QueryRequest{Limit: 3}
+	for page := 0; ; page++ {
+		if page > 2 {
+			t.Fatalf("too many pages")
+		}
+		results, cont, err := h.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resultRefs(results)...)
+		if cont == "" {
+			break
+		}
+		q.Continue = cont
+	}
+	want := []string{"perma-5", "perma-3", "perma-2", "perma-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged results = %q; want %q", got, want)
+	}
+}
+
+// countingIndex counts the recent permanodes it sends.
+type countingIndex struct {
+	*test.FakeIndex
+	sent int
+}
+
+func (ci *countingIndex) GetRecentPermanodes(dest chan *Result, owner *blobref.BlobRef, limit int) error {
+	ch := make(chan *Result)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- ci.FakeIndex.GetRecentPermanodes(ch, owner, limit)
+	}()
+	for res := range ch {
+		ci.sent++
+		dest <- res
+	}
+	close(dest)
+	return <-errch
+}
+
+func TestQueryReadsOnlyWhatItNeeds(t *testing.T) {
+	ci := &countingIndex{FakeIndex: test.NewFakeIndex()}
+	const n = 100
+	for i := 1; i <= n; i++ {
+		pn := blobref.MustParse(fmt.Sprintf("perma-%d", i))
+		title := "other"
+		if i == 1 {
+			title = "oldest"
+		}
+		ci.AddClaim(owner, pn, "set-attribute", "title", title)
+	}
+	h := NewHandler(ci, owner)
+
+	results, cont, err := h.Query(&QueryRequest{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || cont == "" {
+		t.Errorf("Query = %d results, continue %q; want 2 and more", len(results), cont)
+	}
+	if ci.sent > 6 {
+		t.Errorf("index sent %d permanodes for a page of 2", ci.sent)
+	}
+
+	// A match past the first windows is still found.
+	q := &QueryRequest{Limit: 2}
+	if err := json.Unmarshal([]byte(`{"attr": {"name": "title", "equals": "oldest"}}`), &q.Constraint); err != nil {
+		t.Fatal(err)
+	}
+	results, cont, err = h.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resultRefs(results); len(got) != 1 || got[0] != "perma-1" || cont != "" {
+		t.Errorf("Query = %q, continue %q; want [perma-1] and no more", got, cont)
+	}
+}
+
+func TestQueryPagingModified(t *testing.T) {
+	fi := queryIndex()
+	h := NewHandler(fi, owner)
+	results, cont, err := h.Query(&QueryRequest{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resultRefs(results), []string{"perma-5", "perma-3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("first page = %q; want %q", got, want)
+	}
+
+	// Modifying the last permanode of the page doesn't make the
+	// next page start over.
+	fi.AddClaim(owner, blobref.MustParse("perma-3"), "add-attribute", "tag", "z")
+	results, cont, err = h.Query(&QueryRequest{Limit: 2, Continue: cont})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resultRefs(results), []string{"perma-2", "perma-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second page = %q; want %q", got, want)
+	}
+	if cont != "" {
+		t.Errorf("continue = %q; want none", cont)
+	}
+
+	if _, _, err := h.Query(&QueryRequest{Continue: "perma-3"}); err == nil {
+		t.Errorf("Query with a bogus continue value succeeded; want an error")
+	}
+}
+
+func TestServeQuery(t *testing.T) {
+	h := NewHandler(queryIndex(), owner)
+	req, err := http.NewRequest("POST", "/search/camli/search/query",
+		strings.NewReader(`{"constraint": {"attr": {"name": "title", "equals": "foo"}}, "describe": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-PrefixHandler-PathSuffix", "camli/search/query")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var res struct {
+		Results []struct {
+			BlobRef string `json:"blobref"`
+			ModTime string `json:"modtime"`
+		} `json:"results"`
+		Perma2 *struct {
+			Permanode struct {
+				Attr map[string][]string `json:"attr"`
+			} `json:"permanode"`
+		} `json:"perma-2"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Error != "" {
+		t.Fatalf("error: %s", res.Error)
+	}
+	if len(res.Results) != 1 || res.Results[0].BlobRef != "perma-2" {
+		t.Fatalf("results = %+v; want perma-2", res.Results)
+	}
+	if _, err := time.Parse(time.RFC3339, res.Results[0].ModTime); err != nil {
+		t.Errorf("bad modtime: %v", err)
+	}
+	if res.Perma2 == nil || !reflect.DeepEqual(res.Perma2.Permanode.Attr["tag"], []string{"x"}) {
+		t.Errorf("perma-2 not described: %+v", res.Perma2)
+	}
+}
@@ -29,6 +29,7 @@ type Result struct {
 	BlobRef     *blobref.BlobRef
 	Signer      *blobref.BlobRef // may be nil
 	LastModTime int64            // seconds since epoch
+	ClaimRef    *blobref.BlobRef // the claim made at LastModTime; may be nil
 }
 
 // Results exists mostly for debugging, to provide a String method on
@@ -39,8 +40,8 @@ func (s Results) String() string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "[%d search results: ", len(s))
 	for _, r := range s {
-		fmt.Fprintf(&buf, "{BlobRef: %s, Signer: %s, LastModTime: %d}",
-			r.BlobRef, r.Signer, r.LastModTime)
+		fmt.Fprintf(&buf, "{BlobRef: %s, Signer: %s, LastModTime: %d, ClaimRef: %s}",
+			r.BlobRef, r.Signer, r.LastModTime, r.ClaimRef)
 	}
 	buf.WriteString("]")
 	return buf.String()
@@ -177,7 +178,8 @@ type Index interface {
 	// a corresponding 'set-attribute' claim attached.
 	// Returns os.ErrNotExist if none is found.
 	// TODO(bradfitz): ErrNotExist here is a weird error message ("file" not found). change.
-	// Only attributes white-listed by IsIndexedAttribute are valid.
+	// Only attributes indexed by the Index are valid; by default
+	// those white-listed by IsIndexedAttribute.
 	PermanodeOfSignerAttrValue(signer *blobref.BlobRef, attr, val string) (*blobref.BlobRef, error)
 
 	// PathsOfSignerTarget queries the index about "camliPath:"
@@ -202,6 +204,9 @@ type Index interface {
 
 // TODO(bradfitz): rename this? This is really about signer-attr-value
 // (PermanodeOfSignerAttrValue), and not about indexed attributes in general.
+//
+// IsIndexedAttribute is the default whitelist of indexed attributes, for
+// indexes not configured with their own "indexedAttributes".
 func IsIndexedAttribute(attr string) bool {
 	switch attr {
 	case "camliRoot", "tag", "title":
@@ -0,0 +1,190 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/fsck"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// maxFsckProblems is how many problems of the last check are shown.
+const maxFsckProblems = 100
+
+// FsckHandler checks a storage's blobs against their blobrefs on
+// demand, and shows the problems found.
+//
+// Example low-level config:
+//
+//	"/fsck/": {
+//	    "handler": "fsck",
+//	    "handlerArgs": {
+//	        "storage": "/bs/",
+//	        "quarantine": true,
+//	        "repairFrom": "/sto-s3/"
+//	    }
+//	},
+type FsckHandler struct {
+	storageName, repairName string
+	checker                 fsck.Checker
+
+	lk       sync.Mutex // protects following
+	running  bool
+	status   string
+	stats    fsck.Stats
+	problems []*fsck.Problem
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("fsck", newFsckFromConfig)
+}
+
+func newFsckFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	h := &FsckHandler{
+		storageName: conf.RequiredString("storage"),
+		repairName:  conf.OptionalString("repairFrom", ""),
+		status:      "not started",
+	}
+	h.checker.Quarantine = conf.OptionalBool("quarantine", false)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	if h.checker.Storage, err = ld.GetStorage(h.storageName); err != nil {
+		return nil, err
+	}
+	if _, ok := h.checker.Storage.(blobserver.Quarantiner); h.checker.Quarantine && !ok {
+		return nil, fmt.Errorf("Prefix %s (type %T) does not support quarantine", h.storageName, h.checker.Storage)
+	}
+	if h.repairName != "" {
+		if h.checker.RepairFrom, err = ld.GetStorage(h.repairName); err != nil {
+			return nil, err
+		}
+	}
+	h.checker.Report = h.addProblem
+	h.checker.Progress = func(st fsck.Stats) {
+		h.lk.Lock()
+		defer h.lk.Unlock()
+		h.stats = st
+	}
+	return h, nil
+}
+
+func (h *FsckHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if req.FormValue("mode") != "check" {
+			http.Error(rw, "unsupported POST mode", http.StatusBadRequest)
+			return
+		}
+		if err := h.start(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(rw, req, req.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	fmt.Fprintf(rw, "<h1>%s Fsck</h1><p><b>Current status: </b>%s</p>",
+		html.EscapeString(h.storageName), html.EscapeString(h.status))
+
+	fmt.Fprintf(rw, "<h2>Stats:</h2><ul>")
+	fmt.Fprintf(rw, "<li>Blobs checked: %d</li>", h.stats.Blobs)
+	fmt.Fprintf(rw, "<li>Bytes checked: %d</li>", h.stats.Bytes)
+	fmt.Fprintf(rw, "<li>Problems: %d</li>", h.stats.Problems)
+	if h.checker.Quarantine {
+		fmt.Fprintf(rw, "<li>Quarantined: %d</li>", h.stats.Quarantined)
+	}
+	if h.repairName != "" {
+		fmt.Fprintf(rw, "<li>Repaired from %s: %d</li>", html.EscapeString(h.repairName), h.stats.Repaired)
+	}
+	fmt.Fprintf(rw, "</ul>")
+
+	if !h.running {
+		fmt.Fprintf(rw, "<form method='post'><input type='hidden' name='mode' value='check'>"+
+			"<input type='submit' value='Check all blobs of %s'></form>",
+			html.EscapeString(h.storageName))
+	}
+
+	if len(h.problems) > 0 {
+		fmt.Fprintf(rw, "<h2>Problems:</h2><ul>")
+		for _, p := range h.problems {
+			fmt.Fprintf(rw, "<li>%s</li>\n", html.EscapeString(p.String()))
+		}
+		if h.stats.Problems > int64(len(h.problems)) {
+			fmt.Fprintf(rw, "<li>... and %d more</li>\n", h.stats.Problems-int64(len(h.problems)))
+		}
+		fmt.Fprintf(rw, "</ul>")
+	}
+}
+
+func (h *FsckHandler) setStatus(s string, args ...interface{}) {
+	s = time.Now().UTC().Format(time.RFC3339) + ": " + fmt.Sprintf(s, args...)
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.status = s
+}
+
+func (h *FsckHandler) addProblem(p *fsck.Problem) {
+	log.Printf("fsck of %s: %s", h.storageName, p)
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	if len(h.problems) < maxFsckProblems {
+		h.problems = append(h.problems, p)
+	}
+}
+
+// start starts checking all the blobs of the storage, unless a check
+// is already running.
+func (h *FsckHandler) start() error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	if h.running {
+		return errors.New("Fsck already in progress")
+	}
+	h.running = true
+	h.stats = fsck.Stats{}
+	h.problems = nil
+	go h.run()
+	return nil
+}
+
+func (h *FsckHandler) run() {
+	defer func() {
+		h.lk.Lock()
+		defer h.lk.Unlock()
+		h.running = false
+	}()
+	h.setStatus("Checking %s", h.storageName)
+	st, err := h.checker.Run()
+	if err != nil {
+		log.Printf("fsck of %s failed: %v", h.storageName, err)
+		h.setStatus("Fsck failed: %v", err)
+		return
+	}
+	h.setStatus("Fsck done; %d blobs checked, %d problems", st.Blobs, st.Problems)
+}
@@ -89,6 +89,8 @@ func newJsonSignFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Hand
 
 	armoredPublicKey, err := jsonsign.ArmoredPublicKey(h.entity)
 
+	// The key's blobref is the signer's identity, so it stays sha1
+	// whatever the default digest; see blobref.SetDefaultDigest.
 	ms := new(blobref.MemoryStore)
 	h.pubKeyBlobRef, err = ms.AddBlob(crypto.SHA1, armoredPublicKey)
 	if err != nil {
@@ -27,6 +27,7 @@ import (
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/index"
 	"camlistore.org/pkg/jsonconfig"
 	"camlistore.org/pkg/misc"
 )
@@ -52,6 +53,17 @@ type SyncHandler struct {
 	totalCopies    int64
 	totalCopyBytes int64
 	totalErrors    int64
+
+	reindexing     bool   // whether a reindex is running
+	reindexStatus  string // of the running or last reindex, if any
+	totalReindexed int64
+	reindexErrors  int64
+}
+
+// reindexer is implemented by sync destinations that can be wiped
+// and rebuilt from the sync source, such as *index.Index.
+type reindexer interface {
+	Reindex(src blobserver.Storage, progress index.ReindexProgressFunc) error
 }
 
 func init() {
@@ -113,6 +125,19 @@ func createSyncHandler(fromName, toName string, from blobserver.StorageQueueCrea
 }
 
 func (sh *SyncHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if req.FormValue("mode") != "reindex" {
+			http.Error(rw, "unsupported POST mode", http.StatusBadRequest)
+			return
+		}
+		if err := sh.startReindex(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(rw, req, req.URL.Path, http.StatusSeeOther)
+		return
+	}
+
 	sh.lk.Lock()
 	defer sh.lk.Unlock()
 
@@ -137,6 +162,21 @@ func (sh *SyncHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(rw, "</ul>")
 	}
 
+	if _, ok := sh.to.(reindexer); ok {
+		fmt.Fprintf(rw, "<h2>Reindex:</h2>")
+		if sh.reindexStatus != "" {
+			fmt.Fprintf(rw, "<p>%s</p><ul>", html.EscapeString(sh.reindexStatus))
+			fmt.Fprintf(rw, "<li>Blobs reindexed: %d</li>", sh.totalReindexed)
+			fmt.Fprintf(rw, "<li>Reindex errors: %d</li>", sh.reindexErrors)
+			fmt.Fprintf(rw, "</ul>")
+		}
+		if !sh.reindexing {
+			fmt.Fprintf(rw, "<form method='post'><input type='hidden' name='mode' value='reindex'>"+
+				"<input type='submit' value='Wipe %s and reindex it from %s'></form>",
+				html.EscapeString(sh.toName), html.EscapeString(sh.fromName))
+		}
+	}
+
 	if len(sh.recentErrors) > 0 {
 		fmt.Fprintf(rw, "<h2>Recent Errors:</h2><ul>")
 		for _, te := range sh.recentErrors {
@@ -155,6 +195,13 @@ func (sh *SyncHandler) setStatus(s string, args ...interface{}) {
 	sh.status = s
 }
 
+func (sh *SyncHandler) setReindexStatus(s string, args ...interface{}) {
+	s = time.Now().UTC().Format(time.RFC3339) + ": " + fmt.Sprintf(s, args...)
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+	sh.reindexStatus = s
+}
+
 func (sh *SyncHandler) setBlobStatus(blobref string, s fmt.Stringer) {
 	sh.lk.Lock()
 	defer sh.lk.Unlock()
@@ -234,6 +281,53 @@ func (sh *SyncHandler) syncQueueLoop() {
 	})
 }
 
+// startReindex starts wiping the destination and rebuilding it from
+// all the blobs of the source, if the destination supports it.
+func (sh *SyncHandler) startReindex() error {
+	ri, ok := sh.to.(reindexer)
+	if !ok {
+		return fmt.Errorf("Prefix %s (type %T) does not support reindexing", sh.toName, sh.to)
+	}
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+	if sh.reindexing {
+		return fmt.Errorf("Reindex of %s already in progress", sh.toName)
+	}
+	sh.reindexing = true
+	sh.totalReindexed, sh.reindexErrors = 0, 0
+	go sh.runReindex(ri)
+	return nil
+}
+
+func (sh *SyncHandler) runReindex(ri reindexer) {
+	defer func() {
+		sh.lk.Lock()
+		defer sh.lk.Unlock()
+		sh.reindexing = false
+	}()
+	sh.setReindexStatus("Wiping %s", sh.toName)
+	err := ri.Reindex(sh.from, func(pass string, br *blobref.BlobRef, err error) {
+		sh.lk.Lock()
+		if err == nil {
+			sh.totalReindexed++
+		} else {
+			sh.reindexErrors++
+		}
+		sh.reindexStatus = fmt.Sprintf("Reindexing %s from %s; pass %q, last blob %s",
+			sh.toName, sh.fromName, pass, br)
+		sh.lk.Unlock()
+		if err != nil {
+			sh.addErrorToLog(fmt.Errorf("reindex error for %s, blob %s: %v", sh.toName, br, err))
+		}
+	})
+	if err != nil {
+		sh.addErrorToLog(fmt.Errorf("reindex of %s failed: %v", sh.toName, err))
+		sh.setReindexStatus("Reindex failed: %v", err)
+		return
+	}
+	sh.setReindexStatus("Reindex done")
+}
+
 func (sh *SyncHandler) copyWorker(res chan<- copyResult, work <-chan blobref.SizedBlobRef) {
 	for sb := range work {
 		res <- copyResult{sb, sh.copyBlob(sb)}
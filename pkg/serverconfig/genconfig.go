@@ -17,6 +17,7 @@ limitations under the License.
 package serverconfig
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -34,6 +35,9 @@ type configPrefixesParams struct {
 	keyId       string
 	indexerPath string
 	blobPath    string
+	// blobStore is the prefix that new blobs are written to. It
+	// is "/bs/", unless blobs are also replicated to other servers.
+	blobStore   string
 	searchOwner *blobref.BlobRef
 }
 
@@ -147,6 +151,70 @@ func addMysqlConfig(prefixes *jsonconfig.Obj, dbname string, dbinfo string) {
 	(*prefixes)["/index-mysql/"] = ob
 }
 
+// addReplicaConfig adds a remote storage for each of the server URLs in
+// replicateTo, and a replica storage writing to both them and localdisk.
+// The remote storages authenticate with the CAMLI_AUTH environment variable.
+// A write succeeds once localdisk, which the replica storage requires,
+// and a majority of the remotes have the blob; a sync handler per remote
+// copies it from localdisk to the others.
+func addReplicaConfig(prefixes *jsonconfig.Obj, replicateTo []string) {
+	backends := []interface{}{"/bs/"}
+	for i, url := range replicateTo {
+		ob := map[string]interface{}{}
+		ob["handler"] = "storage-remote"
+		ob["handlerArgs"] = map[string]interface{}{
+			"url": url,
+		}
+		prefix := fmt.Sprintf("/r%d/", i+1)
+		(*prefixes)[prefix] = ob
+		backends = append(backends, prefix)
+
+		ob = map[string]interface{}{}
+		ob["handler"] = "sync"
+		ob["handlerArgs"] = map[string]interface{}{
+			"from": "/bs/",
+			"to":   prefix,
+		}
+		(*prefixes)[fmt.Sprintf("/sync-to-r%d/", i+1)] = ob
+	}
+
+	ob := map[string]interface{}{}
+	ob["handler"] = "storage-replica"
+	ob["handlerArgs"] = map[string]interface{}{
+		"backends":            backends,
+		"minWritesForSuccess": 1 + len(replicateTo)/2 + 1,
+		"requiredBackends":    []interface{}{"/bs/"},
+	}
+	(*prefixes)["/bs-and-replicas/"] = ob
+}
+
+// addS3Config adds an s3 storage described by s3, of the form
+// "access_key:secret_key:bucket", and a sync handler copying
+// everything from localdisk to it.
+func addS3Config(prefixes *jsonconfig.Obj, s3 string) error {
+	f := strings.SplitN(s3, ":", 3)
+	if len(f) != 3 || f[0] == "" || f[1] == "" || f[2] == "" {
+		return errors.New(`Malformed s3 config string. Want: "access_key:secret_key:bucket"`)
+	}
+	ob := map[string]interface{}{}
+	ob["handler"] = "storage-s3"
+	ob["handlerArgs"] = map[string]interface{}{
+		"aws_access_key":        f[0],
+		"aws_secret_access_key": f[1],
+		"bucket":                f[2],
+	}
+	(*prefixes)["/sto-s3/"] = ob
+
+	ob = map[string]interface{}{}
+	ob["handler"] = "sync"
+	ob["handlerArgs"] = map[string]interface{}{
+		"from": "/bs/",
+		"to":   "/sto-s3/",
+	}
+	(*prefixes)["/sync-to-s3/"] = ob
+	return nil
+}
+
 func addMemindexConfig(prefixes *jsonconfig.Obj) {
 	ob := map[string]interface{}{}
 	ob["handler"] = "storage-memory-only-dev-indexer"
@@ -188,7 +256,10 @@ func genLowLevelPrefixes(params *configPrefixesParams) jsonconfig.Obj {
 	ob = map[string]interface{}{}
 	ob["handler"] = "storage-replica"
 	ob["handlerArgs"] = map[string]interface{}{
-		"backends": []interface{}{"/bs/", params.indexerPath},
+		"backends": []interface{}{params.blobStore, params.indexerPath},
+		// The index only receives blobs; never read (and so
+		// never read-repair) from it.
+		"readWeights": map[string]interface{}{params.indexerPath: 0},
 	}
 	prefixes["/bs-and-index/"] = ob
 
@@ -198,7 +269,7 @@ func genLowLevelPrefixes(params *configPrefixesParams) jsonconfig.Obj {
 		"write": map[string]interface{}{
 			"if":   "isSchema",
 			"then": "/bs-and-index/",
-			"else": "/bs/",
+			"else": params.blobStore,
 		},
 		"read": "/bs/",
 	}
@@ -231,18 +302,19 @@ func genLowLevelPrefixes(params *configPrefixesParams) jsonconfig.Obj {
 
 func GenLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 	var (
-		baseUrl    = conf.RequiredString("listen")
-		auth       = conf.RequiredString("auth")
-		keyId      = conf.RequiredString("identity")
-		secretRing = conf.RequiredString("identitySecretRing")
-		blobPath   = conf.RequiredString("blobPath")
-		tlsOn      = conf.OptionalBool("TLS", false)
-		dbname     = conf.OptionalString("dbname", "")
-		mysql      = conf.OptionalString("mysql", "")
-		mongo      = conf.OptionalString("mongo", "")
-		_          = conf.OptionalList("replicateTo")
-		_          = conf.OptionalString("s3", "")
-		publish    = conf.OptionalObject("publish")
+		baseUrl     = conf.RequiredString("listen")
+		auth        = conf.RequiredString("auth")
+		keyId       = conf.RequiredString("identity")
+		secretRing  = conf.RequiredString("identitySecretRing")
+		blobPath    = conf.RequiredString("blobPath")
+		tlsOn       = conf.OptionalBool("TLS", false)
+		dbname      = conf.OptionalString("dbname", "")
+		mysql       = conf.OptionalString("mysql", "")
+		mongo       = conf.OptionalString("mongo", "")
+		replicateTo = conf.OptionalList("replicateTo")
+		s3          = conf.OptionalString("s3", "")
+		publish     = conf.OptionalObject("publish")
+		hashName    = conf.OptionalString("hash", "")
 	)
 	if err := conf.Validate(); err != nil {
 		return nil, err
@@ -258,6 +330,10 @@ func GenLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 	obj["baseURL"] = scheme + "://" + baseUrl
 	obj["https"] = tlsOn
 	obj["auth"] = auth
+	if hashName != "" {
+		obj["hash"] = hashName
+	}
+	obj["resumableDir"] = filepath.Join(blobPath, "/resumable")
 
 	if dbname == "" {
 		username := os.Getenv("USER")
@@ -288,11 +364,18 @@ func GenLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 		return nil, err
 	}
 
+	blobStore := "/bs/"
+	if len(replicateTo) > 0 {
+		blobStore = "/bs-and-replicas/"
+	}
+
 	prefixesParams := &configPrefixesParams{
 		secretRing:  secretRing,
 		keyId:       keyId,
 		indexerPath: indexerPath,
 		blobPath:    blobPath,
+		blobStore:   blobStore,
+		// As the sig handler's: signer blobrefs stay sha1.
 		searchOwner: blobref.SHA1FromString(armoredPublicKey),
 	}
 
@@ -321,12 +404,20 @@ func GenLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 	if indexerPath == "/index-mem/" {
 		addMemindexConfig(&prefixes)
 	}
+	if len(replicateTo) > 0 {
+		addReplicaConfig(&prefixes, replicateTo)
+	}
+	if s3 != "" {
+		if err := addS3Config(&prefixes, s3); err != nil {
+			return nil, err
+		}
+	}
 
 	obj["prefixes"] = (map[string]interface{})(prefixes)
 
 	lowLevelConf = &Config{
-		jsonconfig.Obj: obj,
-		configPath:     conf.configPath,
+		Obj:        obj,
+		configPath: conf.configPath,
 	}
 	return lowLevelConf, nil
 }
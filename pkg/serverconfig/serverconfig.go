@@ -27,6 +27,7 @@ import (
 	"strings"
 
 	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/blobserver/handlers"
 	"camlistore.org/pkg/httputil"
@@ -99,6 +100,10 @@ func (s *storageAndConfig) Config() *blobserver.Config {
 
 func handleCamliUsingStorage(conn http.ResponseWriter, req *http.Request, action string, storage blobserver.StorageConfiger) {
 	handler := unsupportedHandler
+	if strings.HasPrefix(action, "upload-resumable/") {
+		auth.RequireAuth(handlers.CreateResumableUploadHandler(storage))(conn, req)
+		return
+	}
 	switch req.Method {
 	case "GET":
 		switch action {
@@ -280,7 +285,7 @@ func handerTypeWantsAuth(handlerType string) bool {
 	// TODO(bradfitz): ask the handler instead? This is a bit of a
 	// weird spot for this policy maybe?
 	switch handlerType {
-	case "ui", "search", "jsonsign", "sync":
+	case "ui", "search", "jsonsign", "sync", "fsck", "replica-status", "shard-rebalance":
 		return true
 	}
 	return false
@@ -346,9 +351,19 @@ func (config *Config) InstallHandlers(hi HandlerInstaller, baseURL string, conte
 		return fmt.Errorf("error while configuring auth: %v", err)
 	}
 	prefixes := config.RequiredObject("prefixes")
+	hashName := config.OptionalString("hash", "")
+	resumableDir := config.OptionalString("resumableDir", "")
 	if err := config.Validate(); err != nil {
 		return fmt.Errorf("configuration error in root object's keys: %v", err)
 	}
+	if resumableDir != "" {
+		handlers.ResumableDir = resumableDir
+	}
+	if hashName != "" {
+		if err := blobref.SetDefaultDigest(hashName); err != nil {
+			return fmt.Errorf("configuration error in root object's keys: %v", err)
+		}
+	}
 
 	hl := &handlerLoader{
 		installer: hi,
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +36,7 @@ type FakeIndex struct {
 	ownerClaims     map[string]search.ClaimList // "<permanode>/<owner>" -> ClaimList
 	signerAttrValue map[string]*blobref.BlobRef // "<signer>\0<attr>\0<value>" -> blobref
 	path            map[string]*search.Path     // "<signer>\0<base>\0<suffix>" -> path
+	fileInfo        map[string]*search.FileInfo // file schema blobref -> info
 
 	cllk  sync.Mutex
 	clock int64
@@ -49,6 +51,7 @@ func NewFakeIndex() *FakeIndex {
 		ownerClaims:     make(map[string]search.ClaimList),
 		signerAttrValue: make(map[string]*blobref.BlobRef),
 		path:            make(map[string]*search.Path),
+		fileInfo:        make(map[string]*search.FileInfo),
 	}
 }
 
@@ -71,15 +74,17 @@ func (fi *FakeIndex) AddMeta(blob *blobref.BlobRef, mime string, size int64) {
 	fi.size[blob.String()] = size
 }
 
-func (fi *FakeIndex) AddClaim(owner, permanode *blobref.BlobRef, claimType, attr, value string) {
+// AddClaim adds a claim and returns its (fake) blobref.
+func (fi *FakeIndex) AddClaim(owner, permanode *blobref.BlobRef, claimType, attr, value string) *blobref.BlobRef {
 	fi.lk.Lock()
 	defer fi.lk.Unlock()
 	date := fi.nextDate()
 
+	br := blobref.MustParse(fmt.Sprintf("claim-%d", date.Unix()))
 	claim := &search.Claim{
 		Permanode: permanode,
 		Signer:    nil,
-		BlobRef:   nil,
+		BlobRef:   br,
 		Date:      date,
 		Type:      claimType,
 		Attr:      attr,
@@ -96,6 +101,13 @@ func (fi *FakeIndex) AddClaim(owner, permanode *blobref.BlobRef, claimType, attr
 		}
 		fi.path[fmt.Sprintf("%s\x00%s\x00%s", owner, permanode, suffix)] = path
 	}
+	return br
+}
+
+func (fi *FakeIndex) AddFileInfo(file *blobref.BlobRef, info *search.FileInfo) {
+	fi.lk.Lock()
+	defer fi.lk.Unlock()
+	fi.fileInfo[file.String()] = info
 }
 
 func (fi *FakeIndex) AddSignerAttrValue(signer *blobref.BlobRef, attr, val string, latest *blobref.BlobRef) {
@@ -109,9 +121,42 @@ func (fi *FakeIndex) AddSignerAttrValue(signer *blobref.BlobRef, attr, val strin
 //
 
 func (fi *FakeIndex) GetRecentPermanodes(dest chan *search.Result, owner *blobref.BlobRef, limit int) error {
-	panic("NOIMPL")
+	defer close(dest)
+	fi.lk.Lock()
+	var results []*search.Result
+	suffix := "/" + owner.String()
+	for key, claims := range fi.ownerClaims {
+		if !strings.HasSuffix(key, suffix) || len(claims) == 0 {
+			continue
+		}
+		res := &search.Result{BlobRef: claims[0].Permanode, Signer: owner}
+		for _, cl := range claims {
+			if t := cl.Date.Unix(); t > res.LastModTime {
+				res.LastModTime = t
+				res.ClaimRef = cl.BlobRef
+			}
+		}
+		results = append(results, res)
+	}
+	fi.lk.Unlock()
+
+	sort.Sort(byModTime(results))
+	for i, res := range results {
+		if i == limit && limit > 0 {
+			break
+		}
+		dest <- res
+	}
+	return nil
 }
 
+// byModTime sorts results from the most recently modified.
+type byModTime []*search.Result
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Less(i, j int) bool { return s[i].LastModTime > s[j].LastModTime }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 // TODO(mpl): write real tests
 func (fi *FakeIndex) SearchPermanodesWithAttr(dest chan<- *blobref.BlobRef, request *search.PermanodeByAttrRequest) error {
 	panic("NOIMPL")
@@ -139,7 +184,12 @@ func (fi *FakeIndex) ExistingFileSchemas(bytesRef *blobref.BlobRef) ([]*blobref.
 }
 
 func (fi *FakeIndex) GetFileInfo(fileRef *blobref.BlobRef) (*search.FileInfo, error) {
-	panic("NOIMPL")
+	fi.lk.Lock()
+	defer fi.lk.Unlock()
+	if info, ok := fi.fileInfo[fileRef.String()]; ok {
+		return info, nil
+	}
+	return nil, os.ErrNotExist
 }
 
 func (fi *FakeIndex) PermanodeOfSignerAttrValue(signer *blobref.BlobRef, attr, val string) (*blobref.BlobRef, error) {
@@ -19,7 +19,9 @@ package test
 import (
 	"io"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"camlistore.org/pkg/blobref"
 )
@@ -59,6 +61,33 @@ func (tf *Fetcher) Fetch(ref *blobref.BlobRef) (file blobref.ReadSeekCloser, siz
 	return
 }
 
+// EnumerateBlobs sends the blobs added to tf, in the manner of
+// blobserver.BlobEnumerator. wait is ignored.
+func (tf *Fetcher) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit int, wait time.Duration) error {
+	defer close(dest)
+	tf.l.Lock()
+	var refs []string
+	for ref := range tf.m {
+		if ref > after {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	if len(refs) > limit {
+		refs = refs[:limit]
+	}
+	sbs := make([]blobref.SizedBlobRef, len(refs))
+	for i, ref := range refs {
+		tb := tf.m[ref]
+		sbs[i] = blobref.SizedBlobRef{BlobRef: tb.BlobRef(), Size: tb.Size()}
+	}
+	tf.l.Unlock()
+	for _, sb := range sbs {
+		dest <- sb
+	}
+	return nil
+}
+
 type strReader struct {
 	s   string
 	pos int
@@ -0,0 +1,375 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+const (
+	// storageWait is the wait given to EnumerateBlobs and StatBlobs
+	// when checking their wait argument.
+	storageWait = 2 * time.Second
+
+	// storageSlack is how much longer than asked a storage may take
+	// to return or to notify.
+	storageSlack = 5 * time.Second
+)
+
+// A StorageFactory returns a new, empty storage to test, and a func
+// releasing it once the test is done, or nil.
+type StorageFactory func(t *testing.T) (sto blobserver.Storage, cleanup func())
+
+// RunStorageTests checks that the storages made by newStorage behave
+// as documented by blobserver.Storage:
+//
+//   - received blobs can be statted and fetched, and corrupt ones are
+//     rejected;
+//   - StatBlobs only reports the existing blobs, and doesn't close its
+//     channel;
+//   - EnumerateBlobs sends the blobs sorted, honors limit and after,
+//     and always closes its channel;
+//   - a wait is only a maximum, for the storages not long-polling;
+//   - removing blobs, even missing or already removed ones, isn't an
+//     error;
+//   - received blobs are notified on the storage's BlobHub.
+//
+// Each check runs on a new storage.
+func RunStorageTests(t *testing.T, newStorage StorageFactory) {
+	checks := []struct {
+		name string
+		fn   func(*testing.T, blobserver.Storage)
+	}{
+		{"ReceiveStatFetch", testReceiveStatFetch},
+		{"Corrupt", testCorrupt},
+		{"Enumerate", testEnumerate},
+		{"Wait", testWait},
+		{"Remove", testRemove},
+		{"BlobHub", testBlobHub},
+	}
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			sto, cleanup := newStorage(t)
+			if cleanup != nil {
+				defer cleanup()
+			}
+			c.fn(t, sto)
+		})
+	}
+}
+
+// testBlobs are blobs of distinct sizes, in the order of their
+// blobrefs.
+var testBlobs = []*Blob{
+	{"foo"},   // sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33
+	{"baar"},  // sha1-b23361951dde70cb3eca44c0c674181673a129dc
+	{"bazzz"}, // sha1-e0eb17003ce1c2812ca8f19089fff44ca32b3710
+}
+
+func receive(t *testing.T, sto blobserver.Storage, b *Blob) {
+	sb, err := sto.ReceiveBlob(b.BlobRef(), b.Reader())
+	if err != nil {
+		t.Fatalf("ReceiveBlob(%v): %v", b.BlobRef(), err)
+	}
+	b.AssertMatches(t, &sb)
+}
+
+// stat returns the blobs reported by StatBlobs, keyed by blobref,
+// checking that the channel isn't closed.
+func stat(t *testing.T, sto blobserver.Storage, blobs []*blobref.BlobRef, wait time.Duration) map[string]int64 {
+	ch := make(chan blobref.SizedBlobRef, len(blobs)+1)
+	if err := sto.StatBlobs(ch, blobs, wait); err != nil {
+		t.Fatalf("StatBlobs: %v", err)
+	}
+	got := make(map[string]int64)
+	for {
+		select {
+		case sb, ok := <-ch:
+			if !ok {
+				t.Errorf("StatBlobs closed its channel")
+				return got
+			}
+			got[sb.BlobRef.String()] = sb.Size
+		default:
+			return got
+		}
+	}
+}
+
+// enumerate returns the blobs sent by EnumerateBlobs, failing if it
+// doesn't close its channel.
+func enumerate(t *testing.T, sto blobserver.Storage, after string, limit int, wait time.Duration) []blobref.SizedBlobRef {
+	ch := make(chan blobref.SizedBlobRef)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- sto.EnumerateBlobs(ch, after, limit, wait)
+	}()
+	var sbs []blobref.SizedBlobRef
+	timeout := time.After(wait + storageSlack)
+	for {
+		select {
+		case sb, ok := <-ch:
+			if !ok {
+				if err := <-errch; err != nil {
+					t.Fatalf("EnumerateBlobs(after=%q, limit=%d): %v", after, limit, err)
+				}
+				return sbs
+			}
+			sbs = append(sbs, sb)
+		case <-timeout:
+			t.Fatalf("EnumerateBlobs(after=%q, limit=%d) didn't close its channel", after, limit)
+		}
+	}
+}
+
+func fetch(t *testing.T, sto blobserver.Storage, br *blobref.BlobRef) (string, error) {
+	rc, size, err := sto.FetchStreaming(br)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %v: %v", br, err)
+	}
+	if size != int64(len(b)) {
+		t.Errorf("FetchStreaming(%v) size = %d; read %d bytes", br, size, len(b))
+	}
+	return string(b), nil
+}
+
+func testReceiveStatFetch(t *testing.T, sto blobserver.Storage) {
+	for _, b := range testBlobs {
+		receive(t, sto, b)
+	}
+	// Receiving a blob again is fine.
+	receive(t, sto, testBlobs[0])
+
+	missing := (&Blob{"missing"}).BlobRef()
+	brs := []*blobref.BlobRef{missing}
+	for _, b := range testBlobs {
+		brs = append(brs, b.BlobRef())
+	}
+	got := stat(t, sto, brs, 0)
+	if len(got) != len(testBlobs) {
+		t.Errorf("StatBlobs reported %d blobs; want %d", len(got), len(testBlobs))
+	}
+	for _, b := range testBlobs {
+		if size, ok := got[b.BlobRef().String()]; !ok || size != b.Size() {
+			t.Errorf("StatBlobs of %v = %d, %v; want %d", b.BlobRef(), size, ok, b.Size())
+		}
+	}
+	if len(stat(t, sto, nil, 0)) != 0 {
+		t.Errorf("StatBlobs of no blobs reported some")
+	}
+
+	for _, b := range testBlobs {
+		s, err := fetch(t, sto, b.BlobRef())
+		if err != nil {
+			t.Errorf("FetchStreaming(%v): %v", b.BlobRef(), err)
+		} else if s != b.Contents {
+			t.Errorf("FetchStreaming(%v) = %q; want %q", b.BlobRef(), s, b.Contents)
+		}
+	}
+	if _, err := fetch(t, sto, missing); err != os.ErrNotExist {
+		t.Errorf("FetchStreaming of a missing blob: err = %v; want os.ErrNotExist", err)
+	}
+}
+
+func testCorrupt(t *testing.T, sto blobserver.Storage) {
+	br := testBlobs[0].BlobRef()
+	if _, err := sto.ReceiveBlob(br, strings.NewReader("not foo")); err == nil {
+		t.Errorf("ReceiveBlob of corrupt contents succeeded")
+	}
+	if got := stat(t, sto, []*blobref.BlobRef{br}, 0); len(got) != 0 {
+		t.Errorf("StatBlobs reported the corrupt blob: %v", got)
+	}
+	if _, err := fetch(t, sto, br); err != os.ErrNotExist {
+		t.Errorf("FetchStreaming of the corrupt blob: err = %v; want os.ErrNotExist", err)
+	}
+	if sbs := enumerate(t, sto, "", 10, 0); len(sbs) != 0 {
+		t.Errorf("EnumerateBlobs sent the corrupt blob: %v", sbs)
+	}
+}
+
+// checkEnumerated checks that sbs are want, in order.
+func checkEnumerated(t *testing.T, what string, sbs []blobref.SizedBlobRef, want []*Blob) {
+	if len(sbs) != len(want) {
+		t.Errorf("%s sent %d blobs; want %d (%v)", what, len(sbs), len(want), sbs)
+		return
+	}
+	for i, b := range want {
+		b.AssertMatches(t, &sbs[i])
+	}
+}
+
+func testEnumerate(t *testing.T, sto blobserver.Storage) {
+	checkEnumerated(t, "EnumerateBlobs of an empty storage", enumerate(t, sto, "", 10, 0), nil)
+
+	for _, b := range testBlobs {
+		receive(t, sto, b)
+	}
+	checkEnumerated(t, "EnumerateBlobs", enumerate(t, sto, "", 10, 0), testBlobs)
+	checkEnumerated(t, "EnumerateBlobs with a limit", enumerate(t, sto, "", 2, 0), testBlobs[:2])
+	checkEnumerated(t, "EnumerateBlobs with a limit of 1", enumerate(t, sto, "", 1, 0), testBlobs[:1])
+
+	first := testBlobs[0].BlobRef().String()
+	checkEnumerated(t, "EnumerateBlobs after the first blob", enumerate(t, sto, first, 10, 0), testBlobs[1:])
+	checkEnumerated(t, "EnumerateBlobs after the first blob, with a limit",
+		enumerate(t, sto, first, 1, 0), testBlobs[1:2])
+	// after needn't be a blobref.
+	checkEnumerated(t, "EnumerateBlobs after \"sha1-c\"", enumerate(t, sto, "sha1-c", 10, 0), testBlobs[2:])
+	checkEnumerated(t, "EnumerateBlobs after \"sha1-\"", enumerate(t, sto, "sha1-", 10, 0), testBlobs)
+	last := testBlobs[len(testBlobs)-1].BlobRef().String()
+	checkEnumerated(t, "EnumerateBlobs after the last blob", enumerate(t, sto, last, 10, 0), nil)
+
+	// Paging through everything, as the sync handler does.
+	var all []blobref.SizedBlobRef
+	after := ""
+	for {
+		sbs := enumerate(t, sto, after, 1, 0)
+		if len(sbs) == 0 {
+			break
+		}
+		if len(all) > len(testBlobs) {
+			t.Fatalf("paging through EnumerateBlobs doesn't end")
+		}
+		all = append(all, sbs...)
+		after = sbs[len(sbs)-1].BlobRef.String()
+	}
+	checkEnumerated(t, "Paging through EnumerateBlobs", all, testBlobs)
+}
+
+func testWait(t *testing.T, sto blobserver.Storage) {
+	b := testBlobs[0]
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := sto.ReceiveBlob(b.BlobRef(), b.Reader()); err != nil {
+			t.Errorf("ReceiveBlob(%v): %v", b.BlobRef(), err)
+		}
+	}()
+
+	start := time.Now()
+	sbs := enumerate(t, sto, "", 10, storageWait)
+	if d := time.Since(start); d > storageWait+storageSlack {
+		t.Errorf("EnumerateBlobs with a wait of %v took %v", storageWait, d)
+	}
+	// Storages not long-polling can return before the blob
+	// arrives, but nothing else may be sent.
+	if len(sbs) > 1 || len(sbs) == 1 && sbs[0].BlobRef.String() != b.BlobRef().String() {
+		t.Errorf("EnumerateBlobs with a wait sent %v", sbs)
+	}
+
+	start = time.Now()
+	got := stat(t, sto, []*blobref.BlobRef{b.BlobRef()}, storageWait)
+	if d := time.Since(start); d > storageWait+storageSlack {
+		t.Errorf("StatBlobs with a wait of %v took %v", storageWait, d)
+	}
+	if size, ok := got[b.BlobRef().String()]; ok && size != b.Size() {
+		t.Errorf("StatBlobs with a wait reported a size of %d; want %d", size, b.Size())
+	}
+
+	// Wait for the blob, so it doesn't arrive after the cleanup.
+	deadline := time.Now().Add(storageSlack)
+	for len(stat(t, sto, []*blobref.BlobRef{b.BlobRef()}, 0)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("blob %v never received", b.BlobRef())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testRemove(t *testing.T, sto blobserver.Storage) {
+	for _, b := range testBlobs {
+		receive(t, sto, b)
+	}
+	gone, kept := testBlobs[0].BlobRef(), testBlobs[1:]
+	missing := (&Blob{"missing"}).BlobRef()
+
+	if err := sto.RemoveBlobs([]*blobref.BlobRef{gone, missing}); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if err := sto.RemoveBlobs([]*blobref.BlobRef{gone}); err != nil {
+		t.Errorf("RemoveBlobs of a removed blob: %v", err)
+	}
+	if err := sto.RemoveBlobs(nil); err != nil {
+		t.Errorf("RemoveBlobs of no blobs: %v", err)
+	}
+
+	if got := stat(t, sto, []*blobref.BlobRef{gone}, 0); len(got) != 0 {
+		t.Errorf("StatBlobs reported the removed blob")
+	}
+	if _, err := fetch(t, sto, gone); err != os.ErrNotExist {
+		t.Errorf("FetchStreaming of the removed blob: err = %v; want os.ErrNotExist", err)
+	}
+	checkEnumerated(t, "EnumerateBlobs after a remove", enumerate(t, sto, "", 10, 0), kept)
+
+	// A removed blob can be received again.
+	receive(t, sto, testBlobs[0])
+	checkEnumerated(t, "EnumerateBlobs after receiving again", enumerate(t, sto, "", 10, 0), testBlobs)
+}
+
+func testBlobHub(t *testing.T, sto blobserver.Storage) {
+	hub := sto.GetBlobHub()
+	all := make(chan *blobref.BlobRef, len(testBlobs))
+	hub.RegisterListener(all)
+	defer hub.UnregisterListener(all)
+	b := testBlobs[1]
+	one := make(chan *blobref.BlobRef, 1)
+	hub.RegisterBlobListener(b.BlobRef(), one)
+	defer hub.UnregisterBlobListener(b.BlobRef(), one)
+
+	for _, b := range testBlobs {
+		receive(t, sto, b)
+	}
+
+	var notified []string
+	timeout := time.After(storageSlack)
+	for len(notified) < len(testBlobs) {
+		select {
+		case br := <-all:
+			notified = append(notified, br.String())
+		case <-timeout:
+			t.Fatalf("BlobHub listener notified of %v; want all of %d blobs", notified, len(testBlobs))
+		}
+	}
+	sort.Strings(notified)
+	for i, b := range testBlobs {
+		if notified[i] != b.BlobRef().String() {
+			t.Errorf("BlobHub listener notified of %v", notified)
+			break
+		}
+	}
+
+	select {
+	case br := <-one:
+		if br.String() != b.BlobRef().String() {
+			t.Errorf("blob listener of %v notified of %v", b.BlobRef(), br)
+		}
+	case <-timeout:
+		t.Errorf("blob listener of %v not notified", b.BlobRef())
+	}
+}
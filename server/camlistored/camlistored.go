@@ -43,13 +43,17 @@ import (
 
 	// Storage options:
 	_ "camlistore.org/pkg/blobserver/cond"
+	_ "camlistore.org/pkg/blobserver/encrypt"
+	_ "camlistore.org/pkg/blobserver/google"
 	_ "camlistore.org/pkg/blobserver/localdisk"
+	_ "camlistore.org/pkg/blobserver/packed"
 	_ "camlistore.org/pkg/blobserver/remote"
 	_ "camlistore.org/pkg/blobserver/replica"
 	_ "camlistore.org/pkg/blobserver/s3"
 	_ "camlistore.org/pkg/blobserver/shard"
 	// Indexers: (also present themselves as storage targets)
 	_ "camlistore.org/pkg/index" // base indexer + in-memory dev index
+	_ "camlistore.org/pkg/index/leveldb"
 	_ "camlistore.org/pkg/index/mongo"
 	_ "camlistore.org/pkg/index/mysql"
 
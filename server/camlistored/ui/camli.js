@@ -77,6 +77,10 @@ function camliDescribeBlob(blobref, opts) {
     var xhr = camliJsonXhr("camliDescribeBlob", opts);
     var path = Camli.config.searchRoot + "camli/search/describe?blobref=" +
         blobref;
+    if (opts && opts.at) {
+        // Describe as of this time (an RFC 3339 string).
+        path += "&at=" + encodeURIComponent(opts.at);
+    }
     xhr.open("GET", path, true);
     xhr.send();
 }